@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+)
+
+func main() {
+	capture := flag.String("capture", "", "capture file recorded by crebrid")
+	protocol := flag.String("protocol", crebrid.WP_V1.String(), "protocol of the controller")
+	digitals := flag.Int("digitalPorts", crebrid.DefaultStatusLayout().Digitals, "number of digital values of a status")
+	analogs := flag.Int("analogPorts", crebrid.DefaultStatusLayout().Analogs, "number of analog values of a status")
+	controller := flag.String("controller", crebrid.DEFAULT_CONTROLLER, "controller which is played")
+	port := flag.Int("port", 0, "port the recorded controller listens on, 0 only decodes the capture")
+	ipcAddr := flag.String("ipc", "", "IPC address of crebrid the recorded clients are played against, e.g. 127.0.0.1:65432")
+	speed := flag.Float64("speed", 1, "speed of the replay, 0 plays without waiting")
+	flag.Parse()
+	if *capture == "" {
+		fmt.Println("missing capture file")
+		flag.Usage()
+		os.Exit(1)
+	}
+	wp, err := crebrid.ParseWireProtocol(*protocol)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	records, err := crebrid.ReadCaptureFile(*capture)
+	if err != nil {
+		fmt.Printf("unable to read the capture: %v\n", err)
+		os.Exit(1)
+	}
+	conns := crebrid.CaptureConnections(records)
+	if len(conns) == 0 {
+		fmt.Println("capture without connections")
+		os.Exit(1)
+	}
+	for _, line := range crebrid.DecodeCapture(conns, wp, crebrid.StatusLayout{Digitals: *digitals, Analogs: *analogs}) {
+		fmt.Println(line)
+	}
+	if *port == 0 && *ipcAddr == "" {
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer stop()
+	mismatches := replay(ctx, conns, *controller, *port, *ipcAddr, *speed)
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("%d differences to the capture\n", len(mismatches))
+		os.Exit(1)
+	}
+	fmt.Println("replay matches the capture")
+}
+
+// replay the controller on the port and the IPC clients against crebrid. the clients start
+// as soon as crebrid connected to the controller, at the offsets they were recorded
+func replay(ctx context.Context, conns []crebrid.CaptureConnection, controller string, port int, ipcAddr string, speed float64) []string {
+	mismatches := make([]string, 0)
+	clients := crebrid.FilterCaptureConnections(conns, crebrid.CAPTURE_STREAM_IPC)
+	start := conns[0].Start
+	var rc crebrid.ReplayController
+	if port > 0 {
+		recorded := crebrid.FilterCaptureConnections(conns, crebrid.CaptureControllerStream(controller))
+		rc = crebrid.NewReplayController(port, recorded, speed)
+		if err := rc.Start(); err != nil {
+			return append(mismatches, fmt.Sprintf("unable to start the recorded controller: %v", err))
+		}
+		defer rc.Stop()
+		fmt.Printf("recorded controller [%s] listens on %s, start crebrid with its ip and port\n", controller, rc.Addr())
+		select {
+		case <-rc.Connected():
+		case <-ctx.Done():
+			return mismatches
+		}
+		if len(recorded) > 0 {
+			start = recorded[0].Start
+		}
+	}
+	if ipcAddr != "" {
+		mismatches = append(mismatches, crebrid.ReplayClients(ipcAddr, clients, start, speed)...)
+	}
+	if rc != nil {
+		select {
+		case <-rc.Done():
+		case <-ctx.Done():
+		}
+		mismatches = append(mismatches, rc.Mismatches()...)
+	}
+	return mismatches
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+	"github.com/dachunky/crestrontcpbridge/pkg/crestronsim"
+)
+
+// keypad commands read from stdin
+const (
+	keypad_script = "script "
+	keypad_drop   = "drop"
+	keypad_status = "status"
+)
+
+func main() {
+	port := flag.Int("port", 43123, "port of the telnet server")
+	accessCode := flag.String("accessCode", "3H34GJ67NH", "access code of the telnet server")
+	digitals := flag.Int("digitalPorts", crebrid.DefaultStatusLayout().Digitals, "number of digital outputs")
+	analogs := flag.Int("analogPorts", crebrid.DefaultStatusLayout().Analogs, "number of analog values")
+	latency := flag.Duration("latency", 0, "latency of every answer")
+	script := flag.String("script", "", "faults of the first requests, e.g. \"ok,delay=2s+drop,lose*3,disconnect\"")
+	cipPort := flag.Int("cipPort", 0, "port of the CIP control system, 0 disables it")
+	ipID := flag.String("ipID", fmt.Sprintf("%02X", crebrid.CIP_DEFAULT_IPID), "IP ID accepted by the CIP control system")
+	flag.Parse()
+	faults, err := crestronsim.ParseSimulatorScript(*script)
+	if err != nil {
+		fmt.Printf("invalid script: %v\n", err)
+		os.Exit(1)
+	}
+	sim := crestronsim.NewTelnetSimulator(*port, *accessCode, crebrid.StatusLayout{Digitals: *digitals, Analogs: *analogs})
+	sim.SetLatency(*latency)
+	sim.Script(faults...)
+	if err := sim.Start(); err != nil {
+		fmt.Printf("unable to start the telnet server: %v\n", err)
+		os.Exit(1)
+	}
+	defer sim.Stop()
+	fmt.Printf("telnet server listens on %s\n", sim.Addr())
+	var cipSim crestronsim.CIPSimulator
+	if *cipPort > 0 {
+		id, err := crebrid.ParseCIPIPID(*ipID)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cipSim = crestronsim.NewCIPSimulator(*cipPort, id)
+		if err := cipSim.Start(); err != nil {
+			fmt.Printf("unable to start the CIP control system: %v\n", err)
+			os.Exit(1)
+		}
+		defer cipSim.Stop()
+		fmt.Printf("CIP control system listens on %s for IP ID %02X\n", cipSim.Addr(), id)
+	}
+	fmt.Println("enter keypad commands like \"d3=on\", \"d3=toggle\" or \"a2=1234\", \"script <steps>\", \"drop\" or \"status\"")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer stop()
+	go readKeypad(sim, cipSim)
+	<-ctx.Done()
+}
+
+// readKeypad commands from stdin until it is closed
+func readKeypad(sim crestronsim.TelnetSimulator, cipSim crestronsim.CIPSimulator) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case line == keypad_status:
+			ss := sim.Status()
+			fmt.Printf("d=%v a=%v\n", ss.D, ss.A)
+		case line == keypad_drop:
+			sim.DropConnections()
+			if cipSim != nil {
+				cipSim.DropConnections()
+			}
+		case strings.HasPrefix(line, keypad_script):
+			faults, err := crestronsim.ParseSimulatorScript(strings.TrimPrefix(line, keypad_script))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			sim.Script(faults...)
+		default:
+			if err := pressKeypad(sim, cipSim, line); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// pressKeypad of a command like "d3=on"
+func pressKeypad(sim crestronsim.TelnetSimulator, cipSim crestronsim.CIPSimulator, line string) error {
+	cmd, err := crebrid.ParseCommand(line)
+	if err != nil {
+		return err
+	}
+	switch cmd.Kind {
+	case crebrid.CK_TOGGLE:
+		ss := sim.Status()
+		if cmd.Port > len(ss.D) {
+			return fmt.Errorf("no digital output %d", cmd.Port)
+		}
+		cmd.On = ss.D[cmd.Port-1] == 0
+		fallthrough
+	case crebrid.CK_SET_DIGITAL:
+		sim.SetDigital(cmd.Port, cmd.On)
+		if cipSim != nil {
+			cipSim.SetDigital(cmd.Port, cmd.On)
+		}
+	case crebrid.CK_SET_ANALOG:
+		sim.SetAnalog(cmd.Port, int(cmd.Value))
+		if cipSim != nil {
+			cipSim.SetAnalog(cmd.Port, int(cmd.Value))
+		}
+	default:
+		return fmt.Errorf("keypads do not run scenes: %s", line)
+	}
+	return nil
+}
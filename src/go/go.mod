@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/google/uuid v1.2.0
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
 	gopkg.in/ini.v1 v1.62.0
 )
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dachunky/crestrontcpbridge/pkg/logging"
 )
@@ -16,12 +17,69 @@ const (
 	CCT_SET
 	CCT_GET
 	CCT_INTERACTIVE
+	CCT_SCENE
+	CCT_SCHEDULE
+	CCT_CALENDAR
+	CCT_RULES
+	CCT_SCRIPT
+	CCT_EVENTS
+	CCT_QUEUE
 )
 
 var commandTypeStr = map[CommandType]string{
 	CCT_SERVER: "server",
 	CCT_SET:    "set",
 	CCT_GET:    "get",
+	CCT_SCENE:    "scene",
+	CCT_SCHEDULE: "schedule",
+	CCT_CALENDAR: "calendar",
+	CCT_RULES:    "rules",
+	CCT_SCRIPT:   "script",
+	CCT_EVENTS:   "events",
+	CCT_QUEUE:    "queue",
+}
+
+const (
+	SCENE_LIST     = "list"
+	SCENE_ACTIVATE = "activate"
+	SCENE_CAPTURE  = "capture"
+)
+
+// sceneActionNeedsName shows which scene actions require a scene name
+var sceneActionNeedsName = map[string]bool{
+	SCENE_LIST:     false,
+	SCENE_ACTIVATE: true,
+	SCENE_CAPTURE:  true,
+}
+
+const (
+	SCHEDULE_ADD    = "add"
+	SCHEDULE_LIST   = "list"
+	SCHEDULE_REMOVE = "rm"
+)
+
+const (
+	CALENDAR_UPCOMING = "upcoming"
+)
+
+const (
+	RULES_LIST = "list"
+	RULES_TEST = "test"
+)
+
+const (
+	SCRIPT_RUN  = "run"
+	SCRIPT_LIST = "list"
+	SCRIPT_STOP = "stop"
+	SCRIPT_LOG  = "log"
+)
+
+// scriptActionNeedsName shows which script actions require a script name
+var scriptActionNeedsName = map[string]bool{
+	SCRIPT_RUN:  true,
+	SCRIPT_LIST: false,
+	SCRIPT_STOP: true,
+	SCRIPT_LOG:  true,
 }
 
 type RegisterType int
@@ -51,10 +109,21 @@ type ParsedArguments struct {
 	Port      int
 	ValueStr  string
 	ValueInt  int
+	Action    string
+	Name      string
+	Schedule  string
+	Command   string
+	Days      int
+	RulesFile string
+	TraceFile string
+	Timeout   string
+	Refresh   bool
+	// Controller of the port, the default controller of the service if it is empty
+	Controller string
 }
 
 func (pa *ParsedArguments) asStringLine() string {
-	return fmt.Sprintf("IP:%s->Cmd:%s->Reg:%s->Port:%d->Str:%s->Int:%d", pa.ServiceIP, commandTypeStr[pa.Cmd], registerTypeStr[pa.Register], pa.Port, pa.ValueStr, pa.ValueInt)
+	return fmt.Sprintf("IP:%s->Cmd:%s->Reg:%s->Port:%d->Str:%s->Int:%d->Action:%s->Name:%s->Schedule:%s->Command:%s->Days:%d->Rules:%s->Trace:%s->Timeout:%s->Refresh:%v->Controller:%s", pa.ServiceIP, commandTypeStr[pa.Cmd], registerTypeStr[pa.Register], pa.Port, pa.ValueStr, pa.ValueInt, pa.Action, pa.Name, pa.Schedule, pa.Command, pa.Days, pa.RulesFile, pa.TraceFile, pa.Timeout, pa.Refresh, pa.Controller)
 }
 
 func ParseAppArguments(args []string) (*ParsedArguments, error) {
@@ -76,14 +145,30 @@ func ParseAppArguments(args []string) (*ParsedArguments, error) {
 	setRegType := setFls.String("reg", "d", "register type to set. default is digital")
 	setPort := setFls.Int("port", -1, "port to set")
 	setValue := setFls.String("value", "", "value to set in case of analog or serial command")
+	setController := setFls.String("controller", "", "controller of the port, e.g. annex. default is the main controller")
 	getFls := flag.NewFlagSet(commandTypeStr[CCT_GET], flag.ExitOnError)
 	getRegType := getFls.String("reg", "d", "register type to get. default is digital")
 	getPort := getFls.Int("port", -1, "port to get")
+	getRefresh := getFls.Bool("refresh", false, "read the state from the controller instead of the cache of the service")
+	getController := getFls.String("controller", "", "controller to get the state of, e.g. annex. default is every controller")
+	schedFls := flag.NewFlagSet(commandTypeStr[CCT_SCHEDULE], flag.ExitOnError)
+	schedCron := schedFls.String("cron", "", "cron expression of a recurring job, e.g. \"0 7 * * mon-fri\"")
+	schedIn := schedFls.String("in", "", "one-shot timer relative to now, e.g. 20m")
+	schedAt := schedFls.String("at", "", "one-shot timer at a local time, e.g. \"2026-10-19 22:00\"")
+	schedSun := schedFls.String("sun", "", "recurring job relative to a sun event, e.g. sunset+15m, sunrise or dusk-10m")
+	schedDo := schedFls.String("do", "", "command to run, e.g. d3=on, d3=off, d3=toggle, a2=30000 or scene=evening")
+	calFls := flag.NewFlagSet(commandTypeStr[CCT_CALENDAR], flag.ExitOnError)
+	calDays := calFls.Int("days", 7, "show the calendar triggers of the next days")
+	rulesFls := flag.NewFlagSet(commandTypeStr[CCT_RULES], flag.ExitOnError)
+	rulesFile := rulesFls.String("rules", "/etc/crebrid/rules.conf", "rules file to test")
+	rulesTrace := rulesFls.String("trace", "", "file with system states to evaluate the rules offline")
+	scriptFls := flag.NewFlagSet(commandTypeStr[CCT_SCRIPT], flag.ExitOnError)
+	scriptTimeout := scriptFls.String("timeout", "", "timeout of the script, e.g. 30m. 0 runs the script without a timeout")
 	argIdx := 0
 	correctedArgs := make([]string, len(args))
 	for idx, arg := range args {
 		logging.LogFmt(logging.LOG_DEBUG, "[%d] %s", idx, arg)
-		if strings.Contains(arg, "port") {
+		if strings.Contains(arg, "port=") {
 			portSplit := strings.Split(arg, "=")
 			portNr := portSplit[1]
 			rmIdx := 0
@@ -132,6 +217,7 @@ func ParseAppArguments(args []string) (*ParsedArguments, error) {
 			return nil, fmt.Errorf("invalid port: %d", *setPort)
 		}
 		ret.Port = *setPort
+		ret.Controller = *setController
 		if *setValue != "" {
 			switch ret.Register {
 			case CRT_ANALOG:
@@ -156,8 +242,124 @@ func ParseAppArguments(args []string) (*ParsedArguments, error) {
 			return nil, fmt.Errorf("invalid port: %d", *setPort)
 		}
 		ret.Port = *getPort
+		ret.Refresh = *getRefresh
+		ret.Controller = *getController
+	case commandTypeStr[CCT_SCENE]:
+		ret.Cmd = CCT_SCENE
+		if arrLen <= argIdx+1 {
+			return nil, fmt.Errorf("scene command needs an action: list, activate or capture")
+		}
+		ret.Action = correctedArgs[argIdx+1]
+		needsName, ok := sceneActionNeedsName[ret.Action]
+		if !ok {
+			return nil, fmt.Errorf("unknown scene action: %s", ret.Action)
+		}
+		if needsName {
+			if arrLen <= argIdx+2 {
+				return nil, fmt.Errorf("scene action [%s] needs a scene name", ret.Action)
+			}
+			ret.Name = correctedArgs[argIdx+2]
+		}
+	case commandTypeStr[CCT_SCHEDULE]:
+		ret.Cmd = CCT_SCHEDULE
+		if arrLen <= argIdx+1 {
+			return nil, fmt.Errorf("schedule command needs an action: add, list or rm")
+		}
+		ret.Action = correctedArgs[argIdx+1]
+		switch ret.Action {
+		case SCHEDULE_LIST:
+		case SCHEDULE_REMOVE:
+			if arrLen <= argIdx+2 {
+				return nil, fmt.Errorf("schedule action [%s] needs a job ID", ret.Action)
+			}
+			ret.Name = correctedArgs[argIdx+2]
+		case SCHEDULE_ADD:
+			schedFls.Parse(correctedArgs[(argIdx + 2):])
+			specs := make([]string, 0)
+			if *schedCron != "" {
+				specs = append(specs, *schedCron)
+			}
+			if *schedIn != "" {
+				specs = append(specs, "in "+*schedIn)
+			}
+			if *schedAt != "" {
+				specs = append(specs, "at "+*schedAt)
+			}
+			if *schedSun != "" {
+				specs = append(specs, *schedSun)
+			}
+			if len(specs) != 1 {
+				return nil, fmt.Errorf("schedule add needs exactly one of -cron, -in, -at or -sun")
+			}
+			if *schedDo == "" {
+				return nil, fmt.Errorf("schedule add needs a command provided by -do")
+			}
+			ret.Schedule = specs[0]
+			ret.Command = *schedDo
+		default:
+			return nil, fmt.Errorf("unknown schedule action: %s", ret.Action)
+		}
+	case commandTypeStr[CCT_CALENDAR]:
+		ret.Cmd = CCT_CALENDAR
+		if arrLen <= argIdx+1 {
+			return nil, fmt.Errorf("calendar command needs an action: upcoming")
+		}
+		ret.Action = correctedArgs[argIdx+1]
+		if ret.Action != CALENDAR_UPCOMING {
+			return nil, fmt.Errorf("unknown calendar action: %s", ret.Action)
+		}
+		calFls.Parse(correctedArgs[(argIdx + 2):])
+		if *calDays < 1 {
+			return nil, fmt.Errorf("invalid number of days: %d", *calDays)
+		}
+		ret.Days = *calDays
+	case commandTypeStr[CCT_RULES]:
+		ret.Cmd = CCT_RULES
+		if arrLen <= argIdx+1 {
+			return nil, fmt.Errorf("rules command needs an action: list or test")
+		}
+		ret.Action = correctedArgs[argIdx+1]
+		switch ret.Action {
+		case RULES_LIST:
+		case RULES_TEST:
+			rulesFls.Parse(correctedArgs[(argIdx + 2):])
+			ret.RulesFile = *rulesFile
+			ret.TraceFile = *rulesTrace
+		default:
+			return nil, fmt.Errorf("unknown rules action: %s", ret.Action)
+		}
+	case commandTypeStr[CCT_SCRIPT]:
+		ret.Cmd = CCT_SCRIPT
+		if arrLen <= argIdx+1 {
+			return nil, fmt.Errorf("script command needs an action: run, list, stop or log")
+		}
+		ret.Action = correctedArgs[argIdx+1]
+		needsName, ok := scriptActionNeedsName[ret.Action]
+		if !ok {
+			return nil, fmt.Errorf("unknown script action: %s", ret.Action)
+		}
+		if needsName {
+			if arrLen <= argIdx+2 {
+				return nil, fmt.Errorf("script action [%s] needs a script name", ret.Action)
+			}
+			ret.Name = correctedArgs[argIdx+2]
+		}
+		if ret.Action == SCRIPT_RUN {
+			scriptFls.Parse(correctedArgs[(argIdx + 3):])
+			if *scriptTimeout != "" {
+				d, err := time.ParseDuration(*scriptTimeout)
+				if *scriptTimeout != "0" && (err != nil || d < 0) {
+					return nil, fmt.Errorf("invalid timeout: %s", *scriptTimeout)
+				}
+			}
+			ret.Timeout = *scriptTimeout
+		}
+	case commandTypeStr[CCT_EVENTS]:
+		ret.Cmd = CCT_EVENTS
+	case commandTypeStr[CCT_QUEUE]:
+		ret.Cmd = CCT_QUEUE
 	default:
-		return nil, fmt.Errorf("either provide no arguments for interactive mode or set or get")
+		return nil, fmt.Errorf("either provide no arguments for interactive mode or set, get, scene, schedule, calendar, rules, script, events or queue")
 	}
 	logging.LogFmt(logging.LOG_DEBUG, "return command: %s", ret.asStringLine())
 	return ret, nil
@@ -238,6 +238,461 @@ func TestParseAppArguments(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "get call with refresh",
+			args: args{
+				args: []string{
+					"get",
+					"-reg=d",
+					"-port=4",
+					"-refresh",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_GET,
+				Register:  CRT_DIGITAL,
+				Port:      4,
+				Refresh:   true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "set call of another controller",
+			args: args{
+				args: []string{
+					"set",
+					"-reg=d",
+					"-port=3",
+					"-controller=annex",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP:  "localhost",
+				Cmd:        CCT_SET,
+				Register:   CRT_DIGITAL,
+				Port:       3,
+				Controller: "annex",
+			},
+			wantErr: false,
+		},
+		{
+			name: "get call of another controller",
+			args: args{
+				args: []string{
+					"get",
+					"-port=0",
+					"-controller=annex",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP:  "localhost",
+				Cmd:        CCT_GET,
+				Register:   CRT_DIGITAL,
+				Port:       0,
+				Controller: "annex",
+			},
+			wantErr: false,
+		},
+		{
+			name: "scene list",
+			args: args{
+				args: []string{
+					"scene",
+					"list",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCENE,
+				Register:  CRT_DIGITAL,
+				Action:    SCENE_LIST,
+			},
+			wantErr: false,
+		},
+		{
+			name: "provide crebrid IP on a scene activation",
+			args: args{
+				args: []string{
+					"server",
+					"-ip=192.123.45.67",
+					"scene",
+					"activate",
+					"evening",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "192.123.45.67",
+				Cmd:       CCT_SCENE,
+				Register:  CRT_DIGITAL,
+				Action:    SCENE_ACTIVATE,
+				Name:      "evening",
+			},
+			wantErr: false,
+		},
+		{
+			name: "scene capture with name containing port",
+			args: args{
+				args: []string{
+					"scene",
+					"capture",
+					"report",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCENE,
+				Register:  CRT_DIGITAL,
+				Action:    SCENE_CAPTURE,
+				Name:      "report",
+			},
+			wantErr: false,
+		},
+		{
+			name: "scene activation w/o name",
+			args: args{
+				args: []string{
+					"scene",
+					"activate",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "unknown scene action",
+			args: args{
+				args: []string{
+					"scene",
+					"delete",
+					"evening",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "schedule add cron job",
+			args: args{
+				args: []string{
+					"schedule",
+					"add",
+					"-cron=0 7 * * mon-fri",
+					"-do=d3=on",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCHEDULE,
+				Register:  CRT_DIGITAL,
+				Action:    SCHEDULE_ADD,
+				Schedule:  "0 7 * * mon-fri",
+				Command:   "d3=on",
+			},
+			wantErr: false,
+		},
+		{
+			name: "schedule add timer",
+			args: args{
+				args: []string{
+					"server",
+					"-ip=192.123.45.67",
+					"schedule",
+					"add",
+					"-in=20m",
+					"-do=scene=evening",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "192.123.45.67",
+				Cmd:       CCT_SCHEDULE,
+				Register:  CRT_DIGITAL,
+				Action:    SCHEDULE_ADD,
+				Schedule:  "in 20m",
+				Command:   "scene=evening",
+			},
+			wantErr: false,
+		},
+		{
+			name: "schedule add sun event",
+			args: args{
+				args: []string{
+					"schedule",
+					"add",
+					"-sun=sunset+15m",
+					"-do=d7=off",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCHEDULE,
+				Register:  CRT_DIGITAL,
+				Action:    SCHEDULE_ADD,
+				Schedule:  "sunset+15m",
+				Command:   "d7=off",
+			},
+			wantErr: false,
+		},
+		{
+			name: "schedule remove job",
+			args: args{
+				args: []string{
+					"schedule",
+					"rm",
+					"3",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCHEDULE,
+				Register:  CRT_DIGITAL,
+				Action:    SCHEDULE_REMOVE,
+				Name:      "3",
+			},
+			wantErr: false,
+		},
+		{
+			name: "schedule add with two schedules",
+			args: args{
+				args: []string{
+					"schedule",
+					"add",
+					"-in=20m",
+					"-at=2026-10-19 22:00",
+					"-do=d3=on",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "schedule add w/o command",
+			args: args{
+				args: []string{
+					"schedule",
+					"add",
+					"-in=20m",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "calendar upcoming default days",
+			args: args{
+				args: []string{
+					"calendar",
+					"upcoming",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_CALENDAR,
+				Register:  CRT_DIGITAL,
+				Action:    CALENDAR_UPCOMING,
+				Days:      7,
+			},
+			wantErr: false,
+		},
+		{
+			name: "calendar upcoming two weeks",
+			args: args{
+				args: []string{
+					"calendar",
+					"upcoming",
+					"-days=14",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_CALENDAR,
+				Register:  CRT_DIGITAL,
+				Action:    CALENDAR_UPCOMING,
+				Days:      14,
+			},
+			wantErr: false,
+		},
+		{
+			name: "calendar unknown action",
+			args: args{
+				args: []string{
+					"calendar",
+					"list",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "rules list",
+			args: args{
+				args: []string{
+					"rules",
+					"list",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_RULES,
+				Register:  CRT_DIGITAL,
+				Action:    RULES_LIST,
+			},
+			wantErr: false,
+		},
+		{
+			name: "rules test with trace",
+			args: args{
+				args: []string{
+					"rules",
+					"test",
+					"-rules=/tmp/rules.conf",
+					"-trace=/tmp/trace.txt",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_RULES,
+				Register:  CRT_DIGITAL,
+				Action:    RULES_TEST,
+				RulesFile: "/tmp/rules.conf",
+				TraceFile: "/tmp/trace.txt",
+			},
+			wantErr: false,
+		},
+		{
+			name: "rules w/o action",
+			args: args{
+				args: []string{
+					"rules",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "script list",
+			args: args{
+				args: []string{
+					"script",
+					"list",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCRIPT,
+				Register:  CRT_DIGITAL,
+				Action:    SCRIPT_LIST,
+			},
+			wantErr: false,
+		},
+		{
+			name: "script run with timeout",
+			args: args{
+				args: []string{
+					"script",
+					"run",
+					"shutters",
+					"-timeout=5m",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCRIPT,
+				Register:  CRT_DIGITAL,
+				Action:    SCRIPT_RUN,
+				Name:      "shutters",
+				Timeout:   "5m",
+			},
+			wantErr: false,
+		},
+		{
+			name: "script stop",
+			args: args{
+				args: []string{
+					"script",
+					"stop",
+					"shutters",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCRIPT,
+				Register:  CRT_DIGITAL,
+				Action:    SCRIPT_STOP,
+				Name:      "shutters",
+			},
+			wantErr: false,
+		},
+		{
+			name: "script log",
+			args: args{
+				args: []string{
+					"script",
+					"log",
+					"shutters",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_SCRIPT,
+				Register:  CRT_DIGITAL,
+				Action:    SCRIPT_LOG,
+				Name:      "shutters",
+			},
+			wantErr: false,
+		},
+		{
+			name: "script run w/o name",
+			args: args{
+				args: []string{
+					"script",
+					"run",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "script run with invalid timeout",
+			args: args{
+				args: []string{
+					"script",
+					"run",
+					"shutters",
+					"-timeout=soon",
+				},
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "events",
+			args: args{
+				args: []string{
+					"events",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_EVENTS,
+				Register:  CRT_DIGITAL,
+			},
+			wantErr: false,
+		},
+		{
+			name: "queue",
+			args: args{
+				args: []string{
+					"queue",
+				},
+			},
+			want: &ParsedArguments{
+				ServiceIP: "localhost",
+				Cmd:       CCT_QUEUE,
+				Register:  CRT_DIGITAL,
+			},
+			wantErr: false,
+		},
 		/*
 			// commented out due to result in failed test but it shouldn't
 			// because malformatted arguments result in an os.Exit(1)
@@ -3,6 +3,7 @@ package crebri
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -13,11 +14,11 @@ import (
 	"github.com/dachunky/crestrontcpbridge/pkg/logging"
 )
 
-func interactive(ic ipc.IpcClient) {
-	fmt.Println("-------- start crebri client ---------")
+func interactive(ic ipc.IpcClient, out io.Writer) {
+	fmt.Fprintln(out, "-------- start crebri client ---------")
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print("client:>")
+		fmt.Fprint(out, "client:>")
 		text, _ := reader.ReadString('\n')
 		if strings.TrimSpace(string(text)) == "q" {
 			logging.Log(logging.LOG_DEBUG, "TCP client exiting...")
@@ -25,7 +26,7 @@ func interactive(ic ipc.IpcClient) {
 		}
 		port, err := strconv.Atoi(text[:(len(text) - 1)])
 		if err != nil {
-			fmt.Printf("client:> invalid input [%s]. Only number are allowed", text)
+			fmt.Fprintf(out, "client:> invalid input [%s]. Only number are allowed", text)
 			continue
 		}
 		cc := ipc.NewClientCommand()
@@ -34,30 +35,109 @@ func interactive(ic ipc.IpcClient) {
 		cc.AddDigitalPorts(port)
 		resp, err := ic.SendCommand(cc)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(out, err)
 			break
 		}
-		fmt.Printf("client:> %v\n", resp.DigitalPortInfo[port])
+		fmt.Fprintf(out, "client:> %v\n", resp.DigitalPortInfo[port])
 		time.Sleep(250)
 	}
 }
 
+var sceneActionToIpcAction = map[string]int{
+	SCENE_LIST:     ipc.IA_LIST,
+	SCENE_ACTIVATE: ipc.IA_ACTIVATE,
+	SCENE_CAPTURE:  ipc.IA_CAPTURE,
+}
+
+var scriptActionToIpcAction = map[string]int{
+	SCRIPT_RUN:  ipc.IA_RUN,
+	SCRIPT_LIST: ipc.IA_LIST,
+	SCRIPT_STOP: ipc.IA_STOP,
+	SCRIPT_LOG:  ipc.IA_LOG,
+}
+
+var scheduleActionToIpcAction = map[string]int{
+	SCHEDULE_ADD:    ipc.IA_ADD,
+	SCHEDULE_LIST:   ipc.IA_LIST,
+	SCHEDULE_REMOVE: ipc.IA_REMOVE,
+}
+
+// sendAndPrintItems sends a sub system command like scene or schedule and prints the returned items
+func sendAndPrintItems(ic ipc.IpcClient, cc *ipc.ClientCommand, out io.Writer) error {
+	resp, err := ic.SendCommand(cc)
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Items {
+		fmt.Fprintln(out, item)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// testRules loads the rules and evaluates them for the states of the trace file. it works
+// offline, so rules can be tried before they are copied to the service
+func testRules(rulesFile string, traceFile string, out io.Writer) error {
+	data, err := os.ReadFile(rulesFile)
+	if err != nil {
+		return err
+	}
+	rules, err := crebrid.LoadRulesFromByteArr(data)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		fmt.Fprintln(out, r)
+	}
+	if traceFile == "" {
+		return nil
+	}
+	data, err = os.ReadFile(traceFile)
+	if err != nil {
+		return err
+	}
+	trace, err := crebrid.ParseRuleTrace(data, time.Local)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "--- dry-run ---")
+	for _, ra := range crebrid.DryRun(rules, trace) {
+		fmt.Fprintln(out, ra)
+	}
+	return nil
+}
+
+// crebri_config_file is the settings file of the service, which holds the IPC port
+const crebri_config_file = "/etc/crebrid/crebrid.conf"
+
+// Execute the command of the command line
 func Execute() error {
+	return ExecuteArgs(os.Args[1:], crebri_config_file, os.Stdout)
+}
+
+// ExecuteArgs executes the command of the arguments with the IPC port of the settings file and
+// writes its output to out
+func ExecuteArgs(args []string, path2Cfg string, out io.Writer) error {
 	logging.Log(logging.LOG_MAIN, "[execute] start client")
 	// read command line arguments
-	cmdArgs, err := ParseAppArguments(os.Args[1:])
+	cmdArgs, err := ParseAppArguments(args)
 	if err != nil {
 		return err
 	}
 	logging.LogFmt(logging.LOG_MAIN, "[execute] arguments parsed: %v", cmdArgs)
-	// read settings from /etc/crebrid/crebrid.conf
-	setts, err := crebrid.LoadFromConfigFile("/etc/crebrid/crebrid.conf")
+	if cmdArgs.Cmd == CCT_RULES && cmdArgs.Action == RULES_TEST {
+		return testRules(cmdArgs.RulesFile, cmdArgs.TraceFile, out)
+	}
+	// read the IPC port from the settings of the service
+	setts, err := crebrid.LoadFromConfigFile(path2Cfg)
 	if err != nil {
 		return err
 	}
 	logging.LogFmt(logging.LOG_MAIN, "try to connect to service: %s:%d", setts.IP, setts.IPCPort)
 	// connect to service via ipc
-	ic, err := ipc.RegisterClient(cmdArgs.ServiceIP, setts.IPCPort)
+	ic, err := ipc.RegisterClient(cmdArgs.ServiceIP, setts.IPCPort, setts.IPCReadPolicy)
 	if err != nil {
 		return err
 	}
@@ -68,19 +148,23 @@ func Execute() error {
 		cc.ID = ic.ClientID()
 		cc.Cmd = ipc.IC_SINGLE
 		cc.AddDigitalPorts(cmdArgs.Port)
+		cc.Controller = cmdArgs.Controller
 		resp, err := ic.SendCommand(cc)
 		if err != nil {
 			return err
 		}
+		if resp.Error != "" {
+			return fmt.Errorf("%s", resp.Error)
+		}
 		if cmdArgs.Port > 0 {
 			if resp.DigitalPortInfo[cmdArgs.Port] {
-				fmt.Println("ON")
+				fmt.Fprintln(out, "ON")
 			} else {
-				fmt.Println("OFF")
+				fmt.Fprintln(out, "OFF")
 			}
 		} else {
 			s := resp.TransformSystemState()
-			fmt.Println(s)
+			fmt.Fprintln(out, s)
 		}
 		return nil
 	case CCT_GET:
@@ -88,22 +172,83 @@ func Execute() error {
 		cc.ID = ic.ClientID()
 		cc.Cmd = ipc.IC_GET
 		cc.AddDigitalPorts(cmdArgs.Port)
+		cc.Refresh = cmdArgs.Refresh
+		cc.Controller = cmdArgs.Controller
 		resp, err := ic.SendCommand(cc)
 		if err != nil {
 			return err
 		}
+		if resp.Error != "" && len(resp.ControllerPortInfo) == 0 {
+			return fmt.Errorf("%s", resp.Error)
+		}
 		if cmdArgs.Port > 0 {
 			if resp.DigitalPortInfo[cmdArgs.Port] {
-				fmt.Println("ON")
+				fmt.Fprintln(out, "ON")
 			} else {
-				fmt.Println("OFF")
+				fmt.Fprintln(out, "OFF")
+			}
+		} else if len(resp.ControllerPortInfo) > 1 {
+			for _, s := range resp.TransformControllerStates() {
+				fmt.Fprintln(out, s)
 			}
 		} else {
 			s := resp.TransformSystemState()
-			fmt.Println(s)
+			fmt.Fprintln(out, s)
+		}
+		if resp.Error != "" {
+			// the state of the controllers which are available is shown anyway
+			return fmt.Errorf("%s", resp.Error)
 		}
 		return nil
+	case CCT_SCENE:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_SCENE
+		cc.Action = sceneActionToIpcAction[cmdArgs.Action]
+		cc.Name = cmdArgs.Name
+		return sendAndPrintItems(ic, cc, out)
+	case CCT_SCHEDULE:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_SCHEDULE
+		cc.Action = scheduleActionToIpcAction[cmdArgs.Action]
+		cc.Name = cmdArgs.Name
+		cc.Schedule = cmdArgs.Schedule
+		cc.Command = cmdArgs.Command
+		return sendAndPrintItems(ic, cc, out)
+	case CCT_CALENDAR:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_CALENDAR
+		cc.Action = ipc.IA_UPCOMING
+		cc.Days = cmdArgs.Days
+		return sendAndPrintItems(ic, cc, out)
+	case CCT_RULES:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_RULES
+		cc.Action = ipc.IA_LIST
+		return sendAndPrintItems(ic, cc, out)
+	case CCT_SCRIPT:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_SCRIPT
+		cc.Action = scriptActionToIpcAction[cmdArgs.Action]
+		cc.Name = cmdArgs.Name
+		cc.Timeout = cmdArgs.Timeout
+		return sendAndPrintItems(ic, cc, out)
+	case CCT_EVENTS:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_EVENTS
+		cc.Action = ipc.IA_LIST
+		return sendAndPrintItems(ic, cc, out)
+	case CCT_QUEUE:
+		cc := ipc.NewClientCommand()
+		cc.ID = ic.ClientID()
+		cc.Cmd = ipc.IC_QUEUE
+		return sendAndPrintItems(ic, cc, out)
 	}
-	interactive(ic)
+	interactive(ic, out)
 	return nil
 }
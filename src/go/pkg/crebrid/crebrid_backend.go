@@ -0,0 +1,151 @@
+package crebrid
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// a backend connects crebrid to a controller. it returns a CrestronControllerClient, which
+// reads the state, sets digital, analog and serial ports and passes the statuses pushed by the
+// controller. the service only uses that interface, so a backend is added by RegisterBackend
+// and selected by the backend key of the settings
+
+const (
+	// BACKEND_TELNET speaks the v1 or v2 protocol with the telnet server module of the program
+	BACKEND_TELNET = "telnet"
+	// BACKEND_CIP registers at the control system like an XPanel
+	BACKEND_CIP = "cip"
+)
+
+// ErrUnknownBackend is returned for a backend which is not registered
+var ErrUnknownBackend = errors.New("unknown controller backend")
+
+// BackendTarget is the controller a backend connects to
+type BackendTarget struct {
+	// Name of the controller in the settings
+	Name string
+	IP   string
+	Port int
+	// Listener the controller connects to, nil if the controller is dialed on IP and Port
+	Listener ControllerListener
+	Policy   ClientPolicy
+	// Recorder of the connections to the controller, nil if they are not recorded
+	Recorder Recorder
+}
+
+// addr of the target for the logs
+func (bt BackendTarget) addr() string {
+	if bt.Listener != nil {
+		return bt.Listener.Addr()
+	}
+	return net.JoinHostPort(bt.IP, strconv.Itoa(bt.Port))
+}
+
+// connect opens a connection to the controller by the policy. it is recorded if the target
+// has a recorder
+func (bt BackendTarget) connect(policy ClientPolicy) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if bt.Listener != nil {
+			conn, err = bt.Listener.Accept(policy.Connect.Timeout)
+		} else {
+			conn, err = dialController(bt.IP, bt.Port, policy)
+		}
+		if err != nil || bt.Recorder == nil {
+			return conn, err
+		}
+		return bt.Recorder.Wrap(CaptureControllerStream(bt.Name), conn), nil
+	}
+}
+
+// BackendFactory connects to the controller of the target. it is called again by the link of
+// the controller whenever the connection has to be re-established
+type BackendFactory func(target BackendTarget) (CrestronControllerClient, error)
+
+var (
+	backendsLock sync.Mutex
+	backends     = map[string]BackendFactory{
+		BACKEND_TELNET: connectTelnet,
+		BACKEND_CIP:    connectCIP,
+	}
+)
+
+// RegisterBackend under a name. a name can only be registered once
+func RegisterBackend(name string, factory BackendFactory) error {
+	if name == "" || factory == nil {
+		return fmt.Errorf("invalid controller backend [%s]", name)
+	}
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := backends[name]; ok {
+		return fmt.Errorf("controller backend [%s] is already registered", name)
+	}
+	backends[name] = factory
+	return nil
+}
+
+// Backends which are registered, sorted by name
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	ret := make([]string, 0, len(backends))
+	for name := range backends {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ConnectBackend connects to the target with the backend of the name
+func ConnectBackend(name string, target BackendTarget) (CrestronControllerClient, error) {
+	backendsLock.Lock()
+	factory, ok := backends[name]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, name)
+	}
+	return factory(target)
+}
+
+// resolveBackend of a controller. without a backend it follows the protocol, so protocol=cip
+// keeps selecting the cip backend
+func resolveBackend(backend string, protocol WireProtocol) (string, WireProtocol, error) {
+	if backend == "" {
+		if protocol == WP_CIP {
+			return BACKEND_CIP, protocol, nil
+		}
+		return BACKEND_TELNET, protocol, nil
+	}
+	backendsLock.Lock()
+	_, ok := backends[backend]
+	backendsLock.Unlock()
+	switch {
+	case !ok:
+		return backend, protocol, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	case backend == BACKEND_CIP:
+		return backend, WP_CIP, nil
+	case backend == BACKEND_TELNET && protocol == WP_CIP:
+		return backend, protocol, fmt.Errorf("backend %s does not speak protocol %s", backend, protocol)
+	}
+	return backend, protocol, nil
+}
+
+// connectTelnet dials the telnet server module or waits for it to connect
+func connectTelnet(target BackendTarget) (CrestronControllerClient, error) {
+	return newControllerClient(target.addr(), target.connect(target.Policy), target.Policy)
+}
+
+// connectCIP dials the control system, which never connects to a panel
+func connectCIP(target BackendTarget) (CrestronControllerClient, error) {
+	if target.Listener != nil {
+		return nil, errCIPListen
+	}
+	policy := target.Policy
+	policy.Protocol = WP_CIP
+	return newCIPClient(target.addr(), target.connect(policy), policy)
+}
@@ -0,0 +1,73 @@
+package crebrid
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeBackend hands out fake controller clients and keeps the target of the last connect
+var fakeBackend struct {
+	lock   sync.Mutex
+	target BackendTarget
+}
+
+func init() {
+	err := RegisterBackend("fake", func(target BackendTarget) (CrestronControllerClient, error) {
+		fakeBackend.lock.Lock()
+		defer fakeBackend.lock.Unlock()
+		fakeBackend.target = target
+		return newFakeControllerClient(make([]int, target.Policy.Layout.Digitals), make([]float64, target.Policy.Layout.Analogs)), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	if got, want := Backends(), []string{BACKEND_CIP, "fake", BACKEND_TELNET}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Backends() = %v, want %v", got, want)
+	}
+	factory := func(target BackendTarget) (CrestronControllerClient, error) {
+		return nil, nil
+	}
+	if err := RegisterBackend(BACKEND_TELNET, factory); err == nil {
+		t.Error("RegisterBackend() of a registered name succeeded")
+	}
+	if err := RegisterBackend("", factory); err == nil {
+		t.Error("RegisterBackend() without name succeeded")
+	}
+	if err := RegisterBackend("knx", nil); err == nil {
+		t.Error("RegisterBackend() without factory succeeded")
+	}
+	if _, err := ConnectBackend("knx", BackendTarget{}); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("ConnectBackend() of an unknown backend error = %v, want %v", err, ErrUnknownBackend)
+	}
+}
+
+func TestControllerByBackend(t *testing.T) {
+	cs, err := LoadFromByteArr([]byte("ip=192.123.45.67\nport=41296\nbackend=fake\ndigitalPorts=3\nanalogPorts=1\n"))
+	if err != nil {
+		t.Fatalf("LoadFromByteArr() error = %v", err)
+	}
+	me := new(mainExecute)
+	me.clock = NewSystemClock()
+	me.setts = *cs
+	me.bus = NewEventBus()
+	ctrl := me.setupController(cs.AllControllers()[0])
+	defer ctrl.link.Stop()
+	fakeBackend.lock.Lock()
+	target := fakeBackend.target
+	fakeBackend.lock.Unlock()
+	if target.Name != DEFAULT_CONTROLLER || target.IP != "192.123.45.67" || target.Port != 41296 || target.Listener != nil {
+		t.Errorf("target of the backend = %+v", target)
+	}
+	// the service uses the client of the backend through the link of the controller
+	if isOn, err := ctrl.ccc.ToggleSwitch(2); err != nil || !isOn {
+		t.Errorf("ToggleSwitch(2) = %v, %v", isOn, err)
+	}
+	if got, want := ctrl.ccc.GetSystemStatus(), (&SystemStatus{D: []int{0, 1, 0}, A: []float64{0}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSystemStatus() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,303 @@
+package crebrid
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+	"gopkg.in/ini.v1"
+)
+
+// calendars are configured in an ini file, one section per calendar entry:
+//
+//	[vacation]
+//	file=/etc/crebrid/calendars/family.ics
+//	summary=Vacation
+//	start=scene=away
+//	end=scene=home
+//
+// every event of the calendar file whose summary contains the summary of the entry (case
+// insensitive) runs the start command at its begin and the end command at its end. an empty
+// summary matches all events. start or end may be omitted. the calendar files are watched and
+// reloaded on changes. a service started during an event does not run the start command.
+
+const (
+	calendar_key_file    = "file"
+	calendar_key_summary = "summary"
+	calendar_key_start   = "start"
+	calendar_key_end     = "end"
+	// calendar files are checked for changes with this interval
+	calendar_poll_interval = 30 * time.Second
+	// occurrences are searched at most one year ahead
+	calendar_horizon = 366 * 24 * time.Hour
+)
+
+// CalendarEntry maps the events of a calendar file to commands
+type CalendarEntry struct {
+	Name    string
+	File    string
+	Summary string
+	Start   *Command
+	End     *Command
+}
+
+func (ce *CalendarEntry) matches(occ *ICalOccurrence) bool {
+	return strings.Contains(strings.ToLower(occ.Summary), strings.ToLower(ce.Summary))
+}
+
+// LoadCalendarEntriesFromByteArr parses the calendar entries of an ini formatted byte array
+func LoadCalendarEntriesFromByteArr(data []byte) ([]*CalendarEntry, error) {
+	iniFl, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*CalendarEntry, 0)
+	for _, sec := range iniFl.Sections() {
+		if sec.Name() == ini.DefaultSection {
+			continue
+		}
+		ce := new(CalendarEntry)
+		ce.Name = sec.Name()
+		ce.File = sec.Key(calendar_key_file).String()
+		if ce.File == "" {
+			return nil, fmt.Errorf("calendar [%s] without file", ce.Name)
+		}
+		ce.Summary = sec.Key(calendar_key_summary).String()
+		if str := sec.Key(calendar_key_start).String(); str != "" {
+			ce.Start, err = ParseCommand(str)
+			if err != nil {
+				return nil, fmt.Errorf("calendar [%s]: %v", ce.Name, err)
+			}
+		}
+		if str := sec.Key(calendar_key_end).String(); str != "" {
+			ce.End, err = ParseCommand(str)
+			if err != nil {
+				return nil, fmt.Errorf("calendar [%s]: %v", ce.Name, err)
+			}
+		}
+		ret = append(ret, ce)
+	}
+	return ret, nil
+}
+
+// calendarFile keeps the parsed content of an iCalendar file and reloads it on changes
+type calendarFile struct {
+	lock    sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	cal     *ICalendar
+}
+
+// reload the file if it was changed since the last call. true is returned on a change
+func (cf *calendarFile) reload() (bool, error) {
+	info, err := os.Stat(cf.path)
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	if err != nil {
+		if cf.cal != nil && len(cf.cal.Events) > 0 {
+			cf.cal = new(ICalendar)
+			cf.modTime = time.Time{}
+			return true, err
+		}
+		cf.cal = new(ICalendar)
+		return false, err
+	}
+	if info.ModTime().Equal(cf.modTime) && info.Size() == cf.size && cf.cal != nil {
+		return false, nil
+	}
+	data, err := os.ReadFile(cf.path)
+	if err != nil {
+		return false, err
+	}
+	cal, err := ParseICalendar(data, time.Local)
+	if err != nil {
+		return false, err
+	}
+	logging.LogFmt(logging.LOG_INFO, "[CALENDAR] loaded [%d] events from: %s", len(cal.Events), cf.path)
+	cf.cal = cal
+	cf.modTime = info.ModTime()
+	cf.size = info.Size()
+	return true, nil
+}
+
+func (cf *calendarFile) occurrences(from time.Time, to time.Time) []ICalOccurrence {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	if cf.cal == nil {
+		return nil
+	}
+	return cf.cal.Occurrences(from, to)
+}
+
+// calendarTrigger fires at the start or the end of the matching events of a calendar entry
+type calendarTrigger struct {
+	entry *CalendarEntry
+	file  *calendarFile
+	atEnd bool
+}
+
+func (ct *calendarTrigger) Next(after time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, occ := range ct.file.occurrences(after, after.Add(calendar_horizon)) {
+		if !ct.entry.matches(&occ) {
+			continue
+		}
+		t := occ.Start
+		if ct.atEnd {
+			t = occ.End
+		}
+		if t.After(after) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func (ct *calendarTrigger) String() string {
+	if ct.atEnd {
+		return fmt.Sprintf("calendar %s end", ct.entry.Name)
+	}
+	return fmt.Sprintf("calendar %s start", ct.entry.Name)
+}
+
+// CalendarWatcher runs commands at the begin and the end of calendar events
+type CalendarWatcher interface {
+	// Start to watch the calendar files for changes
+	Start()
+	// Stop watching and wait until the routine is finished
+	Stop()
+	// Upcoming triggers within the given duration
+	Upcoming(d time.Duration) []string
+}
+
+type calendarWatcher struct {
+	clock    Clock
+	sched    Scheduler
+	entries  []*CalendarEntry
+	files    map[string]*calendarFile
+	quit     chan bool
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewCalendarWatcher loads the calendar entries from the given file and adds their start and
+// end triggers to the scheduler. a missing file results in a watcher without entries
+func NewCalendarWatcher(clock Clock, path2File string, sched Scheduler) (CalendarWatcher, error) {
+	data, err := os.ReadFile(path2File)
+	if err != nil {
+		logging.LogFmt(logging.LOG_WARN, "[CALENDAR] unable to read calendars from: %s", path2File)
+		data = []byte{}
+	}
+	entries, err := LoadCalendarEntriesFromByteArr(data)
+	if err != nil {
+		return nil, err
+	}
+	return newCalendarWatcher(clock, entries, sched)
+}
+
+func newCalendarWatcher(clock Clock, entries []*CalendarEntry, sched Scheduler) (CalendarWatcher, error) {
+	cw := new(calendarWatcher)
+	cw.clock = clock
+	cw.sched = sched
+	cw.entries = entries
+	cw.files = make(map[string]*calendarFile)
+	cw.quit = make(chan bool)
+	for _, ce := range entries {
+		cf, ok := cw.files[ce.File]
+		if !ok {
+			cf = &calendarFile{path: ce.File}
+			_, err := cf.reload()
+			if err != nil {
+				logging.LogFmt(logging.LOG_ERROR, "[CALENDAR] unable to load calendar [%s]: %s", ce.File, err)
+			}
+			cw.files[ce.File] = cf
+		}
+		if ce.Start != nil {
+			err := sched.AddTrigger(ce.Name+":start", &calendarTrigger{entry: ce, file: cf}, ce.Start)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ce.End != nil {
+			err := sched.AddTrigger(ce.Name+":end", &calendarTrigger{entry: ce, file: cf, atEnd: true}, ce.End)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cw, nil
+}
+
+// checkFiles reloads changed calendar files and reschedules their triggers
+func (cw *calendarWatcher) checkFiles() {
+	changed := false
+	for path, cf := range cw.files {
+		fileChanged, err := cf.reload()
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[CALENDAR] unable to reload calendar [%s]: %s", path, err)
+		}
+		changed = changed || fileChanged
+	}
+	if changed {
+		cw.sched.Reschedule()
+	}
+}
+
+func (cw *calendarWatcher) execute() {
+	defer cw.wg.Done()
+	for {
+		select {
+		case <-cw.clock.After(calendar_poll_interval):
+			cw.checkFiles()
+		case <-cw.quit:
+			logging.Log(logging.LOG_DEBUG, "[CALENDAR] routine escaped")
+			return
+		}
+	}
+}
+
+func (cw *calendarWatcher) Start() {
+	logging.LogFmt(logging.LOG_MAIN, "[CALENDAR] watch %d calendar files", len(cw.files))
+	cw.wg.Add(1)
+	go cw.execute()
+}
+
+func (cw *calendarWatcher) Stop() {
+	// the lifecycle may stop the watcher more than once
+	cw.quitOnce.Do(func() { close(cw.quit) })
+	cw.wg.Wait()
+}
+
+type upcomingTrigger struct {
+	at   time.Time
+	line string
+}
+
+func (cw *calendarWatcher) Upcoming(d time.Duration) []string {
+	now := cw.clock.Now()
+	triggers := make([]upcomingTrigger, 0)
+	for _, ce := range cw.entries {
+		for _, occ := range cw.files[ce.File].occurrences(now, now.Add(d)) {
+			if !ce.matches(&occ) {
+				continue
+			}
+			if ce.Start != nil && !occ.Start.Before(now) {
+				triggers = append(triggers, upcomingTrigger{at: occ.Start, line: fmt.Sprintf("%s %s start: %s (%s)", occ.Start.Format(schedule_at_layout), ce.Name, ce.Start, occ.Summary)})
+			}
+			if ce.End != nil && occ.End.Before(now.Add(d)) {
+				triggers = append(triggers, upcomingTrigger{at: occ.End, line: fmt.Sprintf("%s %s end: %s (%s)", occ.End.Format(schedule_at_layout), ce.Name, ce.End, occ.Summary)})
+			}
+		}
+	}
+	sort.SliceStable(triggers, func(i, j int) bool { return triggers[i].at.Before(triggers[j].at) })
+	ret := make([]string, len(triggers))
+	for i, ut := range triggers {
+		ret[i] = ut.line
+	}
+	return ret
+}
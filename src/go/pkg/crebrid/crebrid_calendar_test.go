@@ -0,0 +1,131 @@
+package crebrid
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadCalendarEntriesFromByteArr(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []*CalendarEntry
+		wantErr bool
+	}{
+		{
+			name: "start and end",
+			data: "[vacation]\nfile=/tmp/family.ics\nsummary=Vacation\nstart=scene=away\nend=scene=home",
+			want: []*CalendarEntry{{
+				Name:    "vacation",
+				File:    "/tmp/family.ics",
+				Summary: "Vacation",
+				Start:   &Command{Kind: CK_SCENE, Scene: "away"},
+				End:     &Command{Kind: CK_SCENE, Scene: "home"},
+			}},
+		},
+		{
+			name: "start only",
+			data: "[guests]\nfile=/tmp/family.ics\nstart=d3=on",
+			want: []*CalendarEntry{{
+				Name:  "guests",
+				File:  "/tmp/family.ics",
+				Start: &Command{Kind: CK_SET_DIGITAL, Port: 3, On: true},
+			}},
+		},
+		{name: "missing file", data: "[vacation]\nstart=scene=away", wantErr: true},
+		{name: "invalid command", data: "[vacation]\nfile=/tmp/family.ics\nstart=d3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadCalendarEntriesFromByteArr([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadCalendarEntriesFromByteArr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadCalendarEntriesFromByteArr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalendarWatcher(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "family.ics")
+	writeCal := func(lines ...string) {
+		err := os.WriteFile(path, icalData(lines...), 0644)
+		if err != nil {
+			t.Fatalf("unable to write calendar: %v", err)
+		}
+	}
+	writeCal(
+		"BEGIN:VEVENT", "UID:1", "SUMMARY:Vacation Italy", "DTSTART;TZID=Europe/Berlin:20261024T080000", "DTEND;TZID=Europe/Berlin:20261031T180000", "END:VEVENT",
+		"BEGIN:VEVENT", "UID:2", "SUMMARY:Dentist", "DTSTART;TZID=Europe/Berlin:20261021T100000", "DURATION:PT1H", "END:VEVENT",
+	)
+	fc := newFakeClock(time.Date(2026, 10, 19, 12, 0, 0, 0, berlin))
+	s, err := NewScheduler(fc, nil, "", func(cmd *Command) error { return nil })
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	entries, err := LoadCalendarEntriesFromByteArr([]byte("[vacation]\nfile=" + path + "\nsummary=vacation\nstart=scene=away\nend=scene=home"))
+	if err != nil {
+		t.Fatalf("LoadCalendarEntriesFromByteArr() error = %v", err)
+	}
+	cw, err := newCalendarWatcher(fc, entries, s)
+	if err != nil {
+		t.Fatalf("newCalendarWatcher() error = %v", err)
+	}
+	next := func() map[string]string {
+		ret := make(map[string]string)
+		for _, sj := range s.Jobs() {
+			ret[sj.ID] = sj.String()
+		}
+		return ret
+	}
+	want := map[string]string{
+		"vacation:start": "vacation:start: [calendar vacation start] scene=away (next: 2026-10-24 08:00)",
+		"vacation:end":   "vacation:end: [calendar vacation end] scene=home (next: 2026-10-31 18:00)",
+	}
+	if got := next(); !reflect.DeepEqual(got, want) {
+		t.Errorf("jobs = %v, want %v", got, want)
+	}
+	if err := s.Remove("vacation:start"); err == nil {
+		t.Errorf("Remove() of a calendar job does not fail")
+	}
+	wantUpcoming := []string{"2026-10-24 08:00 vacation start: scene=away (Vacation Italy)"}
+	if got := cw.Upcoming(7 * 24 * time.Hour); !reflect.DeepEqual(got, wantUpcoming) {
+		t.Errorf("Upcoming() = %v, want %v", got, wantUpcoming)
+	}
+	// the vacation was cancelled
+	writeCal("BEGIN:VEVENT", "UID:2", "SUMMARY:Dentist", "DTSTART;TZID=Europe/Berlin:20261021T100000", "END:VEVENT")
+	cw.(*calendarWatcher).checkFiles()
+	want = map[string]string{
+		"vacation:start": "vacation:start: [calendar vacation start] scene=away (next: never)",
+		"vacation:end":   "vacation:end: [calendar vacation end] scene=home (next: never)",
+	}
+	if got := next(); !reflect.DeepEqual(got, want) {
+		t.Errorf("jobs after reload = %v, want %v", got, want)
+	}
+}
+
+func TestCalendarWatcherStopTwice(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	s, err := NewScheduler(fc, nil, "", func(cmd *Command) error { return nil })
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	cw, err := newCalendarWatcher(fc, nil, s)
+	if err != nil {
+		t.Fatalf("newCalendarWatcher() error = %v", err)
+	}
+	cw.Start()
+	cw.Stop()
+	// a second stop, e.g. by the shutdown after a restart, does not panic
+	cw.Stop()
+}
@@ -0,0 +1,211 @@
+package crebrid
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// a capture holds every byte crebrid exchanged with the controllers and the IPC clients. it
+// is a file of JSON lines, one record per read or write of a connection:
+//
+//	{"t":"2023-01-26T16:35:49.123456789+01:00","s":"ipc#3","d":"rx","b":"Zm9v"}
+
+// directions of the capture records
+const (
+	// CAPTURE_OPEN the connection was opened, the data is the address of the peer
+	CAPTURE_OPEN = "open"
+	// CAPTURE_RX bytes received by crebrid
+	CAPTURE_RX = "rx"
+	// CAPTURE_TX bytes sent by crebrid
+	CAPTURE_TX = "tx"
+	// CAPTURE_EOF the peer closed the connection
+	CAPTURE_EOF = "eof"
+	// CAPTURE_CLOSE crebrid closed the connection
+	CAPTURE_CLOSE = "close"
+)
+
+// CAPTURE_STREAM_IPC is the stream of the IPC clients, the one of a controller is returned by
+// CaptureControllerStream
+const CAPTURE_STREAM_IPC = "ipc"
+
+// capture_stream_controller prefixes the streams of the controllers
+const capture_stream_controller = "controller:"
+
+// CaptureControllerStream of the controller of the name, e.g. "controller:main"
+func CaptureControllerStream(name string) string {
+	return capture_stream_controller + name
+}
+
+// CaptureRecord of a single read or write of a connection
+type CaptureRecord struct {
+	Time time.Time `json:"t"`
+	// Stream of the connection, numbered per stream like "ipc#3"
+	Stream string `json:"s"`
+	Dir    string `json:"d"`
+	Data   []byte `json:"b,omitempty"`
+}
+
+func (cr CaptureRecord) String() string {
+	return fmt.Sprintf("%s %s %s %q", cr.Time.Format(time.RFC3339Nano), cr.Stream, cr.Dir, cr.Data)
+}
+
+// Recorder writes the bytes of the connections it wraps to a capture
+type Recorder interface {
+	// Wrap a connection of the stream. the connections of a stream are numbered, so the
+	// records of "ipc#2" belong to the second IPC client
+	Wrap(stream string, conn net.Conn) net.Conn
+	// Close the capture, the wrapped connections are no longer recorded
+	Close() error
+}
+
+type recorder struct {
+	clock Clock
+	// lock guards the fields below, every record is written at once
+	lock   sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	conns  map[string]int
+	closed bool
+	err    error
+}
+
+// NewRecorder writes the capture to w
+func NewRecorder(clock Clock, w io.Writer) Recorder {
+	rec := new(recorder)
+	rec.clock = clock
+	rec.enc = json.NewEncoder(w)
+	rec.conns = make(map[string]int)
+	return rec
+}
+
+// OpenRecorder appends the capture to the file of the path
+func OpenRecorder(clock Clock, path string) (Recorder, error) {
+	fl, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	rec := NewRecorder(clock, fl).(*recorder)
+	rec.closer = fl
+	logging.LogFmt(logging.LOG_MAIN, "[capture] record the connections to: %s", path)
+	return rec, nil
+}
+
+func (rec *recorder) Wrap(stream string, conn net.Conn) net.Conn {
+	rec.lock.Lock()
+	rec.conns[stream]++
+	rc := &recordingConn{Conn: conn, rec: rec, stream: fmt.Sprintf("%s#%d", stream, rec.conns[stream])}
+	rec.lock.Unlock()
+	rec.record(rc.stream, CAPTURE_OPEN, []byte(conn.RemoteAddr().String()))
+	return rc
+}
+
+// record the data of a connection. a capture which cannot be written stops recording, so the
+// service keeps running
+func (rec *recorder) record(stream string, dir string, data []byte) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.closed || rec.err != nil {
+		return
+	}
+	rec.err = rec.enc.Encode(CaptureRecord{Time: rec.clock.Now(), Stream: stream, Dir: dir, Data: data})
+	if rec.err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[capture] stop recording: %s", rec.err)
+	}
+}
+
+func (rec *recorder) Close() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.closed {
+		return nil
+	}
+	rec.closed = true
+	if rec.closer != nil {
+		return rec.closer.Close()
+	}
+	return nil
+}
+
+// recordingConn records every byte read and written. the reads are recorded as they were
+// returned, so a replay splits the stream like the connection did
+type recordingConn struct {
+	net.Conn
+	rec    *recorder
+	stream string
+	// writeLock is held by a write until it is recorded, so the answer of the peer, which
+	// may be read meanwhile, is recorded after it
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func (rc *recordingConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	rc.writeLock.Lock()
+	defer rc.writeLock.Unlock()
+	if n > 0 {
+		rc.rec.record(rc.stream, CAPTURE_RX, b[:n])
+	}
+	if err == io.EOF {
+		rc.rec.record(rc.stream, CAPTURE_EOF, nil)
+	}
+	return n, err
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	rc.writeLock.Lock()
+	defer rc.writeLock.Unlock()
+	n, err := rc.Conn.Write(b)
+	if n > 0 {
+		rc.rec.record(rc.stream, CAPTURE_TX, b[:n])
+	}
+	return n, err
+}
+
+func (rc *recordingConn) Close() error {
+	rc.closeOnce.Do(func() {
+		rc.rec.record(rc.stream, CAPTURE_CLOSE, nil)
+	})
+	return rc.Conn.Close()
+}
+
+// ReadCapture of a reader. a record which is cut off at the end, e.g. by a crash of the
+// service, ends the capture
+func ReadCapture(reader io.Reader) ([]CaptureRecord, error) {
+	ret := make([]CaptureRecord, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var lineErr error
+	for line := 1; scanner.Scan(); line++ {
+		if lineErr != nil {
+			return nil, lineErr
+		}
+		var cr CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &cr); err != nil {
+			lineErr = fmt.Errorf("invalid capture record in line %d: %w", line, err)
+			continue
+		}
+		ret = append(ret, cr)
+	}
+	if lineErr != nil {
+		logging.LogFmt(logging.LOG_WARN, "[capture] skip the last record: %s", lineErr)
+	}
+	return ret, scanner.Err()
+}
+
+// ReadCaptureFile of the path
+func ReadCaptureFile(path string) ([]CaptureRecord, error) {
+	fl, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+	return ReadCapture(fl)
+}
@@ -0,0 +1,567 @@
+package crebrid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// a replay plays the peers of crebrid from a capture: the controller answers with the bytes
+// crebrid received from it and the IPC clients send their recorded requests. the bytes
+// crebrid sends are compared with the recorded ones, so every difference of a dev machine to
+// the field shows up
+
+const (
+	// replay_read_timeout is the time crebrid has to send the bytes of a record
+	replay_read_timeout = 10 * time.Second
+	// replay_dial_timeout is the time the service has to accept a replayed IPC client
+	replay_dial_timeout = 10 * time.Second
+)
+
+// CaptureConnection of a capture with its records in order
+type CaptureConnection struct {
+	// Stream of the connection, e.g. "controller:main#2"
+	Stream string
+	// Addr of the peer
+	Addr string
+	// Start of the connection
+	Start time.Time
+	// Records of the connection but its open record
+	Records []CaptureRecord
+}
+
+// Of is true if the connection belongs to the stream, e.g. CAPTURE_STREAM_IPC
+func (cc CaptureConnection) Of(stream string) bool {
+	return strings.HasPrefix(cc.Stream, stream+"#")
+}
+
+// CaptureConnections of the records in the order they were opened
+func CaptureConnections(records []CaptureRecord) []CaptureConnection {
+	ret := make([]CaptureConnection, 0)
+	index := make(map[string]int)
+	for _, cr := range records {
+		i, ok := index[cr.Stream]
+		if !ok {
+			// a connection without open record was opened before the capture started
+			i = len(ret)
+			index[cr.Stream] = i
+			ret = append(ret, CaptureConnection{Stream: cr.Stream, Start: cr.Time})
+		}
+		if cr.Dir == CAPTURE_OPEN {
+			ret[i].Addr = string(cr.Data)
+			ret[i].Start = cr.Time
+			continue
+		}
+		ret[i].Records = append(ret[i].Records, cr)
+	}
+	return ret
+}
+
+// FilterCaptureConnections of the stream
+func FilterCaptureConnections(conns []CaptureConnection, stream string) []CaptureConnection {
+	ret := make([]CaptureConnection, 0)
+	for _, cc := range conns {
+		if cc.Of(stream) {
+			ret = append(ret, cc)
+		}
+	}
+	return ret
+}
+
+// captureOffset of a record to the start of the capture, e.g. "+1.250s"
+func captureOffset(t time.Time, start time.Time) string {
+	return fmt.Sprintf("+%.3fs", t.Sub(start).Seconds())
+}
+
+// chunkReader returns the data of the records of one direction read by read, like the
+// connection returned them to crebrid
+type chunkReader struct {
+	records []CaptureRecord
+	next    int
+	pending []byte
+	// at is the time of the record read last
+	at time.Time
+}
+
+func newChunkReader(records []CaptureRecord, dir string) *chunkReader {
+	cr := new(chunkReader)
+	for _, rec := range records {
+		if rec.Dir == dir {
+			cr.records = append(cr.records, rec)
+		}
+	}
+	return cr
+}
+
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	if len(cr.pending) == 0 {
+		if cr.next >= len(cr.records) {
+			return 0, io.EOF
+		}
+		cr.pending = cr.records[cr.next].Data
+		cr.at = cr.records[cr.next].Time
+		cr.next++
+	}
+	n := copy(b, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+// decodedMessage of a connection
+type decodedMessage struct {
+	at   time.Time
+	dir  string
+	text string
+}
+
+// DecodeCapture feeds the bytes of every connection through the parsers of crebrid and
+// returns a line per message, frame or dropped frame in the order of time. the controllers
+// are decoded by the protocol and the status layout
+func DecodeCapture(conns []CaptureConnection, protocol WireProtocol, layout StatusLayout) []string {
+	ret := make([]string, 0)
+	if len(conns) == 0 {
+		return ret
+	}
+	start := conns[0].Start
+	for _, cc := range conns {
+		if cc.Start.Before(start) {
+			start = cc.Start
+		}
+	}
+	msgs := make([]decodedMessage, 0)
+	for _, cc := range conns {
+		if cc.Addr != "" {
+			msgs = append(msgs, decodedMessage{at: cc.Start, dir: CAPTURE_OPEN, text: cc.Stream + " " + CAPTURE_OPEN + " " + cc.Addr})
+		}
+		for _, dir := range []string{CAPTURE_RX, CAPTURE_TX} {
+			var decoded []decodedMessage
+			switch {
+			case cc.Of(CAPTURE_STREAM_IPC):
+				decoded = decodeIPC(newChunkReader(cc.Records, dir), dir)
+			case protocol == WP_V2:
+				decoded = decodeWireV2(newChunkReader(cc.Records, dir), dir, layout)
+			case protocol == WP_CIP:
+				decoded = decodeCIP(newChunkReader(cc.Records, dir), dir)
+			default:
+				decoded = decodeWireV1(newChunkReader(cc.Records, dir), dir, layout)
+			}
+			for _, msg := range decoded {
+				msg.text = cc.Stream + " " + dir + " " + msg.text
+				msgs = append(msgs, msg)
+			}
+		}
+		for _, rec := range cc.Records {
+			if rec.Dir == CAPTURE_EOF || rec.Dir == CAPTURE_CLOSE {
+				msgs = append(msgs, decodedMessage{at: rec.Time, dir: rec.Dir, text: cc.Stream + " " + rec.Dir})
+			}
+		}
+	}
+	// a message of a chunk is shown before the connection closes after it
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].at.Before(msgs[j].at)
+	})
+	for _, msg := range msgs {
+		ret = append(ret, captureOffset(msg.at, start)+" "+msg.text)
+	}
+	return ret
+}
+
+// decodeIPC reads the messages like the IPC server and the client do, a message ends with a
+// read of less than a block
+func decodeIPC(cr *chunkReader, dir string) []decodedMessage {
+	ret := make([]decodedMessage, 0)
+	for {
+		buf, err := ipc.ReadUntilEOF(bufio.NewReader(cr), ipc.ReadPolicy{Retries: 1})
+		if err != nil {
+			return ret
+		}
+		msg := decodedMessage{at: cr.at, dir: dir}
+		switch {
+		case dir == CAPTURE_RX && string(buf) == ipc.CLIENT_QUIT_COMMAND:
+			msg.text = "quit"
+		case dir == CAPTURE_RX:
+			cc, err := ipc.ClientCommandFromRequest(buf)
+			msg.text = decodedJSON("command", cc, err)
+		default:
+			sr, err := ipc.ServerResponseFromResponse(buf)
+			msg.text = decodedJSON("response", sr, err)
+		}
+		ret = append(ret, msg)
+	}
+}
+
+// decodedJSON of a message or the error why it could not be decoded
+func decodedJSON(kind string, v interface{}, err error) string {
+	if err != nil {
+		return fmt.Sprintf("invalid %s: %s", kind, err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("invalid %s: %s", kind, err)
+	}
+	return kind + " " + string(data)
+}
+
+// decodeWireV1 reads the statuses of the controller by the status decoder of the v1 client.
+// the requests of crebrid are shown as they were written
+func decodeWireV1(cr *chunkReader, dir string, layout StatusLayout) []decodedMessage {
+	ret := make([]decodedMessage, 0)
+	if dir == CAPTURE_TX {
+		for _, rec := range cr.records {
+			ret = append(ret, decodedMessage{at: rec.Time, dir: dir, text: fmt.Sprintf("request %q", rec.Data)})
+		}
+		return ret
+	}
+	sd := newStatusDecoder(cr, layout)
+	for {
+		ss, err := sd.Next()
+		var fe *FrameError
+		switch {
+		case errors.As(err, &fe):
+			ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: "drop " + err.Error()})
+		case err != nil:
+			return ret
+		default:
+			ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: decodedStatus(ss)})
+		}
+	}
+}
+
+// decodeWireV2 reads the frames by the wire decoder. the statuses of the answers and the
+// pushes of the controller are decoded by the layout
+func decodeWireV2(cr *chunkReader, dir string, layout StatusLayout) []decodedMessage {
+	ret := make([]decodedMessage, 0)
+	wd := NewWireDecoder(cr)
+	for {
+		wf, err := wd.Next()
+		var fe *FrameError
+		switch {
+		case errors.As(err, &fe):
+			ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: "drop " + err.Error()})
+			continue
+		case err != nil:
+			return ret
+		}
+		text := "frame " + wf.String()
+		if dir == CAPTURE_RX && (wf.Type == WT_ACK || wf.Type == WT_PUSH) && strings.Contains(wf.Payload, "{") {
+			ss, err := newStatusDecoder(strings.NewReader(wf.Payload), layout).Next()
+			if err != nil {
+				text += " drop " + err.Error()
+			} else {
+				text += " " + decodedStatus(ss)
+			}
+		}
+		ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: text})
+	}
+}
+
+// decodeCIP reads the packets of the control system and their joins
+func decodeCIP(cr *chunkReader, dir string) []decodedMessage {
+	ret := make([]decodedMessage, 0)
+	reader := bufio.NewReader(cr)
+	for {
+		cp, err := ReadCIPPacket(reader)
+		if err == io.ErrUnexpectedEOF {
+			ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: "drop packet cut off by the end of the connection"})
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: "drop " + err.Error()})
+			}
+			return ret
+		}
+		text := "packet " + cp.String()
+		if cp.Type == CIP_DATA || cp.Type == CIP_SERIAL {
+			if cj, err := ParseCIPJoin(cp); err == nil {
+				text += " " + cj.String()
+			}
+		}
+		ret = append(ret, decodedMessage{at: cr.at, dir: dir, text: text})
+	}
+}
+
+// decodedStatus like the status command of crestronsim
+func decodedStatus(ss *SystemStatus) string {
+	return fmt.Sprintf("status d=%v a=%v", ss.D, ss.A)
+}
+
+// ReplayPeer plays the peer of crebrid on the connection: the bytes crebrid received are
+// sent at the recorded pace, the bytes crebrid sent are read and compared with the recorded
+// ones. the responses to IPC clients are encrypted with a random nonce, so they are compared
+// decoded and without their IDs. speed 2 plays twice as fast, 0 as fast as possible. the
+// differences to the recording are returned, an error ends the replay of the connection
+func ReplayPeer(conn net.Conn, cc CaptureConnection, speed float64) ([]string, error) {
+	mismatches := make([]string, 0)
+	prev := cc.Start
+	played := time.Now()
+	for _, rec := range cc.Records {
+		at := captureOffset(rec.Time, cc.Start)
+		switch {
+		case rec.Dir == CAPTURE_RX:
+			if speed > 0 {
+				time.Sleep(time.Until(played.Add(time.Duration(float64(rec.Time.Sub(prev)) / speed))))
+			}
+			if _, err := conn.Write(rec.Data); err != nil {
+				return mismatches, fmt.Errorf("%s %s: %w", cc.Stream, at, err)
+			}
+		case rec.Dir == CAPTURE_TX && cc.Of(CAPTURE_STREAM_IPC):
+			conn.SetReadDeadline(time.Now().Add(replay_read_timeout))
+			buf, err := ipc.ReadUntilEOF(bufio.NewReader(conn), ipc.ReadPolicy{Retries: 1})
+			if err != nil {
+				return mismatches, fmt.Errorf("%s %s: %w", cc.Stream, at, err)
+			}
+			if got, want := replayedResponse(buf), replayedResponse(rec.Data); got != want {
+				mismatches = append(mismatches, fmt.Sprintf("%s %s: crebrid answered %s, recorded %s", cc.Stream, at, got, want))
+			}
+		case rec.Dir == CAPTURE_TX:
+			got := make([]byte, len(rec.Data))
+			conn.SetReadDeadline(time.Now().Add(replay_read_timeout))
+			n, err := io.ReadFull(conn, got)
+			if !bytes.Equal(got[:n], rec.Data) {
+				mismatches = append(mismatches, fmt.Sprintf("%s %s: crebrid sent %q, recorded %q", cc.Stream, at, got[:n], rec.Data))
+			}
+			if err != nil {
+				return mismatches, fmt.Errorf("%s %s: %w", cc.Stream, at, err)
+			}
+		case rec.Dir == CAPTURE_EOF:
+			// the peer closed the connection, which is done by the caller
+			return mismatches, nil
+		case rec.Dir == CAPTURE_CLOSE:
+			conn.SetReadDeadline(time.Now().Add(replay_read_timeout))
+			n, err := io.Copy(ioutil.Discard, conn)
+			if n > 0 {
+				mismatches = append(mismatches, fmt.Sprintf("%s %s: crebrid sent %d bytes before it closed the connection", cc.Stream, at, n))
+			}
+			if err != nil {
+				return mismatches, fmt.Errorf("%s %s: connection not closed: %w", cc.Stream, at, err)
+			}
+			return mismatches, nil
+		}
+		prev = rec.Time
+		played = time.Now()
+	}
+	return mismatches, nil
+}
+
+// replay_updated matches the time of the last update of a port in the items of a response
+var replay_updated = regexp.MustCompile(`\(updated [0-9-]+ [0-9:]+\)`)
+
+// replayedResponse of an IPC client without the IDs and the times of the state store, which
+// differ on every run
+func replayedResponse(data []byte) string {
+	sr, err := ipc.ServerResponseFromResponse(data)
+	if err == nil {
+		sr.ID = ""
+		sr.ResponseID = ""
+		for i, item := range sr.Items {
+			sr.Items[i] = replay_updated.ReplaceAllString(item, "(updated)")
+		}
+	}
+	return decodedJSON("response", sr, err)
+}
+
+// ReplayController plays the controller of a capture. every connection crebrid opens plays
+// the next recorded connection of the controller
+type ReplayController interface {
+	// Start listening
+	Start() error
+	// Stop listening and close the connections
+	Stop()
+	// Addr the controller listens on
+	Addr() string
+	// Connected is closed as soon as crebrid connected the first time
+	Connected() <-chan bool
+	// Done is closed as soon as every recorded connection was played
+	Done() <-chan bool
+	// Mismatches of the bytes crebrid sent to the recorded ones
+	Mismatches() []string
+}
+
+type replayController struct {
+	port  int
+	conns []CaptureConnection
+	speed float64
+	ln    net.Listener
+	wg    sync.WaitGroup
+	// lock guards the fields below
+	lock       sync.Mutex
+	next       int
+	played     int
+	open       map[net.Conn]bool
+	mismatches []string
+	connected  chan bool
+	done       chan bool
+}
+
+// NewReplayController of the recorded connections of a controller, see
+// FilterCaptureConnections. port 0 picks a free port
+func NewReplayController(port int, conns []CaptureConnection, speed float64) ReplayController {
+	rc := new(replayController)
+	rc.port = port
+	rc.conns = conns
+	rc.speed = speed
+	rc.open = make(map[net.Conn]bool)
+	rc.connected = make(chan bool)
+	rc.done = make(chan bool)
+	if len(conns) == 0 {
+		close(rc.done)
+	}
+	return rc
+}
+
+func (rc *replayController) Start() error {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(rc.port)))
+	if err != nil {
+		return err
+	}
+	rc.ln = ln
+	rc.wg.Add(1)
+	go rc.serve()
+	return nil
+}
+
+func (rc *replayController) serve() {
+	defer rc.wg.Done()
+	for {
+		conn, err := rc.ln.Accept()
+		if err != nil {
+			return
+		}
+		rc.lock.Lock()
+		if rc.next == 0 {
+			close(rc.connected)
+		}
+		if rc.next >= len(rc.conns) {
+			rc.mismatches = append(rc.mismatches, fmt.Sprintf("connection %d of crebrid is not recorded", rc.next+1))
+			rc.next++
+			rc.lock.Unlock()
+			conn.Close()
+			continue
+		}
+		cc := rc.conns[rc.next]
+		rc.next++
+		rc.open[conn] = true
+		rc.lock.Unlock()
+		logging.LogFmt(logging.LOG_INFO, "[replay] play %s to: %s", cc.Stream, conn.RemoteAddr())
+		rc.wg.Add(1)
+		go rc.play(conn, cc)
+	}
+}
+
+// play a recorded connection
+func (rc *replayController) play(conn net.Conn, cc CaptureConnection) {
+	defer rc.wg.Done()
+	mismatches, err := ReplayPeer(conn, cc, rc.speed)
+	conn.Close()
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	delete(rc.open, conn)
+	rc.mismatches = append(rc.mismatches, mismatches...)
+	if err != nil {
+		rc.mismatches = append(rc.mismatches, err.Error())
+	}
+	rc.played++
+	if rc.played == len(rc.conns) {
+		close(rc.done)
+	}
+}
+
+func (rc *replayController) Stop() {
+	if rc.ln == nil {
+		return
+	}
+	rc.ln.Close()
+	rc.lock.Lock()
+	for conn := range rc.open {
+		conn.Close()
+	}
+	rc.lock.Unlock()
+	rc.wg.Wait()
+}
+
+func (rc *replayController) Addr() string {
+	if rc.ln == nil {
+		return ""
+	}
+	return rc.ln.Addr().String()
+}
+
+func (rc *replayController) Connected() <-chan bool {
+	return rc.connected
+}
+
+func (rc *replayController) Done() <-chan bool {
+	return rc.done
+}
+
+func (rc *replayController) Mismatches() []string {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return append([]string{}, rc.mismatches...)
+}
+
+// ReplayClients plays the recorded IPC clients against the service at the address. every
+// client connects at its recorded offset to start, scaled by speed, and the clients run side
+// by side like they did. speed 0 plays the clients one after another. the differences to the
+// recording are returned
+func ReplayClients(addr string, conns []CaptureConnection, start time.Time, speed float64) []string {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	ret := make([]string, 0)
+	play := func(cc CaptureConnection) {
+		mismatches, err := replayClient(addr, cc, speed)
+		lock.Lock()
+		defer lock.Unlock()
+		ret = append(ret, mismatches...)
+		if err != nil {
+			ret = append(ret, err.Error())
+		}
+	}
+	begin := time.Now()
+	for _, cc := range conns {
+		if speed <= 0 {
+			play(cc)
+			continue
+		}
+		wg.Add(1)
+		go func(cc CaptureConnection) {
+			defer wg.Done()
+			time.Sleep(time.Until(begin.Add(time.Duration(float64(cc.Start.Sub(start)) / speed))))
+			play(cc)
+		}(cc)
+	}
+	wg.Wait()
+	return ret
+}
+
+// replayClient connects to the service and plays the recorded client
+func replayClient(addr string, cc CaptureConnection, speed float64) ([]string, error) {
+	var conn net.Conn
+	var err error
+	// the service may still start up
+	for deadline := time.Now().Add(replay_dial_timeout); ; time.Sleep(100 * time.Millisecond) {
+		conn, err = net.DialTimeout("tcp", addr, replay_dial_timeout)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cc.Stream, err)
+	}
+	defer conn.Close()
+	return ReplayPeer(conn, cc, speed)
+}
@@ -0,0 +1,248 @@
+package crebrid
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+func TestRecorder(t *testing.T) {
+	start := time.Date(2023, 1, 26, 16, 35, 49, 0, time.UTC)
+	clock := newFakeClock(start)
+	var capture bytes.Buffer
+	rec := NewRecorder(clock, &capture)
+	local, remote := net.Pipe()
+	conn := rec.Wrap(CAPTURE_STREAM_IPC, local)
+	go func() {
+		buf := make([]byte, 8)
+		n, _ := remote.Read(buf)
+		remote.Write(buf[:n])
+		remote.Close()
+	}()
+	clock.Advance(time.Second)
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 8)
+	n, _ := conn.Read(buf)
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("Read() after the peer closed error = %v", err)
+	}
+	conn.Close()
+	conn.Close()
+	// the second connection of the stream gets its own number
+	second, _ := net.Pipe()
+	rec.Wrap(CAPTURE_STREAM_IPC, second).Close()
+	rec.Close()
+	// a closed recorder records nothing
+	conn.Write([]byte("late"))
+	records, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatalf("ReadCapture() error = %v", err)
+	}
+	at := start.Add(time.Second)
+	want := []CaptureRecord{
+		{Time: start, Stream: "ipc#1", Dir: CAPTURE_OPEN, Data: []byte("pipe")},
+		{Time: at, Stream: "ipc#1", Dir: CAPTURE_TX, Data: []byte("ping")},
+		{Time: at, Stream: "ipc#1", Dir: CAPTURE_RX, Data: buf[:n]},
+		{Time: at, Stream: "ipc#1", Dir: CAPTURE_EOF},
+		{Time: at, Stream: "ipc#1", Dir: CAPTURE_CLOSE},
+		{Time: at, Stream: "ipc#2", Dir: CAPTURE_OPEN, Data: []byte("pipe")},
+		{Time: at, Stream: "ipc#2", Dir: CAPTURE_CLOSE},
+	}
+	for i := range records {
+		records[i].Time = records[i].Time.UTC()
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("ReadCapture() = %v, want %v", records, want)
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	line := `{"t":"2023-01-26T16:35:49Z","s":"ipc#1","d":"rx","b":"cQ=="}`
+	tests := []struct {
+		name    string
+		data    string
+		want    int
+		wantErr bool
+	}{
+		{name: "empty", data: "", want: 0},
+		{name: "records", data: line + "\n" + line + "\n", want: 2},
+		// the service crashed while it wrote the last record
+		{name: "cut off", data: line + "\n" + line[:20], want: 1},
+		{name: "invalid", data: line[:20] + "\n" + line + "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadCapture(strings.NewReader(tt.data))
+			if (err != nil) != tt.wantErr || (err == nil && len(got) != tt.want) {
+				t.Errorf("ReadCapture() = %v, %v, want %d records, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeCapture(t *testing.T) {
+	start := time.Date(2023, 1, 26, 16, 35, 49, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	cc := ipc.NewClientCommand()
+	cc.Cmd = ipc.IC_SINGLE
+	cc.AddDigitalPorts(2)
+	request, _ := cc.GetCommand2Send()
+	sr := ipc.NewServerResponse()
+	sr.Cmd = ipc.IC_SINGLE
+	sr.ResponseID = "42"
+	sr.DigitalPortInfo[2] = true
+	response, _ := sr.GetResponse2Send()
+	ack := WireFrame{Seq: 1, Type: WT_ACK, Payload: `T{"d":[0,1],"a":[7]}`}.Encode()
+	push := WireFrame{Type: WT_PUSH, Payload: `{"d":[0,1,1],"a":[7]}`}.Encode()
+	records := []CaptureRecord{
+		{Time: at(0), Stream: "controller:main#1", Dir: CAPTURE_OPEN, Data: []byte("10.0.0.2:41794")},
+		{Time: at(100), Stream: "ipc#1", Dir: CAPTURE_OPEN, Data: []byte("127.0.0.1:50000")},
+		{Time: at(110), Stream: "ipc#1", Dir: CAPTURE_RX, Data: request},
+		{Time: at(120), Stream: "controller:main#1", Dir: CAPTURE_TX, Data: WireFrame{Seq: 1, Type: WT_TOGGLE, Payload: "CODE,2"}.Encode()},
+		// the answer is split across two reads, it is decoded with the second one
+		{Time: at(130), Stream: "controller:main#1", Dir: CAPTURE_RX, Data: ack[:10]},
+		{Time: at(140), Stream: "controller:main#1", Dir: CAPTURE_RX, Data: ack[10:]},
+		{Time: at(150), Stream: "ipc#1", Dir: CAPTURE_TX, Data: response},
+		{Time: at(160), Stream: "ipc#1", Dir: CAPTURE_RX, Data: []byte(ipc.CLIENT_QUIT_COMMAND)},
+		{Time: at(170), Stream: "ipc#1", Dir: CAPTURE_CLOSE},
+		{Time: at(200), Stream: "controller:main#1", Dir: CAPTURE_RX, Data: push},
+		{Time: at(300), Stream: "controller:main#1", Dir: CAPTURE_EOF},
+	}
+	want := []string{
+		"+0.000s controller:main#1 open 10.0.0.2:41794",
+		"+0.100s ipc#1 open 127.0.0.1:50000",
+		`+0.110s ipc#1 rx command {"cmd":1,"id":"","digitalPorts":[2],"action":0,"name":"","schedule":"","command":"","days":0,"timeout":"","refresh":false,"controller":""}`,
+		"+0.120s controller:main#1 tx frame 0001 T [CODE,2]",
+		`+0.140s controller:main#1 rx frame 0001 K [T{"d":[0,1],"a":[7]}] status d=[0 1] a=[7]`,
+		`+0.150s ipc#1 tx response {"cmd":1,"id":"","digitalPortInfo":{"2":true},"responseId":"42","items":null,"error":"","controllerPortInfo":null}`,
+		"+0.160s ipc#1 rx quit",
+		"+0.170s ipc#1 close",
+		`+0.200s controller:main#1 rx frame 0000 P [{"d":[0,1,1],"a":[7]}] drop invalid status frame at offset 0: 3 digital values, want 2 near "{\"d\":[0,1,1],\"a\""`,
+		"+0.300s controller:main#1 eof",
+	}
+	got := DecodeCapture(CaptureConnections(records), WP_V2, StatusLayout{Digitals: 2, Analogs: 1})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeCapture() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// v1 statuses are decoded from the stream like the v1 client does. a connection which was
+	// opened before the capture started has no open record
+	records = []CaptureRecord{
+		{Time: at(0), Stream: "controller:main#1", Dir: CAPTURE_TX, Data: []byte("CODE2")},
+		{Time: at(10), Stream: "controller:main#1", Dir: CAPTURE_RX, Data: []byte(`{"d":[0,`)},
+		{Time: at(20), Stream: "controller:main#1", Dir: CAPTURE_RX, Data: []byte("1],\"a\":[7]}\r\n{\"d\":[1")},
+	}
+	want = []string{
+		"+0.000s controller:main#1 tx request \"CODE2\"",
+		"+0.020s controller:main#1 rx status d=[0 1] a=[7]",
+	}
+	if got := DecodeCapture(CaptureConnections(records), WP_V1, StatusLayout{Digitals: 2, Analogs: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeCapture() of v1 =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestReplayController(t *testing.T) {
+	tests := []struct {
+		protocol WireProtocol
+		listen   func(t *testing.T) (string, int)
+		layout   StatusLayout
+	}{
+		{WP_V1, (&fakeCrestron{d: []int{0, 0, 0, 0}}).listen, StatusLayout{Digitals: 4}},
+		{WP_V2, (&fakeCrestronV2{accessCode: "123DEF", d: []int{0, 0, 0, 0}, a: []float64{0, 0}, serials: make(map[int]string)}).listen, StatusLayout{Digitals: 4, Analogs: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol.String(), func(t *testing.T) {
+			// record a session with the fake controller
+			ip, port := tt.listen(t)
+			var capture bytes.Buffer
+			rec := NewRecorder(NewSystemClock(), &capture)
+			policy := DefaultClientPolicy()
+			policy.Protocol = tt.protocol
+			policy.Connect.Timeout = time.Second
+			policy.Layout = tt.layout
+			target := BackendTarget{Name: DEFAULT_CONTROLLER, IP: ip, Port: port, Policy: policy, Recorder: rec}
+			session := func(target BackendTarget) (bool, *SystemStatus) {
+				client, err := ConnectBackend(BACKEND_TELNET, target)
+				if err != nil {
+					t.Fatalf("ConnectBackend() error = %v", err)
+				}
+				defer client.Close()
+				client.SetAccessCode("123DEF")
+				isOn, err := client.ToggleSwitch(3)
+				if err != nil {
+					t.Fatalf("ToggleSwitch(3) error = %v", err)
+				}
+				return isOn, client.GetSystemStatus()
+			}
+			recordedOn, recordedStatus := session(target)
+			rec.Close()
+			records, err := ReadCapture(&capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns := FilterCaptureConnections(CaptureConnections(records), CaptureControllerStream(DEFAULT_CONTROLLER))
+			// the replayed controller answers like the fake did
+			rc := NewReplayController(0, conns, 0)
+			if err := rc.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Stop()
+			target.Port = portOf(t, rc.Addr())
+			target.Recorder = nil
+			isOn, ss := session(target)
+			if isOn != recordedOn || !reflect.DeepEqual(ss, recordedStatus) {
+				t.Errorf("replayed session = %v, %v, want %v, %v", isOn, ss, recordedOn, recordedStatus)
+			}
+			select {
+			case <-rc.Done():
+			case <-time.After(time.Second):
+				t.Fatal("replay not done")
+			}
+			if got := rc.Mismatches(); len(got) != 0 {
+				t.Errorf("Mismatches() = %v", got)
+			}
+		})
+	}
+}
+
+func TestReplayPeer(t *testing.T) {
+	start := time.Now()
+	cc := CaptureConnection{Stream: "controller:main#1", Start: start, Records: []CaptureRecord{
+		{Time: start, Dir: CAPTURE_TX, Data: []byte("abc")},
+		{Time: start.Add(time.Second), Dir: CAPTURE_RX, Data: []byte("ok")},
+		{Time: start.Add(2 * time.Second), Dir: CAPTURE_CLOSE},
+	}}
+	local, remote := net.Pipe()
+	go func() {
+		// crebrid sends another request than the recorded one
+		local.Write([]byte("abd"))
+		io.ReadFull(local, make([]byte, 2))
+		local.Close()
+	}()
+	mismatches, err := ReplayPeer(remote, cc, 0)
+	want := []string{`controller:main#1 +0.000s: crebrid sent "abd", recorded "abc"`}
+	if err != nil || !reflect.DeepEqual(mismatches, want) {
+		t.Errorf("ReplayPeer() = %v, %v, want %v", mismatches, err, want)
+	}
+}
+
+// portOf the address of a listener
+func portOf(t *testing.T, addr string) int {
+	t.Helper()
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
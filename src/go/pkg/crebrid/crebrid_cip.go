@@ -0,0 +1,242 @@
+package crebrid
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the Crestron Internet Protocol (CIP) is spoken by touch panels and XPanels with the control
+// system on TCP port 41794. every packet starts with its type and the length of its payload:
+//
+//	<type:1> <length:2 big endian> <payload:length>
+//
+// crebrid registers like an XPanel by its IP ID and reads and writes the joins of the program
+// directly, so the telnet server module is not needed
+
+// CIP_DEFAULT_PORT of the control system
+const CIP_DEFAULT_PORT = 41794
+
+// CIP_DEFAULT_IPID of crebrid at the control system
+const CIP_DEFAULT_IPID = 0x03
+
+// CIPType of a packet
+type CIPType byte
+
+const (
+	// CIP_REGISTER registers the IP ID of the panel, sent by the panel
+	CIP_REGISTER CIPType = 0x01
+	// CIP_REGISTER_RESULT accepts or rejects the IP ID, sent by the control system
+	CIP_REGISTER_RESULT CIPType = 0x02
+	// CIP_DISCONNECT closes the connection, sent by both sides
+	CIP_DISCONNECT CIPType = 0x03
+	// CIP_DATA carries a digital or analog join or an update, sent by both sides
+	CIP_DATA CIPType = 0x05
+	// CIP_HEARTBEAT is sent by the panel, the control system answers CIP_HEARTBEAT_RESPONSE
+	CIP_HEARTBEAT          CIPType = 0x0D
+	CIP_HEARTBEAT_RESPONSE CIPType = 0x0E
+	// CIP_REGISTER_REQUEST asks the panel for its IP ID right after it connected
+	CIP_REGISTER_REQUEST CIPType = 0x0F
+	// CIP_SERIAL carries a serial join, sent by both sides
+	CIP_SERIAL CIPType = 0x12
+)
+
+// data types of CIP_DATA packets
+const (
+	// CIP_DATA_DIGITAL is the feedback of a digital join, sent by the control system
+	CIP_DATA_DIGITAL = 0x00
+	// CIP_DATA_UPDATE requests all joins or marks the end of them
+	CIP_DATA_UPDATE = 0x03
+	// CIP_DATA_ANALOG sets or feeds back an analog join
+	CIP_DATA_ANALOG = 0x14
+	// CIP_DATA_PRESS presses or releases a digital join like a button of an XPanel
+	CIP_DATA_PRESS = 0x27
+	// CIP_DATA_SERIAL is the data type of CIP_SERIAL packets
+	CIP_DATA_SERIAL = 0x34
+)
+
+const (
+	// CIP_UPDATE_REQUEST asks the control system to send all joins
+	CIP_UPDATE_REQUEST = 0x00
+	// CIP_UPDATE_END follows the last join of an update
+	CIP_UPDATE_END = 0x16
+	// cip_digital_off marks a released or low digital join in the high byte of the join
+	cip_digital_off = 0x80
+	// cip_serial_ascii is the encoding of a serial join
+	cip_serial_ascii = 0x03
+	// cip_max_digital is the highest digital join, the join is sent in 15 bits
+	cip_max_digital = 0x8000
+	// cip_max_join is the highest analog and serial join
+	cip_max_join = 0x10000
+	// cip_packet_max is the longest payload which is accepted
+	cip_packet_max = 4096
+	// cip_disconnect_timeout is the time to tell the control system about a closed connection
+	cip_disconnect_timeout = 500 * time.Millisecond
+)
+
+var (
+	// cip_register_success is the payload of CIP_REGISTER_RESULT which accepts the IP ID
+	cip_register_success = []byte{0x00, 0x00, 0x00, 0x1F}
+	// cip_register_failed is the payload of CIP_REGISTER_RESULT of an IP ID which is not
+	// defined in the program
+	cip_register_failed = []byte{0xFF, 0xFF, 0x02}
+)
+
+// ErrCIPRegistration is returned if the control system rejected the IP ID
+var ErrCIPRegistration = errors.New("IP ID rejected by the control system")
+
+// CIPPacket of the Crestron Internet Protocol
+type CIPPacket struct {
+	Type    CIPType
+	Payload []byte
+}
+
+// Encode the packet with its header
+func (cp CIPPacket) Encode() []byte {
+	ret := make([]byte, 3, 3+len(cp.Payload))
+	ret[0] = byte(cp.Type)
+	binary.BigEndian.PutUint16(ret[1:], uint16(len(cp.Payload)))
+	return append(ret, cp.Payload...)
+}
+
+func (cp CIPPacket) String() string {
+	return fmt.Sprintf("%02X % X", byte(cp.Type), cp.Payload)
+}
+
+// ReadCIPPacket reads the next packet of the reader
+func ReadCIPPacket(reader *bufio.Reader) (CIPPacket, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return CIPPacket{}, err
+	}
+	length := int(binary.BigEndian.Uint16(header[1:]))
+	if length > cip_packet_max {
+		return CIPPacket{}, fmt.Errorf("%w: CIP packet of type %02X exceeds %d bytes", ErrInvalidFrame, header[0], cip_packet_max)
+	}
+	cp := CIPPacket{Type: CIPType(header[0]), Payload: make([]byte, length)}
+	if _, err := io.ReadFull(reader, cp.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return CIPPacket{}, err
+	}
+	return cp, nil
+}
+
+// cipRegister registers the IP ID of crebrid like an XPanel
+func cipRegister(ipID int) CIPPacket {
+	return CIPPacket{Type: CIP_REGISTER, Payload: []byte{0x00, 0x00, 0x00, 0x00, 0x00, byte(ipID), 0x40, 0xFF, 0xFF, 0xF1, 0x01}}
+}
+
+// CIPRegisterResult accepts or rejects the IP ID of a panel, sent by the control system
+func CIPRegisterResult(accepted bool) CIPPacket {
+	if !accepted {
+		return CIPPacket{Type: CIP_REGISTER_RESULT, Payload: cip_register_failed}
+	}
+	return CIPPacket{Type: CIP_REGISTER_RESULT, Payload: cip_register_success}
+}
+
+// cipData wraps the data of a join or an update into a CIP_DATA packet
+func cipData(dataType byte, data ...byte) CIPPacket {
+	payload := []byte{0x00, 0x00, byte(len(data) + 1), dataType}
+	return CIPPacket{Type: CIP_DATA, Payload: append(payload, data...)}
+}
+
+// CIPDigital of a join, which is sent as little endian number of 15 bits. the highest bit is
+// set for a low join
+func CIPDigital(dataType byte, join int, on bool) CIPPacket {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, uint16(join-1))
+	if !on {
+		data[1] |= cip_digital_off
+	}
+	return cipData(dataType, data...)
+}
+
+// CIPAnalog of a join, join and value are sent as big endian numbers
+func CIPAnalog(join int, value int) CIPPacket {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data, uint16(join-1))
+	binary.BigEndian.PutUint16(data[2:], uint16(value))
+	return cipData(CIP_DATA_ANALOG, data...)
+}
+
+// CIPSerial of a join as ASCII text
+func CIPSerial(join int, text string) CIPPacket {
+	data := []byte{CIP_DATA_SERIAL, 0x00, 0x00, cip_serial_ascii}
+	binary.BigEndian.PutUint16(data[1:], uint16(join-1))
+	data = append(data, text...)
+	return CIPPacket{Type: CIP_SERIAL, Payload: append([]byte{0x00, 0x00, byte(len(data))}, data...)}
+}
+
+// CIPUpdate requests all joins or marks the end of an update
+func CIPUpdate(code byte) CIPPacket {
+	return cipData(CIP_DATA_UPDATE, code)
+}
+
+// CIPJoin is the content of a CIP_DATA or CIP_SERIAL packet
+type CIPJoin struct {
+	// DataType of the join, e.g. CIP_DATA_DIGITAL
+	DataType byte
+	Join     int
+	On       bool
+	Value    int
+	Text     string
+	// Update is the code of an update, the join is 0
+	Update byte
+}
+
+func (cj CIPJoin) String() string {
+	switch cj.DataType {
+	case CIP_DATA_DIGITAL, CIP_DATA_PRESS:
+		return fmt.Sprintf("%s%d=%s", scene_digital_prefix, cj.Join, sceneDigitalValue(cj.On))
+	case CIP_DATA_ANALOG:
+		return fmt.Sprintf("%s%d=%d", scene_analog_prefix, cj.Join, cj.Value)
+	case CIP_DATA_SERIAL:
+		return "s" + strconv.Itoa(cj.Join) + "=" + cj.Text
+	}
+	return fmt.Sprintf("update %02X", cj.Update)
+}
+
+// ParseCIPJoin of a CIP_DATA or CIP_SERIAL packet
+func ParseCIPJoin(cp CIPPacket) (CIPJoin, error) {
+	invalid := fmt.Errorf("%w: CIP packet %s", ErrInvalidFrame, cp)
+	// the payload starts with two bytes of 0 and the length of the data behind it
+	if len(cp.Payload) < 4 || int(cp.Payload[2]) != len(cp.Payload)-3 {
+		return CIPJoin{}, invalid
+	}
+	data := cp.Payload[3:]
+	cj := CIPJoin{DataType: data[0]}
+	switch {
+	case cp.Type == CIP_SERIAL && cj.DataType == CIP_DATA_SERIAL && len(data) >= 4 && data[3] == cip_serial_ascii:
+		cj.Join = int(binary.BigEndian.Uint16(data[1:])) + 1
+		cj.Text = string(data[4:])
+	case cp.Type != CIP_DATA:
+		return CIPJoin{}, invalid
+	case (cj.DataType == CIP_DATA_DIGITAL || cj.DataType == CIP_DATA_PRESS) && len(data) == 3:
+		cj.On = data[2]&cip_digital_off == 0
+		cj.Join = int(binary.LittleEndian.Uint16(data[1:])&(cip_max_digital-1)) + 1
+	case cj.DataType == CIP_DATA_ANALOG && len(data) == 5:
+		cj.Join = int(binary.BigEndian.Uint16(data[1:])) + 1
+		cj.Value = int(binary.BigEndian.Uint16(data[3:]))
+	case cj.DataType == CIP_DATA_UPDATE && len(data) == 2:
+		cj.Update = data[1]
+	default:
+		return CIPJoin{}, invalid
+	}
+	return cj, nil
+}
+
+// ParseCIPIPID of a hexadecimal IP ID like "03" or "0x1F"
+func ParseCIPIPID(str string) (int, error) {
+	ipID, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(str)), "0x"), 16, 8)
+	if err != nil || ipID < 0x03 || ipID > 0xFE {
+		return 0, fmt.Errorf("invalid IP ID [%s]: expect 03-FE", str)
+	}
+	return int(ipID), nil
+}
@@ -0,0 +1,446 @@
+package crebrid
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// cipClient speaks CIP with the control system like an XPanel. the digital and analog joins of
+// the program are the ports of the status: a toggle presses and releases the digital join like
+// a button and expects the program to send the changed join back. every join the control
+// system sends on its own is pushed. the access code is not used, the control system accepts
+// crebrid by its IP ID
+type cipClient struct {
+	addr    string
+	connect func() (net.Conn, error)
+	policy  ClientPolicy
+	conn    net.Conn
+	// writeLock keeps the packets of the requests apart
+	writeLock sync.Mutex
+	// lock guards the fields below, which are shared with the reader routine
+	lock     sync.Mutex
+	digitals []int
+	analogs  []float64
+	// curStatus is nil until the first update of all joins ended
+	curStatus *SystemStatus
+	// waiters for a join or the end of an update
+	waiters []*cipWaiter
+	// updates which are running, the joins they send are not pushed
+	updates int
+	// readErr is set as soon as the connection broke
+	readErr error
+	// readerDone is closed as soon as the reader routine stopped
+	readerDone chan bool
+	onPush     func(ss *SystemStatus)
+}
+
+// cipWaiter waits for a join of a data type or the end of an update, which is the join 0
+type cipWaiter struct {
+	dataType byte
+	join     int
+	done     chan bool
+}
+
+func newCIPClient(addr string, connect func() (net.Conn, error), policy ClientPolicy) (CrestronControllerClient, error) {
+	ccc := new(cipClient)
+	ccc.addr = addr
+	ccc.connect = connect
+	ccc.policy = policy
+	err := ccc.dial()
+	if err != nil {
+		return nil, err
+	}
+	return ccc, nil
+}
+
+// dial the control system, register the IP ID and start the reader routine of the new
+// connection
+func (ccc *cipClient) dial() error {
+	conn, err := ccc.connect()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	err = ccc.register(conn, reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ccc.lock.Lock()
+	ccc.conn = conn
+	ccc.digitals = make([]int, ccc.policy.Layout.Digitals)
+	ccc.analogs = make([]float64, ccc.policy.Layout.Analogs)
+	ccc.curStatus = nil
+	ccc.waiters = nil
+	ccc.updates = 0
+	ccc.readErr = nil
+	ccc.readerDone = make(chan bool)
+	ccc.lock.Unlock()
+	go ccc.readPackets(conn, reader, ccc.readerDone)
+	return nil
+}
+
+// register the IP ID as soon as the control system asks for it
+func (ccc *cipClient) register(conn net.Conn, reader *bufio.Reader) error {
+	if ccc.policy.Connect.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(ccc.policy.Connect.Timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	for {
+		cp, err := ReadCIPPacket(reader)
+		if err != nil {
+			return fmt.Errorf("register IP ID %02X: %w", ccc.policy.IPID, err)
+		}
+		switch cp.Type {
+		case CIP_REGISTER_REQUEST:
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] register IP ID %02X", ccc.policy.IPID)
+			if _, err := conn.Write(cipRegister(ccc.policy.IPID).Encode()); err != nil {
+				return err
+			}
+		case CIP_REGISTER_RESULT:
+			if len(cp.Payload) != len(cip_register_success) {
+				return fmt.Errorf("%w: IP ID %02X on [%s]", ErrCIPRegistration, ccc.policy.IPID, ccc.addr)
+			}
+			logging.LogFmt(logging.LOG_INFO, "[controller client] IP ID %02X registered on [%s]", ccc.policy.IPID, ccc.addr)
+			return nil
+		default:
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] ignore packet before registration: %s", cp)
+		}
+	}
+}
+
+// readPackets is the only routine which reads from the connection. it applies the joins to the
+// status and wakes the requests which wait for them. it stops at the first read error or as
+// soon as the control system disconnects
+func (ccc *cipClient) readPackets(conn net.Conn, reader *bufio.Reader, done chan bool) {
+	defer close(done)
+	for {
+		cp, err := ReadCIPPacket(reader)
+		if err == nil && cp.Type == CIP_DISCONNECT {
+			err = fmt.Errorf("%w: control system disconnected", ErrControllerUnavailable)
+		}
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] stop reading: %s", err)
+			ccc.lock.Lock()
+			ccc.readErr = err
+			ccc.lock.Unlock()
+			return
+		}
+		if cp.Type != CIP_DATA && cp.Type != CIP_SERIAL {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] ignore packet: %s", cp)
+			continue
+		}
+		cj, err := ParseCIPJoin(cp)
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[controller client] drop packet: %s", err)
+			continue
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] receive join: %s", cj)
+		ccc.apply(cj)
+	}
+}
+
+// apply a join of the control system. a changed join creates a new status, so the former one
+// stays untouched for those who still hold it
+func (ccc *cipClient) apply(cj CIPJoin) {
+	ccc.lock.Lock()
+	changed := false
+	switch cj.DataType {
+	case CIP_DATA_DIGITAL:
+		value := 0
+		if cj.On {
+			value = 1
+		}
+		ccc.digitals, changed = setDigitalJoin(ccc.digitals, cj.Join, value, ccc.policy.Layout.Digitals)
+	case CIP_DATA_ANALOG:
+		ccc.analogs, changed = setAnalogJoin(ccc.analogs, cj.Join, float64(cj.Value), ccc.policy.Layout.Analogs)
+	case CIP_DATA_UPDATE:
+		if cj.Update != CIP_UPDATE_END {
+			ccc.lock.Unlock()
+			return
+		}
+		// the status is complete as soon as the first update ended
+		changed = true
+	default:
+		// serial joins are not part of the status
+		ccc.lock.Unlock()
+		return
+	}
+	if changed && (ccc.curStatus != nil || cj.DataType == CIP_DATA_UPDATE) {
+		ccc.curStatus = &SystemStatus{D: append([]int{}, ccc.digitals...), A: append([]float64{}, ccc.analogs...)}
+	}
+	answered := ccc.wake(cj)
+	push := changed && !answered && ccc.updates == 0 && cj.DataType != CIP_DATA_UPDATE && ccc.curStatus != nil
+	ss := ccc.curStatus
+	onPush := ccc.onPush
+	ccc.lock.Unlock()
+	if push && onPush != nil {
+		onPush(ss)
+	}
+}
+
+// setDigitalJoin to the value, joins beyond the layout are dropped. a layout of 0 takes every
+// join
+func setDigitalJoin(joins []int, join int, value int, layout int) ([]int, bool) {
+	if layout > 0 && join > layout {
+		return joins, false
+	}
+	for len(joins) < join {
+		joins = append(joins, 0)
+	}
+	if joins[join-1] == value {
+		return joins, false
+	}
+	joins[join-1] = value
+	return joins, true
+}
+
+// setAnalogJoin like setDigitalJoin
+func setAnalogJoin(joins []float64, join int, value float64, layout int) ([]float64, bool) {
+	if layout > 0 && join > layout {
+		return joins, false
+	}
+	for len(joins) < join {
+		joins = append(joins, 0)
+	}
+	if joins[join-1] == value {
+		return joins, false
+	}
+	joins[join-1] = value
+	return joins, true
+}
+
+// wake the waiters of the join, true if there was one. the lock has to be held
+func (ccc *cipClient) wake(cj CIPJoin) bool {
+	woken := false
+	waiters := ccc.waiters[:0]
+	for _, w := range ccc.waiters {
+		if w.dataType == cj.DataType && w.join == cj.Join {
+			if w.dataType == CIP_DATA_UPDATE {
+				ccc.updates--
+			}
+			close(w.done)
+			woken = true
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	ccc.waiters = waiters
+	return woken
+}
+
+// forget a waiter, its join is not awaited any longer
+func (ccc *cipClient) forget(w *cipWaiter) {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	for i, other := range ccc.waiters {
+		if other == w {
+			ccc.waiters = append(ccc.waiters[:i], ccc.waiters[i+1:]...)
+			if w.dataType == CIP_DATA_UPDATE {
+				ccc.updates--
+			}
+			return
+		}
+	}
+}
+
+func (ccc *cipClient) ReDial() error {
+	logging.LogFmt(logging.LOG_INFO, "[controller client] close current connection on [%s] and re-dial", ccc.addr)
+	ccc.Close()
+	err := ccc.dial()
+	if err != nil {
+		return err
+	}
+	logging.Log(logging.LOG_DEBUG, "[controller client] successfully re-dialed")
+	return nil
+}
+
+func (ccc *cipClient) Close() {
+	logging.Log(logging.LOG_INFO, "[controller client] close connection to server")
+	ccc.writeLock.Lock()
+	// the control system frees the IP ID right away instead of waiting for its timeout
+	ccc.conn.SetWriteDeadline(time.Now().Add(cip_disconnect_timeout))
+	ccc.conn.Write(CIPPacket{Type: CIP_DISCONNECT}.Encode())
+	ccc.writeLock.Unlock()
+	ccc.conn.Close()
+	// the reader stops with the closed connection, so no routine is left behind
+	<-ccc.readerDone
+}
+
+// SetAccessCode is not used by CIP, the control system accepts crebrid by its IP ID
+func (ccc *cipClient) SetAccessCode(accessCode string) {}
+
+func (ccc *cipClient) OnStatusPush(handler func(ss *SystemStatus)) {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	ccc.onPush = handler
+}
+
+func (ccc *cipClient) GetSystemStatus() *SystemStatus {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	return ccc.curStatus
+}
+
+// request sends the packets and waits for the join of the waiter
+func (ccc *cipClient) request(w *cipWaiter, timeout time.Duration, packets ...CIPPacket) (*SystemStatus, error) {
+	w.done = make(chan bool)
+	ccc.lock.Lock()
+	if ccc.readErr != nil {
+		err := ccc.readErr
+		ccc.lock.Unlock()
+		return nil, err
+	}
+	ccc.waiters = append(ccc.waiters, w)
+	if w.dataType == CIP_DATA_UPDATE {
+		ccc.updates++
+	}
+	ccc.lock.Unlock()
+	err := ccc.write(timeout, packets...)
+	if err != nil {
+		ccc.forget(w)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+		return ccc.GetSystemStatus(), nil
+	case <-timer.C:
+		ccc.forget(w)
+		err := fmt.Errorf("%w within [%s]: join %d of data type %02X", ErrResponseTimeout, timeout, w.join, w.dataType)
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] %s", err)
+		return nil, err
+	case <-ccc.readerDone:
+		ccc.lock.Lock()
+		defer ccc.lock.Unlock()
+		return nil, ccc.readErr
+	}
+}
+
+// write the packets in one go
+func (ccc *cipClient) write(timeout time.Duration, packets ...CIPPacket) error {
+	data := make([]byte, 0)
+	for _, cp := range packets {
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] sending packet: %s", cp)
+		data = append(data, cp.Encode()...)
+	}
+	ccc.writeLock.Lock()
+	defer ccc.writeLock.Unlock()
+	ccc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := ccc.conn.Write(data)
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[controller client] failed to write on connection: %s", ccc.conn.RemoteAddr().String())
+	}
+	return err
+}
+
+// readStatus requests all joins of the control system. a missing end of the update is retried
+// by the status policy
+func (ccc *cipClient) readStatus() (*SystemStatus, error) {
+	return retryOperation(ccc.policy.Status, ccc.policy.RetryDelay, "request status", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(&cipWaiter{dataType: CIP_DATA_UPDATE, join: 0}, timeout, CIPUpdate(CIP_UPDATE_REQUEST))
+	})
+}
+
+func (ccc *cipClient) UpdateSystemStatus() error {
+	_, err := ccc.readStatus()
+	return err
+}
+
+// ToggleSwitch presses and releases the digital join. the program has to toggle the join and
+// send it back
+func (ccc *cipClient) ToggleSwitch(switchID int) (bool, error) {
+	if switchID < 1 {
+		_, err := ccc.readStatus()
+		return err == nil, err
+	}
+	if switchID > cip_max_digital {
+		return false, fmt.Errorf("%w: %d", ErrInvalidSwitch, switchID)
+	}
+	// the state before the toggle judges a missing answer. it is read right before the toggle,
+	// as a keypad may have changed the switch since the last status
+	ss, err := ccc.readStatus()
+	if err != nil {
+		return false, err
+	}
+	return toggleChecked(ccc.policy, switchID, !switchState(ss, switchID), func() (*SystemStatus, error) {
+		w := &cipWaiter{dataType: CIP_DATA_DIGITAL, join: switchID}
+		return ccc.request(w, ccc.policy.Toggle.Timeout, CIPDigital(CIP_DATA_PRESS, switchID, true), CIPDigital(CIP_DATA_PRESS, switchID, false))
+	}, ccc.readStatus)
+}
+
+// SetDigital presses the digital join only if its current state differs, as a press toggles it
+func (ccc *cipClient) SetDigital(switchID int, on bool) (bool, error) {
+	if switchID < 1 || switchID > cip_max_digital {
+		return false, fmt.Errorf("%w: %d", ErrInvalidSwitch, switchID)
+	}
+	ss := ccc.GetSystemStatus()
+	if ss == nil {
+		var err error
+		ss, err = ccc.readStatus()
+		if err != nil {
+			return false, err
+		}
+	}
+	if switchState(ss, switchID) == on {
+		return on, nil
+	}
+	isOn, err := ccc.ToggleSwitch(switchID)
+	if err != nil {
+		return isOn, err
+	}
+	if isOn != on {
+		return isOn, fmt.Errorf("%w: switch ID [%d] to: %v", ErrSwitchUnchanged, switchID, on)
+	}
+	return isOn, nil
+}
+
+// SetAnalog join to the value rounded to an integer of the control system. the program has to
+// send the join back
+func (ccc *cipClient) SetAnalog(port int, value float64) error {
+	if port < 1 || port > cip_max_join {
+		return fmt.Errorf("%w: analog port %d", ErrInvalidSwitch, port)
+	}
+	rounded := math.Round(value)
+	if rounded < 0 || rounded > wire_max_id {
+		return fmt.Errorf("%w: analog value %v is out of 0-%d", ErrInvalidValue, value, wire_max_id)
+	}
+	if ss := ccc.GetSystemStatus(); ss != nil && port <= len(ss.A) && ss.A[port-1] == rounded {
+		// the control system does not send an unchanged join back
+		return nil
+	}
+	_, err := retryOperation(ccc.policy.Analog, ccc.policy.RetryDelay, "set analog", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(&cipWaiter{dataType: CIP_DATA_ANALOG, join: port}, timeout, CIPAnalog(port, int(rounded)))
+	})
+	return err
+}
+
+// SetSerial join to a printable ASCII text. serial joins are not part of the status, so the
+// text is not awaited back
+func (ccc *cipClient) SetSerial(port int, value string) error {
+	if port < 1 || port > cip_max_join {
+		return fmt.Errorf("%w: serial port %d", ErrInvalidSwitch, port)
+	}
+	if len(value) > wire_serial_max {
+		return fmt.Errorf("%w: serial value exceeds %d characters", ErrInvalidValue, wire_serial_max)
+	}
+	for _, c := range value {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("%w: serial value holds [%q]", ErrInvalidValue, c)
+		}
+	}
+	ccc.lock.Lock()
+	err := ccc.readErr
+	ccc.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return ccc.write(ccc.policy.Serial.Timeout, CIPSerial(port, value))
+}
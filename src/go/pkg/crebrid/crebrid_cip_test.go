@@ -0,0 +1,116 @@
+package crebrid
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCIPPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet CIPPacket
+		data   []byte
+		want   CIPJoin
+	}{
+		{
+			name:   "digital high",
+			packet: CIPDigital(CIP_DATA_DIGITAL, 3, true),
+			data:   []byte{0x05, 0x00, 0x06, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00},
+			want:   CIPJoin{DataType: CIP_DATA_DIGITAL, Join: 3, On: true},
+		},
+		{
+			name:   "digital press released",
+			packet: CIPDigital(CIP_DATA_PRESS, 300, false),
+			data:   []byte{0x05, 0x00, 0x06, 0x00, 0x00, 0x03, 0x27, 0x2B, 0x81},
+			want:   CIPJoin{DataType: CIP_DATA_PRESS, Join: 300},
+		},
+		{
+			name:   "analog",
+			packet: CIPAnalog(2, 30000),
+			data:   []byte{0x05, 0x00, 0x08, 0x00, 0x00, 0x05, 0x14, 0x00, 0x01, 0x75, 0x30},
+			want:   CIPJoin{DataType: CIP_DATA_ANALOG, Join: 2, Value: 30000},
+		},
+		{
+			name:   "serial",
+			packet: CIPSerial(1, "hi"),
+			data:   []byte{0x12, 0x00, 0x09, 0x00, 0x00, 0x06, 0x34, 0x00, 0x00, 0x03, 'h', 'i'},
+			want:   CIPJoin{DataType: CIP_DATA_SERIAL, Join: 1, Text: "hi"},
+		},
+		{
+			name:   "update request",
+			packet: CIPUpdate(CIP_UPDATE_REQUEST),
+			data:   []byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x02, 0x03, 0x00},
+			want:   CIPJoin{DataType: CIP_DATA_UPDATE, Update: CIP_UPDATE_REQUEST},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.packet.Encode(); !bytes.Equal(got, tt.data) {
+				t.Errorf("Encode() = % X, want % X", got, tt.data)
+			}
+			cp, err := ReadCIPPacket(bufio.NewReader(bytes.NewReader(tt.data)))
+			if err != nil {
+				t.Fatalf("ReadCIPPacket() error = %v", err)
+			}
+			got, err := ParseCIPJoin(cp)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCIPJoin() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIPJoinErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet CIPPacket
+	}{
+		{name: "too short", packet: CIPPacket{Type: CIP_DATA, Payload: []byte{0x00, 0x00, 0x01}}},
+		{name: "wrong length", packet: CIPPacket{Type: CIP_DATA, Payload: []byte{0x00, 0x00, 0x05, 0x00, 0x02, 0x00}}},
+		{name: "unknown data type", packet: CIPPacket{Type: CIP_DATA, Payload: []byte{0x00, 0x00, 0x03, 0x42, 0x02, 0x00}}},
+		{name: "serial in data packet", packet: CIPPacket{Type: CIP_DATA, Payload: CIPSerial(1, "hi").Payload}},
+		{name: "heartbeat", packet: CIPPacket{Type: CIP_HEARTBEAT, Payload: []byte{0x00, 0x00, 0x01, 0x00}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCIPJoin(tt.packet); !errors.Is(err, ErrInvalidFrame) {
+				t.Errorf("ParseCIPJoin() error = %v, want %v", err, ErrInvalidFrame)
+			}
+		})
+	}
+}
+
+func TestReadCIPPacketCutOff(t *testing.T) {
+	data := CIPAnalog(2, 30000).Encode()
+	_, err := ReadCIPPacket(bufio.NewReader(bytes.NewReader(data[:len(data)-1])))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadCIPPacket() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestParseCIPIPID(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    int
+		wantErr bool
+	}{
+		{str: "03", want: 0x03},
+		{str: "0x1f", want: 0x1F},
+		{str: " FE ", want: 0xFE},
+		{str: "02", wantErr: true},
+		{str: "FF", wantErr: true},
+		{str: "xy", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := ParseCIPIPID(tt.str)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseCIPIPID() = %02X, %v, want %02X, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
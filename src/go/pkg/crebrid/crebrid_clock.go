@@ -0,0 +1,27 @@
+package crebrid
+
+import "time"
+
+// Clock abstracts the time source, so time driven components like the scheduler can be
+// tested without waiting for the real time to pass
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the channel
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+// NewSystemClock returns a clock based on the time package
+func NewSystemClock() Clock {
+	return systemClock{}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
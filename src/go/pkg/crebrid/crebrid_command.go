@@ -0,0 +1,283 @@
+package crebrid
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// commands are written like the ports of a scene:
+//
+//	d3=on       set digital port 3 to on
+//	d3=off      set digital port 3 to off
+//	d3=toggle   toggle digital port 3
+//	a2=30000    set analog port 2
+//	scene=name  activate a scene
+//
+// ports of a controller but the default one are prefixed by its name, e.g. annex:d3=on
+
+type CommandKind int
+
+const (
+	CK_SET_DIGITAL CommandKind = iota
+	CK_TOGGLE
+	CK_SET_ANALOG
+	CK_SCENE
+)
+
+const (
+	command_value_toggle = "toggle"
+	command_scene_key    = "scene"
+	// command_controller_separator separates the controller from the port
+	command_controller_separator = ":"
+)
+
+// Command is a single action executed by crebrid on the controller, e.g. by the scheduler
+type Command struct {
+	Kind  CommandKind
+	Port  int
+	On    bool
+	Value float64
+	Scene string
+	// Controller of the port, the default controller if it is empty
+	Controller string
+	// Priority of the command in the command queue
+	Priority CommandPriority
+}
+
+// ParseCommand parses a command string like "d3=on", "annex:d3=on" or "scene=evening"
+func ParseCommand(str string) (*Command, error) {
+	split := strings.SplitN(strings.TrimSpace(str), "=", 2)
+	if len(split) != 2 {
+		return nil, fmt.Errorf("invalid command [%s]: expect [<controller>:]<port>=<value> or scene=<name>", str)
+	}
+	key := strings.TrimSpace(split[0])
+	value := strings.TrimSpace(split[1])
+	cmd := new(Command)
+	if i := strings.Index(key, command_controller_separator); i >= 0 {
+		cmd.Controller = strings.TrimSpace(key[:i])
+		key = strings.TrimSpace(key[i+1:])
+		if cmd.Controller == "" {
+			return nil, fmt.Errorf("invalid command [%s]: controller name is missing", str)
+		}
+	}
+	key = strings.ToLower(key)
+	if key == command_scene_key {
+		if cmd.Controller != "" {
+			return nil, fmt.Errorf("invalid command [%s]: scenes belong to the controller [%s]", str, DEFAULT_CONTROLLER)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("invalid command [%s]: scene name is missing", str)
+		}
+		cmd.Kind = CK_SCENE
+		cmd.Scene = value
+		return cmd, nil
+	}
+	if strings.ToLower(value) == command_value_toggle && strings.HasPrefix(key, scene_digital_prefix) {
+		port, err := strconv.Atoi(key[1:])
+		if err != nil || port < 1 {
+			return nil, fmt.Errorf("invalid command [%s]: invalid port number", str)
+		}
+		cmd.Kind = CK_TOGGLE
+		cmd.Port = port
+		return cmd, nil
+	}
+	// everything else has the syntax of a scene entry
+	sc := NewScene("")
+	err := parseSceneEntry("command", key, value, sc)
+	if err != nil {
+		return nil, err
+	}
+	for port, on := range sc.Digital {
+		cmd.Kind = CK_SET_DIGITAL
+		cmd.Port = port
+		cmd.On = on
+	}
+	for port, value := range sc.Analog {
+		cmd.Kind = CK_SET_ANALOG
+		cmd.Port = port
+		cmd.Value = value
+	}
+	return cmd, nil
+}
+
+func (cmd *Command) String() string {
+	ctrl := ""
+	if cmd.Controller != "" {
+		ctrl = cmd.Controller + command_controller_separator
+	}
+	switch cmd.Kind {
+	case CK_SET_DIGITAL:
+		return fmt.Sprintf("%s%s%d=%s", ctrl, scene_digital_prefix, cmd.Port, sceneDigitalValue(cmd.On))
+	case CK_TOGGLE:
+		return fmt.Sprintf("%s%s%d=%s", ctrl, scene_digital_prefix, cmd.Port, command_value_toggle)
+	case CK_SET_ANALOG:
+		return fmt.Sprintf("%s%s%d=%s", ctrl, scene_analog_prefix, cmd.Port, strconv.FormatFloat(cmd.Value, 'f', -1, 64))
+	case CK_SCENE:
+		return fmt.Sprintf("%s=%s", command_scene_key, cmd.Scene)
+	}
+	return fmt.Sprintf("unknown command kind: %d", cmd.Kind)
+}
+
+// executeCommand on its controller. it has to be called by a command of the command queue
+func (me *mainExecute) executeCommand(ctrl *controller, cmd *Command) error {
+	logging.LogFmt(logging.LOG_INFO, "[service] execute command: %s", cmd)
+	switch cmd.Kind {
+	case CK_SET_DIGITAL:
+		_, err := ctrl.ccc.SetDigital(cmd.Port, cmd.On)
+		return err
+	case CK_TOGGLE:
+		_, err := ctrl.ccc.ToggleSwitch(cmd.Port)
+		return err
+	case CK_SET_ANALOG:
+		return ctrl.ccc.SetAnalog(cmd.Port, cmd.Value)
+	case CK_SCENE:
+		sc, ok := me.scenes.Get(cmd.Scene)
+		if !ok {
+			return fmt.Errorf("unknown scene: %s", cmd.Scene)
+		}
+		return me.activateScene(sc, ipc.NewServerResponse())
+	}
+	return fmt.Errorf("unknown command kind: %d", cmd.Kind)
+}
+
+// runCommand queues the command by its priority and executes it. it is used by all components
+// which act on their own, like the scheduler
+func (me *mainExecute) runCommand(cmd *Command) error {
+	ctrl, err := me.controller(cmd.Controller)
+	if err == nil {
+		err = me.queue.Submit(cmd.Priority, cmd.String(), func() error {
+			err := me.executeCommand(ctrl, cmd)
+			me.publishCommand(cmd, err)
+			me.publishStatus(ctrl)
+			return err
+		})
+	}
+	if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueStopped) || errors.Is(err, ErrUnknownController) {
+		me.publishCommand(cmd, err)
+	}
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[service] command [%s] failed: %s", cmd, err)
+	}
+	return err
+}
+
+// readStatus of the default controller from its state store if it is fresh, otherwise from
+// the controller. used by scripts
+func (me *mainExecute) readStatus() (*SystemStatus, error) {
+	ctrl := me.defaultController()
+	if ctrl.store.Fresh(me.clock.Now(), me.setts.StatusMaxAge) {
+		ss, _, _ := ctrl.store.Status()
+		return ss, nil
+	}
+	return me.readController(ctrl, QP_NORMAL)
+}
+
+// pollStatus reads the system status from every controller, used by the status poller. a
+// controller which is not available does not keep the others from being read
+func (me *mainExecute) pollStatus() error {
+	var ret error
+	for _, ctrl := range me.controllers {
+		_, err := me.readController(ctrl, QP_POLL)
+		if err != nil && ret == nil {
+			ret = fmt.Errorf("controller [%s]: %w", ctrl.setts.Name, err)
+		}
+	}
+	return ret
+}
+
+// readController reads the system status from the controller. concurrent reads are coalesced,
+// so every caller which asks while a read of its own or a higher priority is in flight gets
+// its result
+func (me *mainExecute) readController(ctrl *controller, prio CommandPriority) (*SystemStatus, error) {
+	return ctrl.reads.Do(prio, func() (*SystemStatus, error) {
+		return me.queueStatusRead(ctrl, prio)
+	})
+}
+
+// queueStatusRead reads the system status by a command of the command queue
+func (me *mainExecute) queueStatusRead(ctrl *controller, prio CommandPriority) (*SystemStatus, error) {
+	var ss *SystemStatus
+	err := me.queue.Submit(prio, "read status "+ctrl.setts.Name, func() error {
+		_, err := ctrl.ccc.ToggleSwitch(system_state_toggle)
+		if err != nil {
+			return err
+		}
+		me.publishStatus(ctrl)
+		ss = ctrl.ccc.GetSystemStatus()
+		return nil
+	})
+	return ss, err
+}
+
+// publishStatus passes the latest system status of the controller to its state store and
+// publishes the changed ports and the status on the event bus. it has to be called by a
+// command of the command queue
+func (me *mainExecute) publishStatus(ctrl *controller) {
+	ss := ctrl.ccc.GetSystemStatus()
+	if ss != ctrl.lastStatus {
+		now := me.clock.Now()
+		evs := DiffSystemStatus(ctrl.lastStatus, ss, now)
+		for i := range evs {
+			evs[i].Controller = ctrl.address()
+			evs[i].Detail = ctrl.prefix() + evs[i].Detail
+		}
+		if ss != nil {
+			cp := &SystemStatus{D: append([]int{}, ss.D...), A: append([]float64{}, ss.A...)}
+			evs = append(evs, Event{Kind: EK_STATUS, At: now, Controller: ctrl.address(), Status: cp})
+		}
+		me.bus.Publish(evs...)
+		ctrl.lastStatus = ss
+	}
+	ctrl.store.Update(ss, me.clock.Now())
+}
+
+// statusPushed by the controller updates its state store right away. the rest of publishStatus
+// has to wait for the command queue, pushes which arrive meanwhile are published together
+func (me *mainExecute) statusPushed(ctrl *controller, ss *SystemStatus) {
+	ctrl.store.Update(ss, me.clock.Now())
+	if !atomic.CompareAndSwapInt32(&ctrl.pushQueued, 0, 1) {
+		return
+	}
+	go func() {
+		err := me.queue.Submit(QP_USER, "status push "+ctrl.setts.Name, func() error {
+			atomic.StoreInt32(&ctrl.pushQueued, 0)
+			me.publishStatus(ctrl)
+			return nil
+		})
+		if err != nil {
+			atomic.StoreInt32(&ctrl.pushQueued, 0)
+			logging.LogFmt(logging.LOG_DEBUG, "[service] pushed status not published: %s", err)
+		}
+	}()
+}
+
+// publishCommand executed on the controller on the event bus
+func (me *mainExecute) publishCommand(cmd *Command, err error) {
+	ev := Event{Kind: EK_COMMAND_EXECUTED, At: me.clock.Now(), Controller: cmd.Controller, Detail: cmd.String()}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	me.bus.Publish(ev)
+}
+
+// linkStateChanged publishes the state of the controller link on the event bus. every state
+// but connected is published as disconnected
+func (me *mainExecute) linkStateChanged(ctrl *controller, state LinkState, err error) {
+	ev := Event{Kind: EK_DISCONNECTED, At: me.clock.Now(), Controller: ctrl.address(), Detail: fmt.Sprintf("%s%s@%d", ctrl.prefix(), ctrl.setts.IP, ctrl.setts.Port)}
+	switch state {
+	case CLS_CONNECTED:
+		ev.Kind = EK_CONNECTED
+	case CLS_CIRCUIT_OPEN, CLS_HALF_OPEN:
+		ev.Detail = fmt.Sprintf("%s (%s)", ev.Detail, state)
+	}
+	if err != nil {
+		ev.Err = err.Error()
+	}
+	me.bus.Publish(ev)
+}
@@ -0,0 +1,219 @@
+package crebrid
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+type CommandPriority int
+
+const (
+	// QP_POLL reads the system status in the background, it runs if nothing else waits
+	QP_POLL CommandPriority = iota - 1
+	// QP_NORMAL commands of the scheduler, rules and scripts
+	QP_NORMAL
+	// QP_USER requests of a user by crebri
+	QP_USER
+	// QP_SAFETY safety and interlock commands run before everything else and are never rejected
+	QP_SAFETY
+)
+
+var commandPriorityStr = map[CommandPriority]string{
+	QP_POLL:   "poll",
+	QP_NORMAL: "normal",
+	QP_USER:   "user",
+	QP_SAFETY: "safety",
+}
+
+func (cp CommandPriority) String() string {
+	return commandPriorityStr[cp]
+}
+
+// ErrQueueFull is returned for commands which are rejected, because too many commands wait
+var ErrQueueFull = errors.New("command queue is full")
+
+// ErrQueueStopped is returned for commands which are submitted after the queue stopped
+var ErrQueueStopped = errors.New("command queue is stopped")
+
+// QueueStats of the command queue
+type QueueStats struct {
+	// Depth is the number of waiting commands
+	Depth    int
+	Executed int
+	Rejected int
+	// LastWait, MaxWait and AvgWait is the time the commands waited for their execution
+	LastWait time.Duration
+	MaxWait  time.Duration
+	AvgWait  time.Duration
+}
+
+func (qs QueueStats) String() string {
+	return fmt.Sprintf("depth %d, executed %d, rejected %d, wait last %s, avg %s, max %s", qs.Depth, qs.Executed, qs.Rejected, qs.LastWait, qs.AvgWait, qs.MaxWait)
+}
+
+// CommandQueue serializes the access to the controller. the commands are executed one after
+// another by a single routine, the ones with the highest priority first and in the order of
+// their submission within the same priority
+type CommandQueue interface {
+	// Submit a command and wait for its execution. the error of the command is returned, or
+	// ErrQueueFull if too many commands wait already
+	Submit(prio CommandPriority, name string, fn func() error) error
+	// Stats of the queue
+	Stats() QueueStats
+	// Start the routine which executes the commands
+	Start()
+	// Stop the routine, commands which still wait fail with ErrQueueStopped
+	Stop()
+}
+
+type queuedCommand struct {
+	prio      CommandPriority
+	seq       uint64
+	name      string
+	fn        func() error
+	submitted time.Time
+	done      chan error
+}
+
+// commandHeap orders the commands by priority and submission
+type commandHeap []*queuedCommand
+
+func (ch commandHeap) Len() int { return len(ch) }
+
+func (ch commandHeap) Less(i, j int) bool {
+	if ch[i].prio != ch[j].prio {
+		return ch[i].prio > ch[j].prio
+	}
+	return ch[i].seq < ch[j].seq
+}
+
+func (ch commandHeap) Swap(i, j int) { ch[i], ch[j] = ch[j], ch[i] }
+
+func (ch *commandHeap) Push(x interface{}) { *ch = append(*ch, x.(*queuedCommand)) }
+
+func (ch *commandHeap) Pop() interface{} {
+	old := *ch
+	qc := old[len(old)-1]
+	*ch = old[:len(old)-1]
+	return qc
+}
+
+type commandQueue struct {
+	lock      sync.Mutex
+	clock     Clock
+	size      int
+	waiting   commandHeap
+	seq       uint64
+	stopped   bool
+	stats     QueueStats
+	totalWait time.Duration
+	wake      chan bool
+	quit      chan bool
+	quitOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewCommandQueue which rejects commands as soon as size commands wait
+func NewCommandQueue(clock Clock, size int) CommandQueue {
+	cq := new(commandQueue)
+	cq.clock = clock
+	cq.size = size
+	cq.wake = make(chan bool, 1)
+	cq.quit = make(chan bool)
+	return cq
+}
+
+func (cq *commandQueue) Submit(prio CommandPriority, name string, fn func() error) error {
+	qc := &queuedCommand{prio: prio, name: name, fn: fn, done: make(chan error, 1)}
+	cq.lock.Lock()
+	if cq.stopped {
+		cq.lock.Unlock()
+		return ErrQueueStopped
+	}
+	if prio < QP_SAFETY && len(cq.waiting) >= cq.size {
+		cq.stats.Rejected++
+		depth := len(cq.waiting)
+		cq.lock.Unlock()
+		logging.LogFmt(logging.LOG_WARN, "[QUEUE] %d commands wait --> reject command [%s]", depth, name)
+		return fmt.Errorf("%w: %d commands wait", ErrQueueFull, depth)
+	}
+	cq.seq++
+	qc.seq = cq.seq
+	qc.submitted = cq.clock.Now()
+	heap.Push(&cq.waiting, qc)
+	cq.lock.Unlock()
+	select {
+	case cq.wake <- true:
+	default:
+	}
+	return <-qc.done
+}
+
+// next command to execute, nil if none waits
+func (cq *commandQueue) next() *queuedCommand {
+	cq.lock.Lock()
+	defer cq.lock.Unlock()
+	if len(cq.waiting) < 1 {
+		return nil
+	}
+	qc := heap.Pop(&cq.waiting).(*queuedCommand)
+	wait := cq.clock.Now().Sub(qc.submitted)
+	cq.stats.Executed++
+	cq.stats.LastWait = wait
+	if wait > cq.stats.MaxWait {
+		cq.stats.MaxWait = wait
+	}
+	cq.totalWait += wait
+	return qc
+}
+
+func (cq *commandQueue) execute() {
+	defer cq.wg.Done()
+	for {
+		qc := cq.next()
+		if qc == nil {
+			select {
+			case <-cq.wake:
+				continue
+			case <-cq.quit:
+				logging.Log(logging.LOG_DEBUG, "[QUEUE] routine escaped")
+				return
+			}
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[QUEUE] execute %s command [%s]", qc.prio, qc.name)
+		qc.done <- qc.fn()
+	}
+}
+
+func (cq *commandQueue) Stats() QueueStats {
+	cq.lock.Lock()
+	defer cq.lock.Unlock()
+	qs := cq.stats
+	qs.Depth = len(cq.waiting)
+	if qs.Executed > 0 {
+		qs.AvgWait = cq.totalWait / time.Duration(qs.Executed)
+	}
+	return qs
+}
+
+func (cq *commandQueue) Start() {
+	cq.wg.Add(1)
+	go cq.execute()
+}
+
+func (cq *commandQueue) Stop() {
+	cq.quitOnce.Do(func() { close(cq.quit) })
+	cq.wg.Wait()
+	cq.lock.Lock()
+	defer cq.lock.Unlock()
+	cq.stopped = true
+	for _, qc := range cq.waiting {
+		qc.done <- ErrQueueStopped
+	}
+	cq.waiting = nil
+}
@@ -0,0 +1,93 @@
+package crebrid
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCommandQueue(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	cq := NewCommandQueue(fc, 4)
+	cq.Start()
+	defer cq.Stop()
+	var lock sync.Mutex
+	order := make([]string, 0)
+	release := make(chan bool)
+	running := make(chan bool)
+	go cq.Submit(QP_NORMAL, "blocker", func() error {
+		running <- true
+		<-release
+		return nil
+	})
+	<-running
+	results := make(chan error, 5)
+	submit := func(prio CommandPriority) {
+		results <- cq.Submit(prio, prio.String(), func() error {
+			lock.Lock()
+			defer lock.Unlock()
+			order = append(order, prio.String())
+			return nil
+		})
+	}
+	for _, prio := range []CommandPriority{QP_POLL, QP_NORMAL, QP_NORMAL, QP_USER} {
+		go submit(prio)
+	}
+	for i := 0; i < 200 && cq.Stats().Depth < 4; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// the queue is saturated, only safety commands are accepted
+	if err := cq.Submit(QP_USER, "rejected", func() error { return nil }); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Submit() error = %v, want %v", err, ErrQueueFull)
+	}
+	go submit(QP_SAFETY)
+	for i := 0; i < 200 && cq.Stats().Depth < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	fc.Advance(2 * time.Second)
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Submit() error = %v", err)
+		}
+	}
+	want := []string{"safety", "user", "normal", "normal", "poll"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+	wantStats := QueueStats{Executed: 6, Rejected: 1, LastWait: 2 * time.Second, MaxWait: 2 * time.Second, AvgWait: 10 * time.Second / 6}
+	if got := cq.Stats(); got != wantStats {
+		t.Errorf("Stats() = %v, want %v", got, wantStats)
+	}
+}
+
+func TestCommandQueueStop(t *testing.T) {
+	cq := NewCommandQueue(NewSystemClock(), 4)
+	cq.Start()
+	release := make(chan bool)
+	running := make(chan bool)
+	go cq.Submit(QP_NORMAL, "blocker", func() error {
+		running <- true
+		<-release
+		return nil
+	})
+	<-running
+	result := make(chan error)
+	go func() {
+		result <- cq.Submit(QP_USER, "waiting", func() error { return nil })
+	}()
+	for i := 0; i < 200 && cq.Stats().Depth < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	cq.Stop()
+	// the waiting command is either executed before the routine escaped or rejected
+	if err := <-result; err != nil && !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Submit() error = %v", err)
+	}
+	if err := cq.Submit(QP_SAFETY, "late", func() error { return nil }); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Submit() error = %v, want %v", err, ErrQueueStopped)
+	}
+}
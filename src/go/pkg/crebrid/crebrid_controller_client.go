@@ -1,13 +1,15 @@
 package crebrid
 
 import (
-	"bufio"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
 	"github.com/dachunky/crestrontcpbridge/pkg/logging"
 )
 
@@ -16,19 +18,45 @@ type SystemStatus struct {
 	A []float64 `json:"a"`
 }
 
+// SystemStatusFromJSON decodes the first status frame of str, the bytes around it are skipped
 func SystemStatusFromJSON(str string) (*SystemStatus, error) {
-	ret := new(SystemStatus)
-	err := json.Unmarshal([]byte(str), ret)
-	if err != nil {
-		return nil, err
+	ss, err := newStatusDecoder(strings.NewReader(str), StatusLayout{}).Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: no complete frame in %q", ErrInvalidFrame, str)
 	}
-	return ret, err
+	return ss, err
 }
 
 const (
 	system_state_toggle = 0
 )
 
+// ErrAnalogNotSupported is returned by controller clients whose protocol cannot write analog values
+var ErrAnalogNotSupported = errors.New("controller protocol does not support analog writes")
+
+// ErrInvalidSwitch is returned for switch IDs which cannot be set
+var ErrInvalidSwitch = errors.New("invalid switch ID")
+
+// ErrSwitchUnchanged is returned if the controller did not change a switch to the requested state
+var ErrSwitchUnchanged = errors.New("switch did not change")
+
+// ErrSerialNotSupported is returned by controller clients whose protocol cannot write serial values
+var ErrSerialNotSupported = errors.New("controller protocol does not support serial writes")
+
+// ErrInvalidValue is returned for values which cannot be sent to the controller
+var ErrInvalidValue = errors.New("invalid value")
+
+// isConnectionError is true for every error of a controller client which is not caused by the
+// request itself, so the connection has to be re-established
+func isConnectionError(err error) bool {
+	for _, requestErr := range []error{ErrAnalogNotSupported, ErrSerialNotSupported, ErrInvalidSwitch, ErrInvalidValue, ErrSwitchUnchanged, ErrCommandRejected} {
+		if errors.Is(err, requestErr) {
+			return false
+		}
+	}
+	return err != nil
+}
+
 type CrestronControllerClient interface {
 	// SetAccessCode for the controller
 	SetAccessCode(accessCode string)
@@ -36,51 +64,326 @@ type CrestronControllerClient interface {
 	GetSystemStatus() *SystemStatus
 	// ToggleSwitch with ID
 	ToggleSwitch(switchID int) (bool, error)
+	// SetDigital switch with ID to the requested state. the switch is only toggled if its
+	// current state differs, so calling it twice has no further effect
+	SetDigital(switchID int, on bool) (bool, error)
+	// SetAnalog port to a value
+	SetAnalog(port int, value float64) error
+	// SetSerial port to a text
+	SetSerial(port int, value string) error
+	// OnStatusPush calls handler with every status the controller sends on its own. it is
+	// called by the routine which reads from the controller, so it must not block
+	OnStatusPush(handler func(ss *SystemStatus))
 	// Close the connection to the server
 	Close()
 	// Re-Dial close the current connection and re-dial
 	ReDial() error
 }
 
+// OperationPolicy is the time the controller has to answer an operation and how often it is
+// retried if the answer is missing
+type OperationPolicy struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// ClientPolicy defines the protocol and the timeouts and retries of the operations of a
+// controller client
+type ClientPolicy struct {
+	// Protocol spoken with the controller
+	Protocol WireProtocol
+	// KeepAlive is the period of the TCP keep-alive probes, 0 disables them
+	KeepAlive time.Duration
+	// RetryDelay between two attempts of an operation
+	RetryDelay time.Duration
+	// Connect is the timeout of a single dial and the number of dials
+	Connect OperationPolicy
+	// Status requests are idempotent, so they are simply sent again
+	Status OperationPolicy
+	// Toggle commands are never sent again blindly. the status is read to decide whether the
+	// switch was toggled even though its answer is missing
+	Toggle OperationPolicy
+	// Analog and Serial are used by clients whose protocol can write analog and serial values
+	Analog OperationPolicy
+	Serial OperationPolicy
+	// Layout of the status frames, frames which do not match are dropped
+	Layout StatusLayout
+	// IPID crebrid registers with at the control system, only used by WP_CIP
+	IPID int
+}
+
+// DefaultClientPolicy speaks v1, which the old and the new telnet server module understand, and
+// gives the controller a second to answer. status requests are sent up to 3 times and toggle
+// commands up to 2 times
+func DefaultClientPolicy() ClientPolicy {
+	return ClientPolicy{
+		Protocol:   WP_V1,
+		KeepAlive:  30 * time.Second,
+		RetryDelay: 100 * time.Millisecond,
+		Connect:    OperationPolicy{Timeout: 5 * time.Second},
+		Status:     OperationPolicy{Timeout: time.Second, Retries: 2},
+		Toggle:     OperationPolicy{Timeout: time.Second, Retries: 1},
+		Analog:     OperationPolicy{Timeout: time.Second},
+		Serial:     OperationPolicy{Timeout: time.Second},
+		Layout:     DefaultStatusLayout(),
+		IPID:       CIP_DEFAULT_IPID,
+	}
+}
+
+// ErrResponseTimeout is returned if the controller did not answer a command in time
+var ErrResponseTimeout = errors.New("no response from controller")
+
 type crestronClient struct {
-	ip         string
-	port       int
+	// addr of the controller for the logs
+	addr string
+	// connect opens the connection to the controller, which is dialed or accepted
+	connect    func() (net.Conn, error)
+	policy     ClientPolicy
 	conn       net.Conn
 	accessCode string
-	curStatus  *SystemStatus
+	// lock guards the fields below, which are shared with the reader routine
+	lock      sync.Mutex
+	curStatus *SystemStatus
+	// pending receives the response of the command which waits for it, nil if none waits
+	pending chan clientResponse
+	// timeout of the pending command
+	timeout time.Duration
+	// late is closed as soon as the missing response of a command arrived. nil if no response
+	// is missing or lateUntil passed
+	late      chan bool
+	lateUntil time.Time
+	// readErr is set as soon as the connection broke
+	readErr error
+	// readerDone is closed as soon as the reader routine stopped
+	readerDone chan bool
+	onPush     func(ss *SystemStatus)
+}
+
+// clientResponse is the status the controller answered to a command or the error why it did not
+type clientResponse struct {
+	ss  *SystemStatus
+	err error
 }
 
-func NewCrestronControllerClient(ip string, port int) (CrestronControllerClient, error) {
+// NewCrestronControllerClient connects to the controller with the protocol, timeouts and
+// retries of the policy
+func NewCrestronControllerClient(ip string, port int, policy ClientPolicy) (CrestronControllerClient, error) {
+	return newControllerClient(net.JoinHostPort(ip, strconv.Itoa(port)), func() (net.Conn, error) {
+		return dialController(ip, port, policy)
+	}, policy)
+}
+
+// NewReverseControllerClient waits for the controller to connect to the listener instead of
+// dialing it. the controller has to connect within the connect timeout of the policy
+func NewReverseControllerClient(listener ControllerListener, policy ClientPolicy) (CrestronControllerClient, error) {
+	return newControllerClient(listener.Addr(), func() (net.Conn, error) {
+		return listener.Accept(policy.Connect.Timeout)
+	}, policy)
+}
+
+// newControllerClient of the protocol of the policy, which opens its connections by connect
+func newControllerClient(addr string, connect func() (net.Conn, error), policy ClientPolicy) (CrestronControllerClient, error) {
+	switch policy.Protocol {
+	case WP_V2:
+		return newCrestronClientV2(addr, connect, policy)
+	case WP_CIP:
+		return newCIPClient(addr, connect, policy)
+	}
 	ccc := new(crestronClient)
-	ccc.ip = ip
-	ccc.port = port
-	connStr := fmt.Sprintf("%s:%d", ip, port)
-	conn, err := net.Dial("tcp", connStr)
+	ccc.addr = addr
+	ccc.connect = connect
+	ccc.policy = policy
+	err := ccc.dial()
 	if err != nil {
 		return nil, err
 	}
-	logging.LogFmt(logging.LOG_DEBUG, "[controller client] successfully connected to: %s", connStr)
-	ccc.conn = conn
-	ccc.curStatus = nil
 	return ccc, nil
 }
 
+// dialController with the connect policy and the TCP keep-alive of the policy
+func dialController(ip string, port int, policy ClientPolicy) (net.Conn, error) {
+	connStr := net.JoinHostPort(ip, strconv.Itoa(port))
+	dialer := net.Dialer{Timeout: policy.Connect.Timeout, KeepAlive: policy.KeepAlive}
+	if policy.KeepAlive <= 0 {
+		// a zero keep-alive of the dialer enables the default period
+		dialer.KeepAlive = -1
+	}
+	var conn net.Conn
+	var err error
+	for attempt := 0; attempt <= policy.Connect.Retries; attempt++ {
+		if attempt > 0 {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] dial [%s] again after: %s", connStr, err)
+			time.Sleep(policy.RetryDelay)
+		}
+		conn, err = dialer.Dial("tcp", connStr)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	logging.LogFmt(logging.LOG_DEBUG, "[controller client] successfully connected to: %s with protocol %s", connStr, policy.Protocol)
+	return conn, nil
+}
+
+// retryOperation repeats an idempotent operation as long as its answer is missing or its frame
+// was corrupted
+func retryOperation(op OperationPolicy, delay time.Duration, name string, fn func(timeout time.Duration) (*SystemStatus, error)) (*SystemStatus, error) {
+	var ss *SystemStatus
+	var err error
+	for attempt := 0; attempt <= op.Retries; attempt++ {
+		if attempt > 0 {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] %s again after: %s", name, err)
+			time.Sleep(delay)
+		}
+		ss, err = fn(op.Timeout)
+		if !errors.Is(err, ErrResponseTimeout) && !errors.Is(err, ErrFrameCorrupted) {
+			break
+		}
+	}
+	return ss, err
+}
+
+// switchState of a switch ID in the system status
+func switchState(ss *SystemStatus, switchID int) bool {
+	return switchID <= len(ss.D) && ss.D[switchID-1] > 0
+}
+
+// toggleChecked toggles the switch, which is expected to be set to want afterwards. want has to
+// be the opposite of a status read right before, never of the cached one. a corrupted toggle
+// was not executed, so it is sent again. if the answer is missing, the status decides whether
+// the switch has to be toggled again
+func toggleChecked(policy ClientPolicy, switchID int, want bool, toggle func() (*SystemStatus, error), readStatus func() (*SystemStatus, error)) (bool, error) {
+	var err error
+	for attempt := 0; attempt <= policy.Toggle.Retries; attempt++ {
+		if attempt > 0 {
+			logging.LogFmt(logging.LOG_INFO, "[controller client] switch ID [%d] did not change --> toggle again", switchID)
+			time.Sleep(policy.RetryDelay)
+		}
+		var ss *SystemStatus
+		ss, err = toggle()
+		if err == nil {
+			isOn := switchState(ss, switchID)
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] switch ID [%d] is set to: %v", switchID, isOn)
+			return isOn, nil
+		}
+		if errors.Is(err, ErrFrameCorrupted) {
+			continue
+		}
+		if !errors.Is(err, ErrResponseTimeout) {
+			return false, err
+		}
+		ss, statusErr := readStatus()
+		if statusErr != nil {
+			return false, statusErr
+		}
+		if isOn := switchState(ss, switchID); isOn == want {
+			logging.LogFmt(logging.LOG_INFO, "[controller client] response of switch ID [%d] is missing, but the status shows it toggled", switchID)
+			return isOn, nil
+		}
+	}
+	return false, err
+}
+
+// dial the controller and start the reader routine of the new connection
+func (ccc *crestronClient) dial() error {
+	conn, err := ccc.connect()
+	if err != nil {
+		return err
+	}
+	ccc.lock.Lock()
+	ccc.conn = conn
+	ccc.pending = nil
+	ccc.late = nil
+	ccc.readErr = nil
+	ccc.readerDone = make(chan bool)
+	ccc.lock.Unlock()
+	go ccc.readResponses(conn, ccc.readerDone)
+	return nil
+}
+
+// readResponses is the only routine which reads from the connection. it passes every status
+// to the waiting command, a status which nobody waits for only updates the current status.
+// the deadline of a command which is not answered fails the command, its response may still
+// arrive within the same timeout. it stops at any other read error
+func (ccc *crestronClient) readResponses(conn net.Conn, done chan bool) {
+	defer close(done)
+	decoder := newStatusDecoder(conn, ccc.policy.Layout)
+	for {
+		ss, err := decoder.Next()
+		var frameErr *FrameError
+		if errors.As(err, &frameErr) {
+			logging.LogFmt(logging.LOG_ERROR, "[controller client] drop response: %s", err)
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			conn.SetReadDeadline(time.Time{})
+			ccc.lock.Lock()
+			err = fmt.Errorf("%w within [%s]", ErrResponseTimeout, ccc.timeout)
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] %s", err)
+			pending := ccc.pending
+			ccc.pending = nil
+			if ccc.late == nil {
+				ccc.late = make(chan bool)
+			}
+			ccc.lateUntil = time.Now().Add(ccc.timeout)
+			ccc.lock.Unlock()
+			if pending != nil {
+				pending <- clientResponse{err: err}
+			}
+			continue
+		}
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] stop reading: %s", err)
+			ccc.lock.Lock()
+			ccc.readErr = err
+			ccc.pending = nil
+			ccc.lock.Unlock()
+			return
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] receive response: %v", ss)
+		ccc.lock.Lock()
+		ccc.curStatus = ss
+		pending := ccc.pending
+		ccc.pending = nil
+		late := ccc.late
+		if pending == nil && late != nil {
+			logging.Log(logging.LOG_INFO, "[controller client] missing response arrived late")
+			close(ccc.late)
+			ccc.late = nil
+		}
+		onPush := ccc.onPush
+		ccc.lock.Unlock()
+		if pending == nil {
+			logging.Log(logging.LOG_DEBUG, "[controller client] receive status without a waiting command")
+			// v1 cannot tell a push from a response, which was pending while a command was sent
+			if late == nil && onPush != nil {
+				onPush(ss)
+			}
+			continue
+		}
+		pending <- clientResponse{ss: ss}
+	}
+}
+
 func (ccc *crestronClient) ReDial() error {
-	logging.LogFmt(logging.LOG_INFO, "[controller client] close current connection on [%s:%d] and re-dial", ccc.ip, ccc.port)
+	logging.LogFmt(logging.LOG_INFO, "[controller client] close current connection on [%s] and re-dial", ccc.addr)
 	ccc.Close()
-	connStr := fmt.Sprintf("%s:%d", ccc.ip, ccc.port)
-	conn, err := net.Dial("tcp", connStr)
+	err := ccc.dial()
 	if err != nil {
 		return err
 	}
-	ccc.conn = conn
-	logging.LogFmt(logging.LOG_DEBUG, "[controller client] successfully re-dial to: %s", connStr)
+	logging.Log(logging.LOG_DEBUG, "[controller client] successfully re-dialed")
 	return nil
 }
 
 func (ccc *crestronClient) Close() {
 	logging.Log(logging.LOG_INFO, "[controller client] close connection to server")
 	ccc.conn.Close()
+	// the reader stops with the closed connection, so no routine is left behind
+	<-ccc.readerDone
 }
 
 func (ccc *crestronClient) SetAccessCode(accessCode string) {
@@ -88,79 +391,145 @@ func (ccc *crestronClient) SetAccessCode(accessCode string) {
 }
 
 func (ccc *crestronClient) GetSystemStatus() *SystemStatus {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
 	return ccc.curStatus
 }
 
 func (ccc *crestronClient) UpdateSystemStatus() error {
-	_, err := ccc.ToggleSwitch(system_state_toggle)
+	_, err := ccc.readStatus()
 	return err
 }
 
-func (ccc *crestronClient) waitForControllerResponse(timeout int) ([]byte, error) {
-	var resp []byte
-	waitChan := make(chan bool)
-	err := fmt.Errorf("timeout received within [%ds]", timeout)
-	logging.LogFmt(logging.LOG_DEBUG, "[WAIT] wait for response for %dms", timeout)
-	defer close(waitChan)
-	go func() {
-		resp, err = ipc.ReadUntilEOF(bufio.NewReader(ccc.conn))
-		waitChan <- true
-	}()
-	responseReceived := false
-	startWait := time.Now()
-	for {
-		waitSince := 0
-		switch {
-		case <-waitChan:
-			responseReceived = true
-		default:
-			waitSince = int(time.Since(startWait).Milliseconds())
-			time.Sleep(time.Millisecond * 250)
-			logging.LogFmt(logging.LOG_DEBUG, "[WAIT] wait since %dms", waitSince)
-		}
-		if responseReceived || (waitSince >= timeout) {
-			break
-		}
+// waitForLateResponse of a previous command, so it is not taken for the response of the next
+// one. the caller has to hold the lock
+func (ccc *crestronClient) waitForLateResponse() {
+	late := ccc.late
+	if late == nil {
+		return
 	}
-	if responseReceived {
-		return resp, nil
-	} else {
-		return nil, err
+	wait := time.Until(ccc.lateUntil)
+	ccc.lock.Unlock()
+	logging.LogFmt(logging.LOG_DEBUG, "[controller client] wait up to %s for a missing response", wait)
+	timer := time.NewTimer(wait)
+	select {
+	case <-late:
+	case <-timer.C:
+	case <-ccc.readerDone:
+	}
+	timer.Stop()
+	ccc.lock.Lock()
+	if ccc.late == late {
+		logging.Log(logging.LOG_DEBUG, "[controller client] missing response is lost")
+		ccc.late = nil
 	}
 }
 
-func (ccc *crestronClient) ToggleSwitch(switchID int) (bool, error) {
+// request sends a single command and waits for the status the controller answers
+func (ccc *crestronClient) request(switchID int, timeout time.Duration) (*SystemStatus, error) {
+	response := make(chan clientResponse, 1)
+	ccc.lock.Lock()
+	if switchID != system_state_toggle {
+		// every response is a complete status, so a late one answers a status request as well
+		ccc.waitForLateResponse()
+	}
+	if ccc.readErr != nil {
+		err := ccc.readErr
+		ccc.lock.Unlock()
+		return nil, err
+	}
+	ccc.pending = response
+	ccc.timeout = timeout
+	ccc.lock.Unlock()
 	cmdStr := fmt.Sprintf("%s%3.3d", ccc.accessCode, switchID)
 	logging.LogFmt(logging.LOG_DEBUG, "[controller client] sending command: %s", cmdStr)
+	// the deadline covers the write and the read of the response by the reader routine
+	ccc.conn.SetDeadline(time.Now().Add(timeout))
 	_, err := ccc.conn.Write([]byte(cmdStr))
 	if err != nil {
 		logging.LogFmt(logging.LOG_ERROR, "[controller client] failed to write on connection: %s", ccc.conn.RemoteAddr().String())
-		return false, err
+		return nil, err
 	}
 	logging.Log(logging.LOG_DEBUG, "[controller client] waiting for response")
-	// create a timeout for the response. normally it has to be responded by the controller within ms
-	// channel to wait for the response
-	resp, err := ccc.waitForControllerResponse(1000)
-	if err != nil {
-		if ccc.curStatus == nil {
-			return false, err
-		} else {
-			return true, err
-		}
+	var resp clientResponse
+	select {
+	case resp = <-response:
+	case <-ccc.readerDone:
+		ccc.lock.Lock()
+		resp.err = ccc.readErr
+		ccc.lock.Unlock()
+	}
+	if resp.err != nil {
+		return nil, resp.err
+	}
+	// a status which is pushed without a command must not run into a deadline
+	ccc.conn.SetDeadline(time.Time{})
+	logging.LogFmt(logging.LOG_DEBUG, "[controller client] current system status: %v", resp.ss)
+	return resp.ss, nil
+}
+
+// readStatus of the controller. a missing response is retried by the status policy
+func (ccc *crestronClient) readStatus() (*SystemStatus, error) {
+	return retryOperation(ccc.policy.Status, ccc.policy.RetryDelay, "request status", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(system_state_toggle, timeout)
+	})
+}
+
+// toggleTo toggles the switch, which is expected to be set to want afterwards
+func (ccc *crestronClient) toggleTo(switchID int, want bool) (bool, error) {
+	return toggleChecked(ccc.policy, switchID, want, func() (*SystemStatus, error) {
+		return ccc.request(switchID, ccc.policy.Toggle.Timeout)
+	}, ccc.readStatus)
+}
+
+func (ccc *crestronClient) ToggleSwitch(switchID int) (bool, error) {
+	if switchID < 1 {
+		_, err := ccc.readStatus()
+		return err == nil, err
 	}
-	logging.LogFmt(logging.LOG_DEBUG, "[controller client] receive response: %s", string(resp))
-	ss, err := SystemStatusFromJSON(string(resp))
+	// the state before the toggle judges a missing answer. it is read right before the toggle,
+	// as a keypad may have changed the switch since the last status
+	ss, err := ccc.readStatus()
 	if err != nil {
 		return false, err
 	}
-	logging.LogFmt(logging.LOG_DEBUG, "[controller client] current system status: %v", ss)
-	ccc.curStatus = ss
-	ret := false
+	return ccc.toggleTo(switchID, !switchState(ss, switchID))
+}
+
+func (ccc *crestronClient) SetDigital(switchID int, on bool) (bool, error) {
 	if switchID < 1 {
-		ret = true
-	} else if ok := switchID <= len(ss.D); ok {
-		ret = ss.D[switchID-1] > 0
-		logging.LogFmt(logging.LOG_DEBUG, "[controller client] switch ID [%d] is set to: %v", switchID, ret)
+		return false, fmt.Errorf("%w: %d", ErrInvalidSwitch, switchID)
 	}
-	return ret, nil
+	ss, err := ccc.readStatus()
+	if err != nil {
+		return false, err
+	}
+	isOn := switchState(ss, switchID)
+	if isOn == on {
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] switch ID [%d] is already set to: %v", switchID, on)
+		return isOn, nil
+	}
+	isOn, err = ccc.toggleTo(switchID, on)
+	if err != nil {
+		return isOn, err
+	}
+	if isOn != on {
+		return isOn, fmt.Errorf("%w: switch ID [%d] to: %v", ErrSwitchUnchanged, switchID, on)
+	}
+	return isOn, nil
+}
+
+func (ccc *crestronClient) SetAnalog(port int, value float64) error {
+	// the telnet server module only knows command IDs, which are mapped to digital outputs
+	return ErrAnalogNotSupported
+}
+
+func (ccc *crestronClient) SetSerial(port int, value string) error {
+	return ErrSerialNotSupported
+}
+
+func (ccc *crestronClient) OnStatusPush(handler func(ss *SystemStatus)) {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	ccc.onPush = handler
 }
@@ -1,8 +1,15 @@
 package crebrid
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSystemStatusFromJSON(t *testing.T) {
@@ -26,6 +33,25 @@ func TestSystemStatusFromJSON(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "system status with line breaks and telnet bytes",
+			args: args{
+				str: "\xff\xfb\x01\r\n{\"d\":[0,1],\"a\":[21]}\r\n",
+			},
+			want: &SystemStatus{
+				D: []int{0, 1},
+				A: []float64{21},
+			},
+			wantErr: false,
+		},
+		{
+			name: "incomplete system status",
+			args: args{
+				str: "{\"d\":[0,1],\"a\":[21]",
+			},
+			want:    nil,
+			wantErr: true,
+		},
 		{
 			name: "invalid system status",
 			args: args{
@@ -48,3 +74,200 @@ func TestSystemStatusFromJSON(t *testing.T) {
 		})
 	}
 }
+
+// fakeCrestron is a controller which toggles its digital ports and answers every command with
+// its status in two parts
+type fakeCrestron struct {
+	lock    sync.Mutex
+	d       []int
+	toggles int
+	// lost commands are neither executed nor answered, dropped ones are executed without an
+	// answer and late ones are answered after the delay
+	lost    int
+	dropped int
+	late    int
+	delay   time.Duration
+}
+
+func (fcr *fakeCrestron) handle(cmd string) (string, time.Duration, bool) {
+	fcr.lock.Lock()
+	defer fcr.lock.Unlock()
+	if fcr.lost > 0 {
+		fcr.lost--
+		return "", 0, false
+	}
+	if id, _ := strconv.Atoi(cmd[len(cmd)-3:]); id > 0 {
+		fcr.d[id-1] = 1 - fcr.d[id-1]
+		fcr.toggles++
+	}
+	if fcr.dropped > 0 {
+		fcr.dropped--
+		return "", 0, false
+	}
+	data, _ := json.Marshal(&SystemStatus{D: fcr.d, A: []float64{}})
+	if fcr.late > 0 {
+		fcr.late--
+		return string(data), fcr.delay, true
+	}
+	return string(data), 0, true
+}
+
+func (fcr *fakeCrestron) update(fn func()) {
+	fcr.lock.Lock()
+	defer fcr.lock.Unlock()
+	fn()
+}
+
+// listen for the client on a local port
+func (fcr *fakeCrestron) listen(t *testing.T) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					resp, delay, ok := fcr.handle(string(buf[:n]))
+					if !ok {
+						continue
+					}
+					time.Sleep(delay)
+					conn.Write([]byte("\r\n" + resp[:5]))
+					time.Sleep(5 * time.Millisecond)
+					conn.Write([]byte(resp[5:]))
+				}
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestCrestronClient(t *testing.T) {
+	fcr := &fakeCrestron{d: []int{0, 0, 0}, delay: 150 * time.Millisecond}
+	ip, port := fcr.listen(t)
+	policy := ClientPolicy{
+		RetryDelay: 10 * time.Millisecond,
+		Connect:    OperationPolicy{Timeout: time.Second},
+		Status:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+		Toggle:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+	}
+	client, err := NewCrestronControllerClient(ip, port, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetAccessCode("1234")
+	toggles := func() int {
+		fcr.lock.Lock()
+		defer fcr.lock.Unlock()
+		return fcr.toggles
+	}
+	if isOn, err := client.ToggleSwitch(0); err != nil || !isOn {
+		t.Fatalf("ToggleSwitch() = %v, %v", isOn, err)
+	}
+	if isOn, err := client.ToggleSwitch(1); err != nil || !isOn {
+		t.Fatalf("ToggleSwitch() = %v, %v", isOn, err)
+	}
+	// the status shows the toggle of a dropped answer, so it is not sent again
+	fcr.update(func() { fcr.dropped = 1 })
+	if isOn, err := client.ToggleSwitch(2); err != nil || !isOn || toggles() != 2 {
+		t.Fatalf("ToggleSwitch() of a dropped answer = %v, %v, toggles = %d", isOn, err, toggles())
+	}
+	// a lost toggle is sent again
+	fcr.update(func() { fcr.lost = 1 })
+	if isOn, err := client.ToggleSwitch(3); err != nil || !isOn || toggles() != 3 {
+		t.Fatalf("ToggleSwitch() of a lost command = %v, %v, toggles = %d", isOn, err, toggles())
+	}
+	// the late status answers the repeated status request
+	fcr.update(func() { fcr.late = 1 })
+	if isOn, err := client.SetDigital(1, false); err != nil || isOn || toggles() != 4 {
+		t.Fatalf("SetDigital() after a late status = %v, %v, toggles = %d", isOn, err, toggles())
+	}
+	if got, want := client.GetSystemStatus(), (&SystemStatus{D: []int{0, 1, 1}, A: []float64{}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSystemStatus() = %v, want %v", got, want)
+	}
+	fcr.update(func() { fcr.lost = 2 })
+	if _, err := client.ToggleSwitch(0); !errors.Is(err, ErrResponseTimeout) || !isConnectionError(err) {
+		t.Fatalf("ToggleSwitch() error = %v, want %v", err, ErrResponseTimeout)
+	}
+	if err := client.ReDial(); err != nil {
+		t.Fatal(err)
+	}
+	if isOn, err := client.SetDigital(1, true); err != nil || !isOn {
+		t.Errorf("SetDigital() = %v, %v", isOn, err)
+	}
+	client.Close()
+	select {
+	case <-client.(*crestronClient).readerDone:
+	default:
+		t.Errorf("reader routine is still running after Close()")
+	}
+}
+
+// an upgraded service keeps talking to a controller which still runs the old telnet server
+// module, which only understands v1
+func TestOldModuleWithDefaultSettings(t *testing.T) {
+	fcr := &fakeCrestron{d: []int{0, 0, 0}}
+	ip, port := fcr.listen(t)
+	setts, err := LoadFromByteArr([]byte(fmt.Sprintf("ip=%s\nport=%d\naccessCode=1234\ndigitalPorts=3\nanalogPorts=0", ip, port)))
+	if err != nil {
+		t.Fatalf("LoadFromByteArr() error = %v", err)
+	}
+	ctrl := setts.AllControllers()[0]
+	client, err := ConnectBackend(ctrl.Backend, BackendTarget{Name: ctrl.Name, IP: ctrl.IP, Port: ctrl.Port, Policy: setts.ControllerPolicy(ctrl)})
+	if err != nil {
+		t.Fatalf("ConnectBackend() error = %v", err)
+	}
+	defer client.Close()
+	client.SetAccessCode(ctrl.AccessCode)
+	if isOn, err := client.ToggleSwitch(2); err != nil || !isOn {
+		t.Errorf("ToggleSwitch(2) = %v, %v", isOn, err)
+	}
+	if got, want := client.GetSystemStatus().D, []int{0, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSystemStatus().D = %v, want %v", got, want)
+	}
+}
+
+// a keypad changes the switch after the last status. the missing answer of the toggle must be
+// judged by the state right before the toggle, not by the cached one
+func TestToggleSwitchAfterKeypad(t *testing.T) {
+	fcr := &fakeCrestron{d: []int{0, 0}}
+	ip, port := fcr.listen(t)
+	policy := ClientPolicy{
+		RetryDelay: 10 * time.Millisecond,
+		Connect:    OperationPolicy{Timeout: time.Second},
+		Status:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+		Toggle:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+	}
+	client, err := NewCrestronControllerClient(ip, port, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetAccessCode("1234")
+	if _, err := client.ToggleSwitch(system_state_toggle); err != nil {
+		t.Fatal(err)
+	}
+	fcr.update(func() {
+		fcr.d[0] = 1
+		fcr.dropped = 1
+	})
+	isOn, err := client.ToggleSwitch(1)
+	fcr.lock.Lock()
+	defer fcr.lock.Unlock()
+	if err != nil || isOn || fcr.toggles != 1 {
+		t.Errorf("ToggleSwitch(1) after a keypad = %v, %v, toggles = %d, want false and 1 toggle", isOn, err, fcr.toggles)
+	}
+}
@@ -0,0 +1,341 @@
+package crebrid
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// wire_max_id is the highest command ID, port and analog value, the integers of the
+// controller have 16 bits
+const wire_max_id = 65535
+
+// wire_serial_max is the longest serial text the telnet server module accepts
+const wire_serial_max = 200
+
+// crestronClientV2 speaks the v2 protocol. every frame carries a sequence number, which the
+// controller echoes in its ack or nak, so a late answer is never taken for the answer of the
+// next frame
+type crestronClientV2 struct {
+	addr       string
+	connect    func() (net.Conn, error)
+	policy     ClientPolicy
+	conn       net.Conn
+	accessCode string
+	// lock guards the fields below, which are shared with the reader routine
+	lock      sync.Mutex
+	curStatus *SystemStatus
+	// statusSeq is the sequence number of the frame whose answer is the current status
+	statusSeq uint16
+	seq       uint16
+	// pending frames which wait for their answer by sequence number
+	pending map[uint16]pendingFrame
+	// readErr is set as soon as the connection broke
+	readErr error
+	// readerDone is closed as soon as the reader routine stopped
+	readerDone chan bool
+	onPush     func(ss *SystemStatus)
+}
+
+// pendingFrame is the type of a frame which was sent and the channel its answer is passed to
+type pendingFrame struct {
+	wireType WireType
+	response chan clientResponse
+}
+
+func newCrestronClientV2(addr string, connect func() (net.Conn, error), policy ClientPolicy) (CrestronControllerClient, error) {
+	ccc := new(crestronClientV2)
+	ccc.addr = addr
+	ccc.connect = connect
+	ccc.policy = policy
+	err := ccc.dial()
+	if err != nil {
+		return nil, err
+	}
+	return ccc, nil
+}
+
+// dial the controller and start the reader routine of the new connection
+func (ccc *crestronClientV2) dial() error {
+	conn, err := ccc.connect()
+	if err != nil {
+		return err
+	}
+	ccc.lock.Lock()
+	ccc.conn = conn
+	ccc.pending = make(map[uint16]pendingFrame)
+	ccc.statusSeq = ccc.seq
+	ccc.readErr = nil
+	ccc.readerDone = make(chan bool)
+	ccc.lock.Unlock()
+	go ccc.readFrames(conn, ccc.readerDone)
+	return nil
+}
+
+// readFrames is the only routine which reads from the connection. it passes the answers to the
+// frames which wait for them, an answer of a frame which timed out only updates the current
+// status. pushes are told apart from the answers by their type and passed to the handler. it
+// stops at the first read error
+func (ccc *crestronClientV2) readFrames(conn net.Conn, done chan bool) {
+	defer close(done)
+	decoder := NewWireDecoder(conn)
+	for {
+		wf, err := decoder.Next()
+		var frameErr *FrameError
+		if errors.As(err, &frameErr) {
+			logging.LogFmt(logging.LOG_ERROR, "[controller client] drop frame: %s", err)
+			continue
+		}
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller client] stop reading: %s", err)
+			ccc.lock.Lock()
+			ccc.readErr = err
+			ccc.lock.Unlock()
+			return
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] receive frame: %s", wf)
+		if wf.Type == WT_PUSH {
+			ccc.pushed(wf)
+			continue
+		}
+		if wf.Type != WT_ACK && wf.Type != WT_NAK {
+			logging.LogFmt(logging.LOG_WARN, "[controller client] ignore frame of type [%c]", wf.Type)
+			continue
+		}
+		resp := ccc.answer(wf)
+		ccc.lock.Lock()
+		// the status of a late answer is older than the one of a frame sent after it
+		if resp.ss != nil && int16(wf.Seq-ccc.statusSeq) > 0 {
+			ccc.curStatus = resp.ss
+			ccc.statusSeq = wf.Seq
+		}
+		pf, ok := ccc.pending[wf.Seq]
+		delete(ccc.pending, wf.Seq)
+		ccc.lock.Unlock()
+		if !ok {
+			logging.LogFmt(logging.LOG_INFO, "[controller client] answer of frame %04X arrived late", wf.Seq)
+			continue
+		}
+		if len(wf.Payload) > 0 && WireType(wf.Payload[0]) != pf.wireType {
+			resp = clientResponse{err: fmt.Errorf("%w: answer of frame %04X echoes type [%c], want [%c]", ErrInvalidFrame, wf.Seq, wf.Payload[0], pf.wireType)}
+		}
+		pf.response <- resp
+	}
+}
+
+// pushed status of the controller, which is always the latest one
+func (ccc *crestronClientV2) pushed(wf WireFrame) {
+	ss, err := newStatusDecoder(strings.NewReader(wf.Payload), ccc.policy.Layout).Next()
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[controller client] drop push: %s", err)
+		return
+	}
+	ccc.lock.Lock()
+	ccc.curStatus = ss
+	onPush := ccc.onPush
+	ccc.lock.Unlock()
+	if onPush != nil {
+		onPush(ss)
+	}
+}
+
+// answer of the controller to a frame. the payload of an ack is the echoed type followed by the
+// status, the one of a nak is the echoed type followed by the reason
+func (ccc *crestronClientV2) answer(wf WireFrame) clientResponse {
+	if len(wf.Payload) < 1 {
+		return clientResponse{err: fmt.Errorf("%w: answer of frame %04X without echo", ErrInvalidFrame, wf.Seq)}
+	}
+	data := wf.Payload[1:]
+	if wf.Type == WT_NAK {
+		if data == NR_CRC {
+			return clientResponse{err: fmt.Errorf("%w: frame %04X", ErrFrameCorrupted, wf.Seq)}
+		}
+		return clientResponse{err: fmt.Errorf("%w: frame %04X of type [%c]: %s", ErrCommandRejected, wf.Seq, wf.Payload[0], data)}
+	}
+	ss, err := newStatusDecoder(strings.NewReader(data), ccc.policy.Layout).Next()
+	if err != nil {
+		return clientResponse{err: fmt.Errorf("%w: status of frame %04X: %v", ErrInvalidFrame, wf.Seq, err)}
+	}
+	return clientResponse{ss: ss}
+}
+
+func (ccc *crestronClientV2) ReDial() error {
+	logging.LogFmt(logging.LOG_INFO, "[controller client] close current connection on [%s] and re-dial", ccc.addr)
+	ccc.Close()
+	err := ccc.dial()
+	if err != nil {
+		return err
+	}
+	logging.Log(logging.LOG_DEBUG, "[controller client] successfully re-dialed")
+	return nil
+}
+
+func (ccc *crestronClientV2) Close() {
+	logging.Log(logging.LOG_INFO, "[controller client] close connection to server")
+	ccc.conn.Close()
+	// the reader stops with the closed connection, so no routine is left behind
+	<-ccc.readerDone
+}
+
+func (ccc *crestronClientV2) SetAccessCode(accessCode string) {
+	ccc.accessCode = accessCode
+}
+
+func (ccc *crestronClientV2) OnStatusPush(handler func(ss *SystemStatus)) {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	ccc.onPush = handler
+}
+
+func (ccc *crestronClientV2) GetSystemStatus() *SystemStatus {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	return ccc.curStatus
+}
+
+// request sends a frame and waits for its answer
+func (ccc *crestronClientV2) request(wireType WireType, args string, timeout time.Duration) (*SystemStatus, error) {
+	response := make(chan clientResponse, 1)
+	ccc.lock.Lock()
+	if ccc.readErr != nil {
+		err := ccc.readErr
+		ccc.lock.Unlock()
+		return nil, err
+	}
+	ccc.seq++
+	if ccc.seq == 0 {
+		// 0 is left for the frames the controller sends on its own
+		ccc.seq = 1
+	}
+	wf := WireFrame{Seq: ccc.seq, Type: wireType, Payload: ccc.accessCode}
+	ccc.pending[wf.Seq] = pendingFrame{wireType: wireType, response: response}
+	ccc.lock.Unlock()
+	if args != "" {
+		wf.Payload += "," + args
+	}
+	logging.LogFmt(logging.LOG_DEBUG, "[controller client] sending frame: %s", wf)
+	ccc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := ccc.conn.Write(wf.Encode())
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[controller client] failed to write on connection: %s", ccc.conn.RemoteAddr().String())
+		ccc.forget(wf.Seq)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-response:
+		return resp.ss, resp.err
+	case <-timer.C:
+		ccc.forget(wf.Seq)
+		err := fmt.Errorf("%w within [%s]: frame %04X", ErrResponseTimeout, timeout, wf.Seq)
+		logging.LogFmt(logging.LOG_DEBUG, "[controller client] %s", err)
+		return nil, err
+	case <-ccc.readerDone:
+		ccc.lock.Lock()
+		defer ccc.lock.Unlock()
+		return nil, ccc.readErr
+	}
+}
+
+// forget a pending frame, its answer is not awaited any longer
+func (ccc *crestronClientV2) forget(seq uint16) {
+	ccc.lock.Lock()
+	defer ccc.lock.Unlock()
+	delete(ccc.pending, seq)
+}
+
+// readStatus of the controller. a missing answer is retried by the status policy
+func (ccc *crestronClientV2) readStatus() (*SystemStatus, error) {
+	return retryOperation(ccc.policy.Status, ccc.policy.RetryDelay, "request status", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(WT_STATUS, "", timeout)
+	})
+}
+
+func (ccc *crestronClientV2) UpdateSystemStatus() error {
+	_, err := ccc.readStatus()
+	return err
+}
+
+func (ccc *crestronClientV2) ToggleSwitch(switchID int) (bool, error) {
+	if switchID < 1 {
+		_, err := ccc.readStatus()
+		return err == nil, err
+	}
+	if switchID > wire_max_id {
+		return false, fmt.Errorf("%w: %d", ErrInvalidSwitch, switchID)
+	}
+	// the state before the toggle judges a missing answer. it is read right before the toggle,
+	// as a keypad may have changed the switch since the last status
+	ss, err := ccc.readStatus()
+	if err != nil {
+		return false, err
+	}
+	return toggleChecked(ccc.policy, switchID, !switchState(ss, switchID), func() (*SystemStatus, error) {
+		return ccc.request(WT_TOGGLE, strconv.Itoa(switchID), ccc.policy.Toggle.Timeout)
+	}, ccc.readStatus)
+}
+
+// SetDigital sets the switch instead of toggling it, so the frame is simply sent again if its
+// answer is missing
+func (ccc *crestronClientV2) SetDigital(switchID int, on bool) (bool, error) {
+	if switchID < 1 || switchID > wire_max_id {
+		return false, fmt.Errorf("%w: %d", ErrInvalidSwitch, switchID)
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	ss, err := retryOperation(ccc.policy.Toggle, ccc.policy.RetryDelay, "set digital", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(WT_DIGITAL, fmt.Sprintf("%d,%d", switchID, value), timeout)
+	})
+	if err != nil {
+		return false, err
+	}
+	isOn := switchState(ss, switchID)
+	if isOn != on {
+		return isOn, fmt.Errorf("%w: switch ID [%d] to: %v", ErrSwitchUnchanged, switchID, on)
+	}
+	return isOn, nil
+}
+
+// SetAnalog port to the value rounded to an integer of the controller
+func (ccc *crestronClientV2) SetAnalog(port int, value float64) error {
+	if port < 1 || port > wire_max_id {
+		return fmt.Errorf("%w: analog port %d", ErrInvalidSwitch, port)
+	}
+	rounded := math.Round(value)
+	if rounded < 0 || rounded > wire_max_id {
+		return fmt.Errorf("%w: analog value %v is out of 0-%d", ErrInvalidValue, value, wire_max_id)
+	}
+	_, err := retryOperation(ccc.policy.Analog, ccc.policy.RetryDelay, "set analog", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(WT_ANALOG, fmt.Sprintf("%d,%d", port, int(rounded)), timeout)
+	})
+	return err
+}
+
+// SetSerial port to a printable ASCII text, which must not hold "@"
+func (ccc *crestronClientV2) SetSerial(port int, value string) error {
+	if port < 1 || port > wire_max_id {
+		return fmt.Errorf("%w: serial port %d", ErrInvalidSwitch, port)
+	}
+	if len(value) > wire_serial_max {
+		return fmt.Errorf("%w: serial value exceeds %d characters", ErrInvalidValue, wire_serial_max)
+	}
+	for _, c := range value {
+		if c < ' ' || c > '~' || c == '@' {
+			return fmt.Errorf("%w: serial value holds [%q]", ErrInvalidValue, c)
+		}
+	}
+	_, err := retryOperation(ccc.policy.Serial, ccc.policy.RetryDelay, "set serial", func(timeout time.Duration) (*SystemStatus, error) {
+		return ccc.request(WT_SERIAL, fmt.Sprintf("%d,%s", port, value), timeout)
+	})
+	return err
+}
@@ -0,0 +1,268 @@
+package crebrid
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCrestronV2 is a controller which speaks v2 like the module telnet_server
+type fakeCrestronV2 struct {
+	lock       sync.Mutex
+	accessCode string
+	d          []int
+	a          []float64
+	serials    map[int]string
+	toggles    int
+	// corrupted frames are rejected by their CRC, dropped ones are executed without an answer
+	// and late ones are answered after the delay
+	corrupted int
+	dropped   int
+	late      int
+	delay     time.Duration
+	// pushes are sent in front of the answer, like a keypad pressed while the frame is executed
+	pushes int
+	conn   net.Conn
+	wlock  sync.Mutex
+}
+
+// handle a frame, the answer and its delay are returned
+func (fcr *fakeCrestronV2) handle(wf WireFrame) ([]byte, time.Duration, bool) {
+	fcr.lock.Lock()
+	defer fcr.lock.Unlock()
+	nak := func(reason string) []byte {
+		return WireFrame{Seq: wf.Seq, Type: WT_NAK, Payload: string(wf.Type) + reason}.Encode()
+	}
+	if fcr.corrupted > 0 {
+		fcr.corrupted--
+		return nak(NR_CRC), 0, true
+	}
+	args := strings.SplitN(wf.Payload, ",", 3)
+	if args[0] != fcr.accessCode {
+		return nak(NR_ACCESS), 0, true
+	}
+	num := func(i int) int {
+		if i >= len(args) {
+			return -1
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	switch wf.Type {
+	case WT_STATUS:
+	case WT_TOGGLE:
+		fcr.d[num(1)-1] = 1 - fcr.d[num(1)-1]
+		fcr.toggles++
+	case WT_DIGITAL:
+		fcr.d[num(1)-1] = num(2)
+	case WT_ANALOG:
+		if num(1) < 1 || num(1) > len(fcr.a) {
+			return nak(NR_RANGE), 0, true
+		}
+		fcr.a[num(1)-1] = float64(num(2))
+	case WT_SERIAL:
+		fcr.serials[num(1)] = args[2]
+	default:
+		return nak(NR_TYPE), 0, true
+	}
+	if fcr.dropped > 0 {
+		fcr.dropped--
+		return nil, 0, false
+	}
+	data, _ := json.Marshal(&SystemStatus{D: fcr.d, A: fcr.a})
+	ack := WireFrame{Seq: wf.Seq, Type: WT_ACK, Payload: string(wf.Type) + string(data)}.Encode()
+	if fcr.pushes > 0 {
+		fcr.pushes--
+		ack = append(WireFrame{Type: WT_PUSH, Payload: string(data)}.Encode(), ack...)
+	}
+	if fcr.late > 0 {
+		fcr.late--
+		return ack, fcr.delay, true
+	}
+	return ack, 0, true
+}
+
+// keypad toggles a digital output on the controller, which pushes its status
+func (fcr *fakeCrestronV2) keypad(id int) {
+	fcr.lock.Lock()
+	fcr.d[id-1] = 1 - fcr.d[id-1]
+	data, _ := json.Marshal(&SystemStatus{D: fcr.d, A: fcr.a})
+	conn := fcr.conn
+	fcr.lock.Unlock()
+	fcr.write(conn, WireFrame{Type: WT_PUSH, Payload: string(data)}.Encode())
+}
+
+// write data to the client, split like the output of the TCP server
+func (fcr *fakeCrestronV2) write(conn net.Conn, data []byte) {
+	fcr.wlock.Lock()
+	defer fcr.wlock.Unlock()
+	conn.Write(append([]byte("\r\n"), data[:12]...))
+	time.Sleep(2 * time.Millisecond)
+	conn.Write(data[12:])
+}
+
+func (fcr *fakeCrestronV2) update(fn func()) {
+	fcr.lock.Lock()
+	defer fcr.lock.Unlock()
+	fn()
+}
+
+// listen for the client on a local port
+func (fcr *fakeCrestronV2) listen(t *testing.T) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fcr.serve(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// serve the frames of the client until the connection is closed
+func (fcr *fakeCrestronV2) serve(conn net.Conn) {
+	fcr.update(func() { fcr.conn = conn })
+	defer conn.Close()
+	decoder := NewWireDecoder(conn)
+	for {
+		wf, err := decoder.Next()
+		if err != nil {
+			return
+		}
+		resp, delay, ok := fcr.handle(wf)
+		if !ok {
+			continue
+		}
+		go func() {
+			time.Sleep(delay)
+			fcr.write(conn, resp)
+		}()
+	}
+}
+
+func TestCrestronClientV2(t *testing.T) {
+	fcr := &fakeCrestronV2{accessCode: "1234", d: []int{0, 0, 0}, a: []float64{0, 0}, serials: make(map[int]string), delay: 150 * time.Millisecond}
+	ip, port := fcr.listen(t)
+	policy := ClientPolicy{
+		Protocol:   WP_V2,
+		RetryDelay: 10 * time.Millisecond,
+		Connect:    OperationPolicy{Timeout: time.Second},
+		Status:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+		Toggle:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+		Analog:     OperationPolicy{Timeout: 100 * time.Millisecond},
+		Serial:     OperationPolicy{Timeout: 100 * time.Millisecond, Retries: 1},
+		Layout:     StatusLayout{Digitals: 3, Analogs: 2},
+	}
+	client, err := NewCrestronControllerClient(ip, port, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetAccessCode("1234")
+	toggles := func() int {
+		fcr.lock.Lock()
+		defer fcr.lock.Unlock()
+		return fcr.toggles
+	}
+	if isOn, err := client.ToggleSwitch(1); err != nil || !isOn {
+		t.Fatalf("ToggleSwitch() = %v, %v", isOn, err)
+	}
+	// a corrupted toggle was not executed, so it is sent again
+	fcr.update(func() { fcr.corrupted = 1 })
+	if isOn, err := client.ToggleSwitch(2); err != nil || !isOn || toggles() != 2 {
+		t.Fatalf("ToggleSwitch() of a corrupted frame = %v, %v, toggles = %d", isOn, err, toggles())
+	}
+	// the status shows the toggle of a dropped answer, so it is not sent again
+	fcr.update(func() { fcr.dropped = 1 })
+	if isOn, err := client.ToggleSwitch(3); err != nil || !isOn || toggles() != 3 {
+		t.Fatalf("ToggleSwitch() of a dropped answer = %v, %v, toggles = %d", isOn, err, toggles())
+	}
+	// the late answer of the first attempt is not taken for the one of the second
+	fcr.update(func() { fcr.late = 1 })
+	if isOn, err := client.SetDigital(1, false); err != nil || isOn {
+		t.Fatalf("SetDigital() of a late answer = %v, %v", isOn, err)
+	}
+	if err := client.SetAnalog(2, 21.6); err != nil {
+		t.Fatalf("SetAnalog() = %v", err)
+	}
+	if err := client.SetAnalog(3, 1); !errors.Is(err, ErrCommandRejected) || isConnectionError(err) {
+		t.Errorf("SetAnalog() of an unknown port error = %v, want %v", err, ErrCommandRejected)
+	}
+	if err := client.SetAnalog(1, 70000); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("SetAnalog() out of range error = %v, want %v", err, ErrInvalidValue)
+	}
+	if err := client.SetSerial(4, "Movie, Night"); err != nil {
+		t.Fatalf("SetSerial() = %v", err)
+	}
+	if err := client.SetSerial(4, "line\r\nbreak"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("SetSerial() with a line break error = %v, want %v", err, ErrInvalidValue)
+	}
+	if got, want := client.GetSystemStatus(), (&SystemStatus{D: []int{0, 1, 1}, A: []float64{0, 22}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSystemStatus() = %v, want %v", got, want)
+	}
+	fcr.update(func() {
+		if fcr.serials[4] != "Movie, Night" {
+			t.Errorf("serial 4 = %q, want %q", fcr.serials[4], "Movie, Night")
+		}
+	})
+	client.SetAccessCode("wrong")
+	if _, err := client.ToggleSwitch(0); !errors.Is(err, ErrCommandRejected) || !strings.Contains(err.Error(), NR_ACCESS) {
+		t.Errorf("ToggleSwitch() with a wrong access code error = %v, want %v", err, ErrCommandRejected)
+	}
+}
+
+func TestCrestronClientV2Push(t *testing.T) {
+	fcr := &fakeCrestronV2{accessCode: "1234", d: []int{0, 0}, a: []float64{0}, serials: make(map[int]string)}
+	ip, port := fcr.listen(t)
+	policy := DefaultClientPolicy()
+	policy.Protocol = WP_V2
+	policy.Layout = StatusLayout{Digitals: 2, Analogs: 1}
+	client, err := NewCrestronControllerClient(ip, port, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetAccessCode("1234")
+	pushes := make(chan *SystemStatus, 2)
+	client.OnStatusPush(func(ss *SystemStatus) { pushes <- ss })
+	awaitPush := func(want *SystemStatus) {
+		t.Helper()
+		select {
+		case got := <-pushes:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("pushed status = %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no status pushed, want %v", want)
+		}
+	}
+	// a push between a frame and its answer does not take the place of the answer
+	fcr.update(func() { fcr.pushes = 1 })
+	if isOn, err := client.SetDigital(1, true); err != nil || !isOn {
+		t.Fatalf("SetDigital() with a push in front of the answer = %v, %v", isOn, err)
+	}
+	awaitPush(&SystemStatus{D: []int{1, 0}, A: []float64{0}})
+	fcr.keypad(2)
+	want := &SystemStatus{D: []int{1, 1}, A: []float64{0}}
+	awaitPush(want)
+	if got := client.GetSystemStatus(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSystemStatus() after a push = %v, want %v", got, want)
+	}
+}
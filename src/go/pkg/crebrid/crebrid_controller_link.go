@@ -0,0 +1,496 @@
+package crebrid
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+type LinkState int
+
+const (
+	// CLS_DISCONNECTED the link waits for the next connection attempt
+	CLS_DISCONNECTED LinkState = iota
+	// CLS_CONNECTED the controller is reachable
+	CLS_CONNECTED
+	// CLS_CIRCUIT_OPEN requests fail fast after too many failed attempts
+	CLS_CIRCUIT_OPEN
+	// CLS_HALF_OPEN a single attempt probes whether the controller is back
+	CLS_HALF_OPEN
+)
+
+var linkStateStr = map[LinkState]string{
+	CLS_DISCONNECTED: "disconnected",
+	CLS_CONNECTED:    "connected",
+	CLS_CIRCUIT_OPEN: "circuit open",
+	CLS_HALF_OPEN:    "half open",
+}
+
+func (ls LinkState) String() string {
+	return linkStateStr[ls]
+}
+
+// ErrControllerUnavailable is returned while the link waits for the next connection attempt
+var ErrControllerUnavailable = errors.New("controller is not connected")
+
+// ErrCircuitOpen is returned without any attempt while the circuit breaker is open
+var ErrCircuitOpen = errors.New("controller is not reachable, circuit breaker is open")
+
+// ErrConnectionDead is the reason a connection is dropped after too many missed heartbeats
+var ErrConnectionDead = errors.New("connection is dead")
+
+// LinkPolicy defines how the link reconnects to the controller
+type LinkPolicy struct {
+	// InitialBackoff after the first failed attempt
+	InitialBackoff time.Duration
+	// MaxBackoff between two attempts
+	MaxBackoff time.Duration
+	// Multiplier of the backoff for every further failed attempt
+	Multiplier float64
+	// Jitter is the part of the backoff which is randomized, e.g. 0.2 for +-20%
+	Jitter float64
+	// BreakerThreshold is the number of failed attempts in a row which open the circuit
+	BreakerThreshold int
+	// OpenTimeout is the time the circuit stays open before it is probed
+	OpenTimeout time.Duration
+	// HeartbeatInterval between two status requests which check the connection, 0 disables
+	// the heartbeat
+	HeartbeatInterval time.Duration
+	// HeartbeatMisses is the number of missed heartbeats in a row after which the connection
+	// is dead
+	HeartbeatMisses int
+}
+
+// DefaultLinkPolicy reconnects after 1s, 2s, 4s, ... and opens the circuit for a minute after
+// 5 failed attempts. a connection is dead after 3 missed heartbeats, one every 10s
+func DefaultLinkPolicy() LinkPolicy {
+	return LinkPolicy{
+		InitialBackoff:    time.Second,
+		MaxBackoff:        30 * time.Second,
+		Multiplier:        2,
+		Jitter:            0.2,
+		BreakerThreshold:  5,
+		OpenTimeout:       time.Minute,
+		HeartbeatInterval: 10 * time.Second,
+		HeartbeatMisses:   3,
+	}
+}
+
+// backoff before the next attempt after the given number of failed attempts
+func (lp LinkPolicy) backoff(failures int, rnd func() float64) time.Duration {
+	d := float64(lp.InitialBackoff)
+	for i := 1; i < failures && d < float64(lp.MaxBackoff); i++ {
+		d *= lp.Multiplier
+	}
+	if d > float64(lp.MaxBackoff) {
+		d = float64(lp.MaxBackoff)
+	}
+	d += d * lp.Jitter * (2*rnd() - 1)
+	return time.Duration(d)
+}
+
+// ControllerLink supervises the connection to the controller. it is used like a controller
+// client, but requests fail fast while the controller is not connected and a routine
+// reconnects in the background. the routine sends heartbeats while the controller is
+// connected, so a silently dropped connection is detected without any request
+type ControllerLink interface {
+	CrestronControllerClient
+	// Connect tries to connect to the controller right now
+	Connect() error
+	// Start the routine which reconnects the controller
+	Start()
+	// Stop the routine and close the connection
+	Stop()
+	// State of the link
+	State() LinkState
+	// SetCommandQueue the heartbeats are submitted to at QP_POLL, so they never pre-empt the
+	// commands which wait. without a queue they are sent right away
+	SetCommandQueue(queue CommandQueue)
+}
+
+type controllerLink struct {
+	lock       sync.Mutex
+	clock      Clock
+	policy     LinkPolicy
+	rnd        func() float64
+	dial       func() (CrestronControllerClient, error)
+	onState    func(state LinkState, err error)
+	accessCode string
+	client     CrestronControllerClient
+	state      LinkState
+	failures   int
+	misses     int
+	queue      CommandQueue
+	// reqLock serializes the requests on the client, e.g. of the users and the heartbeat
+	reqLock sync.Mutex
+	// statusLock guards status and onPush instead of lock, because the pushes arrive on the
+	// reader routine of the client, which Close waits for while lock is held
+	statusLock sync.Mutex
+	status     *SystemStatus
+	onPush     func(ss *SystemStatus)
+	wake       chan bool
+	quit       chan bool
+	quitOnce   sync.Once
+	wg         sync.WaitGroup
+}
+
+// NewControllerLink connects to the controller by calling dial. onState is called for every
+// change of the link state with the error which caused it
+func NewControllerLink(clock Clock, policy LinkPolicy, dial func() (CrestronControllerClient, error), onState func(state LinkState, err error)) ControllerLink {
+	cl := new(controllerLink)
+	cl.clock = clock
+	cl.policy = policy
+	cl.rnd = rand.Float64
+	cl.dial = dial
+	cl.onState = onState
+	cl.state = CLS_DISCONNECTED
+	cl.wake = make(chan bool, 1)
+	cl.quit = make(chan bool)
+	return cl
+}
+
+// setState and notify the listener. the caller has to hold the lock
+func (cl *controllerLink) setState(state LinkState, err error) {
+	if state == cl.state {
+		return
+	}
+	if err != nil {
+		logging.LogFmt(logging.LOG_WARN, "[LINK] %s --> %s: %s", cl.state, state, err)
+	} else {
+		logging.LogFmt(logging.LOG_INFO, "[LINK] %s --> %s", cl.state, state)
+	}
+	cl.state = state
+	if cl.onState != nil {
+		cl.onState(state, err)
+	}
+}
+
+func (cl *controllerLink) State() LinkState {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.state
+}
+
+func (cl *controllerLink) SetCommandQueue(queue CommandQueue) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.queue = queue
+}
+
+func (cl *controllerLink) Connect() error {
+	cl.lock.Lock()
+	if cl.state == CLS_CIRCUIT_OPEN {
+		cl.setState(CLS_HALF_OPEN, nil)
+	}
+	accessCode := cl.accessCode
+	cl.lock.Unlock()
+	client, err := cl.dial()
+	if err == nil {
+		client.SetAccessCode(accessCode)
+		client.OnStatusPush(cl.pushed)
+		// the status request proves that the controller answers with the access code
+		_, err = client.ToggleSwitch(system_state_toggle)
+		if err != nil {
+			client.Close()
+		}
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if err != nil {
+		cl.failures++
+		if cl.state == CLS_HALF_OPEN || cl.failures >= cl.policy.BreakerThreshold {
+			cl.setState(CLS_CIRCUIT_OPEN, err)
+		} else {
+			cl.setState(CLS_DISCONNECTED, err)
+		}
+		return err
+	}
+	if cl.client != nil {
+		cl.client.Close()
+	}
+	cl.client = client
+	cl.setStatus(client.GetSystemStatus())
+	cl.failures = 0
+	cl.misses = 0
+	cl.setState(CLS_CONNECTED, nil)
+	return nil
+}
+
+// nextAttempt is the time to wait until the next connection attempt. false if connected
+func (cl *controllerLink) nextAttempt() (time.Duration, bool) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	switch {
+	case cl.state == CLS_CONNECTED:
+		return 0, false
+	case cl.state == CLS_CIRCUIT_OPEN:
+		return cl.policy.OpenTimeout, true
+	case cl.failures == 0:
+		return 0, true
+	}
+	return cl.policy.backoff(cl.failures, cl.rnd), true
+}
+
+func (cl *controllerLink) execute() {
+	defer cl.wg.Done()
+	for {
+		wait, ok := cl.nextAttempt()
+		if !ok {
+			var heartbeat <-chan time.Time
+			if cl.policy.HeartbeatInterval > 0 {
+				heartbeat = cl.clock.After(cl.policy.HeartbeatInterval)
+			}
+			select {
+			case <-heartbeat:
+				cl.heartbeat()
+				continue
+			case <-cl.wake:
+				continue
+			case <-cl.quit:
+				logging.Log(logging.LOG_DEBUG, "[LINK] routine escaped")
+				return
+			}
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[LINK] next connection attempt in %s", wait)
+		select {
+		case <-cl.clock.After(wait):
+		case <-cl.wake:
+			// woken by ReDial, which reset the backoff
+			continue
+		case <-cl.quit:
+			logging.Log(logging.LOG_DEBUG, "[LINK] routine escaped")
+			return
+		}
+		err := cl.Connect()
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[LINK] connection attempt failed: %s", err)
+		}
+	}
+}
+
+// heartbeat requests the system status. a missed heartbeat keeps the connection, so a late
+// response can bring it back in sync, but too many missed heartbeats in a row drop it. a
+// broken connection, e.g. reset by the controller, is dropped right away. the heartbeat waits
+// in the command queue behind every other command
+func (cl *controllerLink) heartbeat() {
+	client, err := cl.connected()
+	if err != nil {
+		return
+	}
+	send := func() error {
+		cl.reqLock.Lock()
+		defer cl.reqLock.Unlock()
+		_, err := client.ToggleSwitch(system_state_toggle)
+		return err
+	}
+	cl.lock.Lock()
+	queue := cl.queue
+	cl.lock.Unlock()
+	if queue != nil {
+		err = queue.Submit(QP_POLL, "heartbeat", send)
+	} else {
+		err = send()
+	}
+	if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueStopped) {
+		// the heartbeat was not sent, the commands in the queue talk to the controller anyway
+		logging.LogFmt(logging.LOG_DEBUG, "[LINK] skip heartbeat: %s", err)
+		return
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if client != cl.client {
+		return
+	}
+	cl.setStatus(client.GetSystemStatus())
+	switch {
+	case !isConnectionError(err):
+		// a rejected request is answered as well
+		if cl.misses > 0 {
+			logging.LogFmt(logging.LOG_INFO, "[LINK] heartbeat is answered again after %d missed", cl.misses)
+		}
+		cl.misses = 0
+		return
+	case errors.Is(err, ErrResponseTimeout):
+		cl.misses++
+		logging.LogFmt(logging.LOG_WARN, "[LINK] missed heartbeat %d of %d: %s", cl.misses, cl.policy.HeartbeatMisses, err)
+		if cl.misses < cl.policy.HeartbeatMisses {
+			return
+		}
+		err = fmt.Errorf("%w: %d heartbeats missed: %v", ErrConnectionDead, cl.policy.HeartbeatMisses, err)
+	}
+	// the routine reconnects right away, because the failures are not counted up
+	client.Close()
+	cl.client = nil
+	cl.misses = 0
+	cl.setState(CLS_DISCONNECTED, err)
+}
+
+func (cl *controllerLink) Start() {
+	cl.wg.Add(1)
+	go cl.execute()
+}
+
+func (cl *controllerLink) Stop() {
+	cl.quitOnce.Do(func() { close(cl.quit) })
+	cl.wg.Wait()
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.client != nil {
+		cl.client.Close()
+		cl.client = nil
+	}
+	// a request after the stop finds no connection
+	cl.setState(CLS_DISCONNECTED, nil)
+}
+
+// connected client or the error why there is none
+func (cl *controllerLink) connected() (CrestronControllerClient, error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	switch cl.state {
+	case CLS_CONNECTED:
+		return cl.client, nil
+	case CLS_CIRCUIT_OPEN:
+		return nil, ErrCircuitOpen
+	}
+	return nil, ErrControllerUnavailable
+}
+
+// done checks the result of a request. a connection error drops the client and wakes the
+// reconnect routine
+func (cl *controllerLink) done(client CrestronControllerClient, err error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.setStatus(client.GetSystemStatus())
+	if err == nil && client == cl.client {
+		// every answered request proves the connection like a heartbeat
+		cl.misses = 0
+	}
+	if !isConnectionError(err) || client != cl.client {
+		return
+	}
+	client.Close()
+	cl.client = nil
+	cl.setState(CLS_DISCONNECTED, err)
+	select {
+	case cl.wake <- true:
+	default:
+	}
+}
+
+func (cl *controllerLink) SetAccessCode(accessCode string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.accessCode = accessCode
+	if cl.client != nil {
+		cl.client.SetAccessCode(accessCode)
+	}
+}
+
+func (cl *controllerLink) OnStatusPush(handler func(ss *SystemStatus)) {
+	cl.statusLock.Lock()
+	defer cl.statusLock.Unlock()
+	cl.onPush = handler
+}
+
+// setStatus of the latest request, nil keeps the status known before
+func (cl *controllerLink) setStatus(ss *SystemStatus) {
+	cl.statusLock.Lock()
+	defer cl.statusLock.Unlock()
+	if ss != nil {
+		cl.status = ss
+	}
+}
+
+// pushed status of a client. a replaced client does not push anymore, because Close waits
+// for its reader routine
+func (cl *controllerLink) pushed(ss *SystemStatus) {
+	cl.statusLock.Lock()
+	cl.status = ss
+	onPush := cl.onPush
+	cl.statusLock.Unlock()
+	if onPush != nil {
+		onPush(ss)
+	}
+}
+
+// GetSystemStatus of the latest request or push, even if the connection is lost afterwards
+func (cl *controllerLink) GetSystemStatus() *SystemStatus {
+	cl.statusLock.Lock()
+	defer cl.statusLock.Unlock()
+	return cl.status
+}
+
+func (cl *controllerLink) ToggleSwitch(switchID int) (bool, error) {
+	client, err := cl.connected()
+	if err != nil {
+		return false, err
+	}
+	cl.reqLock.Lock()
+	ret, err := client.ToggleSwitch(switchID)
+	cl.reqLock.Unlock()
+	cl.done(client, err)
+	return ret, err
+}
+
+func (cl *controllerLink) SetDigital(switchID int, on bool) (bool, error) {
+	client, err := cl.connected()
+	if err != nil {
+		return false, err
+	}
+	cl.reqLock.Lock()
+	ret, err := client.SetDigital(switchID, on)
+	cl.reqLock.Unlock()
+	cl.done(client, err)
+	return ret, err
+}
+
+func (cl *controllerLink) SetAnalog(port int, value float64) error {
+	client, err := cl.connected()
+	if err != nil {
+		return err
+	}
+	cl.reqLock.Lock()
+	err = client.SetAnalog(port, value)
+	cl.reqLock.Unlock()
+	cl.done(client, err)
+	return err
+}
+
+func (cl *controllerLink) SetSerial(port int, value string) error {
+	client, err := cl.connected()
+	if err != nil {
+		return err
+	}
+	cl.reqLock.Lock()
+	err = client.SetSerial(port, value)
+	cl.reqLock.Unlock()
+	cl.done(client, err)
+	return err
+}
+
+func (cl *controllerLink) Close() {
+	cl.Stop()
+}
+
+// ReDial drops the current connection, the routine reconnects right away even if it backs off
+// or the circuit is open
+func (cl *controllerLink) ReDial() error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.client != nil {
+		cl.client.Close()
+		cl.client = nil
+	}
+	cl.failures = 0
+	cl.setState(CLS_DISCONNECTED, nil)
+	select {
+	case cl.wake <- true:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package crebrid
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinkPolicyBackoff(t *testing.T) {
+	lp := DefaultLinkPolicy()
+	tests := []struct {
+		failures int
+		rnd      float64
+		want     time.Duration
+	}{
+		{failures: 1, rnd: 0.5, want: time.Second},
+		{failures: 2, rnd: 0.5, want: 2 * time.Second},
+		{failures: 3, rnd: 0.5, want: 4 * time.Second},
+		{failures: 12, rnd: 0.5, want: 30 * time.Second},
+		{failures: 1, rnd: 1, want: 1200 * time.Millisecond},
+		{failures: 3, rnd: 0, want: 3200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := lp.backoff(tt.failures, func() float64 { return tt.rnd })
+		if got != tt.want {
+			t.Errorf("backoff(%d, %v) = %v, want %v", tt.failures, tt.rnd, got, tt.want)
+		}
+	}
+}
+
+// linkTestClient fails every request with err
+type linkTestClient struct {
+	*fakeControllerClient
+	err    error
+	onPush func(ss *SystemStatus)
+}
+
+func (ltc *linkTestClient) OnStatusPush(handler func(ss *SystemStatus)) {
+	ltc.onPush = handler
+}
+
+func (ltc *linkTestClient) ToggleSwitch(switchID int) (bool, error) {
+	if ltc.err != nil {
+		return false, ltc.err
+	}
+	return ltc.fakeControllerClient.ToggleSwitch(switchID)
+}
+
+func (ltc *linkTestClient) SetAnalog(port int, value float64) error {
+	return ErrAnalogNotSupported
+}
+
+func TestControllerLink(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	var lock sync.Mutex
+	dialErr := errors.New("connection refused")
+	clients := make([]*linkTestClient, 0)
+	states := make([]string, 0)
+	policy := LinkPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 2, BreakerThreshold: 3, OpenTimeout: time.Minute}
+	cl := NewControllerLink(fc, policy, func() (CrestronControllerClient, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		ltc := &linkTestClient{fakeControllerClient: newFakeControllerClient([]int{0, 0}, []float64{0})}
+		clients = append(clients, ltc)
+		return ltc, nil
+	}, func(state LinkState, err error) {
+		states = append(states, state.String())
+	})
+	waitForState := func(want LinkState) {
+		for i := 0; i < 200; i++ {
+			if cl.State() == want {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("State() = %s, want %s", cl.State(), want)
+	}
+	if cl.Connect() == nil {
+		t.Fatalf("Connect() does not fail")
+	}
+	if _, err := cl.ToggleSwitch(1); !errors.Is(err, ErrControllerUnavailable) {
+		t.Errorf("ToggleSwitch() error = %v, want %v", err, ErrControllerUnavailable)
+	}
+	cl.Start()
+	defer cl.Stop()
+	// backoff of 1s and 2s, the third failed attempt opens the circuit
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		fc.waitForWaiter(t)
+		fc.Advance(d)
+	}
+	waitForState(CLS_CIRCUIT_OPEN)
+	if _, err := cl.ToggleSwitch(1); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("ToggleSwitch() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	lock.Lock()
+	dialErr = nil
+	lock.Unlock()
+	fc.waitForWaiter(t)
+	fc.Advance(time.Minute)
+	waitForState(CLS_CONNECTED)
+	isOn, err := cl.ToggleSwitch(2)
+	if err != nil || !isOn {
+		t.Fatalf("ToggleSwitch() = %v, %v", isOn, err)
+	}
+	// a connection error drops the client and reconnects right away
+	lock.Lock()
+	clients[0].err = errors.New("broken pipe")
+	lock.Unlock()
+	if _, err := cl.ToggleSwitch(1); err == nil {
+		t.Fatalf("ToggleSwitch() of a broken connection does not fail")
+	}
+	waitForState(CLS_CONNECTED)
+	// a request error keeps the connection
+	if err := cl.SetAnalog(1, 100); !errors.Is(err, ErrAnalogNotSupported) || cl.State() != CLS_CONNECTED {
+		t.Errorf("SetAnalog() error = %v, state = %s", err, cl.State())
+	}
+	if cl.GetSystemStatus() == nil {
+		t.Errorf("GetSystemStatus() is nil")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(clients) != 2 {
+		t.Errorf("dialed clients = %d, want 2", len(clients))
+	}
+	want := []string{"circuit open", "half open", "connected", "disconnected", "connected"}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+func TestControllerLinkHeartbeat(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	var lock sync.Mutex
+	clients := make([]*linkTestClient, 0)
+	states := make([]string, 0)
+	policy := LinkPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 2, BreakerThreshold: 3, OpenTimeout: time.Minute, HeartbeatInterval: 10 * time.Second, HeartbeatMisses: 2}
+	cl := NewControllerLink(fc, policy, func() (CrestronControllerClient, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		ltc := &linkTestClient{fakeControllerClient: newFakeControllerClient([]int{0, 0}, []float64{0})}
+		clients = append(clients, ltc)
+		return ltc, nil
+	}, func(state LinkState, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			states = append(states, state.String()+": "+err.Error())
+		} else {
+			states = append(states, state.String())
+		}
+	})
+	if err := cl.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	cl.Start()
+	defer cl.Stop()
+	fc.waitForWaiter(t)
+	fc.Advance(10 * time.Second)
+	// the first missed heartbeat keeps the connection, the second one drops it
+	fc.waitForWaiter(t)
+	lock.Lock()
+	clients[0].err = ErrResponseTimeout
+	lock.Unlock()
+	fc.Advance(10 * time.Second)
+	fc.waitForWaiter(t)
+	if cl.State() != CLS_CONNECTED {
+		t.Fatalf("State() after a missed heartbeat = %s, want %s", cl.State(), CLS_CONNECTED)
+	}
+	fc.Advance(10 * time.Second)
+	// the link reconnects right away
+	fc.waitForWaiter(t)
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"connected", "disconnected: connection is dead: 2 heartbeats missed: no response from controller", "connected"}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+	if len(clients) != 2 {
+		t.Errorf("dialed clients = %d, want 2", len(clients))
+	}
+}
+
+func TestControllerLinkHeartbeatBrokenConnection(t *testing.T) {
+	fcr := &fakeCrestronV2{accessCode: "1234", d: []int{0, 0}, a: []float64{0}, serials: make(map[int]string)}
+	ip, port := fcr.listen(t)
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	var lock sync.Mutex
+	states := make([]LinkState, 0)
+	policy := DefaultLinkPolicy()
+	cl := NewControllerLink(fc, policy, func() (CrestronControllerClient, error) {
+		clientPolicy := DefaultClientPolicy()
+		clientPolicy.Protocol = WP_V2
+		clientPolicy.Layout = StatusLayout{Digitals: 2, Analogs: 1}
+		return NewCrestronControllerClient(ip, port, clientPolicy)
+	}, func(state LinkState, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		states = append(states, state)
+	})
+	cl.SetAccessCode("1234")
+	if err := cl.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	cl.Start()
+	defer cl.Stop()
+	fc.waitForWaiter(t)
+	// the controller reboots
+	fcr.update(func() { fcr.conn.Close() })
+	// the heartbeat finds the closed socket and the link dials again without a further interval
+	fc.Advance(policy.HeartbeatInterval)
+	fc.waitForWaiter(t)
+	lock.Lock()
+	defer lock.Unlock()
+	want := []LinkState{CLS_CONNECTED, CLS_DISCONNECTED, CLS_CONNECTED}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+// orderLinkClient records the switches it toggles
+type orderLinkClient struct {
+	*linkTestClient
+	lock sync.Mutex
+	ids  []int
+}
+
+func (olc *orderLinkClient) ToggleSwitch(switchID int) (bool, error) {
+	olc.lock.Lock()
+	olc.ids = append(olc.ids, switchID)
+	olc.lock.Unlock()
+	return olc.linkTestClient.ToggleSwitch(switchID)
+}
+
+func (olc *orderLinkClient) toggled() []int {
+	olc.lock.Lock()
+	defer olc.lock.Unlock()
+	return append([]int(nil), olc.ids...)
+}
+
+func TestControllerLinkHeartbeatQueued(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	olc := &orderLinkClient{linkTestClient: &linkTestClient{fakeControllerClient: newFakeControllerClient([]int{0, 0, 0}, []float64{0})}}
+	policy := DefaultLinkPolicy()
+	cl := NewControllerLink(fc, policy, func() (CrestronControllerClient, error) {
+		return olc, nil
+	}, func(state LinkState, err error) {})
+	queue := NewCommandQueue(NewSystemClock(), 8)
+	queue.Start()
+	defer queue.Stop()
+	cl.SetCommandQueue(queue)
+	if err := cl.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	cl.Start()
+	defer cl.Stop()
+	waitForDepth := func(want int) {
+		for i := 0; i < 200 && queue.Stats().Depth < want; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if depth := queue.Stats().Depth; depth != want {
+			t.Fatalf("Depth = %d, want %d", depth, want)
+		}
+	}
+	submit := func(prio CommandPriority, fn func() error) {
+		go queue.Submit(prio, "test", fn)
+	}
+	// a user command blocks the queue while the others wait
+	started := make(chan bool)
+	release := make(chan bool)
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	// a failed test unblocks the queue before it stops
+	defer unblock()
+	submit(QP_USER, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	submit(QP_USER, func() error {
+		_, err := cl.ToggleSwitch(1)
+		return err
+	})
+	waitForDepth(1)
+	fc.waitForWaiter(t)
+	fc.Advance(policy.HeartbeatInterval)
+	waitForDepth(2)
+	submit(QP_NORMAL, func() error {
+		_, err := cl.ToggleSwitch(2)
+		return err
+	})
+	waitForDepth(3)
+	unblock()
+	// the heartbeat is sent after every waiting command
+	want := []int{system_state_toggle, 1, 2, system_state_toggle}
+	for i := 0; i < 200 && len(olc.toggled()) < len(want); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := olc.toggled(); !reflect.DeepEqual(got, want) {
+		t.Errorf("toggled = %v, want %v", got, want)
+	}
+}
+
+func TestControllerLinkPush(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	var ltc *linkTestClient
+	cl := NewControllerLink(fc, DefaultLinkPolicy(), func() (CrestronControllerClient, error) {
+		ltc = &linkTestClient{fakeControllerClient: newFakeControllerClient([]int{0, 0}, []float64{0})}
+		return ltc, nil
+	}, func(state LinkState, err error) {})
+	pushed := make([]*SystemStatus, 0)
+	cl.OnStatusPush(func(ss *SystemStatus) {
+		// the handler may use the link, e.g. to read the status
+		if cl.GetSystemStatus() != ss {
+			t.Errorf("GetSystemStatus() in the handler is not the pushed status")
+		}
+		pushed = append(pushed, ss)
+	})
+	if err := cl.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	ss := &SystemStatus{D: []int{1, 0}, A: []float64{0}}
+	ltc.onPush(ss)
+	if got := cl.GetSystemStatus(); got != ss {
+		t.Errorf("GetSystemStatus() after a push = %v, want %v", got, ss)
+	}
+	if want := []*SystemStatus{ss}; !reflect.DeepEqual(pushed, want) {
+		t.Errorf("pushed = %v, want %v", pushed, want)
+	}
+}
+
+func TestControllerLinkReDial(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	var lock sync.Mutex
+	dialErr := errors.New("connection refused")
+	cl := NewControllerLink(fc, DefaultLinkPolicy(), func() (CrestronControllerClient, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		return &linkTestClient{fakeControllerClient: newFakeControllerClient([]int{0, 0}, []float64{0})}, nil
+	}, func(state LinkState, err error) {})
+	if cl.Connect() == nil {
+		t.Fatalf("Connect() does not fail")
+	}
+	cl.Start()
+	defer cl.Stop()
+	fc.waitForWaiter(t)
+	lock.Lock()
+	dialErr = nil
+	lock.Unlock()
+	// the controller connected on its own, so the link does not wait for the backoff
+	cl.ReDial()
+	for i := 0; i < 200 && cl.State() != CLS_CONNECTED; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cl.State() != CLS_CONNECTED {
+		t.Errorf("State() after ReDial = %s, want %s", cl.State(), CLS_CONNECTED)
+	}
+}
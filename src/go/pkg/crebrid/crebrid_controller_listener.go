@@ -0,0 +1,229 @@
+package crebrid
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// ErrWrongAccessCode is the reason a connection of the controller is rejected
+var ErrWrongAccessCode = errors.New("wrong access code")
+
+// ControllerListener waits for the controller to connect instead of dialing it, e.g. if a
+// firewall only allows connections from the controller. the controller authenticates itself by
+// a hello with the access code as its first line, either as v2 frame of type WT_HELLO or as the
+// plain access code. a controller which reconnects replaces its former connection
+type ControllerListener interface {
+	// Start to listen on the port
+	Start() error
+	// Stop listening and close the connections which are not accepted yet
+	Stop()
+	// Accept the next connection of the controller, it waits up to timeout for the controller
+	// to connect
+	Accept(timeout time.Duration) (net.Conn, error)
+	// Addr the listener listens on
+	Addr() string
+}
+
+type controllerListener struct {
+	port       int
+	policy     ClientPolicy
+	accessCode string
+	onConnect  func()
+	// lock guards the fields below
+	lock sync.Mutex
+	ln   net.Listener
+	// hellos are the connections which did not authenticate yet
+	hellos map[net.Conn]bool
+	// waiting is the connection of the controller which is not accepted yet
+	waiting net.Conn
+	ready   chan bool
+	wg      sync.WaitGroup
+}
+
+// NewControllerListener on port. the hello has to arrive within the connect timeout of the
+// policy. onConnect is called as soon as the controller authenticated itself, before its
+// connection is accepted, so the former connection can be dropped
+func NewControllerListener(port int, policy ClientPolicy, accessCode string, onConnect func()) ControllerListener {
+	cl := new(controllerListener)
+	cl.port = port
+	cl.policy = policy
+	cl.accessCode = accessCode
+	cl.onConnect = onConnect
+	cl.hellos = make(map[net.Conn]bool)
+	cl.ready = make(chan bool, 1)
+	return cl
+}
+
+func (cl *controllerListener) Start() error {
+	lc := net.ListenConfig{KeepAlive: cl.policy.KeepAlive}
+	if cl.policy.KeepAlive <= 0 {
+		// a zero keep-alive of the listener enables the default period
+		lc.KeepAlive = -1
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", cl.port))
+	if err != nil {
+		return err
+	}
+	cl.lock.Lock()
+	cl.ln = ln
+	cl.lock.Unlock()
+	logging.LogFmt(logging.LOG_INFO, "[controller listener] wait for the controller on: %s", ln.Addr())
+	cl.wg.Add(1)
+	go cl.serve(ln)
+	return nil
+}
+
+func (cl *controllerListener) Stop() {
+	cl.lock.Lock()
+	if cl.ln != nil {
+		cl.ln.Close()
+		cl.ln = nil
+	}
+	for conn := range cl.hellos {
+		conn.Close()
+	}
+	if cl.waiting != nil {
+		cl.waiting.Close()
+		cl.waiting = nil
+	}
+	cl.lock.Unlock()
+	cl.wg.Wait()
+}
+
+func (cl *controllerListener) Addr() string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.ln != nil {
+		return cl.ln.Addr().String()
+	}
+	return fmt.Sprintf(":%d", cl.port)
+}
+
+func (cl *controllerListener) Accept(timeout time.Duration) (net.Conn, error) {
+	deadline := time.After(timeout)
+	for {
+		cl.lock.Lock()
+		conn := cl.waiting
+		cl.waiting = nil
+		cl.lock.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-cl.ready:
+		case <-deadline:
+			return nil, fmt.Errorf("%w: controller did not connect to [%s] within %s", ErrControllerUnavailable, cl.Addr(), timeout)
+		}
+	}
+}
+
+// serve the connections until the listener is closed
+func (cl *controllerListener) serve(ln net.Listener) {
+	defer cl.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[controller listener] stop listening: %s", err)
+			return
+		}
+		cl.lock.Lock()
+		if cl.ln != ln {
+			// stopped while the connection was accepted
+			cl.lock.Unlock()
+			conn.Close()
+			return
+		}
+		cl.hellos[conn] = true
+		cl.lock.Unlock()
+		cl.wg.Add(1)
+		go cl.authenticate(conn)
+	}
+}
+
+// authenticate the controller by its hello, a connection without a valid hello is closed
+func (cl *controllerListener) authenticate(conn net.Conn) {
+	defer cl.wg.Done()
+	if cl.policy.Connect.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cl.policy.Connect.Timeout))
+	}
+	accessCode, err := readHello(conn)
+	if err == nil && subtle.ConstantTimeCompare([]byte(accessCode), []byte(cl.accessCode)) != 1 {
+		err = ErrWrongAccessCode
+	}
+	cl.lock.Lock()
+	delete(cl.hellos, conn)
+	cl.lock.Unlock()
+	if err != nil {
+		logging.LogFmt(logging.LOG_WARN, "[controller listener] reject connection of [%s]: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	logging.LogFmt(logging.LOG_INFO, "[controller listener] controller connected from [%s]", conn.RemoteAddr())
+	if cl.onConnect != nil {
+		cl.onConnect()
+	}
+	cl.offer(conn)
+}
+
+// offer the connection to Accept. a connection which is not accepted yet is closed, because
+// the controller gave it up
+func (cl *controllerListener) offer(conn net.Conn) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.ln == nil {
+		conn.Close()
+		return
+	}
+	if cl.waiting != nil {
+		cl.waiting.Close()
+	}
+	cl.waiting = conn
+	select {
+	case cl.ready <- true:
+	default:
+	}
+}
+
+// readHello of the controller, which is its first line that is not empty. it is read byte by
+// byte, so nothing behind it is taken from the connection
+func readHello(reader io.Reader) (string, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return "", err
+		}
+		if b[0] != '\n' {
+			line = append(line, b[0])
+			if len(line) > wire_frame_max {
+				return "", fmt.Errorf("hello exceeds %d bytes", wire_frame_max)
+			}
+			continue
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte(WIRE_V2_PREFIX)) {
+		return string(line), nil
+	}
+	wf, err := ParseWireFrame(line)
+	if err != nil {
+		return "", err
+	}
+	if wf.Type != WT_HELLO {
+		return "", fmt.Errorf("frame of type [%c] instead of hello", wf.Type)
+	}
+	return wf.Payload, nil
+}
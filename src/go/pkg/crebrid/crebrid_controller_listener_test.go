@@ -0,0 +1,162 @@
+package crebrid
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadHello(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "plain access code",
+			data: "3H34GJ67NH\r\n",
+			want: "3H34GJ67NH",
+		},
+		{
+			name: "v2 hello behind empty lines",
+			data: "\r\n\r\n" + string(WireFrame{Type: WT_HELLO, Payload: "3H34GJ67NH"}.Encode()),
+			want: "3H34GJ67NH",
+		},
+		{
+			name:    "v2 frame of another type",
+			data:    string(WireFrame{Type: WT_STATUS, Payload: "3H34GJ67NH"}.Encode()),
+			wantErr: "instead of hello",
+		},
+		{
+			name:    "corrupted v2 hello",
+			data:    strings.Replace(string(WireFrame{Type: WT_HELLO, Payload: "3H34GJ67NH"}.Encode()), "3H", "4H", 1),
+			wantErr: "CRC",
+		},
+		{
+			name:    "no line",
+			data:    "3H34GJ67NH",
+			wantErr: "EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readHello(strings.NewReader(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readHello() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("readHello() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// connectController dials the listener like the controller and sends the hello
+func connectController(t *testing.T, listener ControllerListener, hello string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", listener.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte(hello)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestControllerListener(t *testing.T) {
+	var lock sync.Mutex
+	connects := 0
+	policy := DefaultClientPolicy()
+	policy.Connect.Timeout = time.Second
+	listener := NewControllerListener(0, policy, "1234", func() {
+		lock.Lock()
+		defer lock.Unlock()
+		connects++
+	})
+	getConnects := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return connects
+	}
+	if err := listener.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Stop()
+	if _, err := listener.Accept(50 * time.Millisecond); !errors.Is(err, ErrControllerUnavailable) {
+		t.Errorf("Accept() without controller error = %v, want %v", err, ErrControllerUnavailable)
+	}
+	// a wrong access code is rejected by closing the connection
+	rejected := connectController(t, listener, "4321\r\n")
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() of a rejected connection error = %v, want %v", err, io.EOF)
+	}
+	// the controller reconnects before the first connection is accepted, so only the second
+	// one is accepted. the status behind the hello is left on the connection
+	first := connectController(t, listener, string(WireFrame{Type: WT_HELLO, Payload: "1234"}.Encode()))
+	defer first.Close()
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 200 && getConnects() < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	second := connectController(t, listener, "1234\r\n{\"d\":[1],\"a\":[]}\r\n")
+	defer second.Close()
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() of a replaced connection error = %v, want %v", err, io.EOF)
+	}
+	conn, err := listener.Accept(time.Second)
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if want := "{\"d\":[1],\"a\":[]}\r\n"; err != nil || line != want {
+		t.Errorf("ReadString() of the accepted connection = %q, %v, want %q", line, err, want)
+	}
+	if got := getConnects(); got != 2 {
+		t.Errorf("connects = %d, want 2", got)
+	}
+}
+
+func TestReverseControllerClient(t *testing.T) {
+	fcr := &fakeCrestronV2{accessCode: "1234", d: []int{0, 0}, a: []float64{0}, serials: make(map[int]string)}
+	policy := DefaultClientPolicy()
+	policy.Protocol = WP_V2
+	policy.Connect.Timeout = time.Second
+	policy.Layout = StatusLayout{Digitals: 2, Analogs: 1}
+	listener := NewControllerListener(0, policy, "1234", nil)
+	if err := listener.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Stop()
+	go fcr.serve(connectController(t, listener, string(WireFrame{Type: WT_HELLO, Payload: "1234"}.Encode())))
+	client, err := NewReverseControllerClient(listener, policy)
+	if err != nil {
+		t.Fatalf("NewReverseControllerClient() error = %v", err)
+	}
+	defer client.Close()
+	client.SetAccessCode("1234")
+	if isOn, err := client.ToggleSwitch(2); err != nil || !isOn {
+		t.Fatalf("ToggleSwitch() = %v, %v", isOn, err)
+	}
+	// the controller reconnects, so ReDial accepts its new connection
+	go fcr.serve(connectController(t, listener, "1234\r\n"))
+	if err := client.ReDial(); err != nil {
+		t.Fatalf("ReDial() error = %v", err)
+	}
+	if isOn, err := client.SetDigital(1, true); err != nil || !isOn {
+		t.Fatalf("SetDigital() after reconnect = %v, %v", isOn, err)
+	}
+}
@@ -0,0 +1,133 @@
+package crebrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// ErrUnknownController is returned for a controller which is not part of the settings
+var ErrUnknownController = errors.New("unknown controller")
+
+// controller managed by the service. every controller has its own supervised link and state
+// store, the command queue is shared by all of them
+type controller struct {
+	setts ControllerSettings
+	ccc   CrestronControllerClient
+	link  ControllerLink
+	// listener waits for the controller to connect, nil if the controller is dialed
+	listener ControllerListener
+	store    StateStore
+	reads    statusFlight
+	// lastStatus is only used by the commands of the command queue
+	lastStatus *SystemStatus
+	// pushQueued is set while a publish of a pushed status waits in the command queue
+	pushQueued int32
+}
+
+// newController with its client and an empty state store
+func newController(setts ControllerSettings, ccc CrestronControllerClient) *controller {
+	ctrl := new(controller)
+	ctrl.setts = setts
+	ctrl.ccc = ccc
+	ctrl.store = NewStateStore()
+	return ctrl
+}
+
+// isDefault is true for the controller of the root section of the settings
+func (ctrl *controller) isDefault() bool {
+	return ctrl.setts.Name == DEFAULT_CONTROLLER
+}
+
+// address of the controller in commands and events. the default controller has none, so
+// "d3=on" is d3 of the default controller and "annex:d3=on" is d3 of the annex
+func (ctrl *controller) address() string {
+	if ctrl.isDefault() {
+		return ""
+	}
+	return ctrl.setts.Name
+}
+
+// prefix of the ports of the controller, e.g. "annex:"
+func (ctrl *controller) prefix() string {
+	if ctrl.isDefault() {
+		return ""
+	}
+	return ctrl.setts.Name + ":"
+}
+
+// setupController creates the supervised link of the controller and connects it, unless the
+// controller connects to crebrid
+func (me *mainExecute) setupController(setts ControllerSettings) *controller {
+	ctrl := newController(setts, nil)
+	policy := DefaultLinkPolicy()
+	policy.HeartbeatInterval = me.setts.HeartbeatInterval
+	policy.HeartbeatMisses = me.setts.HeartbeatMisses
+	target := BackendTarget{Name: setts.Name, IP: setts.IP, Port: setts.Port, Policy: me.setts.ControllerPolicy(setts), Recorder: me.recorder}
+	if setts.ListenPort > 0 {
+		ctrl.listener = NewControllerListener(setts.ListenPort, target.Policy, setts.AccessCode, func() {
+			// the controller reconnected, so its former connection is dropped and the link
+			// accepts the new one right away
+			ctrl.link.ReDial()
+		})
+		target.Listener = ctrl.listener
+	}
+	dial := func() (CrestronControllerClient, error) {
+		return ConnectBackend(setts.Backend, target)
+	}
+	ctrl.link = NewControllerLink(me.clock, policy, dial, func(state LinkState, err error) {
+		me.linkStateChanged(ctrl, state, err)
+	})
+	ctrl.link.SetCommandQueue(me.queue)
+	// everything but the lifecycle of the link uses it like a plain controller client
+	ctrl.ccc = ctrl.link
+	ctrl.ccc.SetAccessCode(setts.AccessCode)
+	if ctrl.listener != nil {
+		// the listener is not started yet, the link accepts the controller as soon as it runs
+		logging.LogFmt(logging.LOG_MAIN, "[service] wait for controller [%s] to connect on port: %d", setts.Name, setts.ListenPort)
+	} else {
+		logging.LogFmt(logging.LOG_DEBUG, "[service] try to connect to controller [%s] by backend: %s", setts.Name, setts.Backend)
+		err := ctrl.link.Connect()
+		if err != nil {
+			// the link keeps trying in the background, so the service starts without the controller
+			logging.LogFmt(logging.LOG_ERROR, "[service] controller [%s] at [%s@%d] is not reachable: %s", setts.Name, setts.IP, setts.Port, err)
+		} else {
+			logging.LogFmt(logging.LOG_MAIN, "[service] successfully connected to controller [%s]: %s@%d", setts.Name, setts.IP, setts.Port)
+		}
+	}
+	ctrl.store.Update(ctrl.ccc.GetSystemStatus(), me.clock.Now())
+	ctrl.lastStatus = ctrl.ccc.GetSystemStatus()
+	return ctrl
+}
+
+// runListener until the context is cancelled. a port which cannot be listened on fails the
+// component, so the lifecycle restarts it
+func (ctrl *controller) runListener(ctx context.Context) error {
+	err := ctrl.listener.Start()
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	ctrl.listener.Stop()
+	return nil
+}
+
+// controller by its name, the default controller if the name is empty
+func (me *mainExecute) controller(name string) (*controller, error) {
+	if name == "" {
+		return me.defaultController(), nil
+	}
+	for _, ctrl := range me.controllers {
+		if ctrl.setts.Name == name {
+			return ctrl, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownController, name)
+}
+
+// defaultController which is used by the scenes, rules and scripts
+func (me *mainExecute) defaultController() *controller {
+	return me.controllers[0]
+}
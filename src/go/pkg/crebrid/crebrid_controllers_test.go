@@ -0,0 +1,91 @@
+package crebrid
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+func TestControllerRequests(t *testing.T) {
+	mainCcc := newFakeControllerClient([]int{0, 1}, []float64{0})
+	annexCcc := newFakeControllerClient([]int{1, 0, 0}, []float64{0})
+	me := new(mainExecute)
+	me.clock = NewSystemClock()
+	me.controllers = []*controller{
+		newController(ControllerSettings{Name: DEFAULT_CONTROLLER}, mainCcc),
+		newController(ControllerSettings{Name: "annex"}, annexCcc),
+	}
+	me.bus = NewEventBus()
+	me.queue = NewCommandQueue(NewSystemClock(), 8)
+	me.queue.Start()
+	defer me.queue.Stop()
+	request := func(cmd int, controller string, ports ...int) *ipc.ServerResponse {
+		t.Helper()
+		cc := ipc.NewClientCommand()
+		cc.Cmd = cmd
+		cc.Controller = controller
+		cc.AddDigitalPorts(ports...)
+		sr, err := me.handleRequest(cc)
+		if err != nil {
+			t.Fatalf("handleRequest() error = %v", err)
+		}
+		return sr
+	}
+	// a get without controller returns every controller
+	sr := request(ipc.IC_GET, "")
+	wantInfo := map[string]map[int]bool{
+		DEFAULT_CONTROLLER: {0: false, 1: true},
+		"annex":            {0: true, 1: false, 2: false},
+	}
+	if sr.Error != "" || !reflect.DeepEqual(sr.ControllerPortInfo, wantInfo) {
+		t.Errorf("get of every controller = %v, %q, want %v", sr.ControllerPortInfo, sr.Error, wantInfo)
+	}
+	if !reflect.DeepEqual(sr.DigitalPortInfo, wantInfo[DEFAULT_CONTROLLER]) {
+		t.Errorf("get of every controller DigitalPortInfo = %v, want %v", sr.DigitalPortInfo, wantInfo[DEFAULT_CONTROLLER])
+	}
+	annexItems := 0
+	for _, item := range sr.Items {
+		if strings.HasPrefix(item, "annex:") {
+			annexItems++
+		}
+	}
+	if len(sr.Items) != 7 || annexItems != 4 {
+		t.Errorf("get of every controller Items = %v, want 3 of main and 4 of annex", sr.Items)
+	}
+	// a get of a controller returns only its ports
+	sr = request(ipc.IC_GET, "annex")
+	if sr.Error != "" || !reflect.DeepEqual(sr.DigitalPortInfo, wantInfo["annex"]) || len(sr.ControllerPortInfo) != 1 {
+		t.Errorf("get of annex = %v, %v, %q", sr.DigitalPortInfo, sr.ControllerPortInfo, sr.Error)
+	}
+	// ports address the chosen controller only
+	sr = request(ipc.IC_SINGLE, "annex", 2)
+	if sr.Error != "" || !sr.DigitalPortInfo[2] || annexCcc.toggles[2] != 1 || len(mainCcc.toggles) != 0 {
+		t.Errorf("toggle annex:d2 = %v, %q, toggles main %v, annex %v", sr.DigitalPortInfo, sr.Error, mainCcc.toggles, annexCcc.toggles)
+	}
+	if sr = request(ipc.IC_SINGLE, "attic", 2); !strings.Contains(sr.Error, ErrUnknownController.Error()) {
+		t.Errorf("toggle of an unknown controller error = %q, want %v", sr.Error, ErrUnknownController)
+	}
+	if sr = request(ipc.IC_GET, "attic"); !strings.Contains(sr.Error, ErrUnknownController.Error()) {
+		t.Errorf("get of an unknown controller error = %q, want %v", sr.Error, ErrUnknownController)
+	}
+	if sr = request(ipc.IC_SCENE, "annex"); sr.Error == "" {
+		t.Errorf("scene request of annex succeeded, want an error")
+	}
+	// commands of the scheduler, rules and scripts address the controller by their prefix
+	cmd, err := ParseCommand("annex:d3=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := me.runCommand(cmd); err != nil || annexCcc.status.D[2] != 1 {
+		t.Errorf("runCommand(%s) = %v, annex status %v", cmd, err, annexCcc.status.D)
+	}
+	if err := me.runCommand(&Command{Kind: CK_SET_DIGITAL, Port: 1, On: true, Controller: "attic"}); !errors.Is(err, ErrUnknownController) {
+		t.Errorf("runCommand() of an unknown controller error = %v, want %v", err, ErrUnknownController)
+	}
+	if !reflect.DeepEqual(mainCcc.status.D, []int{0, 1}) {
+		t.Errorf("main status = %v, want it untouched", mainCcc.status.D)
+	}
+}
@@ -0,0 +1,218 @@
+package crebrid
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron expressions use the common five fields: minute hour day-of-month month day-of-week
+//
+//	*/15 6-22 * * mon-fri
+//
+// each field accepts '*', single values, ranges 'a-b', lists 'a,b' and steps '/n'. months and
+// week days may be given by their english three letter names. if day-of-month and day-of-week
+// are both restricted, a day matches if one of them matches (like vixie cron).
+//
+// daylight saving time: the expression describes wall clock times of the location of the
+// time passed to Next. a wall clock time which does not exist due to a forward jump is shifted
+// by the length of the jump (02:30 becomes 03:30), a wall clock time which exists twice due
+// to a backward jump runs once at its second occurrence.
+
+const (
+	cron_max_search_days = 5 * 366
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+type cronFieldDef struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFieldDefs = []cronFieldDef{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: cronMonthNames},
+	{name: "day of week", min: 0, max: 7, names: cronDayNames},
+}
+
+// CronSchedule is a parsed cron expression
+type CronSchedule struct {
+	expr    string
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+// ParseCron parses a five field cron expression or one of the macros like @daily
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	fieldStr := expr
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		fieldStr = macro
+	}
+	fields := strings.Fields(fieldStr)
+	if len(fields) != len(cronFieldDefs) {
+		return nil, fmt.Errorf("cron expression [%s] needs %d fields but has %d", expr, len(cronFieldDefs), len(fields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		b, err := parseCronField(field, cronFieldDefs[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression [%s]: %v", expr, err)
+		}
+		bits[i] = b
+	}
+	cs := new(CronSchedule)
+	cs.expr = expr
+	cs.minute = bits[0]
+	cs.hour = bits[1]
+	cs.dom = bits[2]
+	cs.month = bits[3]
+	// sunday may be written as 0 or 7
+	cs.dow = bits[4]
+	if cs.dow&(1<<7) != 0 {
+		cs.dow = (cs.dow | 1) &^ (1 << 7)
+	}
+	cs.domStar = strings.HasPrefix(fields[2], "*")
+	cs.dowStar = strings.HasPrefix(fields[4], "*")
+	return cs, nil
+}
+
+func parseCronValue(str string, def cronFieldDef) (int, error) {
+	if v, ok := def.names[strings.ToLower(str)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value: %s", def.name, str)
+	}
+	if v < def.min || v > def.max {
+		return 0, fmt.Errorf("%s value %d out of range [%d-%d]", def.name, v, def.min, def.max)
+	}
+	return v, nil
+}
+
+func parseCronField(field string, def cronFieldDef) (uint64, error) {
+	var ret uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		rangeStr := part
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid %s step: %s", def.name, part)
+			}
+			step = s
+			rangeStr = part[:idx]
+		}
+		lo, hi := def.min, def.max
+		switch {
+		case rangeStr == "*":
+		case strings.Contains(rangeStr, "-"):
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			var err error
+			lo, err = parseCronValue(bounds[0], def)
+			if err != nil {
+				return 0, err
+			}
+			hi, err = parseCronValue(bounds[1], def)
+			if err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid %s range: %s", def.name, rangeStr)
+			}
+		default:
+			v, err := parseCronValue(rangeStr, def)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step > 1 {
+				hi = def.max
+			} else {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			ret |= 1 << uint(v)
+		}
+	}
+	return ret, nil
+}
+
+func (cs *CronSchedule) matchDay(t time.Time) bool {
+	if cs.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := cs.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after the given time the expression matches. false is
+// returned if the expression never matches, e.g. for the 30th of february
+func (cs *CronSchedule) Next(after time.Time) (time.Time, bool) {
+	loc := after.Location()
+	for i := 0; i < cron_max_search_days; i++ {
+		day := time.Date(after.Year(), after.Month(), after.Day()+i, 12, 0, 0, 0, loc)
+		if !cs.matchDay(day) {
+			continue
+		}
+		var best time.Time
+		for h := 0; h < 24; h++ {
+			if cs.hour&(1<<uint(h)) == 0 {
+				continue
+			}
+			for m := 0; m < 60; m++ {
+				if cs.minute&(1<<uint(m)) == 0 {
+					continue
+				}
+				// non existing wall clock times are normalized behind the gap by time.Date,
+				// so the candidates of a day are not necessarily in ascending order
+				t := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, loc)
+				if t.After(after) && (best.IsZero() || t.Before(best)) {
+					best = t
+				}
+			}
+		}
+		if !best.IsZero() {
+			return best, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (cs *CronSchedule) String() string {
+	return cs.expr
+}
@@ -0,0 +1,134 @@
+package crebrid
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "every minute", expr: "* * * * *", wantErr: false},
+		{name: "lists ranges and steps", expr: "0,30 6-22/2 1-15 */3 1-5", wantErr: false},
+		{name: "names", expr: "0 7 * jan-mar mon,wed,fri", wantErr: false},
+		{name: "macro", expr: "@daily", wantErr: false},
+		{name: "sunday as 7", expr: "0 9 * * 7", wantErr: false},
+		{name: "too few fields", expr: "0 7 * *", wantErr: true},
+		{name: "minute out of range", expr: "60 7 * * *", wantErr: true},
+		{name: "invalid range", expr: "0 22-6 * * *", wantErr: true},
+		{name: "invalid step", expr: "*/0 * * * *", wantErr: true},
+		{name: "unknown name", expr: "0 7 * * mo", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCron(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCron() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+	tests := []struct {
+		name   string
+		expr   string
+		after  time.Time
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			name:   "next minute",
+			expr:   "* * * * *",
+			after:  time.Date(2026, 10, 19, 20, 15, 30, 0, berlin),
+			want:   time.Date(2026, 10, 19, 20, 16, 0, 0, berlin),
+			wantOk: true,
+		},
+		{
+			name:   "working days skip the weekend",
+			expr:   "0 7 * * mon-fri",
+			after:  time.Date(2026, 10, 23, 7, 0, 0, 0, berlin),
+			want:   time.Date(2026, 10, 26, 7, 0, 0, 0, berlin),
+			wantOk: true,
+		},
+		{
+			name:   "day of month or day of week",
+			expr:   "0 12 1 * sun",
+			after:  time.Date(2026, 10, 19, 0, 0, 0, 0, berlin),
+			want:   time.Date(2026, 10, 25, 12, 0, 0, 0, berlin),
+			wantOk: true,
+		},
+		{
+			name:   "sunday as 7",
+			expr:   "0 9 * * 7",
+			after:  time.Date(2026, 10, 19, 0, 0, 0, 0, berlin),
+			want:   time.Date(2026, 10, 25, 9, 0, 0, 0, berlin),
+			wantOk: true,
+		},
+		{
+			name:   "leap day",
+			expr:   "0 0 29 feb *",
+			after:  time.Date(2026, 10, 19, 0, 0, 0, 0, berlin),
+			want:   time.Date(2028, 2, 29, 0, 0, 0, 0, berlin),
+			wantOk: true,
+		},
+		{
+			name:   "never",
+			expr:   "0 0 30 feb *",
+			after:  time.Date(2026, 10, 19, 0, 0, 0, 0, berlin),
+			want:   time.Time{},
+			wantOk: false,
+		},
+		{
+			name:   "dst forward jump shifts a missing time",
+			expr:   "30 2 * * *",
+			after:  time.Date(2026, 3, 29, 1, 0, 0, 0, berlin),
+			want:   time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "dst backward jump runs at the second occurrence",
+			expr:   "30 2 * * *",
+			after:  time.Date(2026, 10, 24, 23, 0, 0, 0, time.UTC),
+			want:   time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "dst backward jump runs a repeated time once",
+			expr:   "30 2 * * *",
+			after:  time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+			want:   time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC),
+			wantOk: true,
+		},
+		{
+			name:   "daily job keeps its wall clock time over dst",
+			expr:   "0 7 * * *",
+			after:  time.Date(2026, 10, 24, 7, 0, 0, 0, berlin),
+			want:   time.Date(2026, 10, 25, 6, 0, 0, 0, time.UTC),
+			wantOk: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron() error = %v", err)
+			}
+			got, ok := cs.Next(tt.after.In(berlin))
+			if ok != tt.wantOk {
+				t.Fatalf("CronSchedule.Next() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("CronSchedule.Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
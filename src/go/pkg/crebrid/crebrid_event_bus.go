@@ -0,0 +1,146 @@
+package crebrid
+
+import (
+	"sync"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// SlowConsumerPolicy decides which event is lost if the queue of a subscriber is full.
+// publishing never blocks, so a slow subscriber cannot stall the controller access
+type SlowConsumerPolicy int
+
+const (
+	// SCP_DROP_NEWEST keeps the queued events and drops the new one, e.g. for consumers which
+	// need the events in the order they happened without gaps in between
+	SCP_DROP_NEWEST SlowConsumerPolicy = iota
+	// SCP_DROP_OLDEST drops the oldest queued event in favour of the new one, e.g. for
+	// consumers which are only interested in the latest state
+	SCP_DROP_OLDEST
+)
+
+// Subscription receives the events of the bus
+type Subscription interface {
+	// Events of the subscription. the channel is closed by Close
+	Events() <-chan Event
+	// Dropped is the number of events which were lost due to a full queue
+	Dropped() uint64
+	// Close the subscription
+	Close()
+}
+
+// EventBus passes the events of crebrid to all subscribers
+type EventBus interface {
+	// Publish the events to all subscribers. it does not block
+	Publish(events ...Event)
+	// Subscribe to the events of the given kinds, all events if no kind is given. the name is
+	// used by the log messages
+	Subscribe(name string, queueSize int, policy SlowConsumerPolicy, kinds ...EventKind) Subscription
+}
+
+type eventBus struct {
+	lock sync.RWMutex
+	subs map[*subscription]bool
+}
+
+type subscription struct {
+	bus    *eventBus
+	name   string
+	policy SlowConsumerPolicy
+	kinds  map[EventKind]bool
+	events chan Event
+	// lock serializes the publishers, so dropping the oldest event cannot interleave
+	lock     sync.Mutex
+	dropped  uint64
+	dropping bool
+	closed   bool
+}
+
+// NewEventBus without subscribers
+func NewEventBus() EventBus {
+	eb := new(eventBus)
+	eb.subs = make(map[*subscription]bool)
+	return eb
+}
+
+func (eb *eventBus) Subscribe(name string, queueSize int, policy SlowConsumerPolicy, kinds ...EventKind) Subscription {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	sub := &subscription{bus: eb, name: name, policy: policy, events: make(chan Event, queueSize)}
+	if len(kinds) > 0 {
+		sub.kinds = make(map[EventKind]bool)
+		for _, ek := range kinds {
+			sub.kinds[ek] = true
+		}
+	}
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	eb.subs[sub] = true
+	logging.LogFmt(logging.LOG_DEBUG, "[EVENTS] new subscriber: %s", name)
+	return sub
+}
+
+func (eb *eventBus) Publish(events ...Event) {
+	eb.lock.RLock()
+	defer eb.lock.RUnlock()
+	for _, ev := range events {
+		logging.LogFmt(logging.LOG_DEBUG, "[EVENTS] publish: %s", ev)
+		for sub := range eb.subs {
+			if sub.kinds != nil && !sub.kinds[ev.Kind] {
+				continue
+			}
+			sub.deliver(ev)
+		}
+	}
+}
+
+// deliver the event without blocking. the caller has to hold the read lock of the bus
+func (sub *subscription) deliver(ev Event) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	select {
+	case sub.events <- ev:
+		sub.dropping = false
+		return
+	default:
+	}
+	if sub.policy == SCP_DROP_OLDEST {
+		select {
+		case <-sub.events:
+		default:
+		}
+		select {
+		case sub.events <- ev:
+		default:
+		}
+	}
+	sub.dropped++
+	// a slow subscriber drops many events in a row, so only the first one is logged
+	if !sub.dropping {
+		logging.LogFmt(logging.LOG_WARN, "[EVENTS] queue of subscriber [%s] is full --> drop event", sub.name)
+	}
+	sub.dropping = true
+}
+
+func (sub *subscription) Events() <-chan Event {
+	return sub.events
+}
+
+func (sub *subscription) Dropped() uint64 {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.dropped
+}
+
+func (sub *subscription) Close() {
+	// the write lock waits for running publishers, so no event is sent to the closed channel
+	sub.bus.lock.Lock()
+	defer sub.bus.lock.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(sub.bus.subs, sub)
+	close(sub.events)
+}
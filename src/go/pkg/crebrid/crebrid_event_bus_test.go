@@ -0,0 +1,129 @@
+package crebrid
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSystemStatus(t *testing.T) {
+	at := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		prev *SystemStatus
+		cur  *SystemStatus
+		want []string
+	}{
+		{
+			name: "no previous state",
+			cur:  &SystemStatus{D: []int{1}},
+			want: []string{},
+		},
+		{
+			name: "digital and analog changes",
+			prev: &SystemStatus{D: []int{1, 0, 0}, A: []float64{100, 200}},
+			cur:  &SystemStatus{D: []int{1, 1, 0}, A: []float64{100, 31000}},
+			want: []string{"2026-10-19 20:00:00 digital d2=on", "2026-10-19 20:00:00 analog a2=31000"},
+		},
+		{
+			name: "new port",
+			prev: &SystemStatus{D: []int{0}},
+			cur:  &SystemStatus{D: []int{0, 0}},
+			want: []string{"2026-10-19 20:00:00 digital d2=off"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, ev := range DiffSystemStatus(tt.prev, tt.cur, at) {
+				got = append(got, ev.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffSystemStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// receive the queued events of the subscription without waiting
+func queuedEvents(sub Subscription) []string {
+	ret := make([]string, 0)
+	for {
+		select {
+		case ev := <-sub.Events():
+			ret = append(ret, ev.Detail)
+		default:
+			return ret
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe("all", 10, SCP_DROP_NEWEST)
+	commands := bus.Subscribe("commands", 10, SCP_DROP_NEWEST, EK_COMMAND_EXECUTED)
+	bus.Publish(
+		Event{Kind: EK_DIGITAL_CHANGED, Port: 3, On: true, Detail: "d3=on"},
+		Event{Kind: EK_COMMAND_EXECUTED, Detail: "d4=toggle"},
+	)
+	if got := queuedEvents(all); !reflect.DeepEqual(got, []string{"d3=on", "d4=toggle"}) {
+		t.Errorf("events of all = %v", got)
+	}
+	if got := queuedEvents(commands); !reflect.DeepEqual(got, []string{"d4=toggle"}) {
+		t.Errorf("events of commands = %v", got)
+	}
+	commands.Close()
+	commands.Close()
+	if _, ok := <-commands.Events(); ok {
+		t.Errorf("channel of a closed subscription is open")
+	}
+	bus.Publish(Event{Kind: EK_COMMAND_EXECUTED, Detail: "d5=toggle"})
+	if got := queuedEvents(all); !reflect.DeepEqual(got, []string{"d5=toggle"}) {
+		t.Errorf("events of all = %v", got)
+	}
+}
+
+func TestEventBusSlowConsumer(t *testing.T) {
+	tests := []struct {
+		policy SlowConsumerPolicy
+		want   []string
+	}{
+		{policy: SCP_DROP_NEWEST, want: []string{"d1=on", "d2=on"}},
+		{policy: SCP_DROP_OLDEST, want: []string{"d3=on", "d4=on"}},
+	}
+	for _, tt := range tests {
+		bus := NewEventBus()
+		sub := bus.Subscribe("slow", 2, tt.policy)
+		for port := 1; port <= 4; port++ {
+			cmd := &Command{Kind: CK_SET_DIGITAL, Port: port, On: true}
+			bus.Publish(Event{Kind: EK_DIGITAL_CHANGED, Port: port, On: true, Detail: cmd.String()})
+		}
+		if got := queuedEvents(sub); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("policy [%d] events = %v, want %v", tt.policy, got, tt.want)
+		}
+		if sub.Dropped() != 2 {
+			t.Errorf("policy [%d] dropped = %d, want 2", tt.policy, sub.Dropped())
+		}
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	bus := NewEventBus()
+	eh := NewEventHistory(bus, 2)
+	eh.Start()
+	at := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	bus.Publish(
+		Event{Kind: EK_CONNECTED, At: at, Detail: "192.168.178.32@43123"},
+		Event{Kind: EK_COMMAND_EXECUTED, At: at, Detail: "d3=on", Err: "timeout"},
+		Event{Kind: EK_DISCONNECTED, At: at, Detail: "192.168.178.32@43123", Err: "EOF"},
+	)
+	// stop waits until the history consumed the queued events
+	eh.Stop()
+	want := []string{
+		"2026-10-19 20:00:00 command d3=on: timeout",
+		"2026-10-19 20:00:00 disconnected 192.168.178.32@43123: EOF",
+	}
+	if got := eh.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Events() = %v, want %v", got, want)
+	}
+}
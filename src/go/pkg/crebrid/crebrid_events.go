@@ -0,0 +1,152 @@
+package crebrid
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type EventKind int
+
+const (
+	EK_DIGITAL_CHANGED EventKind = iota
+	EK_ANALOG_CHANGED
+	EK_CONNECTED
+	EK_DISCONNECTED
+	EK_COMMAND_EXECUTED
+	// EK_STATUS is published with every new system status of a controller, the first one as
+	// well. consumers which evaluate the whole status, like the rules, get it by Status
+	EK_STATUS
+)
+
+var eventKindStr = map[EventKind]string{
+	EK_DIGITAL_CHANGED:  "digital",
+	EK_ANALOG_CHANGED:   "analog",
+	EK_CONNECTED:        "connected",
+	EK_DISCONNECTED:     "disconnected",
+	EK_COMMAND_EXECUTED: "command",
+	EK_STATUS:           "status",
+}
+
+func (ek EventKind) String() string {
+	return eventKindStr[ek]
+}
+
+const (
+	// number of events kept by the event history
+	event_history_size = 200
+)
+
+// Event is published on the event bus whenever something happens in crebrid
+type Event struct {
+	Kind EventKind
+	At   time.Time
+	// Port of a changed digital or analog port
+	Port int
+	// On is the new state of a digital port
+	On bool
+	// Value is the new value of an analog port
+	Value float64
+	// Controller the event belongs to, empty for the default controller
+	Controller string
+	// Detail describes the event like a command, e.g. d12=on or annex:d12=on, or the address
+	// of the controller
+	Detail string
+	// Err of a failed command or the reason of a lost connection
+	Err string
+	// Status of an EK_STATUS event
+	Status *SystemStatus
+}
+
+func (ev Event) String() string {
+	str := fmt.Sprintf("%s %s %s", ev.At.Format(rule_trace_layout), ev.Kind, ev.Detail)
+	if ev.Err != "" {
+		str += ": " + ev.Err
+	}
+	return str
+}
+
+// DiffSystemStatus creates an event for every port which differs between two states. a port
+// which is new in the current state is changed as well, there are no events without a
+// previous state
+func DiffSystemStatus(prev *SystemStatus, cur *SystemStatus, at time.Time) []Event {
+	ret := make([]Event, 0)
+	if prev == nil || cur == nil {
+		return ret
+	}
+	for i, v := range cur.D {
+		if i < len(prev.D) && (prev.D[i] > 0) == (v > 0) {
+			continue
+		}
+		cmd := &Command{Kind: CK_SET_DIGITAL, Port: i + 1, On: v > 0}
+		ret = append(ret, Event{Kind: EK_DIGITAL_CHANGED, At: at, Port: cmd.Port, On: cmd.On, Detail: cmd.String()})
+	}
+	for i, v := range cur.A {
+		if i < len(prev.A) && prev.A[i] == v {
+			continue
+		}
+		cmd := &Command{Kind: CK_SET_ANALOG, Port: i + 1, Value: v}
+		ret = append(ret, Event{Kind: EK_ANALOG_CHANGED, At: at, Port: cmd.Port, Value: cmd.Value, Detail: cmd.String()})
+	}
+	return ret
+}
+
+// EventHistory keeps the latest events of the bus, so they can be shown by crebri
+type EventHistory interface {
+	// Start to consume the events of the bus
+	Start()
+	// Stop to consume events and wait until the routine is finished
+	Stop()
+	// Events which were recorded, the oldest first
+	Events() []string
+}
+
+type eventHistory struct {
+	lock   sync.Mutex
+	sub    Subscription
+	events []Event
+	size   int
+	wg     sync.WaitGroup
+}
+
+// NewEventHistory subscribes to the events of the bus and keeps the given number of events.
+// the statuses are not kept, their changes are
+func NewEventHistory(bus EventBus, size int) EventHistory {
+	eh := new(eventHistory)
+	eh.size = size
+	// the history is only interested in the latest events, so a slow history drops old ones
+	eh.sub = bus.Subscribe("history", size, SCP_DROP_OLDEST, EK_DIGITAL_CHANGED, EK_ANALOG_CHANGED, EK_CONNECTED, EK_DISCONNECTED, EK_COMMAND_EXECUTED)
+	return eh
+}
+
+func (eh *eventHistory) execute() {
+	defer eh.wg.Done()
+	for ev := range eh.sub.Events() {
+		eh.lock.Lock()
+		eh.events = append(eh.events, ev)
+		if len(eh.events) > eh.size {
+			eh.events = eh.events[len(eh.events)-eh.size:]
+		}
+		eh.lock.Unlock()
+	}
+}
+
+func (eh *eventHistory) Start() {
+	eh.wg.Add(1)
+	go eh.execute()
+}
+
+func (eh *eventHistory) Stop() {
+	eh.sub.Close()
+	eh.wg.Wait()
+}
+
+func (eh *eventHistory) Events() []string {
+	eh.lock.Lock()
+	defer eh.lock.Unlock()
+	ret := make([]string, len(eh.events))
+	for i, ev := range eh.events {
+		ret[i] = ev.String()
+	}
+	return ret
+}
@@ -0,0 +1,656 @@
+package crebrid
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// a subset of RFC 5545 is supported, which covers the files exported by the common calendar
+// applications: VEVENT with DTSTART, DTEND or DURATION, SUMMARY, STATUS, EXDATE,
+// RECURRENCE-ID and RRULE with FREQ DAILY, WEEKLY, MONTHLY and YEARLY, INTERVAL, COUNT,
+// UNTIL, BYDAY, BYMONTHDAY, BYMONTH, BYSETPOS and WKST. time zones are resolved by their
+// TZID as IANA name, unknown time zones and floating times use the default location.
+
+const (
+	ical_date_layout      = "20060102"
+	ical_date_time_layout = "20060102T150405"
+	// the expansion of a recurrence stops after this number of periods
+	ical_max_periods = 100000
+)
+
+type icalFreq int
+
+const (
+	icf_daily icalFreq = iota
+	icf_weekly
+	icf_monthly
+	icf_yearly
+)
+
+var icalFreqStr = map[string]icalFreq{
+	"DAILY":   icf_daily,
+	"WEEKLY":  icf_weekly,
+	"MONTHLY": icf_monthly,
+	"YEARLY":  icf_yearly,
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// icalByDay is a BYDAY entry like MO, 2TU or -1FR. nth is zero for every week day of the period
+type icalByDay struct {
+	nth     int
+	weekday time.Weekday
+}
+
+type icalRRule struct {
+	freq       icalFreq
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []icalByDay
+	byMonthDay []int
+	byMonth    []int
+	bySetPos   []int
+	wkst       time.Weekday
+}
+
+// ICalEvent is a single VEVENT of a calendar
+type ICalEvent struct {
+	UID          string
+	Summary      string
+	Start        time.Time
+	Duration     time.Duration
+	AllDay       bool
+	Cancelled    bool
+	RecurrenceID time.Time
+	rrule        *icalRRule
+	exDates      []time.Time
+}
+
+// ICalOccurrence is a single occurrence of a, possibly recurring, event
+type ICalOccurrence struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	End     time.Time
+}
+
+// ICalendar holds all events of a calendar file
+type ICalendar struct {
+	Events []*ICalEvent
+}
+
+type icalProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// unfoldICalLines joins continuation lines, which start with a space or a tab
+func unfoldICalLines(data []byte) []string {
+	ret := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(ret) > 0 {
+			ret[len(ret)-1] += line[1:]
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+func parseICalProperty(line string) (*icalProperty, error) {
+	inQuotes := false
+	valueIdx := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ':' && !inQuotes {
+			valueIdx = i
+			break
+		}
+	}
+	if valueIdx < 0 {
+		return nil, fmt.Errorf("invalid content line: %s", line)
+	}
+	prop := new(icalProperty)
+	prop.params = make(map[string]string)
+	prop.value = line[valueIdx+1:]
+	parts := strings.Split(line[:valueIdx], ";")
+	prop.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		prop.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+	}
+	return prop, nil
+}
+
+func unescapeICalText(str string) string {
+	replacer := strings.NewReplacer("\\\\", "\\", "\\;", ";", "\\,", ",", "\\n", "\n", "\\N", "\n")
+	return replacer.Replace(str)
+}
+
+// parseICalTime parses a DATE or DATE-TIME value. the second return value is true for a DATE
+func parseICalTime(value string, params map[string]string, defaultLoc *time.Location) (time.Time, bool, error) {
+	loc := defaultLoc
+	if tzid, ok := params["TZID"]; ok {
+		if tzLoc, err := time.LoadLocation(tzid); err == nil {
+			loc = tzLoc
+		}
+	}
+	if params["VALUE"] == "DATE" || len(value) == len(ical_date_layout) {
+		t, err := time.ParseInLocation(ical_date_layout, value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.ParseInLocation(ical_date_time_layout, strings.TrimSuffix(value, "Z"), time.UTC)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation(ical_date_time_layout, value, loc)
+	return t, false, err
+}
+
+// parseICalDuration parses durations like P1D, PT1H30M or -P1W
+func parseICalDuration(value string) (time.Duration, error) {
+	str := value
+	sign := time.Duration(1)
+	if strings.HasPrefix(str, "-") {
+		sign = -1
+		str = str[1:]
+	}
+	str = strings.TrimPrefix(str, "+")
+	if !strings.HasPrefix(str, "P") {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	str = str[1:]
+	var ret time.Duration
+	inTime := false
+	num := ""
+	for _, c := range str {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+		case c == 'T':
+			inTime = true
+		default:
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration: %s", value)
+			}
+			num = ""
+			switch {
+			case c == 'W' && !inTime:
+				ret += time.Duration(n) * 7 * 24 * time.Hour
+			case c == 'D' && !inTime:
+				ret += time.Duration(n) * 24 * time.Hour
+			case c == 'H' && inTime:
+				ret += time.Duration(n) * time.Hour
+			case c == 'M' && inTime:
+				ret += time.Duration(n) * time.Minute
+			case c == 'S' && inTime:
+				ret += time.Duration(n) * time.Second
+			default:
+				return 0, fmt.Errorf("invalid duration: %s", value)
+			}
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return sign * ret, nil
+}
+
+func parseICalIntList(value string, min int, max int) ([]int, error) {
+	ret := make([]int, 0)
+	for _, str := range strings.Split(value, ",") {
+		v, err := strconv.Atoi(str)
+		if err != nil || v == 0 || v < min || v > max {
+			return nil, fmt.Errorf("invalid value: %s", str)
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func parseICalRRule(value string, defaultLoc *time.Location) (*icalRRule, error) {
+	rr := new(icalRRule)
+	rr.interval = 1
+	rr.wkst = time.Monday
+	hasFreq := false
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid RRULE part: %s", part)
+		}
+		key := strings.ToUpper(kv[0])
+		val := strings.ToUpper(kv[1])
+		var err error
+		switch key {
+		case "FREQ":
+			freq, ok := icalFreqStr[val]
+			if !ok {
+				return nil, fmt.Errorf("unsupported RRULE frequency: %s", val)
+			}
+			rr.freq = freq
+			hasFreq = true
+		case "INTERVAL":
+			rr.interval, err = strconv.Atoi(val)
+			if err == nil && rr.interval < 1 {
+				err = fmt.Errorf("interval has to be positive")
+			}
+		case "COUNT":
+			rr.count, err = strconv.Atoi(val)
+		case "UNTIL":
+			rr.until, _, err = parseICalTime(val, map[string]string{}, defaultLoc)
+			if err == nil && len(val) == len(ical_date_layout) {
+				// a DATE as UNTIL includes the whole day
+				rr.until = rr.until.Add(24*time.Hour - time.Second)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				if len(day) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY: %s", val)
+				}
+				wd, ok := icalWeekdays[day[len(day)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY: %s", val)
+				}
+				bd := icalByDay{weekday: wd}
+				if len(day) > 2 {
+					bd.nth, err = strconv.Atoi(day[:len(day)-2])
+					if err != nil {
+						return nil, fmt.Errorf("invalid BYDAY: %s", val)
+					}
+				}
+				rr.byDay = append(rr.byDay, bd)
+			}
+		case "BYMONTHDAY":
+			rr.byMonthDay, err = parseICalIntList(val, -31, 31)
+		case "BYMONTH":
+			rr.byMonth, err = parseICalIntList(val, 1, 12)
+		case "BYSETPOS":
+			rr.bySetPos, err = parseICalIntList(val, -366, 366)
+		case "WKST":
+			wd, ok := icalWeekdays[val]
+			if !ok {
+				err = fmt.Errorf("invalid WKST: %s", val)
+			}
+			rr.wkst = wd
+		default:
+			return nil, fmt.Errorf("unsupported RRULE part: %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid RRULE [%s]: %v", value, err)
+		}
+	}
+	if !hasFreq {
+		return nil, fmt.Errorf("RRULE without FREQ: %s", value)
+	}
+	return rr, nil
+}
+
+// ParseICalendar parses the events of an iCalendar file. floating times and unknown time
+// zones are interpreted in the default location
+func ParseICalendar(data []byte, defaultLoc *time.Location) (*ICalendar, error) {
+	cal := new(ICalendar)
+	var ev *ICalEvent
+	var end time.Time
+	hasEnd := false
+	hasDuration := false
+	unsupported := false
+	depth := 0
+	for _, line := range unfoldICalLines(data) {
+		prop, err := parseICalProperty(line)
+		if err != nil {
+			return nil, err
+		}
+		switch prop.name {
+		case "BEGIN":
+			if strings.ToUpper(prop.value) == "VEVENT" {
+				ev = new(ICalEvent)
+				hasEnd = false
+				hasDuration = false
+				unsupported = false
+				depth = 0
+			} else if ev != nil {
+				// e.g. VALARM inside of an event
+				depth++
+			}
+			continue
+		case "END":
+			if ev == nil {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if strings.ToUpper(prop.value) != "VEVENT" {
+				continue
+			}
+			if ev.Start.IsZero() {
+				return nil, fmt.Errorf("event [%s] without DTSTART", ev.UID)
+			}
+			switch {
+			case hasEnd:
+				ev.Duration = end.Sub(ev.Start)
+			case !hasDuration && ev.AllDay:
+				ev.Duration = 24 * time.Hour
+			}
+			if unsupported {
+				logging.LogFmt(logging.LOG_WARN, "[ICAL] skip event [%s] with unsupported recurrence", ev.UID)
+			} else {
+				cal.Events = append(cal.Events, ev)
+			}
+			ev = nil
+			continue
+		}
+		if ev == nil || depth > 0 {
+			continue
+		}
+		switch prop.name {
+		case "UID":
+			ev.UID = prop.value
+		case "SUMMARY":
+			ev.Summary = unescapeICalText(prop.value)
+		case "STATUS":
+			ev.Cancelled = strings.ToUpper(prop.value) == "CANCELLED"
+		case "DTSTART":
+			ev.Start, ev.AllDay, err = parseICalTime(prop.value, prop.params, defaultLoc)
+		case "DTEND":
+			end, _, err = parseICalTime(prop.value, prop.params, defaultLoc)
+			hasEnd = true
+		case "DURATION":
+			ev.Duration, err = parseICalDuration(prop.value)
+			hasDuration = true
+		case "RRULE":
+			ev.rrule, err = parseICalRRule(prop.value, defaultLoc)
+			if err != nil {
+				// e.g. BYHOUR or FREQ=HOURLY. such an event must not break the whole calendar
+				logging.LogFmt(logging.LOG_WARN, "[ICAL] event [%s]: %v", ev.UID, err)
+				unsupported = true
+				err = nil
+			}
+		case "RECURRENCE-ID":
+			ev.RecurrenceID, _, err = parseICalTime(prop.value, prop.params, defaultLoc)
+		case "EXDATE":
+			for _, value := range strings.Split(prop.value, ",") {
+				var exDate time.Time
+				exDate, _, err = parseICalTime(value, prop.params, defaultLoc)
+				if err != nil {
+					break
+				}
+				ev.exDates = append(ev.exDates, exDate)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event [%s]: invalid %s: %v", ev.UID, prop.name, err)
+		}
+	}
+	return cal, nil
+}
+
+func daysInMonth(year int, month time.Month, loc *time.Location) int {
+	return time.Date(year, month+1, 0, 12, 0, 0, 0, loc).Day()
+}
+
+func containsInt(list []int, v int) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMonthDay checks a day against a BYMONTHDAY list, negative values count from the end
+func matchesMonthDay(list []int, day time.Time) bool {
+	dim := daysInMonth(day.Year(), day.Month(), day.Location())
+	for _, md := range list {
+		if md == day.Day() || (md < 0 && dim+md+1 == day.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandByDay returns the days between first and last (inclusive), which match the BYDAY
+// list. ordinals like 2MO or -1FR count within this range
+func expandByDay(byDay []icalByDay, first time.Time, last time.Time) []time.Time {
+	ret := make([]time.Time, 0)
+	for _, bd := range byDay {
+		matches := make([]time.Time, 0)
+		for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+			if d.Weekday() == bd.weekday {
+				matches = append(matches, d)
+			}
+		}
+		switch {
+		case bd.nth == 0:
+			ret = append(ret, matches...)
+		case bd.nth > 0 && bd.nth <= len(matches):
+			ret = append(ret, matches[bd.nth-1])
+		case bd.nth < 0 && -bd.nth <= len(matches):
+			ret = append(ret, matches[len(matches)+bd.nth])
+		}
+	}
+	return ret
+}
+
+func matchesWeekday(byDay []icalByDay, day time.Time) bool {
+	for _, bd := range byDay {
+		if bd.weekday == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// periodDays returns the candidate days (at noon) of the k-th period of the rule
+func (rr *icalRRule) periodDays(start time.Time, k int) (time.Time, []time.Time) {
+	loc := start.Location()
+	startDay := time.Date(start.Year(), start.Month(), start.Day(), 12, 0, 0, 0, loc)
+	days := make([]time.Time, 0)
+	var periodStart time.Time
+	switch rr.freq {
+	case icf_daily:
+		periodStart = startDay.AddDate(0, 0, k*rr.interval)
+		days = append(days, periodStart)
+	case icf_weekly:
+		offset := (int(startDay.Weekday()) - int(rr.wkst) + 7) % 7
+		periodStart = startDay.AddDate(0, 0, k*rr.interval*7-offset)
+		for i := 0; i < 7; i++ {
+			d := periodStart.AddDate(0, 0, i)
+			if (len(rr.byDay) == 0 && d.Weekday() == startDay.Weekday()) || matchesWeekday(rr.byDay, d) {
+				days = append(days, d)
+			}
+		}
+	case icf_monthly:
+		periodStart = time.Date(startDay.Year(), startDay.Month()+time.Month(k*rr.interval), 1, 12, 0, 0, 0, loc)
+		days = rr.monthDays(periodStart, startDay)
+	case icf_yearly:
+		year := startDay.Year() + k*rr.interval
+		periodStart = time.Date(year, 1, 1, 12, 0, 0, 0, loc)
+		switch {
+		case len(rr.byMonth) > 0 || len(rr.byMonthDay) > 0:
+			months := rr.byMonth
+			if len(months) == 0 {
+				months = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+			}
+			for _, m := range months {
+				days = append(days, rr.monthDays(time.Date(year, time.Month(m), 1, 12, 0, 0, 0, loc), startDay)...)
+			}
+		case len(rr.byDay) > 0:
+			days = expandByDay(rr.byDay, periodStart, time.Date(year, 12, 31, 12, 0, 0, 0, loc))
+		default:
+			if startDay.Day() <= daysInMonth(year, startDay.Month(), loc) {
+				days = append(days, time.Date(year, startDay.Month(), startDay.Day(), 12, 0, 0, 0, loc))
+			}
+		}
+	}
+	// limiting parts
+	filtered := make([]time.Time, 0, len(days))
+	for _, d := range days {
+		if len(rr.byMonth) > 0 && !containsInt(rr.byMonth, int(d.Month())) {
+			continue
+		}
+		if rr.freq == icf_daily {
+			if len(rr.byMonthDay) > 0 && !matchesMonthDay(rr.byMonthDay, d) {
+				continue
+			}
+			if len(rr.byDay) > 0 && !matchesWeekday(rr.byDay, d) {
+				continue
+			}
+		}
+		filtered = append(filtered, d)
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].Before(filtered[j]) })
+	if len(rr.bySetPos) > 0 {
+		selected := make([]time.Time, 0)
+		for i, d := range filtered {
+			if containsInt(rr.bySetPos, i+1) || containsInt(rr.bySetPos, i-len(filtered)) {
+				selected = append(selected, d)
+			}
+		}
+		filtered = selected
+	}
+	return periodStart, filtered
+}
+
+// monthDays expands BYMONTHDAY and BYDAY within the month of first
+func (rr *icalRRule) monthDays(first time.Time, startDay time.Time) []time.Time {
+	loc := first.Location()
+	dim := daysInMonth(first.Year(), first.Month(), loc)
+	last := time.Date(first.Year(), first.Month(), dim, 12, 0, 0, 0, loc)
+	days := make([]time.Time, 0)
+	switch {
+	case len(rr.byMonthDay) > 0:
+		for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+			if matchesMonthDay(rr.byMonthDay, d) && (len(rr.byDay) == 0 || matchesWeekday(rr.byDay, d)) {
+				days = append(days, d)
+			}
+		}
+	case len(rr.byDay) > 0:
+		days = expandByDay(rr.byDay, first, last)
+	default:
+		if startDay.Day() <= dim {
+			days = append(days, time.Date(first.Year(), first.Month(), startDay.Day(), 12, 0, 0, 0, loc))
+		}
+	}
+	return days
+}
+
+func (ev *ICalEvent) isExcluded(start time.Time) bool {
+	for _, ex := range ev.exDates {
+		if ex.Equal(start) {
+			return true
+		}
+		// an EXDATE given as DATE excludes the whole day
+		if ex.Hour() == 0 && ex.Minute() == 0 && ex.Second() == 0 {
+			y1, m1, d1 := ex.Date()
+			y2, m2, d2 := start.In(ex.Location()).Date()
+			if y1 == y2 && m1 == m2 && d1 == d2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// starts calls emit for every start time of the event before the given time in ascending order
+func (ev *ICalEvent) starts(to time.Time, emit func(start time.Time)) {
+	if !ev.Start.Before(to) {
+		return
+	}
+	emit(ev.Start)
+	if ev.rrule == nil {
+		return
+	}
+	rr := ev.rrule
+	count := 1
+	for k := 0; k < ical_max_periods; k++ {
+		periodStart, days := rr.periodDays(ev.Start, k)
+		if periodStart.After(to) {
+			return
+		}
+		for _, d := range days {
+			start := time.Date(d.Year(), d.Month(), d.Day(), ev.Start.Hour(), ev.Start.Minute(), ev.Start.Second(), 0, ev.Start.Location())
+			if !start.After(ev.Start) {
+				continue
+			}
+			if !start.Before(to) {
+				return
+			}
+			if !rr.until.IsZero() && start.After(rr.until) {
+				return
+			}
+			if rr.count > 0 && count >= rr.count {
+				return
+			}
+			count++
+			emit(start)
+		}
+	}
+}
+
+// Occurrences of all events which overlap the range [from, to), ordered by their start
+func (cal *ICalendar) Occurrences(from time.Time, to time.Time) []ICalOccurrence {
+	ret := make([]ICalOccurrence, 0)
+	overrides := make(map[string]map[int64]bool)
+	for _, ev := range cal.Events {
+		if ev.RecurrenceID.IsZero() {
+			continue
+		}
+		if overrides[ev.UID] == nil {
+			overrides[ev.UID] = make(map[int64]bool)
+		}
+		overrides[ev.UID][ev.RecurrenceID.Unix()] = true
+	}
+	for _, ev := range cal.Events {
+		if ev.Cancelled {
+			continue
+		}
+		ev.starts(to, func(start time.Time) {
+			if ev.RecurrenceID.IsZero() && overrides[ev.UID][start.Unix()] {
+				return
+			}
+			end := start.Add(ev.Duration)
+			if ev.AllDay {
+				// all day events end at midnight, even on days with 23 or 25 hours
+				days := int(ev.Duration / (24 * time.Hour))
+				end = time.Date(start.Year(), start.Month(), start.Day()+days, 0, 0, 0, 0, start.Location())
+			}
+			if end.After(from) || (ev.Duration == 0 && !start.Before(from)) {
+				if !ev.isExcluded(start) {
+					ret = append(ret, ICalOccurrence{UID: ev.UID, Summary: ev.Summary, Start: start, End: end})
+				}
+			}
+		})
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Start.Before(ret[j].Start) })
+	return ret
+}
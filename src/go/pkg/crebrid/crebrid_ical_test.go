@@ -0,0 +1,135 @@
+package crebrid
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func icalData(lines ...string) []byte {
+	return []byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" + strings.Join(lines, "\r\n") + "\r\nEND:VCALENDAR\r\n")
+}
+
+func occurrenceStarts(occs []ICalOccurrence, loc *time.Location) []string {
+	ret := make([]string, 0, len(occs))
+	for _, occ := range occs {
+		ret = append(ret, occ.Start.In(loc).Format("2006-01-02 15:04"))
+	}
+	return ret
+}
+
+func TestICalendarOccurrences(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		from time.Time
+		to   time.Time
+		want []string
+	}{
+		{
+			name: "single event in UTC",
+			data: icalData("BEGIN:VEVENT", "UID:1", "SUMMARY:Party", "DTSTART:20261024T180000Z", "DTEND:20261024T230000Z", "END:VEVENT"),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 11, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-24 20:00"},
+		},
+		{
+			name: "weekdays with count",
+			data: icalData("BEGIN:VEVENT", "UID:1", "DTSTART;TZID=Europe/Berlin:20261019T070000", "DURATION:PT1H", "RRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR;COUNT=4", "END:VEVENT"),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 12, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-19 07:00", "2026-10-21 07:00", "2026-10-23 07:00", "2026-10-26 07:00"},
+		},
+		{
+			name: "daily keeps the local time across DST",
+			data: icalData("BEGIN:VEVENT", "UID:1", "DTSTART;TZID=Europe/Berlin:20261023T070000", "RRULE:FREQ=DAILY;UNTIL=20261026T060000Z", "END:VEVENT"),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 12, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-23 07:00", "2026-10-24 07:00", "2026-10-25 07:00", "2026-10-26 07:00"},
+		},
+		{
+			name: "last friday of the month",
+			data: icalData("BEGIN:VEVENT", "UID:1", "DTSTART;TZID=Europe/Berlin:20261030T190000", "RRULE:FREQ=MONTHLY;BYDAY=-1FR", "END:VEVENT"),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2027, 1, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-30 19:00", "2026-11-27 19:00", "2026-12-25 19:00"},
+		},
+		{
+			name: "last working day of the month",
+			data: icalData("BEGIN:VEVENT", "UID:1", "DTSTART;TZID=Europe/Berlin:20261030T170000", "RRULE:FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", "END:VEVENT"),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2027, 1, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-30 17:00", "2026-11-30 17:00", "2026-12-31 17:00"},
+		},
+		{
+			name: "exdate and moved occurrence",
+			data: icalData(
+				"BEGIN:VEVENT", "UID:1", "DTSTART;TZID=Europe/Berlin:20261019T070000", "RRULE:FREQ=DAILY;COUNT=4",
+				"EXDATE;TZID=Europe/Berlin:20261020T070000", "END:VEVENT",
+				"BEGIN:VEVENT", "UID:1", "RECURRENCE-ID;TZID=Europe/Berlin:20261021T070000", "DTSTART;TZID=Europe/Berlin:20261021T090000", "END:VEVENT",
+			),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 12, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-19 07:00", "2026-10-21 09:00", "2026-10-22 07:00"},
+		},
+		{
+			name: "cancelled event and nested alarm",
+			data: icalData(
+				"BEGIN:VEVENT", "UID:1", "DTSTART:20261024T180000Z", "STATUS:CANCELLED", "END:VEVENT",
+				"BEGIN:VEVENT", "UID:2", "DTSTART:20261025T180000Z", "BEGIN:VALARM", "TRIGGER:-PT15M", "END:VALARM", "END:VEVENT",
+			),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 11, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-25 19:00"},
+		},
+		{
+			name: "all day event overlapping the range",
+			data: icalData("BEGIN:VEVENT", "UID:1", "DTSTART;VALUE=DATE:20261017", "DTEND;VALUE=DATE:20261020", "END:VEVENT"),
+			from: time.Date(2026, 10, 19, 12, 0, 0, 0, berlin),
+			to:   time.Date(2026, 10, 26, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-17 00:00"},
+		},
+		{
+			name: "unsupported rule skips only its event",
+			data: icalData(
+				"BEGIN:VEVENT", "UID:1", "DTSTART:20261024T180000Z", "RRULE:FREQ=HOURLY", "END:VEVENT",
+				"BEGIN:VEVENT", "UID:2", "DTSTART:20261025T180000Z", "END:VEVENT",
+			),
+			from: time.Date(2026, 10, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 11, 1, 0, 0, 0, 0, berlin),
+			want: []string{"2026-10-25 19:00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal, err := ParseICalendar(tt.data, berlin)
+			if err != nil {
+				t.Fatalf("ParseICalendar() error = %v", err)
+			}
+			got := occurrenceStarts(cal.Occurrences(tt.from, tt.to), berlin)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Occurrences() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseICalendarFolding(t *testing.T) {
+	data := icalData("BEGIN:VEVENT", "UID:1", "SUMMARY:Family", "  vacation", "DTSTART;VALUE=DATE:20261024", "END:VEVENT")
+	cal, err := ParseICalendar(data, time.UTC)
+	if err != nil {
+		t.Fatalf("ParseICalendar() error = %v", err)
+	}
+	if len(cal.Events) != 1 {
+		t.Fatalf("found %d events, want 1", len(cal.Events))
+	}
+	ev := cal.Events[0]
+	if ev.Summary != "Family vacation" || !ev.AllDay || ev.Duration != 24*time.Hour {
+		t.Errorf("event = %+v, want an unfolded summary and an all day event", ev)
+	}
+}
@@ -0,0 +1,163 @@
+package crebrid
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+type RestartPolicy int
+
+const (
+	// RP_NEVER a failed component stops the whole service
+	RP_NEVER RestartPolicy = iota
+	// RP_ON_FAILURE a failed component is restarted after a backoff
+	RP_ON_FAILURE
+	// RP_ALWAYS a component is restarted whenever it returns
+	RP_ALWAYS
+)
+
+const (
+	// first delay before a failed component is restarted, it doubles with every restart
+	lifecycle_restart_delay = time.Second
+	// longest delay before a failed component is restarted
+	lifecycle_max_restart_delay = 30 * time.Second
+	// a component which ran this long is considered healthy again, so its delay is reset
+	lifecycle_stable_after = time.Minute
+)
+
+// Component of the service, which is supervised by the lifecycle
+type Component struct {
+	Name string
+	// Run the component until the context is cancelled. an error means the component failed,
+	// nil that it is finished
+	Run     func(ctx context.Context) error
+	Restart RestartPolicy
+}
+
+// RunUntilDone creates the run function of a component which is started by start and stopped
+// by stop as soon as the context is cancelled
+func RunUntilDone(start func(), stop func()) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		start()
+		<-ctx.Done()
+		stop()
+		return nil
+	}
+}
+
+// Lifecycle starts the components in the order they were added and stops them in reverse
+// order, each within the shutdown timeout
+type Lifecycle interface {
+	// Add a component. components cannot be added while the lifecycle runs
+	Add(c Component)
+	// Run the components until the context is cancelled or a component fails which must not
+	// be restarted. the error of the component is returned
+	Run(ctx context.Context) error
+}
+
+type lifecycle struct {
+	clock           Clock
+	shutdownTimeout time.Duration
+	components      []Component
+}
+
+// NewLifecycle without components
+func NewLifecycle(clock Clock, shutdownTimeout time.Duration) Lifecycle {
+	lc := new(lifecycle)
+	lc.clock = clock
+	lc.shutdownTimeout = shutdownTimeout
+	return lc
+}
+
+func (lc *lifecycle) Add(c Component) {
+	lc.components = append(lc.components, c)
+}
+
+// supervised component with its own context, so it can be stopped on its own
+type supervised struct {
+	comp   Component
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+// supervise runs the component and restarts it by its policy. fatal receives the error of a
+// component which must not be restarted
+func (lc *lifecycle) supervise(ctx context.Context, comp Component, done chan bool, fatal chan error) {
+	defer close(done)
+	delay := lifecycle_restart_delay
+	for {
+		started := lc.clock.Now()
+		logging.LogFmt(logging.LOG_INFO, "[LIFECYCLE] start component: %s", comp.Name)
+		err := comp.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[LIFECYCLE] component [%s] failed: %s", comp.Name, err)
+		} else {
+			logging.LogFmt(logging.LOG_INFO, "[LIFECYCLE] component [%s] finished", comp.Name)
+		}
+		switch {
+		case comp.Restart == RP_ALWAYS, comp.Restart == RP_ON_FAILURE && err != nil:
+		case err != nil:
+			fatal <- fmt.Errorf("component [%s] failed: %w", comp.Name, err)
+			return
+		default:
+			return
+		}
+		if lc.clock.Now().Sub(started) >= lifecycle_stable_after {
+			delay = lifecycle_restart_delay
+		}
+		logging.LogFmt(logging.LOG_INFO, "[LIFECYCLE] restart component [%s] in %s", comp.Name, delay)
+		select {
+		case <-lc.clock.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+		if delay > lifecycle_max_restart_delay {
+			delay = lifecycle_max_restart_delay
+		}
+	}
+}
+
+func (lc *lifecycle) Run(ctx context.Context) error {
+	// every component may report a failure, so the channel never blocks a supervisor
+	fatal := make(chan error, len(lc.components))
+	running := make([]*supervised, 0, len(lc.components))
+	for _, comp := range lc.components {
+		// the components do not inherit the context, so they can be stopped one after another
+		compCtx, cancel := context.WithCancel(context.Background())
+		sv := &supervised{comp: comp, cancel: cancel, done: make(chan bool)}
+		running = append(running, sv)
+		go lc.supervise(compCtx, comp, sv.done, fatal)
+	}
+	logging.LogFmt(logging.LOG_MAIN, "[LIFECYCLE] started %d components", len(running))
+	var err error
+	select {
+	case <-ctx.Done():
+		logging.Log(logging.LOG_MAIN, "[LIFECYCLE] shutdown requested")
+	case err = <-fatal:
+		logging.LogFmt(logging.LOG_FATAL, "[LIFECYCLE] shutdown due to: %s", err)
+	}
+	lc.shutdown(running)
+	return err
+}
+
+// shutdown stops the components in reverse order. a component which does not stop within the
+// timeout is left behind, so a hanging component cannot block the shutdown
+func (lc *lifecycle) shutdown(running []*supervised) {
+	for i := len(running) - 1; i >= 0; i-- {
+		sv := running[i]
+		sv.cancel()
+		select {
+		case <-sv.done:
+			logging.LogFmt(logging.LOG_INFO, "[LIFECYCLE] component [%s] stopped", sv.comp.Name)
+		case <-lc.clock.After(lc.shutdownTimeout):
+			logging.LogFmt(logging.LOG_ERROR, "[LIFECYCLE] component [%s] did not stop within %s", sv.comp.Name, lc.shutdownTimeout)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package crebrid
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lifecycleRecorder records the start and stop of the components in their order
+type lifecycleRecorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (lr *lifecycleRecorder) record(event string) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	lr.events = append(lr.events, event)
+}
+
+func (lr *lifecycleRecorder) recorded() []string {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	return append([]string{}, lr.events...)
+}
+
+func (lr *lifecycleRecorder) component(name string) Component {
+	return Component{Name: name, Run: RunUntilDone(func() { lr.record("start " + name) }, func() { lr.record("stop " + name) })}
+}
+
+func (lr *lifecycleRecorder) waitFor(t *testing.T, event string) {
+	for i := 0; i < 200; i++ {
+		for _, e := range lr.recorded() {
+			if e == event {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("event [%s] not recorded: %v", event, lr.recorded())
+}
+
+func TestLifecycleShutdownOrder(t *testing.T) {
+	lr := new(lifecycleRecorder)
+	lc := NewLifecycle(NewSystemClock(), time.Second)
+	lc.Add(lr.component("link"))
+	lc.Add(lr.component("scheduler"))
+	lc.Add(lr.component("ipc"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- lc.Run(ctx)
+	}()
+	for _, name := range []string{"link", "scheduler", "ipc"} {
+		lr.waitFor(t, "start "+name)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := []string{"stop ipc", "stop scheduler", "stop link"}
+	if got := lr.recorded()[3:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("shutdown = %v, want %v", got, want)
+	}
+}
+
+func TestLifecycleShutdownTimeout(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	lc := NewLifecycle(fc, 10*time.Second)
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	// the component does not stop when it is cancelled
+	lc.Add(Component{Name: "stuck", Run: func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- lc.Run(ctx)
+	}()
+	<-started
+	cancel()
+	fc.waitForWaiter(t)
+	select {
+	case err := <-done:
+		t.Fatalf("Run() = %v before the shutdown timeout", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fc.Advance(10 * time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run() does not return after the shutdown timeout")
+	}
+}
+
+func TestLifecycleRestartOnFailure(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	lr := new(lifecycleRecorder)
+	lc := NewLifecycle(fc, time.Second)
+	runs := 0
+	lc.Add(Component{Name: "ipc", Restart: RP_ON_FAILURE, Run: func(ctx context.Context) error {
+		runs++
+		lr.record("run ipc")
+		if runs < 3 {
+			return errors.New("address already in use")
+		}
+		<-ctx.Done()
+		return nil
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- lc.Run(ctx)
+	}()
+	// the restart delay doubles after each failure
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		fc.waitForWaiter(t)
+		fc.Advance(d)
+	}
+	for i := 0; i < 200 && len(lr.recorded()) < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := len(lr.recorded()); got != 3 {
+		t.Errorf("runs = %d, want 3", got)
+	}
+}
+
+func TestLifecycleFatalFailure(t *testing.T) {
+	lr := new(lifecycleRecorder)
+	lc := NewLifecycle(NewSystemClock(), 50*time.Millisecond)
+	lc.Add(lr.component("link"))
+	lc.Add(Component{Name: "hanging", Run: func(ctx context.Context) error {
+		// ignores the context, so the shutdown has to give up on it
+		select {}
+	}})
+	lc.Add(Component{Name: "broken", Run: func(ctx context.Context) error {
+		lr.waitFor(t, "start link")
+		return errors.New("broken")
+	}})
+	err := lc.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "component [broken] failed: broken") {
+		t.Fatalf("Run() error = %v", err)
+	}
+	lr.waitFor(t, "stop link")
+}
@@ -1,8 +1,11 @@
 package crebrid
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"runtime"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,68 +26,173 @@ const (
 	SES_ERROR
 )
 
+const (
+	// time each component has to stop during the shutdown of the service
+	service_shutdown_timeout = 10 * time.Second
+	// interval to check the IPC server for errors
+	service_ipc_check_interval = 50 * time.Millisecond
+)
+
 type Service interface {
-	Init() bool
-	Start()
-	Stop()
+	// Run the service until the context is cancelled or a component fails for good
+	Run(ctx context.Context) error
+	// Status of the service
 	Status() ServiceStatus
 }
 
 type mainExecute struct {
-	ccc    CrestronControllerClient
-	status ServiceStatus
-	setts  CrebridDSettings
-	doStop chan bool
-	wait   sync.WaitGroup
+	// controllers of the settings, the default controller first
+	controllers []*controller
+	scenes      SceneStore
+	sched       Scheduler
+	cal         CalendarWatcher
+	rules       RuleEngine
+	scripts     ScriptManager
+	poller      StatusPoller
+	bus         EventBus
+	history     EventHistory
+	queue       CommandQueue
+	setts       CrebridDSettings
+	// clock of the service, its components and the age of the stored status
+	clock Clock
+	// statusLock guards status, which is read while the service runs
+	statusLock sync.Mutex
+	status     ServiceStatus
+	// recorder of the connections, nil if they are not recorded
+	recorder Recorder
 }
 
 func NewMainExecute(setts CrebridDSettings) Service {
 	me := new(mainExecute)
 	me.status = SES_STOPPED
 	me.setts = setts
+	me.clock = NewSystemClock()
 	return me
 }
 
-func (me *mainExecute) Init() bool {
-	ccc, err := NewCrestronControllerClient(me.setts.IP, me.setts.Port)
+// setup the components of the service. the service starts even if the controller or a file
+// is not available, the components pick them up later
+func (me *mainExecute) setup() {
+	me.bus = NewEventBus()
+	me.history = NewEventHistory(me.bus, event_history_size)
+	if me.setts.CaptureFile != "" {
+		rec, err := OpenRecorder(me.clock, me.setts.CaptureFile)
+		if err != nil {
+			// the service runs without the capture, it is only used to debug
+			logging.LogFmt(logging.LOG_ERROR, "[service] unable to record the connections to [%s]: %s", me.setts.CaptureFile, err)
+		} else {
+			me.recorder = rec
+		}
+	}
+	// the links submit their heartbeats to the queue
+	me.queue = NewCommandQueue(me.clock, me.setts.QueueSize)
+	for _, setts := range me.setts.AllControllers() {
+		me.controllers = append(me.controllers, me.setupController(setts))
+	}
+	var err error
+	me.scenes, err = LoadScenesFromFile(me.setts.ScenesFile)
 	if err != nil {
-		logging.LogFmt(logging.LOG_FATAL, "[service] creation of crestron controller client failed: %s", err)
-		me.status = SES_ERROR
-		return false
-	}
-	logging.LogFmt(logging.LOG_MAIN, "[service] successfully connected to controller: %s@%d", me.setts.IP, me.setts.Port)
-	me.ccc = ccc
-	me.ccc.SetAccessCode(me.setts.AccessCode)
-	logging.Log(logging.LOG_DEBUG, "[service] try to send a get command")
-	_, err = me.ccc.ToggleSwitch(0)
+		logging.LogFmt(logging.LOG_ERROR, "[service] unable to load scenes from [%s]: %s", me.setts.ScenesFile, err)
+		me.scenes, _ = LoadScenesFromByteArr([]byte{})
+	}
+	me.sched, err = NewScheduler(me.clock, me.setts.GeoLocation(), me.setts.ScheduleFile, me.runCommand)
 	if err != nil {
-		logging.LogFmt(logging.LOG_FATAL, "[service] test command to server failed: %s", err)
-		me.status = SES_ERROR
-		return false
+		logging.LogFmt(logging.LOG_ERROR, "[service] unable to load schedule from [%s]: %s", me.setts.ScheduleFile, err)
+		me.sched, _ = NewScheduler(me.clock, me.setts.GeoLocation(), "", me.runCommand)
+	}
+	me.cal, err = NewCalendarWatcher(me.clock, me.setts.CalendarsFile, me.sched)
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[service] unable to load calendars from [%s]: %s", me.setts.CalendarsFile, err)
+		me.cal, _ = newCalendarWatcher(me.clock, nil, me.sched)
+	}
+	me.rules, err = NewRuleEngine(me.clock, me.bus, me.setts.RulesFile, me.runCommand)
+	if err != nil {
+		// the engine keeps watching the file, so fixed rules are picked up without a restart
+		logging.LogFmt(logging.LOG_ERROR, "[service] unable to load rules from [%s]: %s", me.setts.RulesFile, err)
+		me.rules = newRuleEngine(me.clock, me.bus, me.setts.RulesFile, me.runCommand)
+	}
+	me.scripts = NewScriptManager(me.clock, me.bus, me.setts.ScriptsDir, me.setts.ScriptsLogDir, me.setts.ScriptTimeout, me.readStatus, me.runCommand)
+	me.poller = NewStatusPoller(me.clock, me.setts.PollInterval, me.pollStatus)
+	// pushes use every component which reacts on the status, so they are accepted at last
+	for _, ctrl := range me.controllers {
+		ctrl := ctrl
+		ctrl.ccc.OnStatusPush(func(ss *SystemStatus) {
+			me.statusPushed(ctrl, ss)
+		})
 	}
-	return true
-}
-
-func (me *mainExecute) Start() {
-	me.doStop = make(chan bool)
-	me.wait.Add(1)
-	go me.execute()
 }
 
-func (me *mainExecute) Stop() {
-	logging.Log(logging.LOG_MAIN, "[service] stopping main routine")
-	me.doStop <- true
-	logging.Log(logging.LOG_DEBUG, "[service] close stop channel")
-	runtime.Gosched()
-	me.wait.Wait()
-	logging.Log(logging.LOG_DEBUG, "[service] wait excaped set status and return")
-	me.status = SES_STOPPED
+func (me *mainExecute) setStatus(status ServiceStatus) {
+	me.statusLock.Lock()
+	defer me.statusLock.Unlock()
+	me.status = status
 }
 
 func (me *mainExecute) Status() ServiceStatus {
+	me.statusLock.Lock()
+	defer me.statusLock.Unlock()
 	return me.status
 }
 
+func (me *mainExecute) Run(ctx context.Context) error {
+	me.setup()
+	if me.recorder != nil {
+		defer me.recorder.Close()
+	}
+	// the components are stopped in reverse order, so the IPC server stops first and the
+	// controller link after everything which uses it
+	lc := NewLifecycle(me.clock, service_shutdown_timeout)
+	lc.Add(Component{Name: "event history", Run: RunUntilDone(me.history.Start, me.history.Stop)})
+	for _, ctrl := range me.controllers {
+		if ctrl.listener != nil {
+			lc.Add(Component{Name: "controller listener " + ctrl.setts.Name, Run: ctrl.runListener, Restart: RP_ON_FAILURE})
+		}
+		lc.Add(Component{Name: "controller link " + ctrl.setts.Name, Run: RunUntilDone(ctrl.link.Start, ctrl.link.Stop)})
+	}
+	lc.Add(Component{Name: "command queue", Run: RunUntilDone(me.queue.Start, me.queue.Stop)})
+	lc.Add(Component{Name: "scheduler", Run: RunUntilDone(me.sched.Start, me.sched.Stop)})
+	lc.Add(Component{Name: "calendars", Run: RunUntilDone(me.cal.Start, me.cal.Stop)})
+	lc.Add(Component{Name: "rules", Run: RunUntilDone(me.rules.Start, me.rules.Stop)})
+	lc.Add(Component{Name: "scripts", Run: RunUntilDone(me.scripts.Start, me.scripts.StopAll)})
+	lc.Add(Component{Name: "status poller", Run: RunUntilDone(me.poller.Start, me.poller.Stop)})
+	lc.Add(Component{Name: "IPC server", Run: me.runIpcServer, Restart: RP_ON_FAILURE})
+	me.setStatus(SES_RUNNING)
+	err := lc.Run(ctx)
+	if err != nil {
+		me.setStatus(SES_ERROR)
+		return err
+	}
+	me.setStatus(SES_STOPPED)
+	logging.Log(logging.LOG_MAIN, "[service] stopped")
+	return nil
+}
+
+// runIpcServer until the context is cancelled. an error of the listener fails the component,
+// so the lifecycle restarts it. an error of a single client only closes its connection
+func (me *mainExecute) runIpcServer(ctx context.Context) error {
+	is := ipc.NewIpcServer(me.setts.IPCPort, me.setts.IPCReadPolicy)
+	if me.recorder != nil {
+		is.WrapConnections(func(conn net.Conn) net.Conn {
+			return me.recorder.Wrap(CAPTURE_STREAM_IPC, conn)
+		})
+	}
+	go is.StartListening(me.handleRequest)
+	logging.LogFmt(logging.LOG_MAIN, "[service] start to listen for IPC commands on port: %d", me.setts.IPCPort)
+	defer is.Close()
+	ticker := time.NewTicker(service_ipc_check_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := is.HasError(); err != nil {
+				return fmt.Errorf("IPC listening interface results in an error: %w", err)
+			}
+		}
+	}
+}
+
 func (me *mainExecute) handleRequest(cc *ipc.ClientCommand) (*ipc.ServerResponse, error) {
 	logging.LogFmt(logging.LOG_DEBUG, "[cmd handler] handle new request: %v", cc)
 	sr := ipc.NewServerResponse()
@@ -92,43 +200,62 @@ func (me *mainExecute) handleRequest(cc *ipc.ClientCommand) (*ipc.ServerResponse
 	sr.Cmd = cc.Cmd
 	logging.Log(logging.LOG_DEBUG, "[cmd handler] setting command")
 	var err error = nil
-	ret := false
 	switch sr.Cmd {
 	case ipc.IC_REGISTER:
 		sr.ID = cc.ID
-	case ipc.IC_SINGLE, ipc.IC_MULTIPLE, ipc.IC_GET:
-		containsStatusReq := sr.Cmd == ipc.IC_GET
-		if sr.Cmd == ipc.IC_GET {
-			ret, err = me.ccc.ToggleSwitch(0)
-			if err != nil {
-				logging.LogFmt(logging.LOG_ERROR, "toggle switch [%d] failed: %s", 0, err)
-				if !ret {
-					err = me.ccc.ReDial()
-				} else {
-					break
-				}
-			}
-		} else {
-			for _, sid := range cc.DigitalPorts {
-				logging.LogFmt(logging.LOG_DEBUG, "[cmd handler] toggle switch %d", sid)
-				isOn, err := me.ccc.ToggleSwitch(sid)
-				logging.Log(logging.LOG_DEBUG, "[cmd handler] switch toggled")
-				if err != nil {
-					logging.LogFmt(logging.LOG_ERROR, "toggle switch [%d] failed: %s", sid, err)
-					break
-				}
-				if sid > 0 {
-					sr.DigitalPortInfo[sid] = isOn
-				} else if sid == 0 {
-					containsStatusReq = true
-				}
+	case ipc.IC_GET:
+		me.handleGetRequest(cc, sr)
+	case ipc.IC_SINGLE, ipc.IC_MULTIPLE, ipc.IC_SCENE:
+		// scenes belong to the default controller
+		ctrl, ctrlErr := me.controller(cc.Controller)
+		if ctrlErr != nil || (sr.Cmd == ipc.IC_SCENE && !ctrl.isDefault()) {
+			if ctrlErr == nil {
+				ctrlErr = fmt.Errorf("scenes belong to the controller [%s]", DEFAULT_CONTROLLER)
 			}
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] request rejected: %s", ctrlErr)
+			sr.Error = ctrlErr.Error()
+			break
 		}
-		if containsStatusReq {
-			for i, v := range me.ccc.GetSystemStatus().D {
-				sr.DigitalPortInfo[i] = v > 0
-			}
+		// requests which use the controller wait for their turn in the command queue
+		queueErr := me.queue.Submit(QP_USER, fmt.Sprintf("IPC request %d", cc.Cmd), func() error {
+			me.handleControllerRequest(ctrl, cc, sr)
+			me.publishStatus(ctrl)
+			return nil
+		})
+		if queueErr != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] request not queued: %s", queueErr)
+			sr.Error = queueErr.Error()
 		}
+	case ipc.IC_SCHEDULE:
+		sr.ID = cc.ID
+		schedErr := me.handleScheduleRequest(cc, sr)
+		if schedErr != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] schedule request failed: %s", schedErr)
+			sr.Error = schedErr.Error()
+		}
+	case ipc.IC_CALENDAR:
+		sr.ID = cc.ID
+		calErr := me.handleCalendarRequest(cc, sr)
+		if calErr != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] calendar request failed: %s", calErr)
+			sr.Error = calErr.Error()
+		}
+	case ipc.IC_RULES:
+		sr.ID = cc.ID
+		sr.Items = append(sr.Items, me.rules.Rules()...)
+	case ipc.IC_SCRIPT:
+		sr.ID = cc.ID
+		scriptErr := me.handleScriptRequest(cc, sr)
+		if scriptErr != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] script request failed: %s", scriptErr)
+			sr.Error = scriptErr.Error()
+		}
+	case ipc.IC_EVENTS:
+		sr.ID = cc.ID
+		sr.Items = append(sr.Items, me.history.Events()...)
+	case ipc.IC_QUEUE:
+		sr.ID = cc.ID
+		sr.Items = append(sr.Items, me.queue.Stats().String())
 	}
 	if err != nil {
 		logging.LogFmt(logging.LOG_DEBUG, "[cmd handler] request could not be handled: %v", err)
@@ -138,39 +265,219 @@ func (me *mainExecute) handleRequest(cc *ipc.ClientCommand) (*ipc.ServerResponse
 	return sr, nil
 }
 
-func (me *mainExecute) execute() {
-	me.status = SES_RUNNING
-	defer func() {
-		// me.wait.Done()
-		logging.Log(logging.LOG_DEBUG, "[execute] wait group done")
-	}()
-	is := ipc.NewIpcServer(me.setts.IPCPort)
-	go is.StartListening(me.handleRequest)
-	logging.LogFmt(logging.LOG_MAIN, "[service] start to listen for IPC commands on port: %d", me.setts.IPCPort)
-	defer is.Close()
-	errTxt := ""
-	aliveMsgTick := time.Now().Unix()
-	for {
-		switch {
-		case <-me.doStop:
-			logging.Log(logging.LOG_MAIN, "[service] main loop escaped")
-			me.wait.Done()
+// handleControllerRequest sets or reads ports of the controller or handles scenes. it has to
+// be called by a command of the command queue
+func (me *mainExecute) handleControllerRequest(ctrl *controller, cc *ipc.ClientCommand, sr *ipc.ServerResponse) {
+	switch sr.Cmd {
+	case ipc.IC_SINGLE, ipc.IC_MULTIPLE:
+		containsStatusReq := false
+		for _, sid := range cc.DigitalPorts {
+			logging.LogFmt(logging.LOG_DEBUG, "[cmd handler] toggle switch %d", sid)
+			isOn, err := ctrl.ccc.ToggleSwitch(sid)
+			logging.Log(logging.LOG_DEBUG, "[cmd handler] switch toggled")
+			if sid > 0 {
+				me.publishCommand(&Command{Kind: CK_TOGGLE, Port: sid, Controller: ctrl.address()}, err)
+			}
+			if err != nil {
+				logging.LogFmt(logging.LOG_ERROR, "toggle switch [%s%d] failed: %s", ctrl.prefix(), sid, err)
+				// the client sees the failure like the one of a scene
+				sr.Error = fmt.Sprintf("toggle switch [%s%d] failed: %s", ctrl.prefix(), sid, err)
+				break
+			}
+			if sid > 0 {
+				sr.DigitalPortInfo[sid] = isOn
+			} else if sid == 0 {
+				containsStatusReq = true
+			}
+		}
+		if ss := ctrl.ccc.GetSystemStatus(); containsStatusReq && ss != nil {
+			for i, v := range ss.D {
+				sr.DigitalPortInfo[i] = v > 0
+			}
+		}
+	case ipc.IC_SCENE:
+		sr.ID = cc.ID
+		sceneErr := me.handleSceneRequest(cc, sr)
+		if sceneErr != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] scene request failed: %s", sceneErr)
+			sr.Error = sceneErr.Error()
+		}
+	}
+}
+
+// handleGetRequest serves the system status of the chosen controller, or of every controller
+// if none is chosen. the digital ports of the chosen or the default controller are returned
+// as DigitalPortInfo
+func (me *mainExecute) handleGetRequest(cc *ipc.ClientCommand, sr *ipc.ServerResponse) {
+	ctrls := me.controllers
+	if cc.Controller != "" {
+		ctrl, err := me.controller(cc.Controller)
+		if err != nil {
+			sr.Error = err.Error()
 			return
-		default:
-			if is.HasError() != nil {
-				newErrTxt := fmt.Sprintf("[service] IPC listening interface results in an error --> escape main loop: %v", is.HasError())
-				if newErrTxt != errTxt {
-					errTxt = newErrTxt
-					logging.Log(logging.LOG_FATAL, errTxt)
-				}
-				me.status = SES_ERROR
-				return
+		}
+		ctrls = []*controller{ctrl}
+	}
+	sr.ControllerPortInfo = make(map[string]map[int]bool)
+	failed := make([]string, 0)
+	for _, ctrl := range ctrls {
+		ss, err := me.getStatus(ctrl, cc.Refresh)
+		if err != nil {
+			// the controller link reconnects on its own, so the request fails but not the service
+			logging.LogFmt(logging.LOG_ERROR, "[cmd handler] read system status of controller [%s] failed: %s", ctrl.setts.Name, err)
+			failed = append(failed, ctrl.prefix()+err.Error())
+			continue
+		}
+		ports := make(map[int]bool)
+		if ss != nil {
+			for i, v := range ss.D {
+				ports[i] = v > 0
 			}
-			time.Sleep(50 * time.Millisecond)
-			if time.Now().Unix()-aliveMsgTick > 10 {
-				aliveMsgTick = time.Now().Unix()
-				logging.Log(logging.LOG_DEBUG, "[service] main thread still alive")
+		}
+		sr.ControllerPortInfo[ctrl.setts.Name] = ports
+		if ctrl == ctrls[0] {
+			sr.DigitalPortInfo = ports
+		}
+		for _, port := range ctrl.store.Ports() {
+			sr.Items = append(sr.Items, ctrl.prefix()+port)
+		}
+	}
+	sr.Error = strings.Join(failed, "; ")
+}
+
+// getStatus of the controller from its state store if it is fresh and no refresh is
+// requested, otherwise it is read from the controller. clients which refresh at the same time
+// share a single read
+func (me *mainExecute) getStatus(ctrl *controller, refresh bool) (*SystemStatus, error) {
+	if !refresh && ctrl.store.Fresh(me.clock.Now(), me.setts.StatusMaxAge) {
+		logging.Log(logging.LOG_DEBUG, "[cmd handler] serve system status from the state store")
+		ss, _, _ := ctrl.store.Status()
+		return ss, nil
+	}
+	return me.readController(ctrl, QP_USER)
+}
+
+func (me *mainExecute) handleSceneRequest(cc *ipc.ClientCommand, sr *ipc.ServerResponse) error {
+	switch cc.Action {
+	case ipc.IA_LIST:
+		for _, name := range me.scenes.Names() {
+			sc, _ := me.scenes.Get(name)
+			sr.Items = append(sr.Items, sc.String())
+		}
+		return nil
+	case ipc.IA_ACTIVATE:
+		sc, ok := me.scenes.Get(cc.Name)
+		if !ok {
+			return fmt.Errorf("unknown scene: %s", cc.Name)
+		}
+		err := me.activateScene(sc, sr)
+		me.publishCommand(&Command{Kind: CK_SCENE, Scene: sc.Name}, err)
+		return err
+	case ipc.IA_CAPTURE:
+		ccc := me.defaultController().ccc
+		_, err := ccc.ToggleSwitch(system_state_toggle)
+		if err != nil {
+			return err
+		}
+		sc := SceneFromSystemStatus(cc.Name, ccc.GetSystemStatus())
+		err = me.scenes.Put(sc)
+		if err != nil {
+			return err
+		}
+		logging.LogFmt(logging.LOG_INFO, "[scenes] captured scene: %s", sc)
+		sr.Items = append(sr.Items, sc.String())
+		return me.scenes.Save()
+	}
+	return fmt.Errorf("unknown scene action: %d", cc.Action)
+}
+
+// activateScene sets every port of the scene to its desired state on the default controller.
+// ports which already have the desired state are not touched, so a scene can be activated
+// repeatedly. analog ports are skipped if the protocol of the controller cannot write them
+func (me *mainExecute) activateScene(sc *Scene, sr *ipc.ServerResponse) error {
+	logging.LogFmt(logging.LOG_INFO, "[scenes] activate scene: %s", sc)
+	ccc := me.defaultController().ccc
+	failed := make([]string, 0)
+	for _, port := range sc.DigitalPorts() {
+		isOn, err := ccc.SetDigital(port, sc.Digital[port])
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[scenes] set digital port [%d] failed: %s", port, err)
+			failed = append(failed, fmt.Sprintf("d%d: %s", port, err))
+			continue
+		}
+		sr.DigitalPortInfo[port] = isOn
+	}
+	for _, port := range sc.AnalogPorts() {
+		err := ccc.SetAnalog(port, sc.Analog[port])
+		if errors.Is(err, ErrAnalogNotSupported) {
+			// a captured scene holds every analog value, even of a client which cannot write them
+			logging.LogFmt(logging.LOG_DEBUG, "[scenes] skip analog port [%d]: %s", port, err)
+			continue
+		}
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[scenes] set analog port [%d] failed: %s", port, err)
+			failed = append(failed, fmt.Sprintf("a%d: %s", port, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("scene [%s] partially activated: %s", sc.Name, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (me *mainExecute) handleScheduleRequest(cc *ipc.ClientCommand, sr *ipc.ServerResponse) error {
+	switch cc.Action {
+	case ipc.IA_LIST:
+		for _, sj := range me.sched.Jobs() {
+			sr.Items = append(sr.Items, sj.String())
+		}
+		return nil
+	case ipc.IA_ADD:
+		sj, err := me.sched.Add(cc.Schedule, cc.Command)
+		if sj != nil {
+			sr.Items = append(sr.Items, sj.String())
+		}
+		return err
+	case ipc.IA_REMOVE:
+		return me.sched.Remove(cc.Name)
+	}
+	return fmt.Errorf("unknown schedule action: %d", cc.Action)
+}
+
+func (me *mainExecute) handleScriptRequest(cc *ipc.ClientCommand, sr *ipc.ServerResponse) error {
+	switch cc.Action {
+	case ipc.IA_LIST:
+		sr.Items = append(sr.Items, me.scripts.List()...)
+		return nil
+	case ipc.IA_RUN:
+		timeout := ScriptDefaultTimeout
+		if cc.Timeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(cc.Timeout)
+			if err != nil || timeout < 0 {
+				return fmt.Errorf("invalid timeout: %s", cc.Timeout)
 			}
 		}
+		return me.scripts.Run(cc.Name, timeout)
+	case ipc.IA_STOP:
+		return me.scripts.Stop(cc.Name)
+	case ipc.IA_LOG:
+		lines, err := me.scripts.Log(cc.Name)
+		sr.Items = append(sr.Items, lines...)
+		return err
+	}
+	return fmt.Errorf("unknown script action: %d", cc.Action)
+}
+
+func (me *mainExecute) handleCalendarRequest(cc *ipc.ClientCommand, sr *ipc.ServerResponse) error {
+	switch cc.Action {
+	case ipc.IA_UPCOMING:
+		days := cc.Days
+		if days < 1 {
+			days = 7
+		}
+		sr.Items = append(sr.Items, me.cal.Upcoming(time.Duration(days)*24*time.Hour)...)
+		return nil
 	}
+	return fmt.Errorf("unknown calendar action: %d", cc.Action)
 }
@@ -0,0 +1,98 @@
+package crebrid
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+// failingControllerClient fails every toggle with err
+type failingControllerClient struct {
+	*fakeControllerClient
+	err error
+}
+
+func (fcc *failingControllerClient) ToggleSwitch(switchID int) (bool, error) {
+	return false, fcc.err
+}
+
+func TestHandleRequestToggleFailure(t *testing.T) {
+	fcc := &failingControllerClient{newFakeControllerClient([]int{0, 0}, []float64{0}), ErrResponseTimeout}
+	me := new(mainExecute)
+	me.clock = NewSystemClock()
+	me.controllers = []*controller{newController(ControllerSettings{Name: DEFAULT_CONTROLLER}, fcc)}
+	me.bus = NewEventBus()
+	me.queue = NewCommandQueue(NewSystemClock(), 8)
+	me.queue.Start()
+	defer me.queue.Stop()
+	cc := ipc.NewClientCommand()
+	cc.Cmd = ipc.IC_SINGLE
+	cc.AddDigitalPorts(2)
+	sr, err := me.handleRequest(cc)
+	if err != nil {
+		t.Fatalf("handleRequest() error = %v", err)
+	}
+	// the client learns about the failure instead of getting an empty answer
+	if !strings.Contains(sr.Error, "toggle switch [2] failed") || !strings.Contains(sr.Error, ErrResponseTimeout.Error()) {
+		t.Errorf("handleRequest() Error = %q, want the failed toggle of switch 2", sr.Error)
+	}
+	if _, ok := sr.DigitalPortInfo[2]; ok {
+		t.Errorf("handleRequest() DigitalPortInfo = %v, want no state of switch 2", sr.DigitalPortInfo)
+	}
+}
+
+// readingControllerClient gets a new system status by every read, like the controller clients
+type readingControllerClient struct {
+	*fakeControllerClient
+	reads int
+	ss    *SystemStatus
+}
+
+func (rcc *readingControllerClient) ToggleSwitch(switchID int) (bool, error) {
+	if switchID == system_state_toggle {
+		rcc.reads++
+		rcc.ss = &SystemStatus{D: append([]int{}, rcc.status.D...), A: append([]float64{}, rcc.status.A...)}
+	}
+	return rcc.fakeControllerClient.ToggleSwitch(switchID)
+}
+
+func (rcc *readingControllerClient) GetSystemStatus() *SystemStatus {
+	return rcc.ss
+}
+
+func TestGetStatusFreshness(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	rcc := &readingControllerClient{fakeControllerClient: newFakeControllerClient([]int{0, 1}, []float64{0})}
+	me := new(mainExecute)
+	me.clock = fc
+	me.setts.StatusMaxAge = 10 * time.Second
+	me.controllers = []*controller{newController(ControllerSettings{Name: DEFAULT_CONTROLLER}, rcc)}
+	me.bus = NewEventBus()
+	me.queue = NewCommandQueue(fc, 8)
+	me.queue.Start()
+	defer me.queue.Stop()
+	tests := []struct {
+		advance   time.Duration
+		refresh   bool
+		wantReads int
+	}{
+		{wantReads: 1},
+		{advance: 10 * time.Second, wantReads: 1},
+		{advance: time.Second, wantReads: 2},
+		{advance: 5 * time.Second, wantReads: 2},
+		{refresh: true, wantReads: 3},
+	}
+	for i, tt := range tests {
+		fc.Advance(tt.advance)
+		ss, err := me.getStatus(me.defaultController(), tt.refresh)
+		if err != nil || !reflect.DeepEqual(ss.D, []int{0, 1}) {
+			t.Fatalf("[%d] getStatus() = %v, %v", i, ss, err)
+		}
+		if rcc.reads != tt.wantReads {
+			t.Errorf("[%d] reads = %d, want %d", i, rcc.reads, tt.wantReads)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package crebrid
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+const (
+	// the rules file is checked for changes with this interval
+	rules_poll_interval = 10 * time.Second
+	// number of system states which wait for the evaluation
+	rules_status_queue = 64
+)
+
+// RuleEngine evaluates the rules for every new system status of the default controller on the
+// event bus and executes their commands
+type RuleEngine interface {
+	// Start the rule engine routine
+	Start()
+	// Stop the rule engine routine and wait until it is finished
+	Stop()
+	// Reload the rules file if it was changed
+	Reload() error
+	// Rules which are currently active
+	Rules() []string
+}
+
+type ruleEngine struct {
+	lock     sync.Mutex
+	clock    Clock
+	path     string
+	modTime  time.Time
+	size     int64
+	eval     *ruleEvaluator
+	run      func(cmd *Command) error
+	sub      Subscription
+	quit     chan bool
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewRuleEngine loads the rules from the given file. a missing file results in an engine
+// without rules, which picks up the file as soon as it is created. commands are executed by
+// calling run
+func NewRuleEngine(clock Clock, bus EventBus, path2File string, run func(cmd *Command) error) (RuleEngine, error) {
+	re := newRuleEngine(clock, bus, path2File, run)
+	err := re.Reload()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if os.IsNotExist(err) {
+		logging.LogFmt(logging.LOG_WARN, "[RULES] unable to read rules from: %s", path2File)
+	}
+	return re, nil
+}
+
+// newRuleEngine without rules. they are loaded by the first reload
+func newRuleEngine(clock Clock, bus EventBus, path2File string, run func(cmd *Command) error) *ruleEngine {
+	re := new(ruleEngine)
+	re.clock = clock
+	re.path = path2File
+	re.eval = newRuleEvaluator(nil)
+	re.run = run
+	// the rules need every status in order, so a slow engine drops the new ones
+	re.sub = bus.Subscribe("rules", rules_status_queue, SCP_DROP_NEWEST, EK_STATUS)
+	re.quit = make(chan bool)
+	return re
+}
+
+func (re *ruleEngine) Reload() error {
+	info, err := os.Stat(re.path)
+	if err != nil {
+		return err
+	}
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	if info.ModTime().Equal(re.modTime) && info.Size() == re.size {
+		return nil
+	}
+	// the file is read only once even if it is broken, the next change triggers a new try
+	re.modTime = info.ModTime()
+	re.size = info.Size()
+	data, err := os.ReadFile(re.path)
+	if err != nil {
+		return err
+	}
+	rules, err := LoadRulesFromByteArr(data)
+	if err != nil {
+		return err
+	}
+	re.eval.setRules(rules)
+	logging.LogFmt(logging.LOG_INFO, "[RULES] loaded [%d] rules from: %s", len(rules), re.path)
+	return nil
+}
+
+func (re *ruleEngine) Rules() []string {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	ret := make([]string, len(re.eval.rules))
+	for i, r := range re.eval.rules {
+		ret[i] = r.String()
+	}
+	return ret
+}
+
+func (re *ruleEngine) runActions(actions []RuleAction) {
+	for _, ra := range actions {
+		logging.LogFmt(logging.LOG_INFO, "[RULES] rule [%s] runs command: %s", ra.Rule, ra.Command)
+		err := re.run(ra.Command)
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[RULES] command [%s] of rule [%s] failed: %s", ra.Command, ra.Rule, err)
+		}
+	}
+}
+
+func (re *ruleEngine) execute() {
+	defer re.wg.Done()
+	lastPoll := re.clock.Now()
+	for {
+		now := re.clock.Now()
+		if now.Sub(lastPoll) >= rules_poll_interval {
+			lastPoll = now
+			err := re.Reload()
+			if err != nil && !os.IsNotExist(err) {
+				logging.LogFmt(logging.LOG_ERROR, "[RULES] unable to reload rules: %s", err)
+			}
+		}
+		re.lock.Lock()
+		due := re.eval.due(now)
+		wait := rules_poll_interval - now.Sub(lastPoll)
+		if next, ok := re.eval.nextDue(); ok && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		re.lock.Unlock()
+		re.runActions(due)
+		select {
+		case ev := <-re.sub.Events():
+			// the rules address the default controller only
+			if ev.Controller != "" || ev.Status == nil {
+				break
+			}
+			re.lock.Lock()
+			actions := re.eval.update(ev.Status, re.clock.Now())
+			re.lock.Unlock()
+			re.runActions(actions)
+		case <-re.clock.After(wait):
+		case <-re.quit:
+			logging.Log(logging.LOG_DEBUG, "[RULES] routine escaped")
+			return
+		}
+	}
+}
+
+func (re *ruleEngine) Start() {
+	logging.LogFmt(logging.LOG_MAIN, "[RULES] start with %d rules", len(re.Rules()))
+	re.wg.Add(1)
+	go re.execute()
+}
+
+func (re *ruleEngine) Stop() {
+	// the lifecycle may stop the engine more than once
+	re.quitOnce.Do(func() { close(re.quit) })
+	re.wg.Wait()
+	re.sub.Close()
+}
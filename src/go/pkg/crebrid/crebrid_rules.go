@@ -0,0 +1,627 @@
+package crebrid
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// rules are stored in an ini file, one section per rule:
+//
+//	[night light]
+//	when=d12=on             condition which fires the rule when it becomes true
+//	between=22:00-06:00     optional local time window, may wrap midnight
+//	if=d5=off,a2<1000       optional conditions which have to hold as well
+//	delay=30s               optional delay of the commands
+//	do=d3=on                commands, separated by commas
+//	for=5m                  optional duration after which digital commands are reverted
+//	cancel=d12=off          optional condition which cancels delayed and pending revert commands
+//
+// conditions compare a port with a value: d12=on, d12=off, a4>30000, a4<=100, a4!=0. the
+// change of a port is described by d12=change or a4=change, which is only allowed for when.
+// a rule fired again while its commands are pending restarts the delay and the revert timer.
+
+const (
+	rule_key_when       = "when"
+	rule_key_between    = "between"
+	rule_key_if         = "if"
+	rule_key_delay      = "delay"
+	rule_key_do         = "do"
+	rule_key_for        = "for"
+	rule_key_cancel     = "cancel"
+	rule_key_priority   = "priority"
+	rule_value_change   = "change"
+	rule_list_separator = ","
+	rule_time_layout    = "15:04"
+	rule_trace_layout   = "2006-01-02 15:04:05"
+)
+
+// the operators are ordered, so the two character operators are found first
+var ruleOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// ruleCondition compares a port of the system status with a value
+type ruleCondition struct {
+	digital bool
+	port    int
+	op      string
+	value   float64
+	change  bool
+}
+
+func parseRuleCondition(str string, allowChange bool) (*ruleCondition, error) {
+	lower := strings.ToLower(strings.ReplaceAll(str, " ", ""))
+	rc := new(ruleCondition)
+	switch {
+	case strings.HasPrefix(lower, scene_digital_prefix):
+		rc.digital = true
+	case strings.HasPrefix(lower, scene_analog_prefix):
+	default:
+		return nil, fmt.Errorf("invalid condition [%s]: expect a port like d12 or a4", str)
+	}
+	opIdx := strings.IndexAny(lower, "<>!=")
+	if opIdx < 0 {
+		return nil, fmt.Errorf("invalid condition [%s]: operator is missing", str)
+	}
+	port, err := strconv.Atoi(lower[1:opIdx])
+	if err != nil || port < 1 {
+		return nil, fmt.Errorf("invalid condition [%s]: invalid port number", str)
+	}
+	rc.port = port
+	for _, op := range ruleOperators {
+		if strings.HasPrefix(lower[opIdx:], op) {
+			rc.op = op
+			break
+		}
+	}
+	valueStr := lower[opIdx+len(rc.op):]
+	if valueStr == rule_value_change {
+		if !allowChange || rc.op != "=" {
+			return nil, fmt.Errorf("invalid condition [%s]: a change can only fire a rule", str)
+		}
+		rc.change = true
+		return rc, nil
+	}
+	if rc.digital {
+		if rc.op != "=" && rc.op != "!=" {
+			return nil, fmt.Errorf("invalid condition [%s]: digital ports only support = and !=", str)
+		}
+		switch valueStr {
+		case scene_value_on:
+			rc.value = 1
+		case scene_value_off:
+			rc.value = 0
+		default:
+			return nil, fmt.Errorf("invalid condition [%s]: expect on or off", str)
+		}
+		return rc, nil
+	}
+	rc.value, err = strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition [%s]: invalid analog value", str)
+	}
+	return rc, nil
+}
+
+// portValue of the condition's port. false if the status does not contain the port
+func (rc *ruleCondition) portValue(ss *SystemStatus) (float64, bool) {
+	if ss == nil {
+		return 0, false
+	}
+	if rc.digital {
+		if rc.port > len(ss.D) {
+			return 0, false
+		}
+		if ss.D[rc.port-1] > 0 {
+			return 1, true
+		}
+		return 0, true
+	}
+	if rc.port > len(ss.A) {
+		return 0, false
+	}
+	return ss.A[rc.port-1], true
+}
+
+func (rc *ruleCondition) holds(ss *SystemStatus) bool {
+	v, ok := rc.portValue(ss)
+	if !ok || rc.change {
+		return false
+	}
+	switch rc.op {
+	case "=":
+		return v == rc.value
+	case "!=":
+		return v != rc.value
+	case ">":
+		return v > rc.value
+	case "<":
+		return v < rc.value
+	case ">=":
+		return v >= rc.value
+	case "<=":
+		return v <= rc.value
+	}
+	return false
+}
+
+// triggered if the condition became true from the previous to the current status
+func (rc *ruleCondition) triggered(prev *SystemStatus, cur *SystemStatus) bool {
+	prevV, prevOk := rc.portValue(prev)
+	curV, curOk := rc.portValue(cur)
+	if !prevOk || !curOk {
+		return false
+	}
+	if rc.change {
+		return prevV != curV
+	}
+	return !rc.holds(prev) && rc.holds(cur)
+}
+
+func (rc *ruleCondition) String() string {
+	prefix := scene_analog_prefix
+	if rc.digital {
+		prefix = scene_digital_prefix
+	}
+	value := strconv.FormatFloat(rc.value, 'f', -1, 64)
+	switch {
+	case rc.change:
+		value = rule_value_change
+	case rc.digital:
+		value = sceneDigitalValue(rc.value > 0)
+	}
+	return fmt.Sprintf("%s%d%s%s", prefix, rc.port, rc.op, value)
+}
+
+// ruleWindow is a local time window given in minutes of the day
+type ruleWindow struct {
+	from int
+	to   int
+}
+
+func parseRuleWindow(str string) (*ruleWindow, error) {
+	split := strings.Split(strings.ReplaceAll(str, " ", ""), "-")
+	if len(split) != 2 {
+		return nil, fmt.Errorf("invalid time window [%s]: expect hh:mm-hh:mm", str)
+	}
+	rw := new(ruleWindow)
+	for i, s := range split {
+		t, err := time.Parse(rule_time_layout, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window [%s]: expect hh:mm-hh:mm", str)
+		}
+		if i == 0 {
+			rw.from = t.Hour()*60 + t.Minute()
+		} else {
+			rw.to = t.Hour()*60 + t.Minute()
+		}
+	}
+	if rw.from == rw.to {
+		return nil, fmt.Errorf("invalid time window [%s]: window is empty", str)
+	}
+	return rw, nil
+}
+
+func (rw *ruleWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if rw.from < rw.to {
+		return m >= rw.from && m < rw.to
+	}
+	return m >= rw.from || m < rw.to
+}
+
+func (rw *ruleWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", rw.from/60, rw.from%60, rw.to/60, rw.to%60)
+}
+
+// Rule runs commands when a condition of the system status becomes true
+type Rule struct {
+	Name    string
+	When    *ruleCondition
+	If      []*ruleCondition
+	Between *ruleWindow
+	Delay   time.Duration
+	Do      []*Command
+	For     time.Duration
+	Cancel  *ruleCondition
+	// Safety rules run their commands before all other commands, e.g. for interlocks
+	Safety bool
+}
+
+func (r *Rule) String() string {
+	parts := []string{r.Name + ":", rule_key_when, r.When.String()}
+	if r.Between != nil {
+		parts = append(parts, rule_key_between, r.Between.String())
+	}
+	for _, rc := range r.If {
+		parts = append(parts, rule_key_if, rc.String())
+	}
+	if r.Delay > 0 {
+		parts = append(parts, rule_key_delay, formatOffset(r.Delay))
+	}
+	cmds := make([]string, len(r.Do))
+	for i, cmd := range r.Do {
+		cmds[i] = cmd.String()
+	}
+	parts = append(parts, rule_key_do, strings.Join(cmds, rule_list_separator))
+	if r.For > 0 {
+		parts = append(parts, rule_key_for, formatOffset(r.For))
+	}
+	if r.Cancel != nil {
+		parts = append(parts, rule_key_cancel, r.Cancel.String())
+	}
+	if r.Safety {
+		parts = append(parts, rule_key_priority, QP_SAFETY.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// revertCommand undoes a digital command, other commands cannot be reverted
+func revertCommand(cmd *Command) (*Command, bool) {
+	switch cmd.Kind {
+	case CK_SET_DIGITAL:
+		return &Command{Kind: CK_SET_DIGITAL, Port: cmd.Port, On: !cmd.On, Controller: cmd.Controller, Priority: cmd.Priority}, true
+	case CK_TOGGLE:
+		return &Command{Kind: CK_TOGGLE, Port: cmd.Port, Controller: cmd.Controller, Priority: cmd.Priority}, true
+	}
+	return nil, false
+}
+
+func parseRuleDuration(sec *ini.Section, key string) (time.Duration, error) {
+	str := sec.Key(key).String()
+	if str == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("rule [%s]: invalid %s [%s]", sec.Name(), key, str)
+	}
+	return d, nil
+}
+
+func parseRule(sec *ini.Section) (*Rule, error) {
+	var err error
+	r := new(Rule)
+	r.Name = sec.Name()
+	r.When, err = parseRuleCondition(sec.Key(rule_key_when).String(), true)
+	if err != nil {
+		return nil, fmt.Errorf("rule [%s]: %v", r.Name, err)
+	}
+	if str := sec.Key(rule_key_between).String(); str != "" {
+		r.Between, err = parseRuleWindow(str)
+		if err != nil {
+			return nil, fmt.Errorf("rule [%s]: %v", r.Name, err)
+		}
+	}
+	if str := sec.Key(rule_key_if).String(); str != "" {
+		for _, condStr := range strings.Split(str, rule_list_separator) {
+			rc, err := parseRuleCondition(condStr, false)
+			if err != nil {
+				return nil, fmt.Errorf("rule [%s]: %v", r.Name, err)
+			}
+			r.If = append(r.If, rc)
+		}
+	}
+	switch str := strings.ToLower(sec.Key(rule_key_priority).String()); str {
+	case "", QP_NORMAL.String():
+	case QP_SAFETY.String():
+		r.Safety = true
+	default:
+		return nil, fmt.Errorf("rule [%s]: invalid %s [%s], expect %s or %s", r.Name, rule_key_priority, str, QP_NORMAL, QP_SAFETY)
+	}
+	for _, cmdStr := range strings.Split(sec.Key(rule_key_do).String(), rule_list_separator) {
+		cmd, err := ParseCommand(cmdStr)
+		if err != nil {
+			return nil, fmt.Errorf("rule [%s]: %v", r.Name, err)
+		}
+		if r.Safety {
+			cmd.Priority = QP_SAFETY
+		}
+		r.Do = append(r.Do, cmd)
+	}
+	r.Delay, err = parseRuleDuration(sec, rule_key_delay)
+	if err != nil {
+		return nil, err
+	}
+	r.For, err = parseRuleDuration(sec, rule_key_for)
+	if err != nil {
+		return nil, err
+	}
+	if r.For > 0 {
+		for _, cmd := range r.Do {
+			if _, ok := revertCommand(cmd); !ok {
+				return nil, fmt.Errorf("rule [%s]: command [%s] cannot be reverted by for", r.Name, cmd)
+			}
+		}
+	}
+	if str := sec.Key(rule_key_cancel).String(); str != "" {
+		r.Cancel, err = parseRuleCondition(str, true)
+		if err != nil {
+			return nil, fmt.Errorf("rule [%s]: %v", r.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// LoadRulesFromByteArr parses the rules of an ini formatted byte array
+func LoadRulesFromByteArr(data []byte) ([]*Rule, error) {
+	iniFl, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Rule, 0)
+	for _, sec := range iniFl.Sections() {
+		if sec.Name() == ini.DefaultSection {
+			continue
+		}
+		r, err := parseRule(sec)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// RuleAction is a command issued by a rule
+type RuleAction struct {
+	At      time.Time
+	Rule    string
+	Command *Command
+}
+
+func (ra RuleAction) String() string {
+	return fmt.Sprintf("%s [%s] %s", ra.At.Format(rule_trace_layout), ra.Rule, ra.Command)
+}
+
+// rulePending are delayed or revert commands of a rule
+type rulePending struct {
+	rule   *Rule
+	at     time.Time
+	cmds   []*Command
+	revert bool
+}
+
+// ruleEvaluator detects the changes between two system states and fires the rules. it does not
+// depend on the real time, so the same code serves the service and the dry-run
+type ruleEvaluator struct {
+	rules   []*Rule
+	last    *SystemStatus
+	pending []*rulePending
+}
+
+func newRuleEvaluator(rules []*Rule) *ruleEvaluator {
+	re := new(ruleEvaluator)
+	re.rules = rules
+	return re
+}
+
+// setRules replaces the rules. pending commands of rules which still exist are kept
+func (re *ruleEvaluator) setRules(rules []*Rule) {
+	byName := make(map[string]*Rule)
+	for _, r := range rules {
+		byName[r.Name] = r
+	}
+	kept := make([]*rulePending, 0, len(re.pending))
+	for _, p := range re.pending {
+		if r, ok := byName[p.rule.Name]; ok {
+			p.rule = r
+			kept = append(kept, p)
+		}
+	}
+	re.rules = rules
+	re.pending = kept
+}
+
+// schedule pending commands, an existing entry of the same rule and kind is replaced
+func (re *ruleEvaluator) schedule(p *rulePending) {
+	re.cancel(p.rule, func(other *rulePending) bool { return other.revert == p.revert })
+	re.pending = append(re.pending, p)
+}
+
+func (re *ruleEvaluator) cancel(r *Rule, match func(p *rulePending) bool) bool {
+	kept := make([]*rulePending, 0, len(re.pending))
+	for _, p := range re.pending {
+		if p.rule.Name != r.Name || !match(p) {
+			kept = append(kept, p)
+		}
+	}
+	cancelled := len(kept) != len(re.pending)
+	re.pending = kept
+	return cancelled
+}
+
+// fire the commands of a rule at the given time
+func (re *ruleEvaluator) fire(r *Rule, cmds []*Command, at time.Time) []RuleAction {
+	ret := make([]RuleAction, 0, len(cmds))
+	for _, cmd := range cmds {
+		ret = append(ret, RuleAction{At: at, Rule: r.Name, Command: cmd})
+	}
+	if r.For > 0 {
+		reverts := make([]*Command, 0, len(cmds))
+		for _, cmd := range cmds {
+			revert, _ := revertCommand(cmd)
+			reverts = append(reverts, revert)
+		}
+		re.schedule(&rulePending{rule: r, at: at.Add(r.For), cmds: reverts, revert: true})
+	}
+	return ret
+}
+
+func (re *ruleEvaluator) conditionsHold(r *Rule, ss *SystemStatus, now time.Time) bool {
+	if r.Between != nil && !r.Between.contains(now) {
+		return false
+	}
+	for _, rc := range r.If {
+		if !rc.holds(ss) {
+			return false
+		}
+	}
+	return true
+}
+
+// update the system status and return the commands of the fired rules. the first status
+// only initializes the evaluator
+func (re *ruleEvaluator) update(ss *SystemStatus, now time.Time) []RuleAction {
+	prev := re.last
+	re.last = ss
+	ret := make([]RuleAction, 0)
+	if prev == nil {
+		return ret
+	}
+	for _, r := range re.rules {
+		if r.Cancel != nil && r.Cancel.triggered(prev, ss) {
+			re.cancel(r, func(p *rulePending) bool { return true })
+		}
+		if !r.When.triggered(prev, ss) || !re.conditionsHold(r, ss, now) {
+			continue
+		}
+		if r.Delay > 0 {
+			re.schedule(&rulePending{rule: r, at: now.Add(r.Delay), cmds: r.Do})
+			continue
+		}
+		ret = append(ret, re.fire(r, r.Do, now)...)
+	}
+	return ret
+}
+
+// due returns the pending commands up to the given time in the order of their execution
+func (re *ruleEvaluator) due(now time.Time) []RuleAction {
+	ret := make([]RuleAction, 0)
+	for {
+		next, ok := re.nextDue()
+		if !ok || next.After(now) {
+			return ret
+		}
+		for i, p := range re.pending {
+			if !p.at.Equal(next) {
+				continue
+			}
+			re.pending = append(re.pending[:i], re.pending[i+1:]...)
+			if p.revert {
+				for _, cmd := range p.cmds {
+					ret = append(ret, RuleAction{At: p.at, Rule: p.rule.Name, Command: cmd})
+				}
+			} else {
+				ret = append(ret, re.fire(p.rule, p.cmds, p.at)...)
+			}
+			break
+		}
+	}
+}
+
+func (re *ruleEvaluator) nextDue() (time.Time, bool) {
+	var next time.Time
+	for _, p := range re.pending {
+		if next.IsZero() || p.at.Before(next) {
+			next = p.at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// RuleSnapshot is the system status at a point in time
+type RuleSnapshot struct {
+	At     time.Time
+	Status *SystemStatus
+}
+
+// DryRun evaluates the rules for a sequence of system states without a controller. the
+// commands of the rules are not applied to the states. pending commands after the last
+// state are executed as if nothing changed anymore
+func DryRun(rules []*Rule, trace []RuleSnapshot) []RuleAction {
+	re := newRuleEvaluator(rules)
+	ret := make([]RuleAction, 0)
+	for _, snap := range trace {
+		ret = append(ret, re.due(snap.At)...)
+		ret = append(ret, re.update(snap.Status, snap.At)...)
+	}
+	for {
+		next, ok := re.nextDue()
+		if !ok {
+			return ret
+		}
+		ret = append(ret, re.due(next)...)
+	}
+}
+
+// ParseRuleTrace reads the system states for a dry-run. each line holds a local time and the
+// changed ports:
+//
+//	2026-10-19 22:30:00 d12=on a4=31000
+//
+// all ports start as off or 0 at the time of the first line. empty lines and lines starting
+// with # are ignored
+func ParseRuleTrace(data []byte, loc *time.Location) ([]RuleSnapshot, error) {
+	ret := make([]RuleSnapshot, 0)
+	cur := &SystemStatus{D: []int{}, A: []float64{}}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expect a date and a time", lineNr)
+		}
+		at, err := time.ParseInLocation(rule_trace_layout, fields[0]+" "+fields[1], loc)
+		if err != nil {
+			at, err = time.ParseInLocation(schedule_at_layout, fields[0]+" "+fields[1], loc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time, expect [%s]", lineNr, rule_trace_layout)
+		}
+		if len(ret) > 0 && at.Before(ret[len(ret)-1].At) {
+			return nil, fmt.Errorf("line %d: time goes backwards", lineNr)
+		}
+		if len(ret) == 0 {
+			ret = append(ret, RuleSnapshot{At: at, Status: cur})
+		}
+		next := &SystemStatus{D: append([]int{}, cur.D...), A: append([]float64{}, cur.A...)}
+		sc := NewScene("")
+		for _, entry := range fields[2:] {
+			split := strings.SplitN(entry, "=", 2)
+			if len(split) != 2 {
+				return nil, fmt.Errorf("line %d: invalid port [%s]", lineNr, entry)
+			}
+			err = parseSceneEntry("trace", strings.ToLower(split[0]), split[1], sc)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNr, err)
+			}
+		}
+		for port, on := range sc.Digital {
+			for len(next.D) < port {
+				next.D = append(next.D, 0)
+			}
+			next.D[port-1] = 0
+			if on {
+				next.D[port-1] = 1
+			}
+		}
+		for port, value := range sc.Analog {
+			for len(next.A) < port {
+				next.A = append(next.A, 0)
+			}
+			next.A[port-1] = value
+		}
+		ret = append(ret, RuleSnapshot{At: at, Status: next})
+		cur = next
+	}
+	// every state holds all ports of the trace, so the first change of a port is detected
+	for _, snap := range ret {
+		for len(snap.Status.D) < len(cur.D) {
+			snap.Status.D = append(snap.Status.D, 0)
+		}
+		for len(snap.Status.A) < len(cur.A) {
+			snap.Status.A = append(snap.Status.A, 0)
+		}
+	}
+	return ret, scanner.Err()
+}
@@ -0,0 +1,220 @@
+package crebrid
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadRulesFromByteArr(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "complete rule",
+			data: "[night light]\nwhen=d12=on\nbetween=22:00-06:00\nif=d5=off, a2 < 1000\ndelay=30s\ndo=d3=on,d4=on\nfor=5m\ncancel=d12=off",
+			want: []string{"night light: when d12=on between 22:00-06:00 if d5=off if a2<1000 delay 30s do d3=on,d4=on for 5m cancel d12=off"},
+		},
+		{
+			name: "analog threshold",
+			data: "[shutters]\nwhen=a4>30000\ndo=scene=shutters closed",
+			want: []string{"shutters: when a4>30000 do scene=shutters closed"},
+		},
+		{
+			name: "change",
+			data: "[doorbell]\nwhen=d7=change\ndo=d8=toggle",
+			want: []string{"doorbell: when d7=change do d8=toggle"},
+		},
+		{
+			name: "safety interlock",
+			data: "[interlock]\nwhen=d1=on\ndo=d2=off\npriority=Safety",
+			want: []string{"interlock: when d1=on do d2=off priority safety"},
+		},
+		{name: "missing when", data: "[broken]\ndo=d3=on", wantErr: true},
+		{name: "digital greater than", data: "[broken]\nwhen=d3>1\ndo=d3=on", wantErr: true},
+		{name: "change in if", data: "[broken]\nwhen=d3=on\nif=d4=change\ndo=d3=on", wantErr: true},
+		{name: "invalid window", data: "[broken]\nwhen=d3=on\nbetween=22:00\ndo=d3=on", wantErr: true},
+		{name: "analog revert", data: "[broken]\nwhen=d3=on\ndo=a2=100\nfor=5m", wantErr: true},
+		{name: "negative delay", data: "[broken]\nwhen=d3=on\ndo=d4=on\ndelay=-5m", wantErr: true},
+		{name: "invalid priority", data: "[broken]\nwhen=d3=on\ndo=d4=on\npriority=high", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := LoadRulesFromByteArr([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadRulesFromByteArr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]string, len(rules))
+			for i, r := range rules {
+				got[i] = r.String()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadRulesFromByteArr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		trace string
+		want  []string
+	}{
+		{
+			name:  "night light within the window",
+			rules: "[night light]\nwhen=d12=on\nbetween=22:00-06:00\ndo=d3=on\nfor=5m",
+			trace: "2026-10-19 21:00:00 d12=off\n2026-10-19 21:30:00 d12=on\n2026-10-19 21:31:00 d12=off\n2026-10-19 23:30:00 d12=on",
+			want:  []string{"2026-10-19 23:30:00 [night light] d3=on", "2026-10-19 23:35:00 [night light] d3=off"},
+		},
+		{
+			name:  "retrigger extends the revert timer",
+			rules: "[stairs]\nwhen=d12=on\ndo=d3=on\nfor=5m",
+			trace: "2026-10-19 20:00:00 d12=on\n2026-10-19 20:01:00 d12=off\n2026-10-19 20:04:00 d12=on",
+			want:  []string{"2026-10-19 20:00:00 [stairs] d3=on", "2026-10-19 20:04:00 [stairs] d3=on", "2026-10-19 20:09:00 [stairs] d3=off"},
+		},
+		{
+			name:  "delay is cancelled",
+			rules: "[garage]\nwhen=d6=on\ndelay=10m\ndo=d9=on\ncancel=d6=off",
+			trace: "2026-10-19 20:00:00 d6=on\n2026-10-19 20:05:00 d6=off\n2026-10-19 21:00:00 d6=on",
+			want:  []string{"2026-10-19 21:10:00 [garage] d9=on"},
+		},
+		{
+			name:  "analog threshold with condition",
+			rules: "[shutters]\nwhen=a4>30000\nif=d5=off\ndo=d7=off,d8=off",
+			trace: "2026-10-19 12:00:00 a4=20000\n2026-10-19 12:10:00 a4=31000\n2026-10-19 12:20:00 a4=29000 d5=on\n2026-10-19 12:30:00 a4=32000\n2026-10-19 12:40:00 a4=20000 d5=off\n2026-10-19 12:50:00 a4=35000",
+			want:  []string{"2026-10-19 12:10:00 [shutters] d7=off", "2026-10-19 12:10:00 [shutters] d8=off", "2026-10-19 12:50:00 [shutters] d7=off", "2026-10-19 12:50:00 [shutters] d8=off"},
+		},
+		{
+			name:  "delayed command with revert",
+			rules: "[fan]\nwhen=d2=on\ndelay=1m\ndo=d10=toggle\nfor=10m",
+			trace: "2026-10-19 08:00:00 d2=on",
+			want:  []string{"2026-10-19 08:01:00 [fan] d10=toggle", "2026-10-19 08:11:00 [fan] d10=toggle"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := LoadRulesFromByteArr([]byte(tt.rules))
+			if err != nil {
+				t.Fatalf("LoadRulesFromByteArr() error = %v", err)
+			}
+			trace, err := ParseRuleTrace([]byte(tt.trace), time.UTC)
+			if err != nil {
+				t.Fatalf("ParseRuleTrace() error = %v", err)
+			}
+			got := make([]string, 0)
+			for _, ra := range DryRun(rules, trace) {
+				got = append(got, ra.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DryRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRuleTraceErrors(t *testing.T) {
+	for _, trace := range []string{
+		"2026-10-19 d12=on",
+		"2026-10-19 20:00:00 d12",
+		"2026-10-19 20:00:00 x12=on",
+		"2026-10-19 20:00:00 d12=on\n2026-10-19 19:00:00 d12=off",
+	} {
+		_, err := ParseRuleTrace([]byte(trace), time.UTC)
+		if err == nil {
+			t.Errorf("ParseRuleTrace(%q) does not fail", trace)
+		}
+	}
+}
+
+func TestRuleEngineHotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	executed := make(chan string, 16)
+	bus := NewEventBus()
+	re, err := NewRuleEngine(fc, bus, path, func(cmd *Command) error {
+		executed <- cmd.String()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewRuleEngine() error = %v", err)
+	}
+	if len(re.Rules()) != 0 {
+		t.Fatalf("rules without a file: %v", re.Rules())
+	}
+	err = os.WriteFile(path, []byte("[stairs]\nwhen=d1=on\ndo=d2=on\nfor=1m"), 0644)
+	if err != nil {
+		t.Fatalf("unable to write rules: %v", err)
+	}
+	err = re.Reload()
+	if err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := strings.Join(re.Rules(), ";"); got != "stairs: when d1=on do d2=on for 1m" {
+		t.Fatalf("Rules() = %s", got)
+	}
+	// a broken file keeps the active rules
+	err = os.WriteFile(path, []byte("[stairs]\nwhen=d1\ndo=d2=on"), 0644)
+	if err != nil {
+		t.Fatalf("unable to write rules: %v", err)
+	}
+	if re.Reload() == nil {
+		t.Fatalf("Reload() of a broken file does not fail")
+	}
+	re.Start()
+	defer re.Stop()
+	expect := func(want string) {
+		select {
+		case got := <-executed:
+			if got != want {
+				t.Fatalf("executed command = %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("command [%s] was not executed", want)
+		}
+	}
+	// the statuses of other controllers do not trigger the rules
+	bus.Publish(
+		Event{Kind: EK_STATUS, Status: &SystemStatus{D: []int{0, 0}}},
+		Event{Kind: EK_STATUS, Controller: "annex", Status: &SystemStatus{D: []int{1, 0}}},
+		Event{Kind: EK_STATUS, Status: &SystemStatus{D: []int{0, 0}}},
+		Event{Kind: EK_STATUS, Status: &SystemStatus{D: []int{1, 0}}},
+	)
+	expect("d2=on")
+	// the routine may still wait for an earlier timeout, so advance until the revert is due
+	for i := 0; i < 100; i++ {
+		fc.Advance(time.Minute)
+		select {
+		case got := <-executed:
+			if got != "d2=off" {
+				t.Fatalf("executed command = %s, want d2=off", got)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatalf("revert command was not executed")
+}
+
+func TestRuleEngineStopTwice(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	re, err := NewRuleEngine(fc, NewEventBus(), filepath.Join(t.TempDir(), "rules.conf"), func(cmd *Command) error { return nil })
+	if err != nil {
+		t.Fatalf("NewRuleEngine() error = %v", err)
+	}
+	re.Start()
+	re.Stop()
+	// a second stop, e.g. by the shutdown after a restart, does not panic
+	re.Stop()
+}
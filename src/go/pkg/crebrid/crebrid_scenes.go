@@ -0,0 +1,246 @@
+package crebrid
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+	"gopkg.in/ini.v1"
+)
+
+// scenes are stored in an ini file. each section is one scene, each key one port:
+//
+//	[evening]
+//	d3=on
+//	d5=off
+//	a2=30000
+//
+// digital ports are prefixed by 'd', analog ports by 'a'. port numbers start with 1
+// like the IDs send to the controller
+
+const (
+	scene_digital_prefix = "d"
+	scene_analog_prefix  = "a"
+	scene_value_on       = "on"
+	scene_value_off      = "off"
+)
+
+// Scene holds the desired state of a set of digital and analog ports
+type Scene struct {
+	Name    string
+	Digital map[int]bool
+	Analog  map[int]float64
+}
+
+// NewScene with initialized port maps
+func NewScene(name string) *Scene {
+	sc := new(Scene)
+	sc.Name = name
+	sc.Digital = make(map[int]bool)
+	sc.Analog = make(map[int]float64)
+	return sc
+}
+
+// SceneFromSystemStatus captures all ports of a system status as a new scene
+func SceneFromSystemStatus(name string, ss *SystemStatus) *Scene {
+	sc := NewScene(name)
+	for i, v := range ss.D {
+		sc.Digital[i+1] = v > 0
+	}
+	for i, v := range ss.A {
+		sc.Analog[i+1] = v
+	}
+	return sc
+}
+
+// DigitalPorts of the scene in ascending order
+func (sc *Scene) DigitalPorts() []int {
+	ret := make([]int, 0, len(sc.Digital))
+	for port := range sc.Digital {
+		ret = append(ret, port)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// AnalogPorts of the scene in ascending order
+func (sc *Scene) AnalogPorts() []int {
+	ret := make([]int, 0, len(sc.Analog))
+	for port := range sc.Analog {
+		ret = append(ret, port)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// String shows the scene as a single line, e.g. "evening: d3=on d5=off a2=30000"
+func (sc *Scene) String() string {
+	parts := make([]string, 0, len(sc.Digital)+len(sc.Analog))
+	for _, port := range sc.DigitalPorts() {
+		parts = append(parts, fmt.Sprintf("%s%d=%s", scene_digital_prefix, port, sceneDigitalValue(sc.Digital[port])))
+	}
+	for _, port := range sc.AnalogPorts() {
+		parts = append(parts, fmt.Sprintf("%s%d=%s", scene_analog_prefix, port, strconv.FormatFloat(sc.Analog[port], 'f', -1, 64)))
+	}
+	return fmt.Sprintf("%s: %s", sc.Name, strings.Join(parts, " "))
+}
+
+func sceneDigitalValue(on bool) string {
+	if on {
+		return scene_value_on
+	}
+	return scene_value_off
+}
+
+func parseSceneEntry(sceneName string, key string, value string, sc *Scene) error {
+	name := strings.ToLower(key)
+	if len(name) < 2 {
+		return fmt.Errorf("scene [%s]: invalid port key [%s]", sceneName, key)
+	}
+	port, err := strconv.Atoi(name[1:])
+	if err != nil || port < 1 {
+		return fmt.Errorf("scene [%s]: invalid port number in key [%s]", sceneName, key)
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch name[:1] {
+	case scene_digital_prefix:
+		switch value {
+		case scene_value_on, "1", "true":
+			sc.Digital[port] = true
+		case scene_value_off, "0", "false":
+			sc.Digital[port] = false
+		default:
+			return fmt.Errorf("scene [%s]: invalid digital value [%s] for port %d", sceneName, value, port)
+		}
+	case scene_analog_prefix:
+		fv, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("scene [%s]: invalid analog value [%s] for port %d", sceneName, value, port)
+		}
+		sc.Analog[port] = fv
+	default:
+		return fmt.Errorf("scene [%s]: unknown port type in key [%s]", sceneName, key)
+	}
+	return nil
+}
+
+// SceneStore keeps all named scenes known by the service
+type SceneStore interface {
+	// Names of all stored scenes in alphabetical order
+	Names() []string
+	// Get a scene by name
+	Get(name string) (*Scene, bool)
+	// Put a scene into the store. an existing scene with the same name is replaced
+	Put(sc *Scene) error
+	// Save the store to the file it was loaded from
+	Save() error
+}
+
+type sceneStore struct {
+	lock   sync.Mutex
+	path   string
+	scenes map[string]*Scene
+}
+
+// LoadScenesFromByteArr parses the scene definitions of an ini formatted byte array
+func LoadScenesFromByteArr(data []byte) (SceneStore, error) {
+	iniFl, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	ss := new(sceneStore)
+	ss.scenes = make(map[string]*Scene)
+	for _, sec := range iniFl.Sections() {
+		if sec.Name() == ini.DefaultSection {
+			continue
+		}
+		sc := NewScene(sec.Name())
+		for _, key := range sec.Keys() {
+			err = parseSceneEntry(sec.Name(), key.Name(), key.String(), sc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[SCENES] found scene: %s", sc)
+		ss.scenes[sc.Name] = sc
+	}
+	return ss, nil
+}
+
+// LoadScenesFromFile reads the scene definitions from an ini file. a missing file results
+// in an empty store, which will create the file on the first save
+func LoadScenesFromFile(path2File string) (SceneStore, error) {
+	data, err := os.ReadFile(path2File)
+	if err != nil {
+		logging.LogFmt(logging.LOG_WARN, "[SCENES] unable to read scenes from: %s", path2File)
+		data = []byte{}
+	}
+	store, err := LoadScenesFromByteArr(data)
+	if err != nil {
+		return nil, err
+	}
+	store.(*sceneStore).path = path2File
+	return store, nil
+}
+
+func (ss *sceneStore) Names() []string {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ret := make([]string, 0, len(ss.scenes))
+	for name := range ss.scenes {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (ss *sceneStore) Get(name string) (*Scene, bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	sc, ok := ss.scenes[name]
+	return sc, ok
+}
+
+func (ss *sceneStore) Put(sc *Scene) error {
+	if strings.TrimSpace(sc.Name) == "" {
+		return fmt.Errorf("a scene needs a name")
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.scenes[sc.Name] = sc
+	return nil
+}
+
+func (ss *sceneStore) toIni() (*ini.File, error) {
+	iniFl := ini.Empty()
+	for _, name := range ss.Names() {
+		sc, _ := ss.Get(name)
+		sec, err := iniFl.NewSection(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range sc.DigitalPorts() {
+			sec.NewKey(fmt.Sprintf("%s%d", scene_digital_prefix, port), sceneDigitalValue(sc.Digital[port]))
+		}
+		for _, port := range sc.AnalogPorts() {
+			sec.NewKey(fmt.Sprintf("%s%d", scene_analog_prefix, port), strconv.FormatFloat(sc.Analog[port], 'f', -1, 64))
+		}
+	}
+	return iniFl, nil
+}
+
+func (ss *sceneStore) Save() error {
+	if ss.path == "" {
+		return fmt.Errorf("scene store was not loaded from a file")
+	}
+	iniFl, err := ss.toIni()
+	if err != nil {
+		return err
+	}
+	logging.LogFmt(logging.LOG_INFO, "[SCENES] save scenes to: %s", ss.path)
+	return iniFl.SaveTo(ss.path)
+}
@@ -0,0 +1,214 @@
+package crebrid
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+// fakeControllerClient keeps the system state in memory and counts the toggles
+type fakeControllerClient struct {
+	status  SystemStatus
+	toggles map[int]int
+	// analogErr is returned by SetAnalog, e.g. ErrAnalogNotSupported of a v1 controller
+	analogErr error
+}
+
+func newFakeControllerClient(d []int, a []float64) *fakeControllerClient {
+	fcc := new(fakeControllerClient)
+	fcc.status.D = d
+	fcc.status.A = a
+	fcc.toggles = make(map[int]int)
+	return fcc
+}
+
+func (fcc *fakeControllerClient) SetAccessCode(accessCode string) {}
+
+func (fcc *fakeControllerClient) GetSystemStatus() *SystemStatus {
+	return &fcc.status
+}
+
+func (fcc *fakeControllerClient) ToggleSwitch(switchID int) (bool, error) {
+	if switchID < 1 {
+		return true, nil
+	}
+	fcc.toggles[switchID]++
+	fcc.status.D[switchID-1] = 1 - fcc.status.D[switchID-1]
+	return fcc.status.D[switchID-1] > 0, nil
+}
+
+func (fcc *fakeControllerClient) SetDigital(switchID int, on bool) (bool, error) {
+	if (fcc.status.D[switchID-1] > 0) == on {
+		return on, nil
+	}
+	return fcc.ToggleSwitch(switchID)
+}
+
+func (fcc *fakeControllerClient) SetAnalog(port int, value float64) error {
+	if fcc.analogErr != nil {
+		return fcc.analogErr
+	}
+	fcc.status.A[port-1] = value
+	return nil
+}
+
+func (fcc *fakeControllerClient) SetSerial(port int, value string) error {
+	return nil
+}
+
+func (fcc *fakeControllerClient) OnStatusPush(handler func(ss *SystemStatus)) {}
+
+func (fcc *fakeControllerClient) Close() {}
+
+func (fcc *fakeControllerClient) ReDial() error {
+	return nil
+}
+
+func TestLoadScenesFromByteArr(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]*Scene
+		wantErr bool
+	}{
+		{
+			name: "valid scenes",
+			data: "# scenes\n[evening]\nd3=on\nd5=off\na2=30000\n[morning]\nD3=0\nd7=true",
+			want: map[string]*Scene{
+				"evening": {
+					Name:    "evening",
+					Digital: map[int]bool{3: true, 5: false},
+					Analog:  map[int]float64{2: 30000},
+				},
+				"morning": {
+					Name:    "morning",
+					Digital: map[int]bool{3: false, 7: true},
+					Analog:  map[int]float64{},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "empty file",
+			data:    "",
+			want:    map[string]*Scene{},
+			wantErr: false,
+		},
+		{
+			name:    "invalid digital value",
+			data:    "[evening]\nd3=half",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "invalid port number",
+			data:    "[evening]\nd0=on",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "unknown port type",
+			data:    "[evening]\ns3=hello",
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadScenesFromByteArr([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadScenesFromByteArr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.(*sceneStore).scenes, tt.want) {
+				t.Errorf("LoadScenesFromByteArr() = %v, want %v", got.(*sceneStore).scenes, tt.want)
+			}
+		})
+	}
+}
+
+func TestSceneCaptureSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenes.conf")
+	store, err := LoadScenesFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadScenesFromFile() error = %v", err)
+	}
+	sc := SceneFromSystemStatus("evening", &SystemStatus{D: []int{1, 0, 1}, A: []float64{23.5}})
+	err = store.Put(sc)
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	err = store.Save()
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded, err := LoadScenesFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadScenesFromFile() error = %v", err)
+	}
+	got, ok := loaded.Get("evening")
+	if !ok {
+		t.Fatalf("captured scene not found after reload")
+	}
+	if !reflect.DeepEqual(got, sc) {
+		t.Errorf("reloaded scene = %v, want %v", got, sc)
+	}
+}
+
+func TestActivateScene(t *testing.T) {
+	fcc := newFakeControllerClient([]int{0, 1, 0, 1}, []float64{0, 0})
+	me := new(mainExecute)
+	me.clock = NewSystemClock()
+	me.controllers = []*controller{newController(ControllerSettings{Name: DEFAULT_CONTROLLER}, fcc)}
+	sc := &Scene{
+		Name:    "evening",
+		Digital: map[int]bool{1: true, 2: true, 4: false},
+		Analog:  map[int]float64{2: 30000},
+	}
+	for i := 0; i < 2; i++ {
+		err := me.activateScene(sc, ipc.NewServerResponse())
+		if err != nil {
+			t.Fatalf("activateScene() error = %v", err)
+		}
+	}
+	wantD := []int{1, 1, 0, 0}
+	if !reflect.DeepEqual(fcc.status.D, wantD) {
+		t.Errorf("digital state = %v, want %v", fcc.status.D, wantD)
+	}
+	if fcc.status.A[1] != 30000 {
+		t.Errorf("analog port 2 = %v, want %v", fcc.status.A[1], 30000)
+	}
+	// activating twice must not toggle any port twice
+	wantToggles := map[int]int{1: 1, 4: 1}
+	if !reflect.DeepEqual(fcc.toggles, wantToggles) {
+		t.Errorf("toggles = %v, want %v", fcc.toggles, wantToggles)
+	}
+}
+
+func TestActivateSceneWithoutAnalogWrites(t *testing.T) {
+	fcc := newFakeControllerClient([]int{0, 1}, []float64{0, 0})
+	fcc.analogErr = ErrAnalogNotSupported
+	me := new(mainExecute)
+	me.clock = NewSystemClock()
+	me.controllers = []*controller{newController(ControllerSettings{Name: DEFAULT_CONTROLLER}, fcc)}
+	// a scene captured on a v1 controller holds its analog values as well
+	sc := SceneFromSystemStatus("evening", &SystemStatus{D: []int{1, 0}, A: []float64{0, 30000}})
+	sr := ipc.NewServerResponse()
+	if err := me.activateScene(sc, sr); err != nil {
+		t.Fatalf("activateScene() error = %v", err)
+	}
+	wantD := []int{1, 0}
+	if !reflect.DeepEqual(fcc.status.D, wantD) || !reflect.DeepEqual(sr.DigitalPortInfo, map[int]bool{1: true, 2: false}) {
+		t.Errorf("digital state = %v, DigitalPortInfo = %v, want %v", fcc.status.D, sr.DigitalPortInfo, wantD)
+	}
+	// other analog errors still fail the scene
+	fcc.analogErr = ErrInvalidValue
+	if err := me.activateScene(sc, ipc.NewServerResponse()); err == nil {
+		t.Errorf("activateScene() with a rejected analog value succeeded, want an error")
+	}
+}
@@ -0,0 +1,420 @@
+package crebrid
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+	"gopkg.in/ini.v1"
+)
+
+// a schedule is given by one of the following specs:
+//
+//	in 20m                  one-shot timer relative to now
+//	at 2026-10-19 22:00     one-shot timer at a local time (RFC 3339 is accepted as well)
+//	0 7 * * mon-fri         recurring job by a cron expression
+//	sunset+15m              recurring job relative to a sun event (see crebrid_sun.go)
+//
+// jobs are persisted in an ini file, one section per job ID:
+//
+//	[3]
+//	schedule=0 7 * * mon-fri
+//	command=d3=on
+
+const (
+	schedule_in_prefix   = "in "
+	schedule_at_prefix   = "at "
+	schedule_at_layout   = "2006-01-02 15:04"
+	schedule_key_spec    = "schedule"
+	schedule_key_command = "command"
+	// the scheduler never sleeps longer, so it recovers quickly from wall clock changes
+	schedule_max_wait = time.Minute
+)
+
+// scheduleTrigger calculates the points in time a job is due
+type scheduleTrigger interface {
+	// Next time the trigger fires after the given time. false if it never fires again
+	Next(after time.Time) (time.Time, bool)
+	// String returns the spec of the trigger, which is stored in the schedule file
+	String() string
+}
+
+type onceTrigger struct {
+	at time.Time
+}
+
+func (ot *onceTrigger) Next(after time.Time) (time.Time, bool) {
+	if ot.at.After(after) {
+		return ot.at, true
+	}
+	return time.Time{}, false
+}
+
+func (ot *onceTrigger) String() string {
+	return schedule_at_prefix + ot.at.Format(time.RFC3339)
+}
+
+func parseScheduleSpec(spec string, now time.Time, geo *GeoLocation) (scheduleTrigger, error) {
+	spec = strings.TrimSpace(spec)
+	st, isSun, err := parseSunSpec(spec, geo)
+	if isSun {
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+	lower := strings.ToLower(spec)
+	switch {
+	case strings.HasPrefix(lower, schedule_in_prefix):
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len(schedule_in_prefix):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timer [%s]: %v", spec, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid timer [%s]: duration has to be positive", spec)
+		}
+		return &onceTrigger{at: now.Add(d)}, nil
+	case strings.HasPrefix(lower, schedule_at_prefix):
+		atStr := strings.TrimSpace(spec[len(schedule_at_prefix):])
+		at, err := time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			at, err = time.ParseInLocation(schedule_at_layout, atStr, now.Location())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid time [%s]: expect [%s] or RFC 3339", atStr, schedule_at_layout)
+		}
+		return &onceTrigger{at: at}, nil
+	}
+	return ParseCron(spec)
+}
+
+// ScheduleJob is a command executed by the scheduler
+type ScheduleJob struct {
+	ID      string
+	Command *Command
+	Next    time.Time
+	trigger scheduleTrigger
+	// static jobs are added by AddTrigger, they are neither persisted nor removable
+	static bool
+}
+
+// Spec of the job as it is stored in the schedule file
+func (sj *ScheduleJob) Spec() string {
+	return sj.trigger.String()
+}
+
+func (sj *ScheduleJob) String() string {
+	if sj.Next.IsZero() {
+		return fmt.Sprintf("%s: [%s] %s (next: never)", sj.ID, sj.Spec(), sj.Command)
+	}
+	return fmt.Sprintf("%s: [%s] %s (next: %s)", sj.ID, sj.Spec(), sj.Command, sj.Next.Format(schedule_at_layout))
+}
+
+// Scheduler runs commands at recurring or one-shot points in time
+type Scheduler interface {
+	// Start the scheduler routine
+	Start()
+	// Stop the scheduler routine and wait until it is finished
+	Stop()
+	// Add a job by a schedule spec and a command string
+	Add(spec string, cmd string) (*ScheduleJob, error)
+	// AddTrigger adds a static job, which is not persisted and cannot be removed. a trigger
+	// without a next execution stays idle until Reschedule is called
+	AddTrigger(id string, trigger scheduleTrigger, cmd *Command) error
+	// Reschedule calculates the next execution of all static jobs, e.g. after the source of
+	// their triggers changed
+	Reschedule()
+	// Remove the job with the given ID
+	Remove(id string) error
+	// Jobs ordered by their next execution time
+	Jobs() []*ScheduleJob
+}
+
+type scheduler struct {
+	lock     sync.Mutex
+	clock    Clock
+	geo      *GeoLocation
+	path     string
+	jobs     map[string]*ScheduleJob
+	lastID   int
+	run      func(cmd *Command) error
+	changed  chan bool
+	quit     chan bool
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewScheduler loads the jobs from the schedule file. a missing file results in an empty
+// scheduler. an empty path disables the persistence. commands are executed by calling run.
+// sun events can only be scheduled if the geo location is provided
+func NewScheduler(clock Clock, geo *GeoLocation, path2File string, run func(cmd *Command) error) (Scheduler, error) {
+	s := new(scheduler)
+	s.clock = clock
+	s.geo = geo
+	s.path = path2File
+	s.jobs = make(map[string]*ScheduleJob)
+	s.run = run
+	s.changed = make(chan bool, 1)
+	s.quit = make(chan bool)
+	if path2File == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path2File)
+	if err != nil {
+		logging.LogFmt(logging.LOG_WARN, "[SCHEDULER] unable to read schedule from: %s", path2File)
+		return s, nil
+	}
+	err = s.load(data)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *scheduler) load(data []byte) error {
+	iniFl, err := ini.Load(data)
+	if err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	for _, sec := range iniFl.Sections() {
+		if sec.Name() == ini.DefaultSection {
+			continue
+		}
+		id, err := strconv.Atoi(sec.Name())
+		if err != nil {
+			return fmt.Errorf("invalid job ID [%s] in schedule file", sec.Name())
+		}
+		trigger, err := parseScheduleSpec(sec.Key(schedule_key_spec).String(), now, s.geo)
+		if err != nil {
+			return fmt.Errorf("job [%d]: %v", id, err)
+		}
+		cmd, err := ParseCommand(sec.Key(schedule_key_command).String())
+		if err != nil {
+			return fmt.Errorf("job [%d]: %v", id, err)
+		}
+		sj := &ScheduleJob{ID: sec.Name(), Command: cmd, trigger: trigger}
+		next, ok := trigger.Next(now)
+		if !ok {
+			// one-shot timer which elapsed while the service was not running: better late than never
+			logging.LogFmt(logging.LOG_WARN, "[SCHEDULER] job [%s] was missed --> run now", sj.ID)
+			next = now
+		}
+		sj.Next = next
+		s.jobs[sj.ID] = sj
+		if id > s.lastID {
+			s.lastID = id
+		}
+		logging.LogFmt(logging.LOG_DEBUG, "[SCHEDULER] found job: %s", sj)
+	}
+	return nil
+}
+
+// save the jobs. the caller has to hold the lock
+func (s *scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	iniFl := ini.Empty()
+	for _, sj := range s.sortedJobs() {
+		if sj.static {
+			continue
+		}
+		sec, err := iniFl.NewSection(sj.ID)
+		if err != nil {
+			return err
+		}
+		sec.NewKey(schedule_key_spec, sj.Spec())
+		sec.NewKey(schedule_key_command, sj.Command.String())
+	}
+	return iniFl.SaveTo(s.path)
+}
+
+// sortedJobs by next execution, idle jobs come last. the caller has to hold the lock
+func (s *scheduler) sortedJobs() []*ScheduleJob {
+	ret := make([]*ScheduleJob, 0, len(s.jobs))
+	for _, sj := range s.jobs {
+		ret = append(ret, sj)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Next.IsZero() != ret[j].Next.IsZero() {
+			return ret[j].Next.IsZero()
+		}
+		if ret[i].Next.Equal(ret[j].Next) {
+			return ret[i].ID < ret[j].ID
+		}
+		return ret[i].Next.Before(ret[j].Next)
+	})
+	return ret
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.changed <- true:
+	default:
+	}
+}
+
+func (s *scheduler) Add(spec string, cmdStr string) (*ScheduleJob, error) {
+	cmd, err := ParseCommand(cmdStr)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	trigger, err := parseScheduleSpec(spec, now, s.geo)
+	if err != nil {
+		return nil, err
+	}
+	next, ok := trigger.Next(now)
+	if !ok {
+		return nil, fmt.Errorf("schedule [%s] never triggers", spec)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastID++
+	sj := &ScheduleJob{ID: strconv.Itoa(s.lastID), Command: cmd, Next: next, trigger: trigger}
+	s.jobs[sj.ID] = sj
+	logging.LogFmt(logging.LOG_INFO, "[SCHEDULER] add job: %s", sj)
+	s.notify()
+	return sj, s.save()
+}
+
+func (s *scheduler) AddTrigger(id string, trigger scheduleTrigger, cmd *Command) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.jobs[id]; ok {
+		return fmt.Errorf("job [%s] already exists", id)
+	}
+	sj := &ScheduleJob{ID: id, Command: cmd, trigger: trigger, static: true}
+	sj.Next, _ = trigger.Next(s.clock.Now())
+	s.jobs[id] = sj
+	logging.LogFmt(logging.LOG_INFO, "[SCHEDULER] add job: %s", sj)
+	s.notify()
+	return nil
+}
+
+func (s *scheduler) Reschedule() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.clock.Now()
+	for _, sj := range s.jobs {
+		if sj.static {
+			sj.Next, _ = sj.trigger.Next(now)
+			logging.LogFmt(logging.LOG_DEBUG, "[SCHEDULER] reschedule job: %s", sj)
+		}
+	}
+	s.notify()
+}
+
+func (s *scheduler) Remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sj, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("unknown job: %s", id)
+	}
+	if sj.static {
+		return fmt.Errorf("job [%s] is not removable", id)
+	}
+	delete(s.jobs, id)
+	logging.LogFmt(logging.LOG_INFO, "[SCHEDULER] remove job: %s", id)
+	s.notify()
+	return s.save()
+}
+
+func (s *scheduler) Jobs() []*ScheduleJob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sortedJobs()
+}
+
+// takeDue collects all jobs which are due and calculates their next execution
+func (s *scheduler) takeDue(now time.Time) []*Command {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	due := make([]*Command, 0)
+	removed := false
+	for _, sj := range s.sortedJobs() {
+		if sj.Next.IsZero() || sj.Next.After(now) {
+			break
+		}
+		due = append(due, sj.Command)
+		next, ok := sj.trigger.Next(now)
+		if !ok && sj.static {
+			sj.Next = time.Time{}
+			continue
+		}
+		if !ok {
+			logging.LogFmt(logging.LOG_DEBUG, "[SCHEDULER] job [%s] finished", sj.ID)
+			delete(s.jobs, sj.ID)
+			removed = true
+			continue
+		}
+		sj.Next = next
+	}
+	if removed {
+		err := s.save()
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[SCHEDULER] unable to save schedule: %s", err)
+		}
+	}
+	return due
+}
+
+// runDue executes all commands which are due at the given time
+func (s *scheduler) runDue(now time.Time) {
+	for _, cmd := range s.takeDue(now) {
+		logging.LogFmt(logging.LOG_INFO, "[SCHEDULER] run command: %s", cmd)
+		err := s.run(cmd)
+		if err != nil {
+			logging.LogFmt(logging.LOG_ERROR, "[SCHEDULER] command [%s] failed: %s", cmd, err)
+		}
+	}
+}
+
+func (s *scheduler) nextDue() (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jobs := s.sortedJobs()
+	if len(jobs) < 1 || jobs[0].Next.IsZero() {
+		return time.Time{}, false
+	}
+	return jobs[0].Next, true
+}
+
+func (s *scheduler) execute() {
+	defer s.wg.Done()
+	for {
+		s.runDue(s.clock.Now())
+		wait := schedule_max_wait
+		if next, ok := s.nextDue(); ok {
+			if d := next.Sub(s.clock.Now()); d < wait {
+				wait = d
+			}
+		}
+		select {
+		case <-s.clock.After(wait):
+		case <-s.changed:
+		case <-s.quit:
+			logging.Log(logging.LOG_DEBUG, "[SCHEDULER] routine escaped")
+			return
+		}
+	}
+}
+
+func (s *scheduler) Start() {
+	logging.LogFmt(logging.LOG_MAIN, "[SCHEDULER] start with %d jobs", len(s.Jobs()))
+	s.wg.Add(1)
+	go s.execute()
+}
+
+func (s *scheduler) Stop() {
+	// the lifecycle may stop the scheduler more than once
+	s.quitOnce.Do(func() { close(s.quit) })
+	s.wg.Wait()
+}
@@ -0,0 +1,227 @@
+package crebrid
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// fakeClock only moves forward when Advance is called
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	fc := new(fakeClock)
+	fc.now = now
+	return fc
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- fc.now
+		return ch
+	}
+	fc.waiters = append(fc.waiters, fakeWaiter{at: fc.now.Add(d), ch: ch})
+	return ch
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.now = fc.now.Add(d)
+	pending := make([]fakeWaiter, 0, len(fc.waiters))
+	for _, w := range fc.waiters {
+		if w.at.After(fc.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- fc.now
+	}
+	fc.waiters = pending
+}
+
+// waitForWaiter blocks until a routine waits on the clock
+func (fc *fakeClock) waitForWaiter(t *testing.T) {
+	fc.waitForWaiters(t, 1)
+}
+
+// waitForWaiters blocks until at least n waits are pending on the clock
+func (fc *fakeClock) waitForWaiters(t *testing.T, n int) {
+	for i := 0; i < 200; i++ {
+		fc.lock.Lock()
+		pending := len(fc.waiters)
+		fc.lock.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("less than %d routines are waiting on the fake clock", n)
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    *Command
+		wantErr bool
+	}{
+		{name: "digital on", str: "d3=on", want: &Command{Kind: CK_SET_DIGITAL, Port: 3, On: true}},
+		{name: "digital off", str: " D12 = off ", want: &Command{Kind: CK_SET_DIGITAL, Port: 12, On: false}},
+		{name: "toggle", str: "d3=toggle", want: &Command{Kind: CK_TOGGLE, Port: 3}},
+		{name: "analog", str: "a2=30000", want: &Command{Kind: CK_SET_ANALOG, Port: 2, Value: 30000}},
+		{name: "scene", str: "scene=evening", want: &Command{Kind: CK_SCENE, Scene: "evening"}},
+		{name: "controller", str: "annex:d3=on", want: &Command{Kind: CK_SET_DIGITAL, Port: 3, On: true, Controller: "annex"}},
+		{name: "controller toggle", str: " annex : D3=toggle", want: &Command{Kind: CK_TOGGLE, Port: 3, Controller: "annex"}},
+		{name: "missing value", str: "d3", wantErr: true},
+		{name: "missing controller name", str: ":d3=on", wantErr: true},
+		{name: "scene of a controller", str: "annex:scene=evening", wantErr: true},
+		{name: "missing scene name", str: "scene=", wantErr: true},
+		{name: "invalid port", str: "dx=on", wantErr: true},
+		{name: "analog toggle", str: "a2=toggle", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCommand(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCommand() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerRunsJobs(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+	fc := newFakeClock(time.Date(2026, 10, 19, 6, 59, 0, 0, berlin))
+	executed := make(chan string, 16)
+	s, err := NewScheduler(fc, nil, "", func(cmd *Command) error {
+		executed <- cmd.String()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	_, err = s.Add("0 7 * * *", "d3=on")
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	_, err = s.Add("in 20m", "scene=evening")
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	s.Start()
+	defer s.Stop()
+	expect := func(want string) {
+		select {
+		case got := <-executed:
+			if got != want {
+				t.Fatalf("executed command = %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("command [%s] was not executed", want)
+		}
+	}
+	fc.waitForWaiter(t)
+	fc.Advance(time.Minute)
+	expect("d3=on")
+	fc.waitForWaiter(t)
+	fc.Advance(19 * time.Minute)
+	expect("scene=evening")
+	jobs := s.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("one-shot job was not removed: %v", jobs)
+	}
+	want := time.Date(2026, 10, 20, 7, 0, 0, 0, berlin)
+	if !jobs[0].Next.Equal(want) {
+		t.Errorf("next execution = %v, want %v", jobs[0].Next, want)
+	}
+}
+
+func TestSchedulerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.conf")
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	run := func(cmd *Command) error { return nil }
+	s, err := NewScheduler(fc, nil, path, run)
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	for _, job := range [][]string{{"0 7 * * mon-fri", "d3=on"}, {"in 20m", "d3=off"}, {"@daily", "d4=toggle"}} {
+		_, err = s.Add(job[0], job[1])
+		if err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	err = s.Remove("3")
+	if err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	err = s.Remove("3")
+	if err == nil {
+		t.Fatalf("Remove() of an unknown job does not fail")
+	}
+	// the service was not running when the timer elapsed
+	fc.Advance(time.Hour)
+	reloaded, err := NewScheduler(fc, nil, path, run)
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	got := make(map[string]string)
+	for _, sj := range reloaded.Jobs() {
+		got[sj.ID] = sj.Spec() + " -> " + sj.Command.String()
+	}
+	want := map[string]string{
+		"1": "0 7 * * mon-fri -> d3=on",
+		"2": "at 2026-10-19T20:20:00Z -> d3=off",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded jobs = %v, want %v", got, want)
+	}
+	if next := reloaded.Jobs()[0]; next.ID != "2" || !next.Next.Equal(fc.Now()) {
+		t.Errorf("missed timer is not due immediately: %v", next)
+	}
+	sj, err := reloaded.Add("in 5m", "d5=on")
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if sj.ID != "3" {
+		t.Errorf("new job ID = %s, want 3", sj.ID)
+	}
+}
+
+func TestSchedulerStopTwice(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	s, err := NewScheduler(fc, nil, "", func(cmd *Command) error { return nil })
+	if err != nil {
+		t.Fatalf("NewScheduler() error = %v", err)
+	}
+	s.Start()
+	s.Stop()
+	// a second stop, e.g. by the shutdown after a restart, does not panic
+	s.Stop()
+}
@@ -0,0 +1,707 @@
+package crebrid
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// scripts are Starlark files (*.star) in the scripts directory. a script runs once from top
+// to bottom, it can wait for changes in between or register handlers by on_change, which keep
+// the script alive until it is stopped or its timeout elapses. the following builtins are
+// provided, ports start with 1:
+//
+//	status()                  struct with the lists d (bool) and a (float) of all ports
+//	digital(port)             current state of a digital port
+//	analog(port)              current value of an analog port
+//	set(port, on)             set a digital port
+//	toggle(port)              toggle a digital port
+//	set_analog(port, value)   set an analog port
+//	scene(name)               activate a scene
+//	sleep(seconds)            wait for the given time
+//	wait_change(timeout=None) wait for changed ports, e.g. ["d12=on", "a4=31000"]. None on timeout
+//	on_change(fn)             call fn with the changed ports after the script reached its end
+//	now()                     struct with year, month, day, hour, minute, second and weekday
+//	log(*args)                write to the log of the script, print does the same
+//
+// scripts are sandboxed: they cannot load modules or access files. a script may execute at
+// most script_max_steps steps between two waits. the timeout of a script is given by a comment
+// at its top like "# timeout=30m", "# timeout=0" runs the script without a timeout.
+
+const (
+	script_ext            = ".star"
+	script_timeout_header = "# timeout="
+	// steps a script may execute without waiting, protects the service from busy loops
+	script_max_steps = 10000000
+	// lines of a script log kept in memory
+	script_log_lines = 100
+	// number of changes which wait for a script
+	script_change_queue = 64
+	// ScriptDefaultTimeout runs a script with the timeout of its header or the settings
+	ScriptDefaultTimeout time.Duration = -1
+)
+
+// scriptFileOptions let scripts use conditions and loops at the top level like common script
+// languages. they apply to the scripts only, not to every Starlark file of the process
+var scriptFileOptions = &syntax.FileOptions{
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+	Recursion:       true,
+}
+
+type ScriptState int
+
+const (
+	SCS_IDLE ScriptState = iota
+	SCS_RUNNING
+	SCS_FINISHED
+	SCS_STOPPED
+	SCS_FAILED
+)
+
+var scriptStateStr = map[ScriptState]string{
+	SCS_IDLE:     "idle",
+	SCS_RUNNING:  "running",
+	SCS_FINISHED: "finished",
+	SCS_STOPPED:  "stopped",
+	SCS_FAILED:   "failed",
+}
+
+func (ss ScriptState) String() string {
+	return scriptStateStr[ss]
+}
+
+// scriptInfo keeps the state of a script across its runs
+type scriptInfo struct {
+	name     string
+	state    ScriptState
+	started  time.Time
+	ended    time.Time
+	timeout  time.Duration
+	err      error
+	logLines []string
+	run      *scriptRun
+}
+
+func (si *scriptInfo) String() string {
+	switch si.state {
+	case SCS_RUNNING:
+		if si.timeout == 0 {
+			return fmt.Sprintf("%s: running since %s", si.name, si.started.Format(rule_trace_layout))
+		}
+		return fmt.Sprintf("%s: running since %s (timeout %s)", si.name, si.started.Format(rule_trace_layout), formatOffset(si.timeout))
+	case SCS_FINISHED:
+		return fmt.Sprintf("%s: finished at %s", si.name, si.ended.Format(rule_trace_layout))
+	case SCS_STOPPED, SCS_FAILED:
+		return fmt.Sprintf("%s: %s at %s: %s", si.name, si.state, si.ended.Format(rule_trace_layout), si.err)
+	}
+	return fmt.Sprintf("%s: %s", si.name, si.state)
+}
+
+// scriptRun is a single execution of a script
+type scriptRun struct {
+	sm       *scriptManager
+	info     *scriptInfo
+	thread   *starlark.Thread
+	stop     chan bool
+	stopOnce sync.Once
+	stopErr  error
+	stopped  ScriptState
+	changes  chan []string
+	handlers []starlark.Callable
+	logFile  *os.File
+}
+
+// ScriptManager runs the scripts of the scripts directory
+type ScriptManager interface {
+	// Run the script with the given name and timeout. the script runs in the background
+	Run(name string, timeout time.Duration) error
+	// Stop the script with the given name
+	Stop(name string) error
+	// Start to pass the changed ports of the default controller on the event bus to the
+	// running scripts
+	Start()
+	// StopAll running scripts, stop passing the changes and wait until they are finished
+	StopAll()
+	// List the available scripts with their state
+	List() []string
+	// Log of the latest lines written by a script
+	Log(name string) ([]string, error)
+}
+
+type scriptManager struct {
+	lock           sync.Mutex
+	dir            string
+	logDir         string
+	clock          Clock
+	defaultTimeout time.Duration
+	status         func() (*SystemStatus, error)
+	run            func(cmd *Command) error
+	scripts        map[string]*scriptInfo
+	sub            Subscription
+	wg             sync.WaitGroup
+	changesWg      sync.WaitGroup
+}
+
+// NewScriptManager for the scripts of the given directory. the logs of the scripts are
+// written to the log directory, an empty path only keeps them in memory. status reads the
+// current system status, commands are executed by calling run
+func NewScriptManager(clock Clock, bus EventBus, dir string, logDir string, defaultTimeout time.Duration, status func() (*SystemStatus, error), run func(cmd *Command) error) ScriptManager {
+	sm := new(scriptManager)
+	sm.clock = clock
+	sm.dir = dir
+	sm.logDir = logDir
+	sm.defaultTimeout = defaultTimeout
+	sm.status = status
+	sm.run = run
+	sm.scripts = make(map[string]*scriptInfo)
+	// every running script has its own queue, which drops the changes it does not handle
+	sm.sub = bus.Subscribe("scripts", script_change_queue, SCP_DROP_NEWEST, EK_DIGITAL_CHANGED, EK_ANALOG_CHANGED)
+	return sm
+}
+
+// scriptHeaderTimeout reads the timeout of the script header. false if there is none
+func scriptHeaderTimeout(src []byte) (time.Duration, bool, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(src)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			return 0, false, nil
+		}
+		if !strings.HasPrefix(strings.ReplaceAll(line, " ", ""), strings.ReplaceAll(script_timeout_header, " ", "")) {
+			continue
+		}
+		valueStr := strings.TrimSpace(line[strings.Index(line, "=")+1:])
+		if valueStr == "0" {
+			return 0, true, nil
+		}
+		d, err := time.ParseDuration(valueStr)
+		if err != nil || d < 0 {
+			return 0, true, fmt.Errorf("invalid timeout in script header: %s", valueStr)
+		}
+		return d, true, nil
+	}
+	return 0, false, nil
+}
+
+func (sm *scriptManager) scriptPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid script name: %s", name)
+	}
+	return filepath.Join(sm.dir, name+script_ext), nil
+}
+
+func (sm *scriptManager) Run(name string, timeout time.Duration) error {
+	path, err := sm.scriptPath(name)
+	if err != nil {
+		return err
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unknown script: %s", name)
+	}
+	if timeout < 0 {
+		headerTimeout, ok, err := scriptHeaderTimeout(src)
+		if err != nil {
+			return err
+		}
+		timeout = sm.defaultTimeout
+		if ok {
+			timeout = headerTimeout
+		}
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	si, ok := sm.scripts[name]
+	if !ok {
+		si = &scriptInfo{name: name}
+		sm.scripts[name] = si
+	}
+	if si.state == SCS_RUNNING {
+		return fmt.Errorf("script [%s] is already running", name)
+	}
+	sr := &scriptRun{sm: sm, info: si, stop: make(chan bool), changes: make(chan []string, script_change_queue)}
+	// the thread exists before the run is published, so a halt always cancels it
+	sr.thread = &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { sr.log(msg) },
+	}
+	sr.thread.SetMaxExecutionSteps(script_max_steps)
+	si.state = SCS_RUNNING
+	si.started = sm.clock.Now()
+	si.timeout = timeout
+	si.err = nil
+	si.logLines = nil
+	si.run = sr
+	if sm.logDir != "" {
+		sr.logFile, err = os.OpenFile(filepath.Join(sm.logDir, name+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logging.LogFmt(logging.LOG_WARN, "[SCRIPT] unable to open log of script [%s]: %s", name, err)
+		}
+	}
+	logging.LogFmt(logging.LOG_INFO, "[SCRIPT] run script: %s", si)
+	sm.wg.Add(1)
+	go sr.execute(path, src)
+	return nil
+}
+
+func (sm *scriptManager) Stop(name string) error {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	si, ok := sm.scripts[name]
+	if !ok || si.state != SCS_RUNNING {
+		return fmt.Errorf("script [%s] is not running", name)
+	}
+	// the script ends on its next step or wait, the caller must not wait for it, because the
+	// script may wait in the command queue for the caller
+	si.run.halt(SCS_STOPPED, fmt.Errorf("stopped by user"))
+	return nil
+}
+
+func (sm *scriptManager) StopAll() {
+	sm.lock.Lock()
+	for _, si := range sm.scripts {
+		if si.state == SCS_RUNNING {
+			si.run.halt(SCS_STOPPED, fmt.Errorf("service stopped"))
+		}
+	}
+	sm.lock.Unlock()
+	sm.wg.Wait()
+	sm.sub.Close()
+	sm.changesWg.Wait()
+}
+
+func (sm *scriptManager) List() []string {
+	names := make(map[string]bool)
+	entries, err := os.ReadDir(sm.dir)
+	if err != nil {
+		logging.LogFmt(logging.LOG_WARN, "[SCRIPT] unable to read scripts directory [%s]: %s", sm.dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), script_ext) {
+			names[strings.TrimSuffix(entry.Name(), script_ext)] = true
+		}
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	for name := range sm.scripts {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	ret := make([]string, len(sorted))
+	for i, name := range sorted {
+		si, ok := sm.scripts[name]
+		if !ok {
+			si = &scriptInfo{name: name}
+		}
+		ret[i] = si.String()
+	}
+	return ret
+}
+
+func (sm *scriptManager) Log(name string) ([]string, error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	si, ok := sm.scripts[name]
+	if !ok {
+		return nil, fmt.Errorf("script [%s] did not run yet", name)
+	}
+	return append([]string{}, si.logLines...), nil
+}
+
+func (sm *scriptManager) Start() {
+	sm.changesWg.Add(1)
+	go sm.passChanges()
+}
+
+// passChanges of the bus to the running scripts. the changes which are queued together, e.g.
+// the ones of a single status, are passed as one list
+func (sm *scriptManager) passChanges() {
+	defer sm.changesWg.Done()
+	events := sm.sub.Events()
+	for ev := range events {
+		evs := []Event{ev}
+	queued:
+		for {
+			select {
+			case next, ok := <-events:
+				if !ok {
+					break queued
+				}
+				evs = append(evs, next)
+			default:
+				break queued
+			}
+		}
+		sm.changed(evs)
+	}
+}
+
+// changed ports of the events are passed to the running scripts. the scripts address the
+// default controller only, e.g. d12=on or a4=31000
+func (sm *scriptManager) changed(evs []Event) {
+	changes := make([]string, 0)
+	for _, ev := range evs {
+		if ev.Controller == "" {
+			changes = append(changes, ev.Detail)
+		}
+	}
+	if len(changes) < 1 {
+		return
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	for _, si := range sm.scripts {
+		if si.state != SCS_RUNNING {
+			continue
+		}
+		select {
+		case si.run.changes <- changes:
+		default:
+			logging.LogFmt(logging.LOG_WARN, "[SCRIPT] script [%s] does not handle its changes --> drop changes", si.name)
+		}
+	}
+}
+
+// halt the script with the given final state. the caller has to hold the manager lock
+func (sr *scriptRun) halt(state ScriptState, err error) {
+	sr.stopOnce.Do(func() {
+		sr.stopped = state
+		sr.stopErr = err
+		close(sr.stop)
+		sr.thread.Cancel(err.Error())
+	})
+}
+
+func (sr *scriptRun) log(msg string) {
+	line := fmt.Sprintf("%s %s", sr.sm.clock.Now().Format(rule_trace_layout), msg)
+	logging.LogFmt(logging.LOG_DEBUG, "[SCRIPT %s] %s", sr.info.name, msg)
+	sr.sm.lock.Lock()
+	defer sr.sm.lock.Unlock()
+	sr.info.logLines = append(sr.info.logLines, line)
+	if len(sr.info.logLines) > script_log_lines {
+		sr.info.logLines = sr.info.logLines[len(sr.info.logLines)-script_log_lines:]
+	}
+	if sr.logFile != nil {
+		fmt.Fprintln(sr.logFile, line)
+	}
+}
+
+// wait for the duration. a negative duration waits without a limit. false if the script was
+// stopped meanwhile
+func (sr *scriptRun) wait(d time.Duration, changes bool) ([]string, bool) {
+	var timeout <-chan time.Time
+	if d >= 0 {
+		timeout = sr.sm.clock.After(d)
+	}
+	var changeCh chan []string
+	if changes {
+		changeCh = sr.changes
+	}
+	// waiting is not computing, so the script gets a fresh step budget
+	sr.thread.Steps = 0
+	select {
+	case ch := <-changeCh:
+		return ch, true
+	case <-timeout:
+		return nil, true
+	case <-sr.stop:
+		return nil, false
+	}
+}
+
+func (sr *scriptRun) execute(path string, src []byte) {
+	defer sr.sm.wg.Done()
+	sr.sm.lock.Lock()
+	timeout := sr.info.timeout
+	sr.sm.lock.Unlock()
+	if timeout > 0 {
+		go func() {
+			select {
+			case <-sr.sm.clock.After(timeout):
+				sr.sm.lock.Lock()
+				sr.halt(SCS_FAILED, fmt.Errorf("timeout after %s", formatOffset(timeout)))
+				sr.sm.lock.Unlock()
+			case <-sr.stop:
+			}
+		}()
+	}
+	_, err := starlark.ExecFileOptions(scriptFileOptions, sr.thread, path, src, sr.builtins())
+	if err == nil && len(sr.handlers) > 0 {
+		err = sr.dispatch()
+	}
+	sr.sm.lock.Lock()
+	si := sr.info
+	si.ended = sr.sm.clock.Now()
+	si.run = nil
+	select {
+	case <-sr.stop:
+		si.state = sr.stopped
+		si.err = sr.stopErr
+	default:
+		if err != nil {
+			si.state = SCS_FAILED
+			si.err = err
+		} else {
+			si.state = SCS_FINISHED
+		}
+		// release the timeout routine
+		sr.halt(si.state, fmt.Errorf("%s", si.state))
+	}
+	sr.sm.lock.Unlock()
+	if si.err != nil {
+		sr.log(fmt.Sprintf("script %s: %s", si.state, si.err))
+	} else {
+		sr.log("script finished")
+	}
+	logging.LogFmt(logging.LOG_INFO, "[SCRIPT] script ended: %s", si)
+	if sr.logFile != nil {
+		sr.logFile.Close()
+	}
+}
+
+// dispatch changes to the handlers registered by on_change until the script is stopped
+func (sr *scriptRun) dispatch() error {
+	for {
+		changes, ok := sr.wait(-1, true)
+		if !ok {
+			return nil
+		}
+		for _, fn := range sr.handlers {
+			_, err := starlark.Call(sr.thread, fn, starlark.Tuple{stringList(changes)}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func stringList(strs []string) *starlark.List {
+	values := make([]starlark.Value, len(strs))
+	for i, str := range strs {
+		values[i] = starlark.String(str)
+	}
+	return starlark.NewList(values)
+}
+
+func (sr *scriptRun) errStopped() error {
+	return fmt.Errorf("script stopped: %v", sr.stopErr)
+}
+
+func (sr *scriptRun) readStatus() (*SystemStatus, error) {
+	ss, err := sr.sm.status()
+	if err != nil {
+		return nil, err
+	}
+	if ss == nil {
+		return nil, fmt.Errorf("system status is not available")
+	}
+	return ss, nil
+}
+
+func (sr *scriptRun) runCommand(cmd *Command) (starlark.Value, error) {
+	select {
+	case <-sr.stop:
+		return nil, sr.errStopped()
+	default:
+	}
+	err := sr.sm.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func secondsToDuration(v starlark.Value) (time.Duration, error) {
+	f, ok := starlark.AsFloat(v)
+	if !ok || f < 0 {
+		return 0, fmt.Errorf("expect a positive number of seconds, got %s", v)
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+func (sr *scriptRun) builtins() starlark.StringDict {
+	builtin := func(name string, fn func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			ret, err := fn(args, kwargs)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", b.Name(), err)
+			}
+			return ret, nil
+		})
+	}
+	return starlark.StringDict{
+		"status": builtin("status", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackPositionalArgs("status", args, kwargs, 0); err != nil {
+				return nil, err
+			}
+			ss, err := sr.readStatus()
+			if err != nil {
+				return nil, err
+			}
+			d := make([]starlark.Value, len(ss.D))
+			for i, v := range ss.D {
+				d[i] = starlark.Bool(v > 0)
+			}
+			a := make([]starlark.Value, len(ss.A))
+			for i, v := range ss.A {
+				a[i] = starlark.Float(v)
+			}
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"d": starlark.NewList(d),
+				"a": starlark.NewList(a),
+			}), nil
+		}),
+		"digital": builtin("digital", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var port int
+			if err := starlark.UnpackPositionalArgs("digital", args, kwargs, 1, &port); err != nil {
+				return nil, err
+			}
+			ss, err := sr.readStatus()
+			if err != nil {
+				return nil, err
+			}
+			if port < 1 || port > len(ss.D) {
+				return nil, fmt.Errorf("unknown digital port: %d", port)
+			}
+			return starlark.Bool(ss.D[port-1] > 0), nil
+		}),
+		"analog": builtin("analog", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var port int
+			if err := starlark.UnpackPositionalArgs("analog", args, kwargs, 1, &port); err != nil {
+				return nil, err
+			}
+			ss, err := sr.readStatus()
+			if err != nil {
+				return nil, err
+			}
+			if port < 1 || port > len(ss.A) {
+				return nil, fmt.Errorf("unknown analog port: %d", port)
+			}
+			return starlark.Float(ss.A[port-1]), nil
+		}),
+		"set": builtin("set", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var port int
+			var on bool
+			if err := starlark.UnpackArgs("set", args, kwargs, "port", &port, "on", &on); err != nil {
+				return nil, err
+			}
+			return sr.runCommand(&Command{Kind: CK_SET_DIGITAL, Port: port, On: on})
+		}),
+		"toggle": builtin("toggle", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var port int
+			if err := starlark.UnpackArgs("toggle", args, kwargs, "port", &port); err != nil {
+				return nil, err
+			}
+			return sr.runCommand(&Command{Kind: CK_TOGGLE, Port: port})
+		}),
+		"set_analog": builtin("set_analog", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var port int
+			var value starlark.Value
+			if err := starlark.UnpackArgs("set_analog", args, kwargs, "port", &port, "value", &value); err != nil {
+				return nil, err
+			}
+			f, ok := starlark.AsFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("expect a number, got %s", value.Type())
+			}
+			return sr.runCommand(&Command{Kind: CK_SET_ANALOG, Port: port, Value: f})
+		}),
+		"scene": builtin("scene", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			if err := starlark.UnpackArgs("scene", args, kwargs, "name", &name); err != nil {
+				return nil, err
+			}
+			return sr.runCommand(&Command{Kind: CK_SCENE, Scene: name})
+		}),
+		"sleep": builtin("sleep", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var seconds starlark.Value
+			if err := starlark.UnpackArgs("sleep", args, kwargs, "seconds", &seconds); err != nil {
+				return nil, err
+			}
+			d, err := secondsToDuration(seconds)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := sr.wait(d, false); !ok {
+				return nil, sr.errStopped()
+			}
+			return starlark.None, nil
+		}),
+		"wait_change": builtin("wait_change", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var timeout starlark.Value = starlark.None
+			if err := starlark.UnpackArgs("wait_change", args, kwargs, "timeout?", &timeout); err != nil {
+				return nil, err
+			}
+			d := time.Duration(-1)
+			if timeout != starlark.None {
+				var err error
+				d, err = secondsToDuration(timeout)
+				if err != nil {
+					return nil, err
+				}
+			}
+			changes, ok := sr.wait(d, true)
+			if !ok {
+				return nil, sr.errStopped()
+			}
+			if changes == nil {
+				return starlark.None, nil
+			}
+			return stringList(changes), nil
+		}),
+		"on_change": builtin("on_change", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var fn starlark.Callable
+			if err := starlark.UnpackArgs("on_change", args, kwargs, "fn", &fn); err != nil {
+				return nil, err
+			}
+			sr.handlers = append(sr.handlers, fn)
+			return starlark.None, nil
+		}),
+		"now": builtin("now", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackPositionalArgs("now", args, kwargs, 0); err != nil {
+				return nil, err
+			}
+			t := sr.sm.clock.Now()
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"year":    starlark.MakeInt(t.Year()),
+				"month":   starlark.MakeInt(int(t.Month())),
+				"day":     starlark.MakeInt(t.Day()),
+				"hour":    starlark.MakeInt(t.Hour()),
+				"minute":  starlark.MakeInt(t.Minute()),
+				"second":  starlark.MakeInt(t.Second()),
+				"weekday": starlark.String(strings.ToLower(t.Weekday().String()[:3])),
+			}), nil
+		}),
+		"log": builtin("log", func(args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if len(kwargs) > 0 {
+				return nil, fmt.Errorf("unexpected keyword arguments")
+			}
+			parts := make([]string, len(args))
+			for i, arg := range args {
+				if s, ok := starlark.AsString(arg); ok {
+					parts[i] = s
+				} else {
+					parts[i] = arg.String()
+				}
+			}
+			sr.log(strings.Join(parts, " "))
+			return starlark.None, nil
+		}),
+	}
+}
@@ -0,0 +1,299 @@
+package crebrid
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.starlark.net/resolve"
+)
+
+// scriptTestHarness applies the commands of the scripts to an in-memory system status
+type scriptTestHarness struct {
+	lock     sync.Mutex
+	dir      string
+	status   *SystemStatus
+	executed []string
+	clock    *fakeClock
+	bus      EventBus
+	sm       ScriptManager
+}
+
+func newScriptTestHarness(t *testing.T) *scriptTestHarness {
+	sh := new(scriptTestHarness)
+	sh.dir = t.TempDir()
+	sh.status = &SystemStatus{D: []int{0, 0, 0, 0}, A: []float64{0, 0}}
+	sh.clock = newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	sh.bus = NewEventBus()
+	sh.sm = NewScriptManager(sh.clock, sh.bus, sh.dir, sh.dir, 10*time.Minute, sh.readStatus, sh.run)
+	return sh
+}
+
+func (sh *scriptTestHarness) readStatus() (*SystemStatus, error) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	return &SystemStatus{D: append([]int{}, sh.status.D...), A: append([]float64{}, sh.status.A...)}, nil
+}
+
+func (sh *scriptTestHarness) run(cmd *Command) error {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	sh.executed = append(sh.executed, cmd.String())
+	switch cmd.Kind {
+	case CK_SET_DIGITAL:
+		sh.status.D[cmd.Port-1] = 0
+		if cmd.On {
+			sh.status.D[cmd.Port-1] = 1
+		}
+	case CK_TOGGLE:
+		sh.status.D[cmd.Port-1] = 1 - sh.status.D[cmd.Port-1]
+	case CK_SET_ANALOG:
+		sh.status.A[cmd.Port-1] = cmd.Value
+	}
+	return nil
+}
+
+func (sh *scriptTestHarness) writeScript(t *testing.T, name string, src string) {
+	err := os.WriteFile(filepath.Join(sh.dir, name+script_ext), []byte(src), 0644)
+	if err != nil {
+		t.Fatalf("unable to write script: %v", err)
+	}
+}
+
+func (sh *scriptTestHarness) executedCommands() []string {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	return append([]string{}, sh.executed...)
+}
+
+// waitForState waits until the script has the state given by the prefix of its list entry
+func (sh *scriptTestHarness) waitForState(t *testing.T, name string, prefix string) string {
+	entry := ""
+	for i := 0; i < 200; i++ {
+		for _, e := range sh.sm.List() {
+			if strings.HasPrefix(e, name+": ") {
+				entry = e
+			}
+		}
+		if strings.HasPrefix(entry, name+": "+prefix) {
+			return entry
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("script state = %s, want %s", entry, prefix)
+	return ""
+}
+
+func TestScriptRunsCommands(t *testing.T) {
+	sh := newScriptTestHarness(t)
+	sh.writeScript(t, "shutters", `
+log("start", now().hour)
+for port in [1, 2]:
+    set(port, True)
+sleep(30)
+if digital(1) and not digital(3):
+    toggle(3)
+set_analog(2, 30000)
+print("analog", analog(2), len(status().d))
+`)
+	err := sh.sm.Run("shutters", ScriptDefaultTimeout)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if sh.sm.Run("shutters", ScriptDefaultTimeout) == nil {
+		t.Errorf("Run() of a running script does not fail")
+	}
+	sh.waitForState(t, "shutters", "running")
+	sh.clock.waitForWaiter(t)
+	sh.clock.Advance(30 * time.Second)
+	sh.waitForState(t, "shutters", "finished")
+	want := []string{"d1=on", "d2=on", "d3=toggle", "a2=30000"}
+	if got := sh.executedCommands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("executed commands = %v, want %v", got, want)
+	}
+	lines, err := sh.sm.Log("shutters")
+	if err != nil {
+		t.Fatalf("Log() error = %v", err)
+	}
+	wantLines := []string{
+		"2026-10-19 20:00:00 start 20",
+		"2026-10-19 20:00:30 analog 30000.0 4",
+		"2026-10-19 20:00:30 script finished",
+	}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("Log() = %v, want %v", lines, wantLines)
+	}
+	data, err := os.ReadFile(filepath.Join(sh.dir, "shutters.log"))
+	if err != nil || strings.Count(string(data), "\n") != 3 {
+		t.Errorf("log file = %q, error = %v", data, err)
+	}
+}
+
+func TestScriptWaitsForChanges(t *testing.T) {
+	sh := newScriptTestHarness(t)
+	sh.writeScript(t, "doorbell", `# timeout=0
+changes = wait_change()
+if "d4=on" in changes:
+    set(1, True)
+def handler(changes):
+    log("changed", changes)
+on_change(handler)
+`)
+	sh.sm.Start()
+	defer sh.sm.StopAll()
+	err := sh.sm.Run("doorbell", ScriptDefaultTimeout)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if entry := sh.waitForState(t, "doorbell", "running"); strings.Contains(entry, "timeout") {
+		t.Errorf("script without timeout: %s", entry)
+	}
+	off := &SystemStatus{D: []int{0, 0, 0, 0}, A: []float64{0, 0}}
+	rang := &SystemStatus{D: []int{0, 0, 0, 1}, A: []float64{0, 0}}
+	sh.bus.Publish(DiffSystemStatus(off, rang, sh.clock.Now())...)
+	for i := 0; i < 200 && len(sh.executedCommands()) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// the changes of other controllers are not passed to the scripts
+	sh.bus.Publish(Event{Kind: EK_DIGITAL_CHANGED, Controller: "annex", Port: 4, On: false, Detail: "annex:d4=off"})
+	sh.bus.Publish(DiffSystemStatus(rang, &SystemStatus{D: []int{0, 0, 0, 1}, A: []float64{0, 12.5}}, sh.clock.Now())...)
+	for i := 0; i < 200; i++ {
+		lines, _ := sh.sm.Log("doorbell")
+		if len(lines) > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	err = sh.sm.Stop("doorbell")
+	if err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	sh.waitForState(t, "doorbell", "stopped")
+	if got := sh.executedCommands(); !reflect.DeepEqual(got, []string{"d1=on"}) {
+		t.Errorf("executed commands = %v", got)
+	}
+	lines, _ := sh.sm.Log("doorbell")
+	if len(lines) < 1 || lines[0] != `2026-10-19 20:00:00 changed ["a2=12.5"]` {
+		t.Errorf("Log() = %v", lines)
+	}
+}
+
+func TestScriptFileOptions(t *testing.T) {
+	sh := newScriptTestHarness(t)
+	sh.writeScript(t, "count", `
+def fib(n):
+    if n < 2:
+        return n
+    return fib(n - 1) + fib(n - 2)
+port = 0
+while port < 2:
+    port += 1
+set_analog(port, fib(10))
+`)
+	err := sh.sm.Run("count", ScriptDefaultTimeout)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	sh.waitForState(t, "count", "finished")
+	want := []string{"a2=55"}
+	if got := sh.executedCommands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("executed commands = %v, want %v", got, want)
+	}
+	// the options of the scripts do not leak into other Starlark files
+	if resolve.AllowGlobalReassign || resolve.AllowRecursion {
+		t.Errorf("resolve.AllowGlobalReassign = %v, resolve.AllowRecursion = %v, want false", resolve.AllowGlobalReassign, resolve.AllowRecursion)
+	}
+}
+
+func TestScriptStopRightAfterRun(t *testing.T) {
+	sh := newScriptTestHarness(t)
+	sh.writeScript(t, "busy", "while True:\n    pass")
+	err := sh.sm.Run("busy", ScriptDefaultTimeout)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	// the stop may come before the script executes, its thread is cancelled anyway
+	sm := sh.sm.(*scriptManager)
+	sm.lock.Lock()
+	run := sm.scripts["busy"].run
+	sm.lock.Unlock()
+	if run == nil || run.thread == nil {
+		t.Fatalf("run of the script = %v, want a run with a thread", run)
+	}
+	if err := sh.sm.Stop("busy"); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	entry := sh.waitForState(t, "busy", "stopped")
+	if !strings.HasSuffix(entry, "stopped by user") {
+		t.Errorf("script state = %s, want stopped by user", entry)
+	}
+}
+
+func TestScriptFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		timeout time.Duration
+		advance time.Duration
+		want    string
+	}{
+		{name: "syntax", src: "set(1, True", want: "failed"},
+		{name: "load", src: `load("os.star", "remove")`, want: "failed"},
+		{name: "unknown port", src: "digital(12)", want: "failed at 2026-10-19 20:00:00: digital: unknown digital port: 12"},
+		{name: "timeout", src: "while True:\n    sleep(10)", timeout: time.Minute, advance: time.Minute, want: "failed at 2026-10-19 20:01:00: timeout after 1m"},
+		{name: "busy", src: "while True:\n    pass", want: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := newScriptTestHarness(t)
+			sh.writeScript(t, tt.name, tt.src)
+			timeout := ScriptDefaultTimeout
+			if tt.timeout > 0 {
+				timeout = tt.timeout
+			}
+			err := sh.sm.Run(tt.name, timeout)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if tt.advance > 0 {
+				// the timeout routine waits as well as the script
+				sh.clock.waitForWaiters(t, 2)
+				sh.clock.Advance(tt.advance)
+			}
+			sh.waitForState(t, tt.name, tt.want)
+		})
+	}
+}
+
+func TestScriptHeaderTimeout(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    time.Duration
+		wantOk  bool
+		wantErr bool
+	}{
+		{src: "# timeout=30m\nset(1, True)", want: 30 * time.Minute, wantOk: true},
+		{src: "# shutters\n# timeout = 0\n", want: 0, wantOk: true},
+		{src: "set(1, True)\n# timeout=30m", wantOk: false},
+		{src: "# timeout=soon", wantOk: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, ok, err := scriptHeaderTimeout([]byte(tt.src))
+		if (err != nil) != tt.wantErr || ok != tt.wantOk || got != tt.want {
+			t.Errorf("scriptHeaderTimeout(%q) = %v, %v, %v", tt.src, got, ok, err)
+		}
+	}
+}
+
+func TestScriptInvalidName(t *testing.T) {
+	sh := newScriptTestHarness(t)
+	for _, name := range []string{"", "../secret", ".hidden", "missing"} {
+		if sh.sm.Run(name, ScriptDefaultTimeout) == nil {
+			t.Errorf("Run(%q) does not fail", name)
+		}
+	}
+}
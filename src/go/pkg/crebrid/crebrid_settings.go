@@ -1,19 +1,141 @@
 package crebrid
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
 	"github.com/dachunky/crestrontcpbridge/pkg/logging"
 	"gopkg.in/ini.v1"
 )
 
 // {"serverIP":"192.168.178.32","port":43123,"accessCode":"3H34GJ67NH"}
 
-type CrebridDSettings struct {
+// DEFAULT_CONTROLLER is the name of the controller of the root section. requests without a
+// controller address it, and so do the scenes, rules and scripts
+const DEFAULT_CONTROLLER = "main"
+
+// errCIPListen rejects a controller which is expected to connect by cip, the control system
+// never connects to a panel
+var errCIPListen = fmt.Errorf("protocol %s needs an %s instead of a %s", WP_CIP, configFileKeyString[cfk_ip], configFileKeyString[cfk_listen_port])
+
+// settings_controller_prefix of the sections of further controllers, e.g. [controller.annex]
+const settings_controller_prefix = "controller."
+
+// ControllerSettings of a single controller
+type ControllerSettings struct {
+	Name       string
 	IP         string
 	Port       int
-	IPCPort    int
+	ListenPort int
 	AccessCode string
+	// Backend which connects to the controller, e.g. BACKEND_TELNET
+	Backend  string
+	Protocol WireProtocol
+	IPID     int
+	// StatusLayout is the number of digital and analog values of the status of the controller
+	StatusLayout StatusLayout
+}
+
+type CrebridDSettings struct {
+	IP   string
+	Port int
+	// ListenPort is the port crebrid waits on for the controller to connect, 0 dials the
+	// controller on IP and Port
+	ListenPort    int
+	IPCPort       int
+	AccessCode    string
+	ScenesFile    string
+	ScheduleFile  string
+	CalendarsFile string
+	RulesFile     string
+	ScriptsDir    string
+	ScriptsLogDir string
+	ScriptTimeout time.Duration
+	PollInterval  time.Duration
+	StatusMaxAge  time.Duration
+	QueueSize     int
+	// CaptureFile records the connections to the controllers and the IPC clients, empty
+	// disables the recording
+	CaptureFile string
+	// Backend which connects to the controller, e.g. BACKEND_TELNET
+	Backend string
+	// Protocol spoken with the controller, v1 by default, so the old telnet server module keeps
+	// working. v2 needs the new module
+	Protocol WireProtocol
+	// IPID crebrid registers with at the control system if the protocol is cip
+	IPID int
+	// KeepAlive is the period of the TCP keep-alive probes, 0 disables them
+	KeepAlive         time.Duration
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+	ConnectPolicy     OperationPolicy
+	StatusPolicy      OperationPolicy
+	TogglePolicy      OperationPolicy
+	AnalogPolicy      OperationPolicy
+	SerialPolicy      OperationPolicy
+	RetryDelay        time.Duration
+	IPCReadPolicy     ipc.ReadPolicy
+	// StatusLayout is the number of digital and analog values of the status of the controller
+	StatusLayout StatusLayout
+	Latitude     float64
+	Longitude    float64
+	// Controllers of the controller sections, the default controller of the root section is
+	// not part of it
+	Controllers []ControllerSettings
+}
+
+// AllControllers with the default controller first
+func (cs *CrebridDSettings) AllControllers() []ControllerSettings {
+	main := ControllerSettings{
+		Name:         DEFAULT_CONTROLLER,
+		IP:           cs.IP,
+		Port:         cs.Port,
+		ListenPort:   cs.ListenPort,
+		AccessCode:   cs.AccessCode,
+		Backend:      cs.Backend,
+		Protocol:     cs.Protocol,
+		IPID:         cs.IPID,
+		StatusLayout: cs.StatusLayout,
+	}
+	return append([]ControllerSettings{main}, cs.Controllers...)
+}
+
+// ControllerPolicy is the client policy of the settings with the protocol, the IP ID and the
+// status layout of the controller
+func (cs *CrebridDSettings) ControllerPolicy(ctrl ControllerSettings) ClientPolicy {
+	cp := cs.ClientPolicy()
+	cp.Protocol = ctrl.Protocol
+	cp.IPID = ctrl.IPID
+	cp.Layout = ctrl.StatusLayout
+	return cp
+}
+
+// ClientPolicy of the controller client by the settings
+func (cs *CrebridDSettings) ClientPolicy() ClientPolicy {
+	return ClientPolicy{
+		Protocol:   cs.Protocol,
+		KeepAlive:  cs.KeepAlive,
+		RetryDelay: cs.RetryDelay,
+		Connect:    cs.ConnectPolicy,
+		Status:     cs.StatusPolicy,
+		Toggle:     cs.TogglePolicy,
+		Analog:     cs.AnalogPolicy,
+		Serial:     cs.SerialPolicy,
+		Layout:     cs.StatusLayout,
+		IPID:       cs.IPID,
+	}
+}
+
+// GeoLocation of the settings. nil if latitude and longitude are not configured
+func (cs *CrebridDSettings) GeoLocation() *GeoLocation {
+	// 0°N 0°E is in the middle of the ocean, so it is used as "not configured"
+	if cs.Latitude == 0 && cs.Longitude == 0 {
+		return nil
+	}
+	return &GeoLocation{Latitude: cs.Latitude, Longitude: cs.Longitude}
 }
 
 type configFileKey int
@@ -21,15 +143,85 @@ type configFileKey int
 const (
 	cfk_ip configFileKey = iota
 	cfk_port
+	cfk_listen_port
 	cfk_ipc_port
 	cfk_access_code
+	cfk_scenes_file
+	cfk_schedule_file
+	cfk_calendars_file
+	cfk_rules_file
+	cfk_scripts_dir
+	cfk_scripts_log_dir
+	cfk_script_timeout
+	cfk_capture_file
+	cfk_poll_interval
+	cfk_status_max_age
+	cfk_queue_size
+	cfk_backend
+	cfk_protocol
+	cfk_ip_id
+	cfk_keep_alive
+	cfk_heartbeat_interval
+	cfk_heartbeat_misses
+	cfk_connect_timeout
+	cfk_connect_retries
+	cfk_status_timeout
+	cfk_status_retries
+	cfk_toggle_timeout
+	cfk_toggle_retries
+	cfk_analog_timeout
+	cfk_analog_retries
+	cfk_serial_timeout
+	cfk_serial_retries
+	cfk_retry_delay
+	cfk_ipc_read_retries
+	cfk_ipc_read_retry_delay
+	cfk_digital_ports
+	cfk_analog_ports
+	cfk_latitude
+	cfk_longitude
 )
 
 var configFileKeyString = map[configFileKey]string{
-	cfk_ip:          "ip",
-	cfk_port:        "port",
-	cfk_ipc_port:    "ipcPort",
-	cfk_access_code: "accessCode",
+	cfk_ip:                   "ip",
+	cfk_port:                 "port",
+	cfk_listen_port:          "listenPort",
+	cfk_ipc_port:             "ipcPort",
+	cfk_access_code:          "accessCode",
+	cfk_scenes_file:          "scenesFile",
+	cfk_schedule_file:        "scheduleFile",
+	cfk_calendars_file:       "calendarsFile",
+	cfk_rules_file:           "rulesFile",
+	cfk_scripts_dir:          "scriptsDir",
+	cfk_scripts_log_dir:      "scriptsLogDir",
+	cfk_script_timeout:       "scriptTimeout",
+	cfk_capture_file:         "captureFile",
+	cfk_poll_interval:        "pollInterval",
+	cfk_status_max_age:       "statusMaxAge",
+	cfk_queue_size:           "queueSize",
+	cfk_backend:              "backend",
+	cfk_protocol:             "protocol",
+	cfk_ip_id:                "ipID",
+	cfk_keep_alive:           "keepAlive",
+	cfk_heartbeat_interval:   "heartbeatInterval",
+	cfk_heartbeat_misses:     "heartbeatMisses",
+	cfk_connect_timeout:      "connectTimeout",
+	cfk_connect_retries:      "connectRetries",
+	cfk_status_timeout:       "statusTimeout",
+	cfk_status_retries:       "statusRetries",
+	cfk_toggle_timeout:       "toggleTimeout",
+	cfk_toggle_retries:       "toggleRetries",
+	cfk_analog_timeout:       "analogTimeout",
+	cfk_analog_retries:       "analogRetries",
+	cfk_serial_timeout:       "serialTimeout",
+	cfk_serial_retries:       "serialRetries",
+	cfk_retry_delay:          "retryDelay",
+	cfk_ipc_read_retries:     "ipcReadRetries",
+	cfk_ipc_read_retry_delay: "ipcReadRetryDelay",
+	cfk_digital_ports:        "digitalPorts",
+	cfk_analog_ports:         "analogPorts",
+	cfk_latitude:             "latitude",
+	cfk_longitude:            "longitude",
 }
 
 func LoadFromByteArr(data []byte) (*CrebridDSettings, error) {
@@ -39,6 +231,8 @@ func LoadFromByteArr(data []byte) (*CrebridDSettings, error) {
 	}
 	cs := new(CrebridDSettings)
 	sec := iniFl.Section("")
+	cp := DefaultClientPolicy()
+	rp := ipc.DefaultReadPolicy()
 	for enm, key := range configFileKeyString {
 		logging.LogFmt(logging.LOG_DEBUG, "found entry: %s", key)
 		switch enm {
@@ -46,15 +240,147 @@ func LoadFromByteArr(data []byte) (*CrebridDSettings, error) {
 			cs.IP = sec.Key(key).MustString("192.168.178.32")
 		case cfk_port:
 			cs.Port = sec.Key(key).MustInt(43123)
+		case cfk_listen_port:
+			cs.ListenPort = sec.Key(key).MustInt(0)
 		case cfk_ipc_port:
 			cs.IPCPort = sec.Key(key).MustInt(65432)
 		case cfk_access_code:
 			cs.AccessCode = sec.Key(key).MustString("3H34GJ67NH")
+		case cfk_scenes_file:
+			cs.ScenesFile = sec.Key(key).MustString("/etc/crebrid/scenes.conf")
+		case cfk_schedule_file:
+			cs.ScheduleFile = sec.Key(key).MustString("/etc/crebrid/schedule.conf")
+		case cfk_calendars_file:
+			cs.CalendarsFile = sec.Key(key).MustString("/etc/crebrid/calendars.conf")
+		case cfk_rules_file:
+			cs.RulesFile = sec.Key(key).MustString("/etc/crebrid/rules.conf")
+		case cfk_scripts_dir:
+			cs.ScriptsDir = sec.Key(key).MustString("/etc/crebrid/scripts")
+		case cfk_scripts_log_dir:
+			cs.ScriptsLogDir = sec.Key(key).MustString("/var/log/crebrid/scripts")
+		case cfk_script_timeout:
+			cs.ScriptTimeout = sec.Key(key).MustDuration(10 * time.Minute)
+		case cfk_capture_file:
+			cs.CaptureFile = sec.Key(key).String()
+		case cfk_poll_interval:
+			cs.PollInterval = sec.Key(key).MustDuration(5 * time.Second)
+		case cfk_status_max_age:
+			cs.StatusMaxAge = sec.Key(key).MustDuration(10 * time.Second)
+		case cfk_queue_size:
+			cs.QueueSize = sec.Key(key).MustInt(32)
+		case cfk_backend:
+			// resolved with the protocol once every key is read
+			cs.Backend = sec.Key(key).String()
+		case cfk_protocol:
+			cs.Protocol, err = ParseWireProtocol(sec.Key(key).MustString(cp.Protocol.String()))
+			if err != nil {
+				return nil, err
+			}
+		case cfk_ip_id:
+			cs.IPID, err = ParseCIPIPID(sec.Key(key).MustString(fmt.Sprintf("%02X", cp.IPID)))
+			if err != nil {
+				return nil, err
+			}
+		case cfk_keep_alive:
+			cs.KeepAlive = sec.Key(key).MustDuration(cp.KeepAlive)
+		case cfk_heartbeat_interval:
+			cs.HeartbeatInterval = sec.Key(key).MustDuration(DefaultLinkPolicy().HeartbeatInterval)
+		case cfk_heartbeat_misses:
+			cs.HeartbeatMisses = sec.Key(key).MustInt(DefaultLinkPolicy().HeartbeatMisses)
+		case cfk_connect_timeout:
+			cs.ConnectPolicy.Timeout = sec.Key(key).MustDuration(cp.Connect.Timeout)
+		case cfk_connect_retries:
+			cs.ConnectPolicy.Retries = sec.Key(key).MustInt(cp.Connect.Retries)
+		case cfk_status_timeout:
+			cs.StatusPolicy.Timeout = sec.Key(key).MustDuration(cp.Status.Timeout)
+		case cfk_status_retries:
+			cs.StatusPolicy.Retries = sec.Key(key).MustInt(cp.Status.Retries)
+		case cfk_toggle_timeout:
+			cs.TogglePolicy.Timeout = sec.Key(key).MustDuration(cp.Toggle.Timeout)
+		case cfk_toggle_retries:
+			cs.TogglePolicy.Retries = sec.Key(key).MustInt(cp.Toggle.Retries)
+		case cfk_analog_timeout:
+			cs.AnalogPolicy.Timeout = sec.Key(key).MustDuration(cp.Analog.Timeout)
+		case cfk_analog_retries:
+			cs.AnalogPolicy.Retries = sec.Key(key).MustInt(cp.Analog.Retries)
+		case cfk_serial_timeout:
+			cs.SerialPolicy.Timeout = sec.Key(key).MustDuration(cp.Serial.Timeout)
+		case cfk_serial_retries:
+			cs.SerialPolicy.Retries = sec.Key(key).MustInt(cp.Serial.Retries)
+		case cfk_retry_delay:
+			cs.RetryDelay = sec.Key(key).MustDuration(cp.RetryDelay)
+		case cfk_ipc_read_retries:
+			cs.IPCReadPolicy.Retries = sec.Key(key).MustInt(rp.Retries)
+		case cfk_ipc_read_retry_delay:
+			cs.IPCReadPolicy.Delay = sec.Key(key).MustDuration(rp.Delay)
+		case cfk_digital_ports:
+			cs.StatusLayout.Digitals = sec.Key(key).MustInt(cp.Layout.Digitals)
+		case cfk_analog_ports:
+			cs.StatusLayout.Analogs = sec.Key(key).MustInt(cp.Layout.Analogs)
+		case cfk_latitude:
+			cs.Latitude = sec.Key(key).MustFloat64(0)
+		case cfk_longitude:
+			cs.Longitude = sec.Key(key).MustFloat64(0)
 		}
 	}
+	// the backend of the file is inherited by the controller sections before it is resolved
+	backend := cs.Backend
+	cs.Backend, cs.Protocol, err = resolveBackend(backend, cs.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if cs.Protocol == WP_CIP && cs.ListenPort > 0 {
+		return nil, errCIPListen
+	}
+	for _, ctrlSec := range iniFl.Sections() {
+		if !strings.HasPrefix(ctrlSec.Name(), settings_controller_prefix) {
+			continue
+		}
+		ctrl, err := loadControllerSection(ctrlSec, cs, backend)
+		if err != nil {
+			return nil, err
+		}
+		cs.Controllers = append(cs.Controllers, ctrl)
+	}
 	return cs, nil
 }
 
+// loadControllerSection of a further controller. the keys which are not set are taken from
+// the root section, except the address of the controller. backend is the unresolved backend of
+// the root section
+func loadControllerSection(sec *ini.Section, cs *CrebridDSettings, backend string) (ControllerSettings, error) {
+	ctrl := ControllerSettings{Name: strings.TrimPrefix(sec.Name(), settings_controller_prefix)}
+	if ctrl.Name == "" || ctrl.Name == DEFAULT_CONTROLLER || strings.ContainsAny(ctrl.Name, ": ") {
+		return ctrl, fmt.Errorf("invalid controller name [%s]", ctrl.Name)
+	}
+	ctrl.IP = sec.Key(configFileKeyString[cfk_ip]).String()
+	ctrl.Port = sec.Key(configFileKeyString[cfk_port]).MustInt(cs.Port)
+	ctrl.ListenPort = sec.Key(configFileKeyString[cfk_listen_port]).MustInt(0)
+	if ctrl.IP == "" && ctrl.ListenPort == 0 {
+		return ctrl, fmt.Errorf("controller [%s] needs an %s or a %s", ctrl.Name, configFileKeyString[cfk_ip], configFileKeyString[cfk_listen_port])
+	}
+	ctrl.AccessCode = sec.Key(configFileKeyString[cfk_access_code]).MustString(cs.AccessCode)
+	var err error
+	ctrl.Protocol, err = ParseWireProtocol(sec.Key(configFileKeyString[cfk_protocol]).MustString(cs.Protocol.String()))
+	if err != nil {
+		return ctrl, fmt.Errorf("controller [%s]: %w", ctrl.Name, err)
+	}
+	ctrl.IPID, err = ParseCIPIPID(sec.Key(configFileKeyString[cfk_ip_id]).MustString(fmt.Sprintf("%02X", cs.IPID)))
+	if err != nil {
+		return ctrl, fmt.Errorf("controller [%s]: %w", ctrl.Name, err)
+	}
+	ctrl.Backend, ctrl.Protocol, err = resolveBackend(sec.Key(configFileKeyString[cfk_backend]).MustString(backend), ctrl.Protocol)
+	if err != nil {
+		return ctrl, fmt.Errorf("controller [%s]: %w", ctrl.Name, err)
+	}
+	if ctrl.Protocol == WP_CIP && ctrl.ListenPort > 0 {
+		return ctrl, fmt.Errorf("controller [%s]: %w", ctrl.Name, errCIPListen)
+	}
+	ctrl.StatusLayout.Digitals = sec.Key(configFileKeyString[cfk_digital_ports]).MustInt(cs.StatusLayout.Digitals)
+	ctrl.StatusLayout.Analogs = sec.Key(configFileKeyString[cfk_analog_ports]).MustInt(cs.StatusLayout.Analogs)
+	return ctrl, nil
+}
+
 func LoadFromConfigFile(path2File string) (*CrebridDSettings, error) {
 	data, err := os.ReadFile(path2File)
 	if err != nil {
@@ -3,6 +3,9 @@ package crebrid
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
 )
 
 func TestLoadFromByteArr(t *testing.T) {
@@ -18,13 +21,41 @@ func TestLoadFromByteArr(t *testing.T) {
 		{
 			name: "valid complete config data",
 			args: args{
-				data: "# this a comment\nip=192.123.45.67\nport=65432\nipcPort=76543\naccessCode=123DEF",
+				data: "# this a comment\nip=192.123.45.67\nport=65432\nlistenPort=43124\nipcPort=76543\naccessCode=123DEF\nscenesFile=/tmp/scenes.conf\nscheduleFile=/tmp/schedule.conf\ncalendarsFile=/tmp/calendars.conf\nrulesFile=/tmp/rules.conf\nscriptsDir=/tmp/scripts\nscriptsLogDir=/tmp/scripts/log\nscriptTimeout=2m\npollInterval=2s\nstatusMaxAge=0\nqueueSize=8\ncaptureFile=/tmp/crebrid.cap\nbackend=telnet\nprotocol=V1\nipID=1f\nkeepAlive=0\nheartbeatInterval=1m\nheartbeatMisses=5\nconnectTimeout=3s\nconnectRetries=1\nstatusTimeout=2500ms\nstatusRetries=4\ntoggleTimeout=3s\ntoggleRetries=0\nanalogTimeout=1500ms\nanalogRetries=2\nserialTimeout=2s\nserialRetries=1\nretryDelay=250ms\nipcReadRetries=20\nipcReadRetryDelay=50ms\ndigitalPorts=12\nanalogPorts=0\nlatitude=52.52\nlongitude=13.405",
 			},
 			want: &CrebridDSettings{
-				IP:         "192.123.45.67",
-				Port:       65432,
-				IPCPort:    76543,
-				AccessCode: "123DEF",
+				IP:                "192.123.45.67",
+				Port:              65432,
+				ListenPort:        43124,
+				IPCPort:           76543,
+				AccessCode:        "123DEF",
+				ScenesFile:        "/tmp/scenes.conf",
+				ScheduleFile:      "/tmp/schedule.conf",
+				CalendarsFile:     "/tmp/calendars.conf",
+				RulesFile:         "/tmp/rules.conf",
+				ScriptsDir:        "/tmp/scripts",
+				ScriptsLogDir:     "/tmp/scripts/log",
+				ScriptTimeout:     2 * time.Minute,
+				PollInterval:      2 * time.Second,
+				StatusMaxAge:      0,
+				QueueSize:         8,
+				CaptureFile:       "/tmp/crebrid.cap",
+				Backend:           BACKEND_TELNET,
+				Protocol:          WP_V1,
+				IPID:              0x1F,
+				KeepAlive:         0,
+				HeartbeatInterval: time.Minute,
+				HeartbeatMisses:   5,
+				ConnectPolicy:     OperationPolicy{Timeout: 3 * time.Second, Retries: 1},
+				StatusPolicy:      OperationPolicy{Timeout: 2500 * time.Millisecond, Retries: 4},
+				TogglePolicy:      OperationPolicy{Timeout: 3 * time.Second},
+				AnalogPolicy:      OperationPolicy{Timeout: 1500 * time.Millisecond, Retries: 2},
+				SerialPolicy:      OperationPolicy{Timeout: 2 * time.Second, Retries: 1},
+				RetryDelay:        250 * time.Millisecond,
+				IPCReadPolicy:     ipc.ReadPolicy{Retries: 20, Delay: 50 * time.Millisecond},
+				StatusLayout:      StatusLayout{Digitals: 12},
+				Latitude:          52.52,
+				Longitude:         13.405,
 			},
 			wantErr: false,
 		},
@@ -34,10 +65,34 @@ func TestLoadFromByteArr(t *testing.T) {
 				data: "# this a comment\nip=192.123.45.67\nport=41296",
 			},
 			want: &CrebridDSettings{
-				IP:         "192.123.45.67",
-				Port:       41296,
-				IPCPort:    65432,
-				AccessCode: "123ABC",
+				IP:                "192.123.45.67",
+				Port:              41296,
+				IPCPort:           65432,
+				AccessCode:        "3H34GJ67NH",
+				ScenesFile:        "/etc/crebrid/scenes.conf",
+				ScheduleFile:      "/etc/crebrid/schedule.conf",
+				CalendarsFile:     "/etc/crebrid/calendars.conf",
+				RulesFile:         "/etc/crebrid/rules.conf",
+				ScriptsDir:        "/etc/crebrid/scripts",
+				ScriptsLogDir:     "/var/log/crebrid/scripts",
+				ScriptTimeout:     10 * time.Minute,
+				PollInterval:      5 * time.Second,
+				StatusMaxAge:      10 * time.Second,
+				QueueSize:         32,
+				Backend:           BACKEND_TELNET,
+				Protocol:          WP_V1,
+				IPID:              CIP_DEFAULT_IPID,
+				KeepAlive:         30 * time.Second,
+				HeartbeatInterval: 10 * time.Second,
+				HeartbeatMisses:   3,
+				ConnectPolicy:     OperationPolicy{Timeout: 5 * time.Second},
+				StatusPolicy:      OperationPolicy{Timeout: time.Second, Retries: 2},
+				TogglePolicy:      OperationPolicy{Timeout: time.Second, Retries: 1},
+				AnalogPolicy:      OperationPolicy{Timeout: time.Second},
+				SerialPolicy:      OperationPolicy{Timeout: time.Second},
+				RetryDelay:        100 * time.Millisecond,
+				IPCReadPolicy:     ipc.ReadPolicy{Retries: 10, Delay: 100 * time.Millisecond},
+				StatusLayout:      StatusLayout{Digitals: 25, Analogs: 20},
 			},
 			wantErr: false,
 		},
@@ -49,6 +104,46 @@ func TestLoadFromByteArr(t *testing.T) {
 			want:    nil,
 			wantErr: true,
 		},
+		{
+			name: "cip with listen port",
+			args: args{
+				data: "ip=192.123.45.67\nprotocol=cip\nlistenPort=43124",
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "invalid IP ID",
+			args: args{
+				data: "ip=192.123.45.67\nprotocol=cip\nipID=xy",
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "unknown backend",
+			args: args{
+				data: "ip=192.123.45.67\nbackend=knx",
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "telnet backend with protocol cip",
+			args: args{
+				data: "ip=192.123.45.67\nbackend=telnet\nprotocol=cip",
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "unknown protocol",
+			args: args{
+				data: "ip=192.123.45.67\nprotocol=v3",
+			},
+			want:    nil,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -63,3 +158,135 @@ func TestLoadFromByteArr(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadControllerSections(t *testing.T) {
+	root := "ip=192.123.45.67\nport=41296\naccessCode=123DEF\nprotocol=v2\ndigitalPorts=12\nanalogPorts=4\n"
+	mainCtrl := ControllerSettings{
+		Name:         DEFAULT_CONTROLLER,
+		IP:           "192.123.45.67",
+		Port:         41296,
+		AccessCode:   "123DEF",
+		Backend:      BACKEND_TELNET,
+		Protocol:     WP_V2,
+		IPID:         CIP_DEFAULT_IPID,
+		StatusLayout: StatusLayout{Digitals: 12, Analogs: 4},
+	}
+	tests := []struct {
+		name    string
+		data    string
+		want    []ControllerSettings
+		wantErr bool
+	}{
+		{
+			name: "default controller only",
+			data: root,
+			want: []ControllerSettings{mainCtrl},
+		},
+		{
+			name: "controller inherits the root section",
+			data: root + "[controller.annex]\nip=192.123.45.68\n",
+			want: []ControllerSettings{mainCtrl, {
+				Name:         "annex",
+				IP:           "192.123.45.68",
+				Port:         41296,
+				AccessCode:   "123DEF",
+				Backend:      BACKEND_TELNET,
+				Protocol:     WP_V2,
+				IPID:         CIP_DEFAULT_IPID,
+				StatusLayout: StatusLayout{Digitals: 12, Analogs: 4},
+			}},
+		},
+		{
+			name: "controller with own settings",
+			data: root + "[controller.annex]\nlistenPort=43124\naccessCode=7K21\nprotocol=v1\ndigitalPorts=8\nanalogPorts=0\n[other]\nip=1.2.3.4\n",
+			want: []ControllerSettings{mainCtrl, {
+				Name:         "annex",
+				Port:         41296,
+				ListenPort:   43124,
+				AccessCode:   "7K21",
+				Backend:      BACKEND_TELNET,
+				Protocol:     WP_V1,
+				IPID:         CIP_DEFAULT_IPID,
+				StatusLayout: StatusLayout{Digitals: 8, Analogs: 0},
+			}},
+		},
+		{
+			name: "controller by cip",
+			data: root + "[controller.annex]\nip=192.123.45.68\nport=41794\nprotocol=cip\nipID=0x1F\n",
+			want: []ControllerSettings{mainCtrl, {
+				Name:         "annex",
+				IP:           "192.123.45.68",
+				Port:         41794,
+				AccessCode:   "123DEF",
+				Backend:      BACKEND_CIP,
+				Protocol:     WP_CIP,
+				IPID:         0x1F,
+				StatusLayout: StatusLayout{Digitals: 12, Analogs: 4},
+			}},
+		},
+		{
+			name: "controller by cip backend",
+			data: root + "[controller.annex]\nip=192.123.45.68\nport=41794\nbackend=cip\n",
+			want: []ControllerSettings{mainCtrl, {
+				Name:         "annex",
+				IP:           "192.123.45.68",
+				Port:         41794,
+				AccessCode:   "123DEF",
+				Backend:      BACKEND_CIP,
+				Protocol:     WP_CIP,
+				IPID:         CIP_DEFAULT_IPID,
+				StatusLayout: StatusLayout{Digitals: 12, Analogs: 4},
+			}},
+		},
+		{
+			name:    "controller with unknown backend",
+			data:    root + "[controller.annex]\nip=192.123.45.68\nbackend=knx\n",
+			wantErr: true,
+		},
+		{
+			name:    "controller by cip with listen port",
+			data:    root + "[controller.annex]\nlistenPort=43124\nprotocol=cip\n",
+			wantErr: true,
+		},
+		{
+			name:    "controller with invalid IP ID",
+			data:    root + "[controller.annex]\nip=192.123.45.68\nipID=FF\n",
+			wantErr: true,
+		},
+		{
+			name:    "controller without address",
+			data:    root + "[controller.annex]\nport=41297\n",
+			wantErr: true,
+		},
+		{
+			name:    "controller named like the default controller",
+			data:    root + "[controller.main]\nip=192.123.45.68\n",
+			wantErr: true,
+		},
+		{
+			name:    "controller name with separator",
+			data:    root + "[controller.an:nex]\nip=192.123.45.68\n",
+			wantErr: true,
+		},
+		{
+			name:    "controller with unknown protocol",
+			data:    root + "[controller.annex]\nip=192.123.45.68\nprotocol=v3\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := LoadFromByteArr([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadFromByteArr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got := cs.AllControllers(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllControllers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
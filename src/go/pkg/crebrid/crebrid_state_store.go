@@ -0,0 +1,104 @@
+package crebrid
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StateStore keeps the latest system status read from the controller together with the time
+// it was read and the time each port got its value. requests are served from the store as long
+// as it is fresh enough
+type StateStore interface {
+	// Update the store with a system status read from the controller at the given time
+	Update(ss *SystemStatus, at time.Time)
+	// Status is a copy of the stored system status and the time it was read. false if nothing
+	// was read so far
+	Status() (*SystemStatus, time.Time, bool)
+	// Fresh is true if the status was read within maxAge
+	Fresh(now time.Time, maxAge time.Duration) bool
+	// Ports with their state and the time they got it, e.g. "d3=on (updated 2026-10-19 20:00:00)".
+	// a read which does not change a port keeps its time
+	Ports() []string
+}
+
+type stateStore struct {
+	lock     sync.Mutex
+	last     *SystemStatus
+	status   *SystemStatus
+	read     time.Time
+	dUpdated []time.Time
+	aUpdated []time.Time
+}
+
+// NewStateStore without a system status
+func NewStateStore() StateStore {
+	return new(stateStore)
+}
+
+func (st *stateStore) Update(ss *SystemStatus, at time.Time) {
+	if ss == nil {
+		return
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	// the controller client keeps its status until it reads a new one, so the same status
+	// does not update the ports again
+	if ss == st.last {
+		return
+	}
+	st.last = ss
+	dUpdated := make([]time.Time, len(ss.D))
+	for i, v := range ss.D {
+		dUpdated[i] = at
+		if st.status != nil && i < len(st.status.D) && st.status.D[i] == v {
+			dUpdated[i] = st.dUpdated[i]
+		}
+	}
+	aUpdated := make([]time.Time, len(ss.A))
+	for i, v := range ss.A {
+		aUpdated[i] = at
+		if st.status != nil && i < len(st.status.A) && st.status.A[i] == v {
+			aUpdated[i] = st.aUpdated[i]
+		}
+	}
+	st.status = &SystemStatus{D: append([]int{}, ss.D...), A: append([]float64{}, ss.A...)}
+	st.read = at
+	st.dUpdated = dUpdated
+	st.aUpdated = aUpdated
+}
+
+func (st *stateStore) Status() (*SystemStatus, time.Time, bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.status == nil {
+		return nil, time.Time{}, false
+	}
+	return &SystemStatus{D: append([]int{}, st.status.D...), A: append([]float64{}, st.status.A...)}, st.read, true
+}
+
+func (st *stateStore) Fresh(now time.Time, maxAge time.Duration) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.status == nil || maxAge <= 0 {
+		return false
+	}
+	return now.Sub(st.read) <= maxAge
+}
+
+func (st *stateStore) Ports() []string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	ret := make([]string, 0)
+	if st.status == nil {
+		return ret
+	}
+	for i, v := range st.status.D {
+		ret = append(ret, fmt.Sprintf("%s%d=%s (updated %s)", scene_digital_prefix, i+1, sceneDigitalValue(v > 0), st.dUpdated[i].Format(rule_trace_layout)))
+	}
+	for i, v := range st.status.A {
+		ret = append(ret, fmt.Sprintf("%s%d=%s (updated %s)", scene_analog_prefix, i+1, strconv.FormatFloat(v, 'f', -1, 64), st.aUpdated[i].Format(rule_trace_layout)))
+	}
+	return ret
+}
@@ -0,0 +1,92 @@
+package crebrid
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	st := NewStateStore()
+	start := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	if _, _, ok := st.Status(); ok {
+		t.Fatalf("Status() of an empty store is ok")
+	}
+	if st.Fresh(start, time.Hour) {
+		t.Errorf("Fresh() of an empty store is true")
+	}
+	ss := &SystemStatus{D: []int{1, 0}, A: []float64{12.5}}
+	st.Update(ss, start)
+	// the same status is not read again, so it keeps its update time
+	st.Update(ss, start.Add(time.Minute))
+	got, updated, ok := st.Status()
+	if !ok || !reflect.DeepEqual(got, ss) || !updated.Equal(start) {
+		t.Errorf("Status() = %v, %v, %v", got, updated, ok)
+	}
+	got.D[0] = 0
+	if got, _, _ := st.Status(); got.D[0] != 1 {
+		t.Errorf("Status() is not a copy")
+	}
+	tests := []struct {
+		now    time.Time
+		maxAge time.Duration
+		want   bool
+	}{
+		{now: start.Add(5 * time.Second), maxAge: 10 * time.Second, want: true},
+		{now: start.Add(10 * time.Second), maxAge: 10 * time.Second, want: true},
+		{now: start.Add(11 * time.Second), maxAge: 10 * time.Second, want: false},
+		{now: start, maxAge: 0, want: false},
+	}
+	for _, tt := range tests {
+		if got := st.Fresh(tt.now, tt.maxAge); got != tt.want {
+			t.Errorf("Fresh(%v, %v) = %v, want %v", tt.now, tt.maxAge, got, tt.want)
+		}
+	}
+	st.Update(&SystemStatus{D: []int{0, 1}, A: []float64{30000}}, start.Add(time.Minute))
+	// a read which does not change a port keeps its time, but makes the store fresh again
+	st.Update(&SystemStatus{D: []int{0, 0}, A: []float64{30000}}, start.Add(2*time.Minute))
+	if !st.Fresh(start.Add(2*time.Minute), 10*time.Second) {
+		t.Errorf("Fresh() right after a read is false")
+	}
+	if _, read, _ := st.Status(); !read.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("Status() read at %v, want %v", read, start.Add(2*time.Minute))
+	}
+	want := []string{
+		"d1=off (updated 2026-10-19 20:01:00)",
+		"d2=off (updated 2026-10-19 20:02:00)",
+		"a1=30000 (updated 2026-10-19 20:01:00)",
+	}
+	if got := st.Ports(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Ports() = %v, want %v", got, want)
+	}
+}
+
+func TestStatusPoller(t *testing.T) {
+	fc := newFakeClock(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC))
+	polls := make(chan bool, 4)
+	sp := NewStatusPoller(fc, 5*time.Second, func() error {
+		polls <- true
+		return errors.New("connection refused")
+	})
+	sp.Start()
+	defer sp.Stop()
+	for i := 0; i < 2; i++ {
+		fc.waitForWaiter(t)
+		fc.Advance(5 * time.Second)
+		select {
+		case <-polls:
+		case <-time.After(time.Second):
+			t.Fatalf("poll [%d] was not executed", i+1)
+		}
+	}
+}
+
+func TestStatusPollerDisabled(t *testing.T) {
+	sp := NewStatusPoller(newFakeClock(time.Now()), 0, func() error {
+		t.Errorf("disabled poller polls")
+		return nil
+	})
+	sp.Start()
+	sp.Stop()
+}
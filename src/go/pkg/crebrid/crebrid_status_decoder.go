@@ -0,0 +1,242 @@
+package crebrid
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StatusLayout is the number of values of the status frames. the defaults match the module
+// system_state_to_json, 0 accepts any number of values
+type StatusLayout struct {
+	Digitals int
+	Analogs  int
+}
+
+// DefaultStatusLayout of the module system_state_to_json
+func DefaultStatusLayout() StatusLayout {
+	return StatusLayout{Digitals: 25, Analogs: 20}
+}
+
+// ErrInvalidFrame is wrapped by every FrameError
+var ErrInvalidFrame = errors.New("invalid status frame")
+
+// FrameError describes a status frame which was dropped by the decoder
+type FrameError struct {
+	// Offset of the error in the stream of the connection
+	Offset int64
+	// Context are the bytes of the frame around the error
+	Context string
+	Reason  string
+}
+
+func (fe *FrameError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %s near %q", ErrInvalidFrame, fe.Offset, fe.Reason, fe.Context)
+}
+
+func (fe *FrameError) Unwrap() error {
+	return ErrInvalidFrame
+}
+
+const (
+	// status_frame_max is far more than the status of the module system_state_to_json, a
+	// longer frame is missing its end
+	status_frame_max = 1024
+	// status_context is the number of bytes in front of and behind an error in a FrameError
+	status_context = 16
+)
+
+// telnet commands which are stripped from the stream
+const (
+	telnet_se   = 0xF0
+	telnet_sb   = 0xFA
+	telnet_will = 0xFB
+	telnet_dont = 0xFE
+	telnet_iac  = 0xFF
+)
+
+// telnetFilter strips telnet commands from a stream, e.g. the negotiation of a console
+type telnetFilter int
+
+const (
+	tn_data telnetFilter = iota
+	tn_command
+	tn_option
+	tn_sub
+	tn_sub_iac
+)
+
+// skip is true for the bytes of telnet commands
+func (tf *telnetFilter) skip(b byte) bool {
+	switch *tf {
+	case tn_command:
+		switch {
+		case b == telnet_sb:
+			*tf = tn_sub
+		case b >= telnet_will && b <= telnet_dont:
+			*tf = tn_option
+		default:
+			*tf = tn_data
+		}
+	case tn_option:
+		*tf = tn_data
+	case tn_sub:
+		if b == telnet_iac {
+			*tf = tn_sub_iac
+		}
+	case tn_sub_iac:
+		*tf = tn_sub
+		if b == telnet_se {
+			*tf = tn_data
+		}
+	default:
+		if b != telnet_iac {
+			return false
+		}
+		*tf = tn_command
+	}
+	return true
+}
+
+// statusDecoder reads the status frames from the stream of the controller. a frame starts at
+// "{" and ends at the matching "}", everything between the frames like CR/LF, traces of the
+// controller and telnet negotiation is skipped. as the status holds no nested objects, a "{"
+// within a frame starts the next one. a frame may span any number of reads, the decoder keeps
+// it even if a read fails, e.g. by its deadline
+type statusDecoder struct {
+	reader *bufio.Reader
+	layout StatusLayout
+	// offset of the next byte in the stream
+	offset int64
+	// start is the offset of the frame
+	start    int64
+	frame    []byte
+	inString bool
+	escaped  bool
+	telnet   telnetFilter
+}
+
+func newStatusDecoder(reader io.Reader, layout StatusLayout) *statusDecoder {
+	sd := new(statusDecoder)
+	sd.reader = bufio.NewReader(reader)
+	sd.layout = layout
+	sd.frame = make([]byte, 0, 256)
+	return sd
+}
+
+// Next status of the stream. a *FrameError is returned for a frame which was dropped, the
+// decoder goes on with the next frame. any other error is the one of the reader
+func (sd *statusDecoder) Next() (*SystemStatus, error) {
+	for {
+		b, err := sd.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		sd.offset++
+		if sd.telnet.skip(b) {
+			continue
+		}
+		if len(sd.frame) == 0 {
+			if b == '{' {
+				sd.begin()
+			}
+			continue
+		}
+		sd.frame = append(sd.frame, b)
+		switch {
+		case sd.escaped:
+			sd.escaped = false
+		case sd.inString && b == '\\':
+			sd.escaped = true
+		case b == '"':
+			sd.inString = !sd.inString
+		case sd.inString:
+		case b == '{':
+			err := sd.fail(len(sd.frame)-1, "frame is cut off by the next one")
+			sd.begin()
+			return nil, err
+		case b == '}':
+			frame, start := sd.frame, sd.start
+			sd.frame = make([]byte, 0, 256)
+			return sd.decode(frame, start)
+		case (b < ' ' && b != '\r' && b != '\n' && b != '\t') || b > '~':
+			err := sd.fail(len(sd.frame)-1, fmt.Sprintf("unexpected byte 0x%02x", b))
+			sd.frame = sd.frame[:0]
+			return nil, err
+		}
+		if len(sd.frame) > status_frame_max {
+			err := sd.fail(len(sd.frame)-1, fmt.Sprintf("frame exceeds %d bytes", status_frame_max))
+			sd.frame = sd.frame[:0]
+			return nil, err
+		}
+	}
+}
+
+// begin a frame with the "{" just read
+func (sd *statusDecoder) begin() {
+	sd.frame = append(sd.frame[:0], '{')
+	sd.start = sd.offset - 1
+	sd.inString = false
+	sd.escaped = false
+}
+
+// fail the current frame at pos
+func (sd *statusDecoder) fail(pos int, reason string) *FrameError {
+	return frameError(sd.frame, sd.start, pos, reason)
+}
+
+func frameError(frame []byte, start int64, pos int, reason string) *FrameError {
+	from := pos - status_context
+	if from < 0 {
+		from = 0
+	}
+	to := pos + status_context
+	if to > len(frame) {
+		to = len(frame)
+	}
+	return &FrameError{Offset: start + int64(pos), Context: string(frame[from:to]), Reason: reason}
+}
+
+// decode and validate a complete frame
+func (sd *statusDecoder) decode(frame []byte, start int64) (*SystemStatus, error) {
+	ss := new(SystemStatus)
+	if err := json.Unmarshal(frame, ss); err != nil {
+		pos := 0
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) {
+			pos = int(syntaxErr.Offset) - 1
+		} else if errors.As(err, &typeErr) {
+			pos = int(typeErr.Offset) - 1
+		}
+		return nil, frameError(frame, start, pos, err.Error())
+	}
+	if reason := sd.layout.validate(ss); reason != "" {
+		return nil, frameError(frame, start, 0, reason)
+	}
+	return ss, nil
+}
+
+// validate the values of a status, the reason why it is invalid is returned
+func (sl StatusLayout) validate(ss *SystemStatus) string {
+	if ss.D == nil {
+		return "digital values \"d\" are missing"
+	}
+	if ss.A == nil {
+		return "analog values \"a\" are missing"
+	}
+	if sl.Digitals > 0 && len(ss.D) != sl.Digitals {
+		return fmt.Sprintf("%d digital values, want %d", len(ss.D), sl.Digitals)
+	}
+	if sl.Analogs > 0 && len(ss.A) != sl.Analogs {
+		return fmt.Sprintf("%d analog values, want %d", len(ss.A), sl.Analogs)
+	}
+	for i, v := range ss.D {
+		if v != 0 && v != 1 {
+			return fmt.Sprintf("digital value d%d is %d", i+1, v)
+		}
+	}
+	return ""
+}
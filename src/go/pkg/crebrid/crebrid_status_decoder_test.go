@@ -0,0 +1,138 @@
+package crebrid
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var updateCaptures = flag.Bool("update", false, "update the golden files of the captures")
+
+// decodeAll frames of the reader, a line per status or dropped frame
+func decodeAll(reader io.Reader, layout StatusLayout) ([]string, error) {
+	sd := newStatusDecoder(reader, layout)
+	lines := make([]string, 0)
+	for {
+		ss, err := sd.Next()
+		var frameErr *FrameError
+		switch {
+		case errors.As(err, &frameErr):
+			lines = append(lines, err.Error())
+		case err == io.EOF:
+			return lines, nil
+		case err != nil:
+			return lines, err
+		default:
+			lines = append(lines, fmt.Sprintf("d=%v a=%v", ss.D, ss.A))
+		}
+	}
+}
+
+// TestStatusDecoderCaptures decodes the captures of a controller, which are read at once, in
+// single bytes and in halves of the reads
+func TestStatusDecoderCaptures(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "captures", "*.cap"))
+	if err != nil || len(captures) == 0 {
+		t.Fatalf("no captures: %v", err)
+	}
+	for _, capture := range captures {
+		t.Run(filepath.Base(capture), func(t *testing.T) {
+			data, err := os.ReadFile(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeAll(bytes.NewReader(data), DefaultStatusLayout())
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := strings.TrimSuffix(capture, ".cap") + ".golden"
+			if *updateCaptures {
+				os.WriteFile(golden, []byte(strings.Join(got, "\n")+"\n"), 0644)
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "\n")+"\n" != string(want) {
+				t.Errorf("decoded frames:\n%s\nwant:\n%s", strings.Join(got, "\n"), want)
+			}
+			readers := map[string]io.Reader{
+				"single bytes": iotest.OneByteReader(bytes.NewReader(data)),
+				"halves":       iotest.HalfReader(bytes.NewReader(data)),
+			}
+			for name, reader := range readers {
+				split, err := decodeAll(reader, DefaultStatusLayout())
+				if err != nil || !reflect.DeepEqual(split, got) {
+					t.Errorf("decoded frames of %s = %v, %v, want %v", name, split, err, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusDecoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		layout StatusLayout
+		want   []string
+	}{
+		{
+			name:   "noise, line breaks and strings",
+			stream: "noise{\"d\":[1],\"a\":[]}\r\n{\"d\":[0],\"x\":\"{}\\\"\",\"a\":[2.5]}{\"d\":[1",
+			want:   []string{"d=[1] a=[]", "d=[0] a=[2.5]"},
+		},
+		{
+			name:   "missing values",
+			stream: "{\"d\":[1]}{\"a\":[1]}",
+			want: []string{
+				"invalid status frame at offset 0: analog values \"a\" are missing near \"{\\\"d\\\":[1]}\"",
+				"invalid status frame at offset 9: digital values \"d\" are missing near \"{\\\"a\\\":[1]}\"",
+			},
+		},
+		{
+			name:   "layout",
+			stream: "{\"d\":[1,0],\"a\":[1]}{\"d\":[1,0,1],\"a\":[1]}{\"d\":[1,0,1],\"a\":[]}",
+			layout: StatusLayout{Digitals: 3, Analogs: 1},
+			want: []string{
+				"invalid status frame at offset 0: 2 digital values, want 3 near \"{\\\"d\\\":[1,0],\\\"a\\\":[\"",
+				"d=[1 0 1] a=[1]",
+				"invalid status frame at offset 40: 0 analog values, want 1 near \"{\\\"d\\\":[1,0,1],\\\"a\\\"\"",
+			},
+		},
+		{
+			name:   "syntax error",
+			stream: "xx{\"d\":[1,,0],\"a\":[]}",
+			want:   []string{"invalid status frame at offset 10: invalid character ',' looking for beginning of value near \"{\\\"d\\\":[1,,0],\\\"a\\\":[]}\""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAll(strings.NewReader(tt.stream), tt.layout)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded frames = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestStatusDecoderReadError keeps the part of the frame which was read before the error
+func TestStatusDecoderReadError(t *testing.T) {
+	reader := iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("{\"d\":[1],\"a\":[]}")))
+	sd := newStatusDecoder(reader, StatusLayout{})
+	if _, err := sd.Next(); err != iotest.ErrTimeout {
+		t.Fatalf("Next() error = %v, want %v", err, iotest.ErrTimeout)
+	}
+	ss, err := sd.Next()
+	if want := (&SystemStatus{D: []int{1}, A: []float64{}}); err != nil || !reflect.DeepEqual(ss, want) {
+		t.Errorf("Next() = %v, %v, want %v", ss, err, want)
+	}
+}
@@ -0,0 +1,77 @@
+package crebrid
+
+import (
+	"sync"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// statusFlight coalesces concurrent reads of the system status, so a single read of the
+// controller serves every caller which asks while it is in flight. a caller only joins a read
+// of its own or a higher priority, as it would wait at the lower priority of the read otherwise.
+// the zero value is ready to use
+type statusFlight struct {
+	lock  sync.Mutex
+	calls map[CommandPriority]*statusCall
+}
+
+// statusCall is a read in flight and the callers which wait for it
+type statusCall struct {
+	done    chan bool
+	callers int
+	ss      *SystemStatus
+	err     error
+}
+
+// Do calls read at the priority, unless a read of the same or a higher priority is in flight
+// already. in this case its result is returned
+func (sf *statusFlight) Do(prio CommandPriority, read func() (*SystemStatus, error)) (*SystemStatus, error) {
+	sf.lock.Lock()
+	if sc := sf.joinable(prio); sc != nil {
+		sc.callers++
+		sf.lock.Unlock()
+		<-sc.done
+		return sc.ss, sc.err
+	}
+	if sf.calls == nil {
+		sf.calls = make(map[CommandPriority]*statusCall)
+	}
+	sc := &statusCall{done: make(chan bool), callers: 1}
+	sf.calls[prio] = sc
+	sf.lock.Unlock()
+	sc.ss, sc.err = read()
+	sf.lock.Lock()
+	// callers which ask from now on need a new read, this one may be outdated for them
+	delete(sf.calls, prio)
+	callers := sc.callers
+	sf.lock.Unlock()
+	close(sc.done)
+	if callers > 1 {
+		logging.LogFmt(logging.LOG_DEBUG, "[service] one status read served %d callers", callers)
+	}
+	return sc.ss, sc.err
+}
+
+// joinable read in flight of the highest priority, which is at least prio. the lock has to be
+// held
+func (sf *statusFlight) joinable(prio CommandPriority) *statusCall {
+	var ret *statusCall
+	best := prio
+	for p, sc := range sf.calls {
+		if p >= best {
+			ret, best = sc, p
+		}
+	}
+	return ret
+}
+
+// waiting is the number of callers of the reads in flight
+func (sf *statusFlight) waiting() int {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	ret := 0
+	for _, sc := range sf.calls {
+		ret += sc.callers
+	}
+	return ret
+}
@@ -0,0 +1,189 @@
+package crebrid
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+func TestStatusFlight(t *testing.T) {
+	var sf statusFlight
+	release := make(chan bool)
+	reads := int32(0)
+	read := func() (*SystemStatus, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return &SystemStatus{D: []int{1}}, nil
+	}
+	var wg sync.WaitGroup
+	results := make([]*SystemStatus, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = sf.Do(QP_USER, read)
+		}(i)
+	}
+	for i := 0; i < 200 && sf.waiting() < len(results); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if reads != 1 {
+		t.Errorf("reads = %d, want 1", reads)
+	}
+	for i, ss := range results {
+		if ss != results[0] {
+			t.Errorf("result %d = %v, want the shared result %v", i, ss, results[0])
+		}
+	}
+	// a read after the flight landed asks the controller again
+	if _, err := sf.Do(QP_USER, read); err != nil || reads != 2 {
+		t.Errorf("Do() error = %v, reads = %d, want 2", err, reads)
+	}
+}
+
+func TestStatusFlightPriority(t *testing.T) {
+	var sf statusFlight
+	release := make(chan bool)
+	reads := int32(0)
+	read := func() (*SystemStatus, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return &SystemStatus{D: []int{1}}, nil
+	}
+	var wg sync.WaitGroup
+	do := func(prio CommandPriority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sf.Do(prio, read)
+		}()
+	}
+	wait := func(callers int) {
+		for i := 0; i < 200 && sf.waiting() < callers; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// a user does not wait at the priority of a poll in flight, a poll joins the read of a user
+	do(QP_POLL)
+	wait(1)
+	do(QP_USER)
+	wait(2)
+	do(QP_POLL)
+	do(QP_NORMAL)
+	wait(4)
+	close(release)
+	wg.Wait()
+	if reads != 2 {
+		t.Errorf("reads = %d, want 2", reads)
+	}
+}
+
+// slowControllerClient answers status requests after a delay and counts them
+type slowControllerClient struct {
+	*fakeControllerClient
+	delay time.Duration
+	reads int64
+}
+
+func (scc *slowControllerClient) ToggleSwitch(switchID int) (bool, error) {
+	if switchID == system_state_toggle {
+		atomic.AddInt64(&scc.reads, 1)
+		time.Sleep(scc.delay)
+	}
+	return scc.fakeControllerClient.ToggleSwitch(switchID)
+}
+
+// dashboard_clients refresh their status at the same time in the benchmark
+const dashboard_clients = 20
+
+// benchmarkRefresh lets the dashboard clients refresh together b.N times through the IPC
+// server, which serves them by handle, and reports the reads of the controller per refresh
+// of all clients
+func benchmarkRefresh(b *testing.B, handle func(me *mainExecute, cc *ipc.ClientCommand) (*ipc.ServerResponse, error)) {
+	scc := &slowControllerClient{fakeControllerClient: newFakeControllerClient([]int{0, 1, 0}, []float64{0}), delay: time.Millisecond}
+	me := new(mainExecute)
+	me.clock = NewSystemClock()
+	me.controllers = []*controller{newController(ControllerSettings{Name: DEFAULT_CONTROLLER}, scc)}
+	me.bus = NewEventBus()
+	me.queue = NewCommandQueue(NewSystemClock(), dashboard_clients)
+	me.queue.Start()
+	defer me.queue.Stop()
+	rp := ipc.ReadPolicy{Retries: 50, Delay: time.Millisecond}
+	is := ipc.NewIpcServer(0, rp)
+	go is.StartListening(func(cc *ipc.ClientCommand) (*ipc.ServerResponse, error) {
+		return handle(me, cc)
+	})
+	defer is.Close()
+	for is.Addr() == "" {
+		if err := is.HasError(); err != nil {
+			b.Fatal(err)
+		}
+		// the server is not listening yet
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, portStr, err := net.SplitHostPort(is.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	clients := make([]ipc.IpcClient, 0, dashboard_clients)
+	for len(clients) < dashboard_clients {
+		ic, err := ipc.RegisterClient("127.0.0.1", port, rp)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer ic.CloseConnection()
+		clients = append(clients, ic)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, ic := range clients {
+			wg.Add(1)
+			go func(ic ipc.IpcClient) {
+				defer wg.Done()
+				cc := ipc.NewClientCommand()
+				cc.Cmd = ipc.IC_GET
+				cc.Refresh = true
+				sr, err := ic.SendCommand(cc)
+				if err != nil {
+					b.Error(err)
+				} else if sr.Error != "" {
+					b.Error(sr.Error)
+				}
+			}(ic)
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&scc.reads))/float64(b.N), "reads/refresh")
+}
+
+func BenchmarkDashboardRefresh(b *testing.B) {
+	b.Run("single-flight", func(b *testing.B) {
+		benchmarkRefresh(b, func(me *mainExecute, cc *ipc.ClientCommand) (*ipc.ServerResponse, error) {
+			return me.handleRequest(cc)
+		})
+	})
+	// every client reads on its own, like before the reads were coalesced
+	b.Run("read-per-client", func(b *testing.B) {
+		benchmarkRefresh(b, func(me *mainExecute, cc *ipc.ClientCommand) (*ipc.ServerResponse, error) {
+			if cc.Cmd != ipc.IC_GET {
+				return me.handleRequest(cc)
+			}
+			sr := ipc.NewServerResponse()
+			sr.Cmd = cc.Cmd
+			if _, err := me.queueStatusRead(me.defaultController(), QP_USER); err != nil {
+				sr.Error = err.Error()
+			}
+			return sr, nil
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package crebrid
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// StatusPoller reads the system status from the controller in a fixed interval, so the state
+// store stays fresh and the rules and scripts see changes which were not made by crebrid
+type StatusPoller interface {
+	// Start the poller routine. an interval of 0 disables the poller
+	Start()
+	// Stop the poller routine and wait until it is finished
+	Stop()
+}
+
+type statusPoller struct {
+	clock    Clock
+	interval time.Duration
+	poll     func() error
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+// NewStatusPoller calls poll every interval
+func NewStatusPoller(clock Clock, interval time.Duration, poll func() error) StatusPoller {
+	sp := new(statusPoller)
+	sp.clock = clock
+	sp.interval = interval
+	sp.poll = poll
+	sp.quit = make(chan bool)
+	return sp
+}
+
+func (sp *statusPoller) execute() {
+	defer sp.wg.Done()
+	failed := false
+	for {
+		select {
+		case <-sp.clock.After(sp.interval):
+		case <-sp.quit:
+			logging.Log(logging.LOG_DEBUG, "[POLLER] routine escaped")
+			return
+		}
+		err := sp.poll()
+		// a broken connection fails every poll, so only the first failure is logged as error
+		if err != nil && !failed {
+			logging.LogFmt(logging.LOG_ERROR, "[POLLER] unable to read the system status: %s", err)
+		} else if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[POLLER] unable to read the system status: %s", err)
+		} else if failed {
+			logging.Log(logging.LOG_INFO, "[POLLER] system status is read again")
+		}
+		failed = err != nil
+	}
+}
+
+func (sp *statusPoller) Start() {
+	if sp.interval <= 0 {
+		logging.Log(logging.LOG_MAIN, "[POLLER] status polling is disabled")
+		return
+	}
+	logging.LogFmt(logging.LOG_MAIN, "[POLLER] poll the system status every %s", sp.interval)
+	sp.wg.Add(1)
+	go sp.execute()
+}
+
+func (sp *statusPoller) Stop() {
+	close(sp.quit)
+	sp.wg.Wait()
+}
@@ -0,0 +1,190 @@
+package crebrid
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// sun events are calculated locally by the sunrise equation, the results are accurate to
+// about one minute. a schedule spec of a sun event may contain an offset:
+//
+//	sunset+15m
+//	sunrise
+//	dusk-10m
+
+type SunEvent int
+
+const (
+	SE_SUNRISE SunEvent = iota
+	SE_SUNSET
+	SE_DAWN
+	SE_DUSK
+	SE_NAUTICAL_DAWN
+	SE_NAUTICAL_DUSK
+	SE_ASTRONOMICAL_DAWN
+	SE_ASTRONOMICAL_DUSK
+)
+
+var sunEventStr = map[SunEvent]string{
+	SE_SUNRISE:           "sunrise",
+	SE_SUNSET:            "sunset",
+	SE_DAWN:              "dawn",
+	SE_DUSK:              "dusk",
+	SE_NAUTICAL_DAWN:     "nauticaldawn",
+	SE_NAUTICAL_DUSK:     "nauticaldusk",
+	SE_ASTRONOMICAL_DAWN: "astronomicaldawn",
+	SE_ASTRONOMICAL_DUSK: "astronomicaldusk",
+}
+
+// sunEventAltitude is the altitude of the sun's center in degrees at the event. sunrise and
+// sunset consider the refraction and the radius of the sun
+var sunEventAltitude = map[SunEvent]float64{
+	SE_SUNRISE:           -0.833,
+	SE_SUNSET:            -0.833,
+	SE_DAWN:              -6,
+	SE_DUSK:              -6,
+	SE_NAUTICAL_DAWN:     -12,
+	SE_NAUTICAL_DUSK:     -12,
+	SE_ASTRONOMICAL_DAWN: -18,
+	SE_ASTRONOMICAL_DUSK: -18,
+}
+
+const (
+	julian_unix_epoch = 2440587.5
+	julian_j2000      = 2451545.0
+	earth_obliquity   = 23.4397
+	// sun events are searched for at most one year
+	sun_max_search_days = 366
+)
+
+func (se SunEvent) String() string {
+	return sunEventStr[se]
+}
+
+func (se SunEvent) isMorning() bool {
+	return se == SE_SUNRISE || se == SE_DAWN || se == SE_NAUTICAL_DAWN || se == SE_ASTRONOMICAL_DAWN
+}
+
+// GeoLocation of the house, used to calculate the sun events
+type GeoLocation struct {
+	// Latitude in degrees, north is positive
+	Latitude float64
+	// Longitude in degrees, east is positive
+	Longitude float64
+}
+
+func sinDeg(deg float64) float64 {
+	return math.Sin(deg * math.Pi / 180)
+}
+
+func cosDeg(deg float64) float64 {
+	return math.Cos(deg * math.Pi / 180)
+}
+
+func julianToTime(j float64) time.Time {
+	secs := (j - julian_unix_epoch) * 86400
+	return time.Unix(0, int64(math.Round(secs))*int64(time.Second)).UTC()
+}
+
+// SunEventTime calculates the time of a sun event on the given day. the day is given by the
+// date of the time in its location. false is returned if the event does not occur on that
+// day, e.g. there is no sunset during the polar day
+func (gl *GeoLocation) SunEventTime(event SunEvent, day time.Time) (time.Time, bool) {
+	noonUTC := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, time.UTC)
+	n := float64(noonUTC.Unix())/86400 + julian_unix_epoch - julian_j2000
+	// mean solar time at the longitude
+	jStar := n - gl.Longitude/360
+	// solar mean anomaly
+	m := math.Mod(357.5291+0.98560028*jStar, 360)
+	// equation of the center
+	c := 1.9148*sinDeg(m) + 0.02*sinDeg(2*m) + 0.0003*sinDeg(3*m)
+	// ecliptic longitude
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	jTransit := julian_j2000 + jStar + 0.0053*sinDeg(m) - 0.0069*sinDeg(2*lambda)
+	// declination of the sun
+	sinDecl := sinDeg(lambda) * sinDeg(earth_obliquity)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHourAngle := (sinDeg(sunEventAltitude[event]) - sinDeg(gl.Latitude)*sinDecl) / (cosDeg(gl.Latitude) * cosDecl)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	if event.isMorning() {
+		return julianToTime(jTransit - hourAngle/360).In(day.Location()), true
+	}
+	return julianToTime(jTransit + hourAngle/360).In(day.Location()), true
+}
+
+// sunTrigger fires at a sun event with an optional offset
+type sunTrigger struct {
+	event  SunEvent
+	offset time.Duration
+	loc    *GeoLocation
+}
+
+func parseSunSpec(spec string, loc *GeoLocation) (*sunTrigger, bool, error) {
+	lower := strings.ToLower(strings.TrimSpace(spec))
+	for event, name := range sunEventStr {
+		if !strings.HasPrefix(lower, name) {
+			continue
+		}
+		rest := strings.TrimSpace(lower[len(name):])
+		// the prefix of a longer event name, e.g. dawn and nauticaldawn, does not match here
+		if rest != "" && rest[0] != '+' && rest[0] != '-' {
+			continue
+		}
+		if loc == nil {
+			return nil, true, fmt.Errorf("schedule [%s] needs latitude and longitude in the settings", spec)
+		}
+		st := &sunTrigger{event: event, loc: loc}
+		if rest != "" {
+			offset, err := time.ParseDuration(strings.ReplaceAll(rest, " ", ""))
+			if err != nil {
+				return nil, true, fmt.Errorf("invalid offset in schedule [%s]: %v", spec, err)
+			}
+			st.offset = offset
+		}
+		return st, true, nil
+	}
+	return nil, false, nil
+}
+
+func (st *sunTrigger) Next(after time.Time) (time.Time, bool) {
+	// start a day earlier, a large offset may move the event of yesterday behind midnight
+	for i := -1; i < sun_max_search_days; i++ {
+		day := time.Date(after.Year(), after.Month(), after.Day()+i, 12, 0, 0, 0, after.Location())
+		t, ok := st.loc.SunEventTime(st.event, day)
+		if !ok {
+			continue
+		}
+		t = t.Add(st.offset)
+		if t.After(after) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// formatOffset without zero units, e.g. 15m instead of 15m0s
+func formatOffset(d time.Duration) string {
+	str := d.String()
+	if strings.HasSuffix(str, "m0s") {
+		str = strings.TrimSuffix(str, "0s")
+	}
+	if strings.HasSuffix(str, "h0m") {
+		str = strings.TrimSuffix(str, "0m")
+	}
+	return str
+}
+
+func (st *sunTrigger) String() string {
+	if st.offset == 0 {
+		return st.event.String()
+	}
+	if st.offset > 0 {
+		return fmt.Sprintf("%s+%s", st.event, formatOffset(st.offset))
+	}
+	return fmt.Sprintf("%s-%s", st.event, formatOffset(-st.offset))
+}
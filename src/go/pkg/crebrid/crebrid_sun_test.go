@@ -0,0 +1,163 @@
+package crebrid
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunEventTime(t *testing.T) {
+	berlinLoc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+	berlin := &GeoLocation{Latitude: 52.52, Longitude: 13.405}
+	tromso := &GeoLocation{Latitude: 69.65, Longitude: 18.96}
+	tests := []struct {
+		name   string
+		geo    *GeoLocation
+		event  SunEvent
+		day    time.Time
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			name:   "sunrise at summer solstice",
+			geo:    berlin,
+			event:  SE_SUNRISE,
+			day:    time.Date(2026, 6, 21, 0, 0, 0, 0, berlinLoc),
+			want:   time.Date(2026, 6, 21, 4, 43, 0, 0, berlinLoc),
+			wantOk: true,
+		},
+		{
+			name:   "sunset at summer solstice",
+			geo:    berlin,
+			event:  SE_SUNSET,
+			day:    time.Date(2026, 6, 21, 0, 0, 0, 0, berlinLoc),
+			want:   time.Date(2026, 6, 21, 21, 33, 0, 0, berlinLoc),
+			wantOk: true,
+		},
+		{
+			name:   "sunrise at winter solstice",
+			geo:    berlin,
+			event:  SE_SUNRISE,
+			day:    time.Date(2026, 12, 21, 0, 0, 0, 0, berlinLoc),
+			want:   time.Date(2026, 12, 21, 8, 15, 0, 0, berlinLoc),
+			wantOk: true,
+		},
+		{
+			name:   "civil dusk at winter solstice",
+			geo:    berlin,
+			event:  SE_DUSK,
+			day:    time.Date(2026, 12, 21, 0, 0, 0, 0, berlinLoc),
+			want:   time.Date(2026, 12, 21, 16, 36, 0, 0, berlinLoc),
+			wantOk: true,
+		},
+		{
+			name:   "no sunset during the polar day",
+			geo:    tromso,
+			event:  SE_SUNSET,
+			day:    time.Date(2026, 6, 21, 0, 0, 0, 0, time.UTC),
+			wantOk: false,
+		},
+		{
+			name:   "no sunrise during the polar night",
+			geo:    tromso,
+			event:  SE_SUNRISE,
+			day:    time.Date(2026, 12, 21, 0, 0, 0, 0, time.UTC),
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.geo.SunEventTime(tt.event, tt.day)
+			if ok != tt.wantOk {
+				t.Fatalf("SunEventTime() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if diff := got.Sub(tt.want); diff < -2*time.Minute || diff > 2*time.Minute {
+				t.Errorf("SunEventTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSunScheduleSpec(t *testing.T) {
+	berlinLoc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+	berlin := &GeoLocation{Latitude: 52.52, Longitude: 13.405}
+	now := time.Date(2026, 6, 21, 22, 0, 0, 0, berlinLoc)
+	tests := []struct {
+		name    string
+		spec    string
+		geo     *GeoLocation
+		want    time.Time
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:    "sunset with offset moves to the next day",
+			spec:    "sunset+15m",
+			geo:     berlin,
+			want:    time.Date(2026, 6, 22, 21, 48, 0, 0, berlinLoc),
+			wantStr: "sunset+15m",
+		},
+		{
+			name:    "sunrise with negative offset",
+			spec:    "Sunrise - 30m",
+			geo:     berlin,
+			want:    time.Date(2026, 6, 22, 4, 13, 0, 0, berlinLoc),
+			wantStr: "sunrise-30m",
+		},
+		{
+			name:    "large offset of yesterday's event",
+			spec:    "sunset+1h",
+			geo:     berlin,
+			want:    time.Date(2026, 6, 21, 22, 33, 0, 0, berlinLoc),
+			wantStr: "sunset+1h",
+		},
+		{
+			name:    "nautical dawn is not dawn",
+			spec:    "nauticaldawn",
+			geo:     berlin,
+			want:    time.Date(2026, 6, 22, 2, 30, 0, 0, berlinLoc),
+			wantStr: "nauticaldawn",
+		},
+		{
+			name:    "sun event w/o location",
+			spec:    "sunset",
+			geo:     nil,
+			wantErr: true,
+		},
+		{
+			name:    "invalid offset",
+			spec:    "sunset+soon",
+			geo:     berlin,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trigger, err := parseScheduleSpec(tt.spec, now, tt.geo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseScheduleSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if trigger.String() != tt.wantStr {
+				t.Errorf("trigger.String() = %s, want %s", trigger.String(), tt.wantStr)
+			}
+			got, ok := trigger.Next(now)
+			if !ok {
+				t.Fatalf("trigger.Next() never fires")
+			}
+			if diff := got.Sub(tt.want); diff < -2*time.Minute || diff > 2*time.Minute {
+				t.Errorf("trigger.Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package crebrid
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WireProtocol spoken with the controller
+type WireProtocol int
+
+const (
+	// WP_V1 sends the access code followed by a command ID with 3 digits, the controller answers
+	// with its status. it is kept as fallback for controllers which run the old telnet server
+	WP_V1 WireProtocol = iota
+	// WP_V2 sends frames with a sequence number, a type, a payload and a CRC. the controller
+	// acknowledges every frame with the status or rejects it with a reason
+	WP_V2
+	// WP_CIP speaks the Crestron Internet Protocol with the control system like an XPanel, the
+	// telnet server module is not needed
+	WP_CIP
+)
+
+var wireProtocolStr = map[WireProtocol]string{
+	WP_V1:  "v1",
+	WP_V2:  "v2",
+	WP_CIP: "cip",
+}
+
+func (wp WireProtocol) String() string {
+	return wireProtocolStr[wp]
+}
+
+// ParseWireProtocol of a name like "v2"
+func ParseWireProtocol(str string) (WireProtocol, error) {
+	for wp, name := range wireProtocolStr {
+		if strings.EqualFold(str, name) {
+			return wp, nil
+		}
+	}
+	return WP_V1, fmt.Errorf("unknown wire protocol [%s]", str)
+}
+
+// WireType of a v2 frame
+type WireType byte
+
+const (
+	// WT_STATUS requests the status, the payload is the access code
+	WT_STATUS WireType = 'S'
+	// WT_TOGGLE toggles a command ID, the payload is "<access code>,<id>"
+	WT_TOGGLE WireType = 'T'
+	// WT_DIGITAL sets a digital output, the payload is "<access code>,<id>,<0|1>"
+	WT_DIGITAL WireType = 'D'
+	// WT_ANALOG sets an analog output, the payload is "<access code>,<port>,<0-65535>"
+	WT_ANALOG WireType = 'A'
+	// WT_SERIAL sets a serial output, the payload is "<access code>,<port>,<text>"
+	WT_SERIAL WireType = 'X'
+	// WT_PUSH is sent by the controller on its own as its status changed, e.g. by a keypad. the
+	// sequence number is 0 and the payload is the status
+	WT_PUSH WireType = 'P'
+	// WT_HELLO is sent by a controller which connects to crebrid instead of being dialed, the
+	// sequence number is 0 and the payload is the access code. it is not answered
+	WT_HELLO WireType = 'H'
+	// WT_ACK acknowledges a frame, the payload is the type of the frame followed by the status
+	WT_ACK WireType = 'K'
+	// WT_NAK rejects a frame, the payload is the type of the frame followed by the reason
+	WT_NAK WireType = 'N'
+)
+
+// reasons of the controller to reject a frame
+const (
+	// NR_CRC the frame is corrupted, it was not executed and can be sent again
+	NR_CRC = "crc"
+	// NR_ACCESS the access code is wrong
+	NR_ACCESS = "access"
+	// NR_TYPE the type of the frame is unknown
+	NR_TYPE = "type"
+	// NR_FORMAT the payload cannot be parsed
+	NR_FORMAT = "format"
+	// NR_RANGE an ID, port or value is out of range
+	NR_RANGE = "range"
+)
+
+// ErrFrameCorrupted is returned if the controller rejected a frame by its CRC
+var ErrFrameCorrupted = errors.New("frame corrupted on the way to the controller")
+
+// ErrCommandRejected is returned if the controller rejected a command for any other reason
+var ErrCommandRejected = errors.New("command rejected by controller")
+
+const (
+	WIRE_V2_PREFIX = "@2;"
+	// wire_frame_max is the longest frame the controller sends
+	wire_frame_max = 512
+)
+
+// WireFrame of the v2 protocol: "@2;<seq>;<type>;<payload>*<crc>\r\n". seq and crc are 4 hex
+// digits, the CRC-16/CCITT covers everything between "@" and "*". the payload must not hold
+// "@", CR or LF
+type WireFrame struct {
+	Seq     uint16
+	Type    WireType
+	Payload string
+}
+
+func (wf WireFrame) String() string {
+	return fmt.Sprintf("%04X %c [%s]", wf.Seq, wf.Type, wf.Payload)
+}
+
+// Encode the frame for the wire
+func (wf WireFrame) Encode() []byte {
+	body := fmt.Sprintf("2;%04X;%c;%s", wf.Seq, wf.Type, wf.Payload)
+	return []byte(fmt.Sprintf("@%s*%04X\r\n", body, CRC16([]byte(body))))
+}
+
+// CRC16 of data by CRC-16/CCITT-FALSE, the one of the module telnet_server
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ParseWireFrame of a line without CR/LF
+func ParseWireFrame(line []byte) (WireFrame, error) {
+	return parseWireFrame(line, 0)
+}
+
+func parseWireFrame(line []byte, start int64) (WireFrame, error) {
+	var wf WireFrame
+	if !strings.HasPrefix(string(line), WIRE_V2_PREFIX) {
+		return wf, frameError(line, start, 0, "frame of an unknown protocol version")
+	}
+	star := strings.LastIndexByte(string(line), '*')
+	// the shortest frame is "@2;0000;S;*0000"
+	if star < 10 || len(line) != star+5 || line[7] != ';' || line[9] != ';' {
+		return wf, frameError(line, start, 0, "malformed frame")
+	}
+	crc, err := strconv.ParseUint(string(line[star+1:]), 16, 16)
+	if err != nil {
+		return wf, frameError(line, start, star+1, "malformed CRC")
+	}
+	if want := CRC16(line[1:star]); uint16(crc) != want {
+		return wf, frameError(line, start, star+1, fmt.Sprintf("CRC %04X, want %04X", crc, want))
+	}
+	seq, err := strconv.ParseUint(string(line[3:7]), 16, 16)
+	if err != nil {
+		return wf, frameError(line, start, 3, "malformed sequence number")
+	}
+	wf.Seq = uint16(seq)
+	wf.Type = WireType(line[8])
+	wf.Payload = string(line[10:star])
+	return wf, nil
+}
+
+// WireDecoder reads the v2 frames from a stream
+type WireDecoder interface {
+	// Next frame of the stream. a *FrameError is returned for a frame which was dropped, the
+	// decoder goes on with the next frame. any other error is the one of the reader
+	Next() (WireFrame, error)
+}
+
+// wireDecoder skips everything in front of "@", a frame ends at LF. like the status decoder it
+// keeps a frame which spans several reads and resynchronizes with the next "@"
+type wireDecoder struct {
+	reader *bufio.Reader
+	offset int64
+	start  int64
+	frame  []byte
+	telnet telnetFilter
+}
+
+func NewWireDecoder(reader io.Reader) WireDecoder {
+	wd := new(wireDecoder)
+	wd.reader = bufio.NewReader(reader)
+	wd.frame = make([]byte, 0, 256)
+	return wd
+}
+
+func (wd *wireDecoder) Next() (WireFrame, error) {
+	for {
+		b, err := wd.reader.ReadByte()
+		if err != nil {
+			return WireFrame{}, err
+		}
+		wd.offset++
+		if wd.telnet.skip(b) {
+			continue
+		}
+		if len(wd.frame) == 0 {
+			if b == '@' {
+				wd.begin()
+			}
+			continue
+		}
+		switch {
+		case b == '@':
+			err := frameError(wd.frame, wd.start, len(wd.frame), "frame is cut off by the next one")
+			wd.begin()
+			return WireFrame{}, err
+		case b == '\n':
+			line, start := wd.frame, wd.start
+			wd.frame = make([]byte, 0, 256)
+			return parseWireFrame(line, start)
+		case b == '\r':
+		case b < ' ' || b > '~':
+			err := frameError(wd.frame, wd.start, len(wd.frame), fmt.Sprintf("unexpected byte 0x%02x", b))
+			wd.frame = wd.frame[:0]
+			return WireFrame{}, err
+		default:
+			wd.frame = append(wd.frame, b)
+		}
+		if len(wd.frame) > wire_frame_max {
+			err := frameError(wd.frame, wd.start, len(wd.frame)-1, fmt.Sprintf("frame exceeds %d bytes", wire_frame_max))
+			wd.frame = wd.frame[:0]
+			return WireFrame{}, err
+		}
+	}
+}
+
+// begin a frame with the "@" just read
+func (wd *wireDecoder) begin() {
+	wd.frame = append(wd.frame[:0], '@')
+	wd.start = wd.offset - 1
+}
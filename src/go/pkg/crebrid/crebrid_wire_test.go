@@ -0,0 +1,112 @@
+package crebrid
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCRC16(t *testing.T) {
+	// check value of CRC-16/CCITT-FALSE
+	if got := CRC16([]byte("123456789")); got != 0x29B1 {
+		t.Errorf("CRC16() = %04X, want 29B1", got)
+	}
+}
+
+func TestWireFrameEncode(t *testing.T) {
+	wf := WireFrame{Seq: 0x1A, Type: WT_TOGGLE, Payload: "3H34GJ67NH,1042"}
+	got := string(wf.Encode())
+	if want := "@2;001A;T;3H34GJ67NH,1042*95CD\r\n"; got != want {
+		t.Errorf("Encode() = %q, want %q", got, want)
+	}
+	parsed, err := ParseWireFrame([]byte(strings.TrimSuffix(got, "\r\n")))
+	if err != nil || parsed != wf {
+		t.Errorf("ParseWireFrame() = %v, %v, want %v", parsed, err, wf)
+	}
+}
+
+func TestParseWireFrame(t *testing.T) {
+	valid := strings.TrimSuffix(string(WireFrame{Seq: 7, Type: WT_ACK, Payload: "S{\"d\":[1],\"a\":[]}"}.Encode()), "\r\n")
+	tests := []struct {
+		name    string
+		line    string
+		want    WireFrame
+		wantErr string
+	}{
+		{
+			name: "ack with status",
+			line: valid,
+			want: WireFrame{Seq: 7, Type: WT_ACK, Payload: "S{\"d\":[1],\"a\":[]}"},
+		},
+		{
+			name:    "unknown version",
+			line:    "@3" + valid[2:],
+			wantErr: "frame of an unknown protocol version",
+		},
+		{
+			name:    "corrupted payload",
+			line:    strings.Replace(valid, "[1]", "[0]", 1),
+			wantErr: "CRC",
+		},
+		{
+			name:    "missing CRC",
+			line:    "@2;0007;K;S",
+			wantErr: "malformed frame",
+		},
+		{
+			name:    "malformed CRC",
+			line:    valid[:len(valid)-4] + "12G4",
+			wantErr: "malformed CRC",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWireFrame([]byte(tt.line))
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidFrame) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseWireFrame() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParseWireFrame() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWireDecoder(t *testing.T) {
+	first := WireFrame{Seq: 1, Type: WT_ACK, Payload: "S{\"d\":[1],\"a\":[]}"}
+	second := WireFrame{Seq: 2, Type: WT_NAK, Payload: "T" + NR_ACCESS}
+	stream := "\xff\xfb\x01\r\nCP3>" + string(first.Encode()) + "@2;0002;K;T{\"d\":" + string(second.Encode()) + "\nreturning: 5\r\n"
+	for name, reader := range map[string]io.Reader{
+		"whole":        strings.NewReader(stream),
+		"single bytes": iotest.OneByteReader(strings.NewReader(stream)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			wd := NewWireDecoder(reader)
+			got := make([]WireFrame, 0)
+			dropped := 0
+			for {
+				wf, err := wd.Next()
+				if err == io.EOF {
+					break
+				}
+				if errors.Is(err, ErrInvalidFrame) {
+					dropped++
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, wf)
+			}
+			if want := []WireFrame{first, second}; !reflect.DeepEqual(got, want) || dropped != 1 {
+				t.Errorf("Next() = %v with %d dropped, want %v with 1 dropped", got, dropped, want)
+			}
+		})
+	}
+}
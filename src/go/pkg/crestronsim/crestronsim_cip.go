@@ -0,0 +1,293 @@
+package crestronsim
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+// cip_simulator_write_timeout is the time a panel has to take a packet of the simulator
+const cip_simulator_write_timeout = time.Second
+
+// CIPSimulator is a control system which speaks CIP with panels, for tests and development
+// without a processor. its program toggles a digital join on every press and sends analog and
+// serial joins back as they are set, like a program which drives the feedback of its panels
+type CIPSimulator interface {
+	// Start to listen for panels
+	Start() error
+	// Stop listening and close the connections of the panels
+	Stop()
+	// Addr the simulator listens on
+	Addr() string
+	// SetDigital join like a keypad of the program, the registered panels get the change
+	SetDigital(join int, on bool)
+	// SetAnalog join like a sensor of the program, the registered panels get the change
+	SetAnalog(join int, value int)
+	// Digital state of a join
+	Digital(join int) bool
+	// Analog value of a join
+	Analog(join int) int
+	// Serial text of a join
+	Serial(join int) string
+	// DropConnections of the panels like a reboot of the control system
+	DropConnections()
+}
+
+type cipSimulator struct {
+	port  int
+	ipIDs map[int]bool
+	// lock guards the fields below. packets are written while it is held, so the packets of
+	// different routines do not interleave
+	lock sync.Mutex
+	ln   net.Listener
+	// conns of the panels, true as soon as a panel is registered
+	conns    map[net.Conn]bool
+	digitals map[int]bool
+	analogs  map[int]int
+	serials  map[int]string
+	wg       sync.WaitGroup
+}
+
+// NewCIPSimulator on port, 0 picks a free port. panels are accepted by one of the IP IDs
+func NewCIPSimulator(port int, ipIDs ...int) CIPSimulator {
+	cs := new(cipSimulator)
+	cs.port = port
+	cs.ipIDs = make(map[int]bool)
+	for _, ipID := range ipIDs {
+		cs.ipIDs[ipID] = true
+	}
+	cs.conns = make(map[net.Conn]bool)
+	cs.digitals = make(map[int]bool)
+	cs.analogs = make(map[int]int)
+	cs.serials = make(map[int]string)
+	return cs
+}
+
+func (cs *cipSimulator) Start() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cs.port))
+	if err != nil {
+		return err
+	}
+	cs.lock.Lock()
+	cs.ln = ln
+	cs.lock.Unlock()
+	logging.LogFmt(logging.LOG_INFO, "[cip simulator] wait for panels on: %s", ln.Addr())
+	cs.wg.Add(1)
+	go cs.serve(ln)
+	return nil
+}
+
+func (cs *cipSimulator) Stop() {
+	cs.lock.Lock()
+	if cs.ln != nil {
+		cs.ln.Close()
+		cs.ln = nil
+	}
+	cs.lock.Unlock()
+	cs.DropConnections()
+	cs.wg.Wait()
+}
+
+func (cs *cipSimulator) Addr() string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.ln != nil {
+		return cs.ln.Addr().String()
+	}
+	return fmt.Sprintf(":%d", cs.port)
+}
+
+func (cs *cipSimulator) DropConnections() {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	for conn := range cs.conns {
+		conn.Close()
+	}
+}
+
+func (cs *cipSimulator) SetDigital(join int, on bool) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.digitals[join] = on
+	cs.broadcast(crebrid.CIPDigital(crebrid.CIP_DATA_DIGITAL, join, on))
+}
+
+func (cs *cipSimulator) SetAnalog(join int, value int) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.analogs[join] = value
+	cs.broadcast(crebrid.CIPAnalog(join, value))
+}
+
+func (cs *cipSimulator) Digital(join int) bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.digitals[join]
+}
+
+func (cs *cipSimulator) Analog(join int) int {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.analogs[join]
+}
+
+func (cs *cipSimulator) Serial(join int) string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.serials[join]
+}
+
+// serve the panels until the listener is closed
+func (cs *cipSimulator) serve(ln net.Listener) {
+	defer cs.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[cip simulator] stop listening: %s", err)
+			return
+		}
+		cs.lock.Lock()
+		if cs.ln != ln {
+			// stopped while the connection was accepted
+			cs.lock.Unlock()
+			conn.Close()
+			return
+		}
+		cs.conns[conn] = false
+		cs.lock.Unlock()
+		cs.wg.Add(1)
+		go cs.handle(conn)
+	}
+}
+
+// handle the packets of a panel, which has to register first
+func (cs *cipSimulator) handle(conn net.Conn) {
+	defer cs.wg.Done()
+	defer func() {
+		cs.lock.Lock()
+		delete(cs.conns, conn)
+		cs.lock.Unlock()
+		conn.Close()
+	}()
+	cs.send(conn, crebrid.CIPPacket{Type: crebrid.CIP_REGISTER_REQUEST, Payload: []byte{0x02}})
+	reader := bufio.NewReader(conn)
+	for {
+		cp, err := crebrid.ReadCIPPacket(reader)
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[cip simulator] panel [%s] is gone: %s", conn.RemoteAddr(), err)
+			return
+		}
+		cs.lock.Lock()
+		registered := cs.conns[conn]
+		cs.lock.Unlock()
+		switch {
+		case cp.Type == crebrid.CIP_REGISTER:
+			if len(cp.Payload) < 6 || !cs.ipIDs[int(cp.Payload[5])] {
+				logging.LogFmt(logging.LOG_WARN, "[cip simulator] reject panel [%s]: %s", conn.RemoteAddr(), cp)
+				cs.send(conn, crebrid.CIPRegisterResult(false))
+				return
+			}
+			cs.lock.Lock()
+			cs.conns[conn] = true
+			cs.lock.Unlock()
+			cs.send(conn, crebrid.CIPRegisterResult(true))
+		case cp.Type == crebrid.CIP_HEARTBEAT:
+			cs.send(conn, crebrid.CIPPacket{Type: crebrid.CIP_HEARTBEAT_RESPONSE, Payload: []byte{0x00, 0x00}})
+		case cp.Type == crebrid.CIP_DISCONNECT:
+			return
+		case !registered:
+			logging.LogFmt(logging.LOG_WARN, "[cip simulator] ignore packet of an unregistered panel: %s", cp)
+		case cp.Type == crebrid.CIP_DATA || cp.Type == crebrid.CIP_SERIAL:
+			cj, err := crebrid.ParseCIPJoin(cp)
+			if err != nil {
+				logging.LogFmt(logging.LOG_WARN, "[cip simulator] drop packet: %s", err)
+				continue
+			}
+			cs.execute(conn, cj)
+		}
+	}
+}
+
+// execute a join of a panel like the program of the control system
+func (cs *cipSimulator) execute(conn net.Conn, cj crebrid.CIPJoin) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	switch cj.DataType {
+	case crebrid.CIP_DATA_PRESS:
+		// the program toggles the join on the press, the release is ignored
+		if cj.On {
+			cs.digitals[cj.Join] = !cs.digitals[cj.Join]
+			cs.broadcast(crebrid.CIPDigital(crebrid.CIP_DATA_DIGITAL, cj.Join, cs.digitals[cj.Join]))
+		}
+	case crebrid.CIP_DATA_ANALOG:
+		cs.analogs[cj.Join] = cj.Value
+		cs.broadcast(crebrid.CIPAnalog(cj.Join, cj.Value))
+	case crebrid.CIP_DATA_SERIAL:
+		cs.serials[cj.Join] = cj.Text
+		cs.broadcast(crebrid.CIPSerial(cj.Join, cj.Text))
+	case crebrid.CIP_DATA_UPDATE:
+		if cj.Update == crebrid.CIP_UPDATE_REQUEST {
+			cs.update(conn)
+		}
+	}
+}
+
+// update sends all joins to the panel in the order of the joins, followed by the end of the
+// update. the lock has to be held
+func (cs *cipSimulator) update(conn net.Conn) {
+	digitals := make([]int, 0, len(cs.digitals))
+	for join := range cs.digitals {
+		digitals = append(digitals, join)
+	}
+	sort.Ints(digitals)
+	for _, join := range digitals {
+		cs.write(conn, crebrid.CIPDigital(crebrid.CIP_DATA_DIGITAL, join, cs.digitals[join]))
+	}
+	analogs := make([]int, 0, len(cs.analogs))
+	for join := range cs.analogs {
+		analogs = append(analogs, join)
+	}
+	sort.Ints(analogs)
+	for _, join := range analogs {
+		cs.write(conn, crebrid.CIPAnalog(join, cs.analogs[join]))
+	}
+	serials := make([]int, 0, len(cs.serials))
+	for join := range cs.serials {
+		serials = append(serials, join)
+	}
+	sort.Ints(serials)
+	for _, join := range serials {
+		cs.write(conn, crebrid.CIPSerial(join, cs.serials[join]))
+	}
+	cs.write(conn, crebrid.CIPUpdate(crebrid.CIP_UPDATE_END))
+}
+
+// broadcast the packet to every registered panel. the lock has to be held
+func (cs *cipSimulator) broadcast(cp crebrid.CIPPacket) {
+	for conn, registered := range cs.conns {
+		if registered {
+			cs.write(conn, cp)
+		}
+	}
+}
+
+// send the packet to the panel
+func (cs *cipSimulator) send(conn net.Conn, cp crebrid.CIPPacket) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.write(conn, cp)
+}
+
+// write the packet to the panel. the lock has to be held
+func (cs *cipSimulator) write(conn net.Conn, cp crebrid.CIPPacket) {
+	conn.SetWriteDeadline(time.Now().Add(cip_simulator_write_timeout))
+	if _, err := conn.Write(cp.Encode()); err != nil {
+		logging.LogFmt(logging.LOG_DEBUG, "[cip simulator] write to panel [%s] failed: %s", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,125 @@
+package crestronsim
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+)
+
+// startCIPSimulator on a free port which accepts the IP ID 03
+func startCIPSimulator(t *testing.T) (CIPSimulator, string, int) {
+	t.Helper()
+	sim := NewCIPSimulator(0, crebrid.CIP_DEFAULT_IPID)
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Stop)
+	_, portStr, err := net.SplitHostPort(sim.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return sim, "127.0.0.1", port
+}
+
+func cipTestPolicy() crebrid.ClientPolicy {
+	policy := crebrid.DefaultClientPolicy()
+	policy.Protocol = crebrid.WP_CIP
+	policy.Connect.Timeout = time.Second
+	policy.Layout = crebrid.StatusLayout{Digitals: 8, Analogs: 4}
+	return policy
+}
+
+func TestCIPSimulatorRegistration(t *testing.T) {
+	_, ip, port := startCIPSimulator(t)
+	policy := cipTestPolicy()
+	policy.IPID = 0x1F
+	if _, err := crebrid.NewCrestronControllerClient(ip, port, policy); !errors.Is(err, crebrid.ErrCIPRegistration) {
+		t.Errorf("NewCrestronControllerClient() with unknown IP ID error = %v, want %v", err, crebrid.ErrCIPRegistration)
+	}
+}
+
+func TestCIPSimulator(t *testing.T) {
+	sim, ip, port := startCIPSimulator(t)
+	sim.SetDigital(2, true)
+	sim.SetAnalog(1, 1234)
+	// joins beyond the layout are not part of the status
+	sim.SetDigital(9, true)
+	client, err := crebrid.NewCrestronControllerClient(ip, port, cipTestPolicy())
+	if err != nil {
+		t.Fatalf("NewCrestronControllerClient() error = %v", err)
+	}
+	defer client.Close()
+	pushes := make(chan *crebrid.SystemStatus, 8)
+	client.OnStatusPush(func(ss *crebrid.SystemStatus) {
+		pushes <- ss
+	})
+	if isOn, err := client.ToggleSwitch(status_toggle); err != nil || !isOn {
+		t.Fatalf("ToggleSwitch() of the status = %v, %v", isOn, err)
+	}
+	ss := client.GetSystemStatus()
+	if len(ss.D) != 8 || len(ss.A) != 4 || ss.D[1] != 1 || ss.A[0] != 1234 {
+		t.Fatalf("status after the update = %v", ss)
+	}
+	// a toggle presses the join and gets the changed join back
+	if isOn, err := client.ToggleSwitch(3); err != nil || !isOn || !sim.Digital(3) {
+		t.Errorf("ToggleSwitch(3) = %v, %v, simulator %v", isOn, err, sim.Digital(3))
+	}
+	if isOn, err := client.SetDigital(3, true); err != nil || !isOn || !sim.Digital(3) {
+		t.Errorf("SetDigital(3, true) of a high join = %v, %v, simulator %v", isOn, err, sim.Digital(3))
+	}
+	if isOn, err := client.SetDigital(2, false); err != nil || isOn || sim.Digital(2) {
+		t.Errorf("SetDigital(2, false) = %v, %v, simulator %v", isOn, err, sim.Digital(2))
+	}
+	if err := client.SetAnalog(4, 30000.4); err != nil || sim.Analog(4) != 30000 || client.GetSystemStatus().A[3] != 30000 {
+		t.Errorf("SetAnalog(4) = %v, simulator %d, status %v", err, sim.Analog(4), client.GetSystemStatus())
+	}
+	if err := client.SetAnalog(4, 70000); !errors.Is(err, crebrid.ErrInvalidValue) {
+		t.Errorf("SetAnalog() out of range error = %v, want %v", err, crebrid.ErrInvalidValue)
+	}
+	if err := client.SetSerial(1, "hello"); err != nil {
+		t.Errorf("SetSerial() error = %v", err)
+	}
+	for i := 0; i < 200 && sim.Serial(1) != "hello"; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := sim.Serial(1); got != "hello" {
+		t.Errorf("serial join 1 = %q, want %q", got, "hello")
+	}
+	select {
+	case ss := <-pushes:
+		t.Errorf("push of the answer of a request: %v", ss)
+	default:
+	}
+	// a join changed by the program is pushed
+	sim.SetDigital(5, true)
+	select {
+	case ss := <-pushes:
+		if ss.D[4] != 1 {
+			t.Errorf("pushed status = %v, want d5 on", ss)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no push of a join changed by the program")
+	}
+	// a reboot of the control system breaks the connection until it is re-dialed
+	sim.DropConnections()
+	for i := 0; i < 200; i++ {
+		if _, err = client.ToggleSwitch(status_toggle); err != nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err == nil {
+		t.Fatal("ToggleSwitch() of a dropped connection succeeded")
+	}
+	if err := client.ReDial(); err != nil {
+		t.Fatalf("ReDial() error = %v", err)
+	}
+	if isOn, err := client.SetDigital(5, false); err != nil || isOn || sim.Digital(5) {
+		t.Errorf("SetDigital(5, false) after re-dial = %v, %v, simulator %v", isOn, err, sim.Digital(5))
+	}
+}
@@ -0,0 +1,556 @@
+// Package crestronsim simulates the controllers crebrid talks to, so the service is developed
+// and tested without a processor: a controller with the telnet server module and a control
+// system which speaks CIP with its panels
+package crestronsim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+	"github.com/dachunky/crestrontcpbridge/pkg/logging"
+)
+
+const (
+	// telnet_simulator_push_delay is the wait of system_state_to_json before it pushes a
+	// change, every change restarts it
+	telnet_simulator_push_delay = 100 * time.Millisecond
+	// telnet_simulator_write_timeout is the time a client has to take an answer
+	telnet_simulator_write_timeout = time.Second
+	// telnet_simulator_rx_max is the longest incomplete frame which is kept
+	telnet_simulator_rx_max = 300
+)
+
+// SimulatorFault of a request to the telnet simulator. the zero value answers the request
+type SimulatorFault struct {
+	// Latency of the answer on top of the latency of the simulator
+	Latency time.Duration
+	// Lose the request, it is neither executed nor answered
+	Lose bool
+	// Corrupt the request on its way, a v2 frame is rejected by its CRC and a v1 request is
+	// declined without answer
+	Corrupt bool
+	// Drop the answer, the request is executed anyway
+	Drop bool
+	// Disconnect the client instead of answering, the request is executed anyway
+	Disconnect bool
+}
+
+// keys of the steps of a simulator script
+const (
+	sim_step_ok         = "ok"
+	sim_step_lose       = "lose"
+	sim_step_corrupt    = "corrupt"
+	sim_step_drop       = "drop"
+	sim_step_disconnect = "disconnect"
+	sim_step_delay      = "delay="
+	sim_step_repeat     = "*"
+)
+
+func (sf SimulatorFault) String() string {
+	var steps []string
+	if sf.Latency > 0 {
+		steps = append(steps, sim_step_delay+sf.Latency.String())
+	}
+	for _, step := range []struct {
+		set  bool
+		name string
+	}{{sf.Lose, sim_step_lose}, {sf.Corrupt, sim_step_corrupt}, {sf.Drop, sim_step_drop}, {sf.Disconnect, sim_step_disconnect}} {
+		if step.set {
+			steps = append(steps, step.name)
+		}
+	}
+	if len(steps) == 0 {
+		return sim_step_ok
+	}
+	return strings.Join(steps, "+")
+}
+
+// ParseSimulatorScript of steps like "ok,delay=2s+drop,lose*3,disconnect". every step is the
+// fault of one request, "*n" repeats it for n requests
+func ParseSimulatorScript(str string) ([]SimulatorFault, error) {
+	var ret []SimulatorFault
+	for _, step := range strings.Split(str, ",") {
+		step = strings.TrimSpace(step)
+		if step == "" {
+			continue
+		}
+		repeat := 1
+		if i := strings.LastIndex(step, sim_step_repeat); i >= 0 {
+			n, err := strconv.Atoi(step[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid repetition of step [%s]", step)
+			}
+			repeat = n
+			step = step[:i]
+		}
+		var sf SimulatorFault
+		for _, opt := range strings.Split(step, "+") {
+			opt = strings.TrimSpace(opt)
+			switch {
+			case opt == sim_step_ok:
+			case opt == sim_step_lose:
+				sf.Lose = true
+			case opt == sim_step_corrupt:
+				sf.Corrupt = true
+			case opt == sim_step_drop:
+				sf.Drop = true
+			case opt == sim_step_disconnect:
+				sf.Disconnect = true
+			case strings.HasPrefix(opt, sim_step_delay):
+				latency, err := time.ParseDuration(strings.TrimPrefix(opt, sim_step_delay))
+				if err != nil || latency < 0 {
+					return nil, fmt.Errorf("invalid delay of step [%s]", step)
+				}
+				sf.Latency = latency
+			default:
+				return nil, fmt.Errorf("invalid step [%s]: expect %s, %s, %s, %s, %s or %s<duration>", step, sim_step_ok, sim_step_lose, sim_step_corrupt, sim_step_drop, sim_step_disconnect, sim_step_delay)
+			}
+		}
+		for i := 0; i < repeat; i++ {
+			ret = append(ret, sf)
+		}
+	}
+	return ret, nil
+}
+
+// TelnetSimulator is a controller which runs the modules telnet_server and
+// system_state_to_json, for tests and development without a processor. it speaks v1 and v2,
+// its logic toggles the digital outputs by the command IDs and holds the analog and serial
+// values. the failures of the next requests can be scripted
+type TelnetSimulator interface {
+	// Start to listen for clients
+	Start() error
+	// Stop listening and close the connections of the clients
+	Stop()
+	// Addr the simulator listens on
+	Addr() string
+	// SetLatency of every answer
+	SetLatency(latency time.Duration)
+	// Script the faults of the next requests, one fault per request in the order they arrive.
+	// the requests behind the script are answered as usual
+	Script(faults ...SimulatorFault)
+	// SetDigital output like a keypad, the change is pushed to the v2 clients
+	SetDigital(id int, on bool)
+	// SetAnalog value like a sensor, the change is pushed to the v2 clients
+	SetAnalog(port int, value int)
+	// Status of the digital outputs and analog values
+	Status() *crebrid.SystemStatus
+	// Serial text of a port
+	Serial(port int) string
+	// Requests received so far, including the lost ones
+	Requests() int
+	// DropConnections of the clients like a reboot of the controller
+	DropConnections()
+}
+
+type telnetSimulator struct {
+	port       int
+	accessCode string
+	// lock guards the fields below. answers are written while it is held, so the answers of
+	// different routines do not interleave
+	lock sync.Mutex
+	ln   net.Listener
+	// conns of the clients, true as soon as a client sent a valid v2 frame
+	conns     map[net.Conn]bool
+	d         []int
+	a         []int
+	serials   map[int]string
+	latency   time.Duration
+	script    []SimulatorFault
+	requests  int
+	pushTimer *time.Timer
+	wg        sync.WaitGroup
+}
+
+// NewTelnetSimulator on port, 0 picks a free port. the layout is the number of digital outputs
+// and analog values of the status
+func NewTelnetSimulator(port int, accessCode string, layout crebrid.StatusLayout) TelnetSimulator {
+	ts := new(telnetSimulator)
+	ts.port = port
+	ts.accessCode = accessCode
+	ts.conns = make(map[net.Conn]bool)
+	ts.d = make([]int, layout.Digitals)
+	ts.a = make([]int, layout.Analogs)
+	ts.serials = make(map[int]string)
+	return ts
+}
+
+func (ts *telnetSimulator) Start() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", ts.port))
+	if err != nil {
+		return err
+	}
+	ts.lock.Lock()
+	ts.ln = ln
+	ts.lock.Unlock()
+	logging.LogFmt(logging.LOG_INFO, "[telnet simulator] wait for clients on: %s", ln.Addr())
+	ts.wg.Add(1)
+	go ts.serve(ln)
+	return nil
+}
+
+func (ts *telnetSimulator) Stop() {
+	ts.lock.Lock()
+	if ts.ln != nil {
+		ts.ln.Close()
+		ts.ln = nil
+	}
+	if ts.pushTimer != nil {
+		ts.pushTimer.Stop()
+	}
+	ts.lock.Unlock()
+	ts.DropConnections()
+	ts.wg.Wait()
+}
+
+func (ts *telnetSimulator) Addr() string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.ln != nil {
+		return ts.ln.Addr().String()
+	}
+	return fmt.Sprintf(":%d", ts.port)
+}
+
+func (ts *telnetSimulator) SetLatency(latency time.Duration) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.latency = latency
+}
+
+func (ts *telnetSimulator) Script(faults ...SimulatorFault) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.script = append(ts.script, faults...)
+}
+
+func (ts *telnetSimulator) SetDigital(id int, on bool) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if id < 1 || id > len(ts.d) || (ts.d[id-1] > 0) == on {
+		return
+	}
+	ts.d[id-1] = 1 - ts.d[id-1]
+	ts.changed()
+}
+
+func (ts *telnetSimulator) SetAnalog(port int, value int) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if port < 1 || port > len(ts.a) || ts.a[port-1] == value {
+		return
+	}
+	ts.a[port-1] = value
+	ts.changed()
+}
+
+func (ts *telnetSimulator) Status() *crebrid.SystemStatus {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ss := &crebrid.SystemStatus{D: append([]int{}, ts.d...), A: make([]float64, len(ts.a))}
+	for i, value := range ts.a {
+		ss.A[i] = float64(value)
+	}
+	return ss
+}
+
+func (ts *telnetSimulator) Serial(port int) string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.serials[port]
+}
+
+func (ts *telnetSimulator) Requests() int {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.requests
+}
+
+func (ts *telnetSimulator) DropConnections() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for conn := range ts.conns {
+		conn.Close()
+	}
+}
+
+// serve the clients until the listener is closed
+func (ts *telnetSimulator) serve(ln net.Listener) {
+	defer ts.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] stop listening: %s", err)
+			return
+		}
+		ts.lock.Lock()
+		if ts.ln != ln {
+			// stopped while the connection was accepted
+			ts.lock.Unlock()
+			conn.Close()
+			return
+		}
+		ts.conns[conn] = false
+		ts.lock.Unlock()
+		ts.wg.Add(1)
+		go ts.handle(conn)
+	}
+}
+
+// handle the requests of a client like the CHANGE request of telnet_server
+func (ts *telnetSimulator) handle(conn net.Conn) {
+	defer ts.wg.Done()
+	defer func() {
+		ts.lock.Lock()
+		delete(ts.conns, conn)
+		ts.lock.Unlock()
+		conn.Close()
+	}()
+	buf := make([]byte, telnet_simulator_rx_max)
+	var rx []byte
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] client [%s] is gone: %s", conn.RemoteAddr(), err)
+			return
+		}
+		// v1 requests are not framed, v2 frames start with "@" and end with LF
+		if len(rx) == 0 && bytes.IndexByte(buf[:n], '@') < 0 {
+			if !ts.handleV1(conn, string(buf[:n])) {
+				return
+			}
+			continue
+		}
+		rx = append(rx, buf[:n]...)
+		for {
+			i := bytes.IndexByte(rx, '\n')
+			if i < 0 {
+				break
+			}
+			line := string(rx[:i+1])
+			rx = rx[i+1:]
+			if !ts.handleV2(conn, line) {
+				return
+			}
+		}
+		// a frame is never that long, drop the garbage
+		if len(rx) > telnet_simulator_rx_max {
+			rx = nil
+		}
+	}
+}
+
+// nextFault of the script for a request which arrived
+func (ts *telnetSimulator) nextFault() SimulatorFault {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.requests++
+	if len(ts.script) == 0 {
+		return SimulatorFault{}
+	}
+	sf := ts.script[0]
+	ts.script = ts.script[1:]
+	logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] fault of request %d: %s", ts.requests, sf)
+	return sf
+}
+
+// handleV1 request "<access code><command ID>", false if the client is disconnected
+func (ts *telnetSimulator) handleV1(conn net.Conn, request string) bool {
+	sf := ts.nextFault()
+	if sf.Lose {
+		return true
+	}
+	i := strings.Index(request, ts.accessCode)
+	if i < 0 || sf.Corrupt || strings.Trim(request[i+len(ts.accessCode):], "0123456789") != "" {
+		logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] request declined: %q", request)
+		return true
+	}
+	// the command ID follows the access code, without one only the status is created
+	id, _ := strconv.Atoi(request[i+len(ts.accessCode):])
+	ts.lock.Lock()
+	ts.conns[conn] = false
+	ts.toggle(id)
+	answer := ts.statusJSON()
+	ts.lock.Unlock()
+	return ts.answer(conn, sf, answer)
+}
+
+// handleV2 frame of a line like HandleFrame of telnet_server, false if the client is
+// disconnected
+func (ts *telnetSimulator) handleV2(conn net.Conn, line string) bool {
+	at := strings.Index(line, crebrid.WIRE_V2_PREFIX)
+	if at < 0 {
+		logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] skip: %q", line)
+		return true
+	}
+	frame := strings.TrimRight(line[at:], "\r\n")
+	star := strings.LastIndexByte(frame, '*')
+	if star < 10 || len(frame) != star+5 || frame[7] != ';' || frame[9] != ';' {
+		// the sequence number cannot be trusted, so the client waits for its timeout
+		logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] malformed frame: %q", frame)
+		return true
+	}
+	seq, err := strconv.ParseUint(frame[3:7], 16, 16)
+	if err != nil {
+		// the sequence number cannot be trusted, so the client waits for its timeout
+		logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] malformed frame: %q", frame)
+		return true
+	}
+	sf := ts.nextFault()
+	if sf.Lose {
+		return true
+	}
+	wt := crebrid.WireType(frame[8])
+	nak := func(reason string) bool {
+		return ts.answer(conn, sf, crebrid.WireFrame{Seq: uint16(seq), Type: crebrid.WT_NAK, Payload: string(wt) + reason}.Encode())
+	}
+	crc, err := strconv.ParseUint(frame[star+1:], 16, 16)
+	if sf.Corrupt || err != nil || uint16(crc) != crebrid.CRC16([]byte(frame[1:star])) {
+		return nak(crebrid.NR_CRC)
+	}
+	// the payload starts with the access code
+	fields := strings.Split(frame[10:star], ",")
+	if fields[0] != ts.accessCode {
+		return nak(crebrid.NR_ACCESS)
+	}
+	ts.lock.Lock()
+	ts.conns[conn] = true
+	ts.lock.Unlock()
+	var id, value int
+	if wt != crebrid.WT_STATUS {
+		if wt != crebrid.WT_TOGGLE && wt != crebrid.WT_DIGITAL && wt != crebrid.WT_ANALOG && wt != crebrid.WT_SERIAL {
+			return nak(crebrid.NR_TYPE)
+		}
+		var ok bool
+		if id, ok = simulatorNumber(fields, 1); !ok {
+			return nak(crebrid.NR_FORMAT)
+		}
+		if id < 1 {
+			return nak(crebrid.NR_RANGE)
+		}
+	}
+	switch wt {
+	case crebrid.WT_TOGGLE:
+		if len(fields) > 2 {
+			return nak(crebrid.NR_FORMAT)
+		}
+	case crebrid.WT_DIGITAL, crebrid.WT_ANALOG:
+		var ok bool
+		if value, ok = simulatorNumber(fields, 2); !ok || len(fields) > 3 {
+			return nak(crebrid.NR_FORMAT)
+		}
+		if wt == crebrid.WT_DIGITAL && value > 1 {
+			return nak(crebrid.NR_RANGE)
+		}
+	}
+	ts.lock.Lock()
+	switch wt {
+	case crebrid.WT_TOGGLE:
+		ts.toggle(id)
+	case crebrid.WT_DIGITAL:
+		if id <= len(ts.d) {
+			ts.d[id-1] = value
+		}
+	case crebrid.WT_ANALOG:
+		if id <= len(ts.a) {
+			ts.a[id-1] = value
+		}
+	case crebrid.WT_SERIAL:
+		// the text is the rest of the payload, it may hold commas
+		ts.serials[id] = strings.Join(fields[2:], ",")
+	}
+	answer := crebrid.WireFrame{Seq: uint16(seq), Type: crebrid.WT_ACK, Payload: string(wt) + string(ts.statusJSON())}.Encode()
+	ts.lock.Unlock()
+	return ts.answer(conn, sf, answer)
+}
+
+// simulatorNumber of the field like IsNumber of telnet_server: 1 to 5 digits up to 65535
+func simulatorNumber(fields []string, i int) (int, bool) {
+	if i >= len(fields) || len(fields[i]) < 1 || len(fields[i]) > 5 || strings.Trim(fields[i], "0123456789") != "" {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(fields[i])
+	return n, n <= 65535
+}
+
+// toggle the digital output of a command ID like the logic behind requestInfo. 0 and the IDs
+// without output only create the status. the lock has to be held
+func (ts *telnetSimulator) toggle(id int) {
+	if id > 0 && id <= len(ts.d) {
+		ts.d[id-1] = 1 - ts.d[id-1]
+	}
+}
+
+// statusJSON like system_state_to_json. the lock has to be held
+func (ts *telnetSimulator) statusJSON() []byte {
+	data, _ := json.Marshal(struct {
+		D []int `json:"d"`
+		A []int `json:"a"`
+	}{ts.d, ts.a})
+	return data
+}
+
+// answer the request after the latency unless the fault drops the answer or disconnects the
+// client, false if the client is disconnected
+func (ts *telnetSimulator) answer(conn net.Conn, sf SimulatorFault, data []byte) bool {
+	if sf.Disconnect {
+		logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] disconnect client [%s]", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if sf.Drop {
+		return true
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	latency := ts.latency + sf.Latency
+	if latency == 0 {
+		ts.write(conn, data)
+		return true
+	}
+	// the client may send further requests while the answer is late
+	ts.wg.Add(1)
+	time.AfterFunc(latency, func() {
+		defer ts.wg.Done()
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+		ts.write(conn, data)
+	})
+	return true
+}
+
+// changed restarts the wait of the push. the lock has to be held
+func (ts *telnetSimulator) changed() {
+	if ts.pushTimer == nil {
+		ts.pushTimer = time.AfterFunc(telnet_simulator_push_delay, ts.push)
+		return
+	}
+	ts.pushTimer.Reset(telnet_simulator_push_delay)
+}
+
+// push the status to the v2 clients
+func (ts *telnetSimulator) push() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	data := crebrid.WireFrame{Type: crebrid.WT_PUSH, Payload: string(ts.statusJSON())}.Encode()
+	for conn, v2 := range ts.conns {
+		if v2 {
+			ts.write(conn, data)
+		}
+	}
+}
+
+// write the data to the client. the lock has to be held
+func (ts *telnetSimulator) write(conn net.Conn, data []byte) {
+	conn.SetWriteDeadline(time.Now().Add(telnet_simulator_write_timeout))
+	if _, err := conn.Write(data); err != nil {
+		logging.LogFmt(logging.LOG_DEBUG, "[telnet simulator] write to client [%s] failed: %s", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,157 @@
+package crestronsim
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+)
+
+// status_toggle is the switch ID which only reads the status of the controller
+const status_toggle = 0
+
+func TestParseSimulatorScript(t *testing.T) {
+	tests := []struct {
+		script  string
+		want    []SimulatorFault
+		wantErr bool
+	}{
+		{script: "", want: nil},
+		{script: "ok, drop", want: []SimulatorFault{{}, {Drop: true}}},
+		{script: "delay=2s+drop,lose*2,corrupt+disconnect", want: []SimulatorFault{{Latency: 2 * time.Second, Drop: true}, {Lose: true}, {Lose: true}, {Corrupt: true, Disconnect: true}}},
+		{script: "drop*0", wantErr: true},
+		{script: "delay=soon", wantErr: true},
+		{script: "explode", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			got, err := ParseSimulatorScript(tt.script)
+			if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSimulatorScript() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+	if got, want := (SimulatorFault{Latency: 2 * time.Second, Drop: true}).String(), "delay=2s+drop"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+// startTelnetSimulator on a free port with 4 digital outputs and 2 analog values
+func startTelnetSimulator(t *testing.T) (TelnetSimulator, string, int) {
+	t.Helper()
+	sim := NewTelnetSimulator(0, "123DEF", crebrid.StatusLayout{Digitals: 4, Analogs: 2})
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Stop)
+	_, portStr, err := net.SplitHostPort(sim.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return sim, "127.0.0.1", port
+}
+
+func telnetTestPolicy(protocol crebrid.WireProtocol) crebrid.ClientPolicy {
+	policy := crebrid.DefaultClientPolicy()
+	policy.Protocol = protocol
+	policy.Connect.Timeout = time.Second
+	policy.Status = crebrid.OperationPolicy{Timeout: 200 * time.Millisecond, Retries: 2}
+	policy.Toggle = crebrid.OperationPolicy{Timeout: 200 * time.Millisecond, Retries: 1}
+	policy.Analog = crebrid.OperationPolicy{Timeout: 200 * time.Millisecond, Retries: 1}
+	policy.RetryDelay = 10 * time.Millisecond
+	policy.Layout = crebrid.StatusLayout{Digitals: 4, Analogs: 2}
+	return policy
+}
+
+func TestTelnetSimulatorV1(t *testing.T) {
+	sim, ip, port := startTelnetSimulator(t)
+	client, err := crebrid.NewCrestronControllerClient(ip, port, telnetTestPolicy(crebrid.WP_V1))
+	if err != nil {
+		t.Fatalf("NewCrestronControllerClient() error = %v", err)
+	}
+	defer client.Close()
+	client.SetAccessCode("123DEF")
+	if isOn, err := client.ToggleSwitch(2); err != nil || !isOn {
+		t.Errorf("ToggleSwitch(2) = %v, %v", isOn, err)
+	}
+	// an ID without output only creates the status
+	if _, err := client.ToggleSwitch(9); err != nil {
+		t.Errorf("ToggleSwitch(9) error = %v", err)
+	}
+	if got, want := sim.Status(), (&crebrid.SystemStatus{D: []int{0, 1, 0, 0}, A: []float64{0, 0}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Status() = %v, want %v", got, want)
+	}
+	// a request with a wrong access code is declined without answer
+	client.SetAccessCode("WRONG")
+	if _, err := client.ToggleSwitch(1); err == nil {
+		t.Error("ToggleSwitch() with wrong access code succeeded")
+	}
+	if sim.Status().D[0] != 0 {
+		t.Error("request with wrong access code toggled the output")
+	}
+}
+
+func TestTelnetSimulatorV2(t *testing.T) {
+	sim, ip, port := startTelnetSimulator(t)
+	client, err := crebrid.NewCrestronControllerClient(ip, port, telnetTestPolicy(crebrid.WP_V2))
+	if err != nil {
+		t.Fatalf("NewCrestronControllerClient() error = %v", err)
+	}
+	defer client.Close()
+	client.SetAccessCode("123DEF")
+	pushes := make(chan *crebrid.SystemStatus, 8)
+	client.OnStatusPush(func(ss *crebrid.SystemStatus) {
+		pushes <- ss
+	})
+	// a corrupted toggle is sent again and toggles once, the status read before it is answered
+	sim.Script(SimulatorFault{}, SimulatorFault{Corrupt: true})
+	if isOn, err := client.ToggleSwitch(1); err != nil || !isOn || sim.Status().D[0] != 1 {
+		t.Errorf("ToggleSwitch(1) of a corrupted frame = %v, %v, status %v", isOn, err, sim.Status())
+	}
+	// a set whose answer is dropped is sent again
+	sim.Script(SimulatorFault{Drop: true})
+	if isOn, err := client.SetDigital(3, true); err != nil || !isOn || sim.Status().D[2] != 1 {
+		t.Errorf("SetDigital(3) with dropped answer = %v, %v, status %v", isOn, err, sim.Status())
+	}
+	if err := client.SetAnalog(2, 1234); err != nil || sim.Status().A[1] != 1234 {
+		t.Errorf("SetAnalog(2) = %v, status %v", err, sim.Status())
+	}
+	if err := client.SetSerial(1, "a,b"); err != nil || sim.Serial(1) != "a,b" {
+		t.Errorf("SetSerial(1) = %v, serial %q", err, sim.Serial(1))
+	}
+	// a status request answered too late for all its attempts times out
+	sim.Script(SimulatorFault{Latency: 500 * time.Millisecond}, SimulatorFault{Latency: 500 * time.Millisecond}, SimulatorFault{Latency: 500 * time.Millisecond})
+	if _, err := client.ToggleSwitch(status_toggle); !errors.Is(err, crebrid.ErrResponseTimeout) {
+		t.Errorf("ToggleSwitch() of a late status error = %v, want %v", err, crebrid.ErrResponseTimeout)
+	}
+	// a keypad is pushed once the wait of system_state_to_json passed
+	sim.SetDigital(4, true)
+	select {
+	case ss := <-pushes:
+		if ss.D[3] != 1 {
+			t.Errorf("pushed status = %v, want output 4 on", ss)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no push of the keypad")
+	}
+	// a disconnect breaks the connection until it is re-dialed
+	requests := sim.Requests()
+	sim.Script(SimulatorFault{}, SimulatorFault{Disconnect: true})
+	if _, err := client.ToggleSwitch(2); err == nil {
+		t.Error("ToggleSwitch() of a disconnected client succeeded")
+	}
+	if sim.Requests() <= requests || sim.Status().D[1] != 1 {
+		t.Errorf("request of the disconnect was not executed: %d requests, status %v", sim.Requests(), sim.Status())
+	}
+	if err := client.ReDial(); err != nil {
+		t.Fatalf("ReDial() error = %v", err)
+	}
+	if isOn, err := client.SetDigital(2, false); err != nil || isOn || sim.Status().D[1] != 0 {
+		t.Errorf("SetDigital(2, false) after re-dial = %v, %v, status %v", isOn, err, sim.Status())
+	}
+}
@@ -0,0 +1,221 @@
+// Package e2e runs crebrid in the process against a simulated controller, so the service is
+// tested end to end through its IPC interface and the command paths of crebri
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebri"
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+	"github.com/dachunky/crestrontcpbridge/pkg/crestronsim"
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+const (
+	// HARNESS_ACCESS_CODE of the simulated controller
+	HARNESS_ACCESS_CODE = "E2E0TEST"
+	// HARNESS_DIGITALS and HARNESS_ANALOGS are the status layout of the simulated controller
+	HARNESS_DIGITALS = 8
+	HARNESS_ANALOGS  = 2
+	// harness_start_timeout is the time the service has to accept IPC clients
+	harness_start_timeout = 5 * time.Second
+	// harness_stop_timeout is the time the service has to shut down
+	harness_stop_timeout = 15 * time.Second
+	// harness_poll_interval of Eventually
+	harness_poll_interval = 20 * time.Millisecond
+)
+
+// harness_settings of crebrid.conf. the timeouts are short, so the failure paths are covered
+// within a few seconds
+const harness_settings = `ip=127.0.0.1
+port=%d
+protocol=v2
+ipcPort=%d
+accessCode=%s
+digitalPorts=%d
+analogPorts=%d
+scenesFile=%[6]s/scenes.conf
+scheduleFile=%[6]s/schedule.conf
+calendarsFile=%[6]s/calendars.conf
+rulesFile=%[6]s/rules.conf
+scriptsDir=%[6]s/scripts
+scriptsLogDir=%[6]s/scripts/log
+pollInterval=1h
+statusMaxAge=1h
+connectTimeout=500ms
+statusTimeout=300ms
+toggleTimeout=300ms
+analogTimeout=300ms
+serialTimeout=300ms
+retryDelay=20ms
+heartbeatInterval=1h
+ipcReadRetries=50
+ipcReadRetryDelay=20ms
+`
+
+// Harness of a service which is connected to a simulated controller. every port is picked at
+// random, so harnesses run in parallel
+type Harness struct {
+	// Controller simulates the main controller of the service
+	Controller crestronsim.TelnetSimulator
+	// ConfigFile of the service, crebri reads the IPC port from it
+	ConfigFile string
+	// Settings the service runs with
+	Settings *crebrid.CrebridDSettings
+	t        testing.TB
+	cancel   context.CancelFunc
+	done     chan error
+}
+
+// NewHarness starts the simulated controller and the service. settings are appended to the
+// settings of the harness, e.g. "protocol=v1" or a controller section. the service is
+// stopped as soon as the test is done
+func NewHarness(t testing.TB, settings string) *Harness {
+	t.Helper()
+	h := &Harness{t: t, done: make(chan error, 1)}
+	h.Controller = crestronsim.NewTelnetSimulator(0, HARNESS_ACCESS_CODE, crebrid.StatusLayout{Digitals: HARNESS_DIGITALS, Analogs: HARNESS_ANALOGS})
+	if err := h.Controller.Start(); err != nil {
+		t.Fatalf("start simulated controller: %v", err)
+	}
+	t.Cleanup(h.Controller.Stop)
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "scripts", "log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := fmt.Sprintf(harness_settings, portOf(t, h.Controller.Addr()), freePort(t), HARNESS_ACCESS_CODE, HARNESS_DIGITALS, HARNESS_ANALOGS, dir)
+	data = mergeSettings(data, settings)
+	h.ConfigFile = filepath.Join(dir, "crebrid.conf")
+	if err := os.WriteFile(h.ConfigFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	h.Settings, err = crebrid.LoadFromConfigFile(h.ConfigFile)
+	if err != nil {
+		t.Fatalf("load settings: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() {
+		h.done <- crebrid.NewMainExecute(*h.Settings).Run(ctx)
+	}()
+	t.Cleanup(h.Stop)
+	h.Eventually("the service accepts IPC clients", harness_start_timeout, func() bool {
+		ic, err := ipc.RegisterClient("127.0.0.1", h.Settings.IPCPort, h.Settings.IPCReadPolicy)
+		if err != nil {
+			return false
+		}
+		ic.CloseConnection()
+		return true
+	})
+	return h
+}
+
+// Stop the service, it is called again by the cleanup of the test
+func (h *Harness) Stop() {
+	h.t.Helper()
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	h.cancel = nil
+	select {
+	case err := <-h.done:
+		if err != nil {
+			h.t.Errorf("service failed: %v", err)
+		}
+	case <-time.After(harness_stop_timeout):
+		h.t.Errorf("service did not stop within %s", harness_stop_timeout)
+	}
+}
+
+// Client registered at the service, it is closed as soon as the test is done
+func (h *Harness) Client() ipc.IpcClient {
+	h.t.Helper()
+	ic, err := ipc.RegisterClient("127.0.0.1", h.Settings.IPCPort, h.Settings.IPCReadPolicy)
+	if err != nil {
+		h.t.Fatalf("register IPC client: %v", err)
+	}
+	h.t.Cleanup(func() { ic.CloseConnection() })
+	return ic
+}
+
+// Crebri runs crebri with the arguments against the service and returns its output
+func (h *Harness) Crebri(args ...string) (string, error) {
+	var out bytes.Buffer
+	err := crebri.ExecuteArgs(append([]string{"server", "-ip=127.0.0.1"}, args...), h.ConfigFile, &out)
+	return strings.TrimSpace(out.String()), err
+}
+
+// Eventually fails the test if cond is not true within the timeout
+func (h *Harness) Eventually(what string, timeout time.Duration, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("%s: not within %s", what, timeout)
+		}
+		time.Sleep(harness_poll_interval)
+	}
+}
+
+// mergeSettings appends the root keys of extra to base, which has no sections, followed by the
+// sections of extra. a root key of extra replaces the one of base
+func mergeSettings(base string, extra string) string {
+	replaced := make(map[string]bool)
+	var root, sections []string
+	for _, line := range strings.Split(extra, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "[") || len(sections) > 0 {
+			sections = append(sections, line)
+			continue
+		}
+		root = append(root, line)
+		replaced[settingsKey(line)] = true
+	}
+	var lines []string
+	for _, line := range strings.Split(base, "\n") {
+		if !replaced[settingsKey(line)] {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(append(append(lines, root...), sections...), "\n")
+}
+
+// settingsKey of a line of the settings
+func settingsKey(line string) string {
+	return strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+}
+
+// portOf the address of a listener
+func portOf(t testing.TB, addr string) int {
+	t.Helper()
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+// freePort for a listener of the service. the port is released right away, so it may be
+// taken by someone else until the service listens on it
+func freePort(t testing.TB) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,232 @@
+package e2e
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dachunky/crestrontcpbridge/pkg/crebrid"
+	"github.com/dachunky/crestrontcpbridge/pkg/crestronsim"
+	"github.com/dachunky/crestrontcpbridge/pkg/ipc"
+)
+
+// reconnect_timeout covers the backoff of the link after a broken connection
+const reconnect_timeout = 5 * time.Second
+
+func TestSetAndGet(t *testing.T) {
+	for _, protocol := range []string{"v1", "v2"} {
+		t.Run(protocol, func(t *testing.T) {
+			h := NewHarness(t, "protocol="+protocol)
+			if out, err := h.Crebri("set", "-port=2"); err != nil || out != "ON" {
+				t.Fatalf("crebri set -port=2 = %q, %v", out, err)
+			}
+			if out, err := h.Crebri("get", "-port=0"); err != nil || out != "OFF,ON,OFF,OFF,OFF,OFF,OFF,OFF" {
+				t.Errorf("crebri get -port=0 = %q, %v", out, err)
+			}
+			if out, err := h.Crebri("set", "-port=2"); err != nil || out != "OFF" {
+				t.Errorf("crebri set -port=2 again = %q, %v", out, err)
+			}
+			if out, err := h.Crebri("set", "-port=5"); err != nil || out != "ON" {
+				t.Errorf("crebri set -port=5 = %q, %v", out, err)
+			}
+			if got, want := h.Controller.Status().D, []int{0, 0, 0, 0, 1, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+				t.Errorf("controller outputs = %v, want %v", got, want)
+			}
+			if out, err := h.Crebri("get", "-port=0", "-refresh"); err != nil || out != "OFF,OFF,OFF,OFF,ON,OFF,OFF,OFF" {
+				t.Errorf("crebri get -port=0 -refresh = %q, %v", out, err)
+			}
+		})
+	}
+}
+
+func TestKeypadPush(t *testing.T) {
+	h := NewHarness(t, "")
+	// the status is pushed by the controller, so the cache of the service follows the keypad
+	// without polling
+	if _, err := h.Crebri("get", "-port=0", "-refresh"); err != nil {
+		t.Fatalf("crebri get -port=0 -refresh error = %v", err)
+	}
+	requests := h.Controller.Requests()
+	h.Controller.SetDigital(3, true)
+	h.Eventually("the keypad is pushed to the service", time.Second, func() bool {
+		out, err := h.Crebri("get", "-port=0")
+		return err == nil && out == "OFF,OFF,ON,OFF,OFF,OFF,OFF,OFF"
+	})
+	if got := h.Controller.Requests(); got != requests {
+		t.Errorf("controller got %d requests after the push, want %d", got, requests)
+	}
+	// crebri sees the events of the push
+	out, err := h.Crebri("events")
+	if err != nil || !strings.Contains(out, "d3=on") {
+		t.Errorf("crebri events = %q, %v", out, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	h := NewHarness(t, "")
+	if _, err := h.Crebri("set", "-port=1"); err != nil {
+		t.Fatalf("crebri set -port=1 error = %v", err)
+	}
+	// the controller reboots, the link notices it on the next request and dials it again
+	h.Controller.DropConnections()
+	h.Eventually("the service reconnects after a reboot", reconnect_timeout, func() bool {
+		_, err := h.Crebri("get", "-port=0", "-refresh")
+		return err == nil
+	})
+	// the controller closes the connection while it executes the toggle, the status read
+	// before it is answered
+	h.Controller.Script(crestronsim.SimulatorFault{}, crestronsim.SimulatorFault{Disconnect: true})
+	if _, err := h.Crebri("set", "-port=4"); err == nil {
+		t.Error("crebri set of a disconnected request succeeded")
+	}
+	h.Eventually("the service reconnects after a disconnect", reconnect_timeout, func() bool {
+		out, err := h.Crebri("get", "-port=0", "-refresh")
+		return err == nil && strings.HasPrefix(out, "ON,OFF,OFF,ON,")
+	})
+	if got, want := h.Controller.Status().D[:4], []int{1, 0, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("controller outputs = %v, want %v", got, want)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	h := NewHarness(t, "")
+	// a late answer within the timeout is taken
+	h.Controller.SetLatency(100 * time.Millisecond)
+	if out, err := h.Crebri("set", "-port=6"); err != nil || out != "ON" {
+		t.Errorf("crebri set -port=6 with latency = %q, %v", out, err)
+	}
+	h.Controller.SetLatency(0)
+	// the status read before the toggle is answered, the toggle and the status reads which
+	// decide whether it was executed are lost
+	h.Controller.Script(crestronsim.SimulatorFault{}, crestronsim.SimulatorFault{Lose: true}, crestronsim.SimulatorFault{Lose: true}, crestronsim.SimulatorFault{Lose: true}, crestronsim.SimulatorFault{Lose: true})
+	if _, err := h.Crebri("set", "-port=7"); err == nil {
+		t.Error("crebri set of a lost request succeeded")
+	}
+	if h.Controller.Status().D[6] != 0 {
+		t.Error("lost request toggled the output")
+	}
+	h.Eventually("the service recovers from the timeout", reconnect_timeout, func() bool {
+		out, err := h.Crebri("set", "-port=7")
+		return err == nil && out == "ON"
+	})
+	if got := h.Controller.Status().D[6]; got != 1 {
+		t.Errorf("output 7 = %d, want 1", got)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	h := NewHarness(t, "")
+	const clients = 8
+	const toggles = 5
+	clientsOf := make([]ipc.IpcClient, clients)
+	for i := range clientsOf {
+		clientsOf[i] = h.Client()
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*toggles*2)
+	for i, ic := range clientsOf {
+		wg.Add(1)
+		go func(port int, ic ipc.IpcClient) {
+			defer wg.Done()
+			for n := 0; n < toggles; n++ {
+				cc := ipc.NewClientCommand()
+				cc.Cmd = ipc.IC_SINGLE
+				cc.AddDigitalPorts(port)
+				sr, err := ic.SendCommand(cc)
+				if err == nil && sr.Error != "" {
+					err = fmt.Errorf("%s", sr.Error)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("toggle %d of port %d: %w", n, port, err)
+					continue
+				}
+				if want := n%2 == 0; sr.DigitalPortInfo[port] != want {
+					errs <- fmt.Errorf("toggle %d of port %d = %v, want %v", n, port, sr.DigitalPortInfo[port], want)
+				}
+				cc = ipc.NewClientCommand()
+				cc.Cmd = ipc.IC_GET
+				if _, err := ic.SendCommand(cc); err != nil {
+					errs <- fmt.Errorf("get of client %d: %w", port, err)
+				}
+			}
+		}(i+1, ic)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// every port was toggled an odd number of times
+	if got, want := h.Controller.Status().D, []int{1, 1, 1, 1, 1, 1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("controller outputs = %v, want %v", got, want)
+	}
+	if got := h.Controller.Requests(); got < clients*toggles {
+		t.Errorf("controller got %d requests, want at least %d", got, clients*toggles)
+	}
+}
+
+func TestSecondController(t *testing.T) {
+	annex := crestronsim.NewTelnetSimulator(0, HARNESS_ACCESS_CODE, crebrid.StatusLayout{Digitals: 2, Analogs: 0})
+	if err := annex.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(annex.Stop)
+	h := NewHarness(t, fmt.Sprintf("[controller.annex]\nip=127.0.0.1\nport=%d\ndigitalPorts=2\nanalogPorts=0\n", portOf(t, annex.Addr())))
+	if out, err := h.Crebri("set", "-port=2", "-controller=annex"); err != nil || out != "ON" {
+		t.Fatalf("crebri set -port=2 -controller=annex = %q, %v", out, err)
+	}
+	if got := annex.Status().D; !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("annex outputs = %v", got)
+	}
+	if got := h.Controller.Status().D[1]; got != 0 {
+		t.Errorf("main output 2 = %d, want 0", got)
+	}
+	out, err := h.Crebri("get", "-port=0")
+	if err != nil || !strings.Contains(out, "annex") {
+		t.Errorf("crebri get of every controller = %q, %v", out, err)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	capture := filepath.Join(t.TempDir(), "crebrid.cap")
+	recorded := NewHarness(t, "captureFile="+capture)
+	if out, err := recorded.Crebri("set", "-port=2"); err != nil || out != "ON" {
+		t.Fatalf("crebri set -port=2 = %q, %v", out, err)
+	}
+	if out, err := recorded.Crebri("get", "-port=0", "-refresh"); err != nil || out != "OFF,ON,OFF,OFF,OFF,OFF,OFF,OFF" {
+		t.Fatalf("crebri get -port=0 -refresh = %q, %v", out, err)
+	}
+	recorded.Stop()
+	records, err := crebrid.ReadCaptureFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := crebrid.CaptureConnections(records)
+	controllers := crebrid.FilterCaptureConnections(conns, crebrid.CaptureControllerStream(crebrid.DEFAULT_CONTROLLER))
+	clients := crebrid.FilterCaptureConnections(conns, crebrid.CAPTURE_STREAM_IPC)
+	if len(controllers) != 1 || len(clients) < 2 {
+		t.Fatalf("capture of %d controller and %d IPC connections", len(controllers), len(clients))
+	}
+	// a second service talks to the recorded controller and gets the recorded requests
+	rc := crebrid.NewReplayController(0, controllers, 0)
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Stop()
+	replayed := NewHarness(t, fmt.Sprintf("port=%d", portOf(t, rc.Addr())))
+	mismatches := crebrid.ReplayClients(fmt.Sprintf("127.0.0.1:%d", replayed.Settings.IPCPort), clients, clients[0].Start, 0)
+	replayed.Stop()
+	select {
+	case <-rc.Done():
+	case <-time.After(reconnect_timeout):
+		t.Fatal("the recorded controller was not played")
+	}
+	mismatches = append(mismatches, rc.Mismatches()...)
+	if len(mismatches) != 0 {
+		t.Errorf("replay differs from the capture:\n%s", strings.Join(mismatches, "\n"))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/dachunky/crestrontcpbridge/pkg/logging"
 )
@@ -20,13 +21,14 @@ type IpcClient interface {
 
 // ipcClient represents a registered IPC client
 type ipcClient struct {
-	id      string
-	ipcConn net.Conn
+	id         string
+	ipcConn    net.Conn
+	readPolicy ReadPolicy
 }
 
 // RegisterClient
-func RegisterClient(ip string, port int) (IpcClient, error) {
-	connStr := fmt.Sprintf("%s:%d", ip, port)
+func RegisterClient(ip string, port int, rp ReadPolicy) (IpcClient, error) {
+	connStr := net.JoinHostPort(ip, strconv.Itoa(port))
 	// connect to the service
 	cs, err := net.Dial("tcp", connStr)
 	if err != nil {
@@ -45,7 +47,7 @@ func RegisterClient(ip string, port int) (IpcClient, error) {
 		logging.LogFmt(logging.LOG_ERROR, "[IPCCLIENT] failed to write in connection stream: %v", err)
 		return nil, err
 	}
-	response, err := ReadUntilEOF(bufio.NewReader(cs)) //.ReadBytes('\n')
+	response, err := ReadUntilEOF(bufio.NewReader(cs), rp) //.ReadBytes('\n')
 	if err != nil {
 		logging.LogFmt(logging.LOG_ERROR, "[IPCCLIENT] receive error register response: %v", err)
 		return nil, err
@@ -61,6 +63,7 @@ func RegisterClient(ip string, port int) (IpcClient, error) {
 	ret := new(ipcClient)
 	ret.id = sr.ID
 	ret.ipcConn = cs
+	ret.readPolicy = rp
 	return ret, nil
 }
 
@@ -84,7 +87,7 @@ func (ic *ipcClient) SendCommand(cc *ClientCommand) (*ServerResponse, error) {
 		return nil, err
 	}
 	logging.Log(logging.LOG_DEBUG, "[IPCCLIENT] data sent --> waiting for response")
-	resp, err := ReadUntilEOF(bufio.NewReader(ic.ipcConn))
+	resp, err := ReadUntilEOF(bufio.NewReader(ic.ipcConn), ic.readPolicy)
 	if err != nil {
 		logging.LogFmt(logging.LOG_ERROR, "[IPCCLIENT] receive error response: %v", err)
 		return nil, err
@@ -1,6 +1,10 @@
 package ipc
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -50,16 +54,8 @@ func TestIpcClientServer(t *testing.T) {
 			wantErr: false,
 		},
 	}
-	port := 65432
-	srv := NewIpcServer(port)
-	go srv.StartListening(ipcEventHandler)
-	defer srv.Close()
-	time.Sleep(100 * time.Millisecond)
-	err := srv.HasError()
-	if err != nil {
-		t.Fatalf("failed to listening to port [%d]: %v", port, err)
-	}
-	client, err := RegisterClient("localhost", port)
+	_, port := startIpcServer(t, ipcEventHandler)
+	client, err := RegisterClient("localhost", port, DefaultReadPolicy())
 	if err != nil {
 		t.Fatalf("failed to register client on port [%d]: %v", port, err)
 	}
@@ -83,3 +79,126 @@ func TestIpcClientServer(t *testing.T) {
 	}
 	t.Log("--> tests run")
 }
+
+// startIpcServer on a free port, which is returned. the server is closed when the test is done
+func startIpcServer(t *testing.T, handler func(cc *ClientCommand) (*ServerResponse, error)) (IpcServer, int) {
+	t.Helper()
+	srv := NewIpcServer(0, DefaultReadPolicy())
+	go srv.StartListening(handler)
+	t.Cleanup(srv.Close)
+	for i := 0; i < 100 && srv.Addr() == "" && srv.HasError() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := srv.HasError(); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	_, portStr, err := net.SplitHostPort(srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return srv, port
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	const clients = 3
+	// every request waits until the requests of all clients are in flight
+	var wg sync.WaitGroup
+	wg.Add(clients)
+	allInFlight := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(allInFlight)
+	}()
+	handler := func(cc *ClientCommand) (*ServerResponse, error) {
+		if cc.Cmd != IC_SINGLE {
+			return ipcEventHandler(cc)
+		}
+		wg.Done()
+		select {
+		case <-allInFlight:
+		case <-time.After(2 * time.Second):
+			sr := NewServerResponse()
+			sr.Cmd = cc.Cmd
+			sr.Error = fmt.Sprintf("request of client %s handled alone", cc.ID)
+			return sr, nil
+		}
+		return ipcEventHandler(cc)
+	}
+	srv, port := startIpcServer(t, handler)
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		client, err := RegisterClient("localhost", port, DefaultReadPolicy())
+		if err != nil {
+			t.Fatalf("failed to register client on port [%d]: %v", port, err)
+		}
+		defer client.CloseConnection()
+		go func(id int) {
+			sr, err := client.SendCommand(&ClientCommand{Cmd: IC_SINGLE, ID: fmt.Sprint(id), DigitalPorts: []int{id}})
+			if err == nil && sr.Error != "" {
+				err = fmt.Errorf("%s", sr.Error)
+			}
+			errs <- err
+		}(i + 1)
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("SendCommand() error = %v", err)
+		}
+	}
+	if err := srv.HasError(); err != nil {
+		t.Errorf("HasError() = %v", err)
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	handler := func(cc *ClientCommand) (*ServerResponse, error) {
+		if cc.Cmd == IC_SINGLE {
+			return nil, fmt.Errorf("port %v is broken", cc.DigitalPorts)
+		}
+		return ipcEventHandler(cc)
+	}
+	srv, port := startIpcServer(t, handler)
+	client, err := RegisterClient("localhost", port, DefaultReadPolicy())
+	if err != nil {
+		t.Fatalf("failed to register client on port [%d]: %v", port, err)
+	}
+	defer client.CloseConnection()
+	// the client gets the error instead of waiting for its read timeout
+	sr, err := client.SendCommand(&ClientCommand{Cmd: IC_SINGLE, ID: "client123", DigitalPorts: []int{3}})
+	if err != nil || sr.Error != "port [3] is broken" {
+		t.Fatalf("SendCommand() of a failing handler = %v, %v, want the error of the handler", sr, err)
+	}
+	// the server keeps running
+	sr, err = client.SendCommand(&ClientCommand{Cmd: IC_MULTIPLE, ID: "client123", DigitalPorts: []int{2}})
+	if err != nil || sr.Error != "" || !sr.DigitalPortInfo[2] {
+		t.Errorf("SendCommand() after a failing handler = %v, %v", sr, err)
+	}
+	if err := srv.HasError(); err != nil {
+		t.Errorf("HasError() = %v, want nil", err)
+	}
+}
+
+func TestBrokenClient(t *testing.T) {
+	srv, port := startIpcServer(t, ipcEventHandler)
+	client, err := RegisterClient("localhost", port, DefaultReadPolicy())
+	if err != nil {
+		t.Fatalf("failed to register client on port [%d]: %v", port, err)
+	}
+	defer client.CloseConnection()
+	// a client which sends garbage and goes away only loses its own connection
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("garbage"))
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := srv.HasError(); err != nil {
+		t.Errorf("HasError() after a broken client = %v, want nil", err)
+	}
+	sr, err := client.SendCommand(&ClientCommand{Cmd: IC_SINGLE, ID: "client123", DigitalPorts: []int{1}})
+	if err != nil || !sr.DigitalPortInfo[1] {
+		t.Errorf("SendCommand() of another client = %v, %v", sr, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,8 +20,44 @@ const (
 	IC_SINGLE
 	// IC_MULTIPLE send a command for multiple items
 	IC_MULTIPLE
-	// IC_GET the state of an item
+	// IC_GET the state of an item. it is served from the state store of the service unless
+	// a refresh is requested
 	IC_GET
+	// IC_SCENE list, activate or capture a named scene
+	IC_SCENE
+	// IC_SCHEDULE list, add or remove scheduled jobs
+	IC_SCHEDULE
+	// IC_CALENDAR show the upcoming triggers of the calendars
+	IC_CALENDAR
+	// IC_RULES list the active rules
+	IC_RULES
+	// IC_SCRIPT list, run or stop scripts and show their logs
+	IC_SCRIPT
+	// IC_EVENTS list the latest events of the service
+	IC_EVENTS
+	// IC_QUEUE show the depth and wait time of the command queue
+	IC_QUEUE
+)
+
+const (
+	// IA_LIST all items of a sub system, e.g. all scenes
+	IA_LIST = iota
+	// IA_ACTIVATE the named item
+	IA_ACTIVATE
+	// IA_CAPTURE the current system state as a new named item
+	IA_CAPTURE
+	// IA_ADD a new item
+	IA_ADD
+	// IA_REMOVE the named item
+	IA_REMOVE
+	// IA_UPCOMING items within the next days
+	IA_UPCOMING
+	// IA_RUN the named item
+	IA_RUN
+	// IA_STOP the named item
+	IA_STOP
+	// IA_LOG of the named item
+	IA_LOG
 )
 
 const (
@@ -32,6 +69,16 @@ type ClientCommand struct {
 	Cmd          int    `json:"cmd"`
 	ID           string `json:"id"`
 	DigitalPorts []int  `json:"digitalPorts"`
+	Action       int    `json:"action"`
+	Name         string `json:"name"`
+	Schedule     string `json:"schedule"`
+	Command      string `json:"command"`
+	Days         int    `json:"days"`
+	Timeout      string `json:"timeout"`
+	Refresh      bool   `json:"refresh"`
+	// Controller the ports belong to, the default controller if it is empty. an IC_GET without
+	// controller returns the state of every controller
+	Controller string `json:"controller"`
 }
 
 func (cc *ClientCommand) AddDigitalPorts(ports ...int) {
@@ -92,6 +139,10 @@ type ServerResponse struct {
 	ID              string       `json:"id"`
 	DigitalPortInfo map[int]bool `json:"digitalPortInfo"`
 	ResponseID      string       `json:"responseId"`
+	Items           []string     `json:"items"`
+	Error           string       `json:"error"`
+	// ControllerPortInfo is the state of the digital ports of every controller of an IC_GET
+	ControllerPortInfo map[string]map[int]bool `json:"controllerPortInfo"`
 }
 
 func (sr *ServerResponse) serialize() ([]byte, error) {
@@ -126,8 +177,27 @@ func (sr *ServerResponse) GetResponse2Send() ([]byte, error) {
 
 // TransformSystemState shows the status of all switches of the system
 func (sr *ServerResponse) TransformSystemState() string {
-	stateArr := make([]string, len(sr.DigitalPortInfo))
-	for i, b := range sr.DigitalPortInfo {
+	return transformPortInfo(sr.DigitalPortInfo)
+}
+
+// TransformControllerStates shows the status of all switches of every controller, one line
+// per controller sorted by name
+func (sr *ServerResponse) TransformControllerStates() []string {
+	names := make([]string, 0, len(sr.ControllerPortInfo))
+	for name := range sr.ControllerPortInfo {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, fmt.Sprintf("%s: %s", name, transformPortInfo(sr.ControllerPortInfo[name])))
+	}
+	return ret
+}
+
+func transformPortInfo(portInfo map[int]bool) string {
+	stateArr := make([]string, len(portInfo))
+	for i, b := range portInfo {
 		if b {
 			stateArr[i] = "ON"
 		} else {
@@ -156,8 +226,19 @@ func ServerResponseFromResponse(data []byte) (*ServerResponse, error) {
 	}
 }
 
+// ReadPolicy defines how often an empty read is retried before the peer is considered gone
+type ReadPolicy struct {
+	Retries int
+	Delay   time.Duration
+}
+
+// DefaultReadPolicy retries an empty read 10 times every 100ms
+func DefaultReadPolicy() ReadPolicy {
+	return ReadPolicy{Retries: 10, Delay: 100 * time.Millisecond}
+}
+
 // ReadUntilEOF
-func ReadUntilEOF(reader *bufio.Reader) ([]byte, error) {
+func ReadUntilEOF(reader *bufio.Reader, rp ReadPolicy) ([]byte, error) {
 	ret := make([]byte, 0)
 	block := 1024
 	zeroLengthRetry := 0
@@ -171,8 +252,8 @@ func ReadUntilEOF(reader *bufio.Reader) ([]byte, error) {
 			if err == io.EOF {
 				if n < 1 {
 					zeroLengthRetry = zeroLengthRetry + 1
-					if zeroLengthRetry < 10 {
-						time.Sleep(100 * time.Millisecond)
+					if zeroLengthRetry < rp.Retries {
+						time.Sleep(rp.Delay)
 						continue
 					}
 					logging.LogFmt(logging.LOG_DEBUG, "[ReadUntilEOF] read EOF with zero content [%d] times", zeroLengthRetry)
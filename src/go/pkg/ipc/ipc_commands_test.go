@@ -10,6 +10,8 @@ func TestClientCommand(t *testing.T) {
 		Cmd          int
 		ID           string
 		DigitalPorts []int
+		Action       int
+		Name         string
 	}
 	tests := []struct {
 		name    string
@@ -43,6 +45,17 @@ func TestClientCommand(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "scene client command",
+			fields: fields{
+				Cmd:          IC_SCENE,
+				ID:           "client123",
+				DigitalPorts: []int{},
+				Action:       IA_ACTIVATE,
+				Name:         "evening",
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -50,6 +63,8 @@ func TestClientCommand(t *testing.T) {
 				Cmd:          tt.fields.Cmd,
 				ID:           tt.fields.ID,
 				DigitalPorts: tt.fields.DigitalPorts,
+				Action:       tt.fields.Action,
+				Name:         tt.fields.Name,
 			}
 			got, err := cc.GetCommand2Send()
 			if (err != nil) != tt.wantErr {
@@ -116,6 +131,9 @@ func TestServerResponse(t *testing.T) {
 		Cmd             int
 		ID              string
 		DigitalPortInfo map[int]bool
+		Items           []string
+		Error           string
+		ControllerInfo  map[string]map[int]bool
 	}
 	tests := []struct {
 		name    string
@@ -155,13 +173,49 @@ func TestServerResponse(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "scene list response",
+			fields: fields{
+				Cmd:             IC_SCENE,
+				ID:              "client123",
+				DigitalPortInfo: map[int]bool{},
+				Items:           []string{"evening: d3=on", "morning: d3=off"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "get response of every controller",
+			fields: fields{
+				Cmd:             IC_GET,
+				DigitalPortInfo: map[int]bool{0: true, 1: false},
+				Items:           []string{"d1=on (updated 1s ago)", "annex:d1=off (updated 1s ago)"},
+				ControllerInfo: map[string]map[int]bool{
+					"main":  {0: true, 1: false},
+					"annex": {0: false},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "error response",
+			fields: fields{
+				Cmd:             IC_SCENE,
+				ID:              "client123",
+				DigitalPortInfo: map[int]bool{},
+				Error:           "unknown scene: night",
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			sr := &ServerResponse{
-				Cmd:             tt.fields.Cmd,
-				ID:              tt.fields.ID,
-				DigitalPortInfo: tt.fields.DigitalPortInfo,
+				Cmd:                tt.fields.Cmd,
+				ID:                 tt.fields.ID,
+				DigitalPortInfo:    tt.fields.DigitalPortInfo,
+				Items:              tt.fields.Items,
+				Error:              tt.fields.Error,
+				ControllerPortInfo: tt.fields.ControllerInfo,
 			}
 			got, err := sr.GetResponse2Send()
 			if (err != nil) != tt.wantErr {
@@ -179,3 +233,15 @@ func TestServerResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestServerResponse_TransformControllerStates(t *testing.T) {
+	sr := NewServerResponse()
+	sr.ControllerPortInfo = map[string]map[int]bool{
+		"main":  {0: true, 1: false},
+		"annex": {0: false},
+	}
+	want := []string{"annex: OFF", "main: ON,OFF"}
+	if got := sr.TransformControllerStates(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ServerResponse.TransformControllerStates() = %v, want %v", got, want)
+	}
+}
@@ -3,12 +3,14 @@
  * a defined way.
  * Work flow:
  * ---------------------  starts       ----------------------
- * | StartListening    | ------------> | handleRequest      |
- * | - starts server   |  go routine   | - react on changes |
- * | - accept requests |               |   in the req chan  |
- * | - put new req in  |               | - call req         |
- * |   buffered chan   |               |   callback         |
+ * | StartListening    | ------------> | serveClient        |
+ * | - starts server   |  go routine   | - read a request   |
+ * | - accept clients  |  per client   | - call req         |
+ * |                   |               |   callback         |
+ * |                   |               | - write response   |
  * ---------------------               ----------------------
+ * The requests of several clients are handled concurrently, the requests
+ * of one client in the order they arrive.
  * Remark: StartListening should be called in a go routine as well
  */
 package ipc
@@ -18,7 +20,6 @@ import (
 	"fmt"
 	"net"
 	"sync"
-	"time"
 
 	"github.com/dachunky/crestrontcpbridge/pkg/logging"
 	"github.com/google/uuid"
@@ -34,67 +35,70 @@ type clientRequest struct {
 type IpcServer interface {
 	// StartListen to a specific port
 	StartListening(cmdHdl func(cc *ClientCommand) (*ServerResponse, error))
-	// Requests received from IPC clients
-	Requests() chan *clientRequest
-	// HasError
+	// Addr the server listens on, empty as long as it does not listen
+	Addr() string
+	// HasError of the listener. an error of a single client only closes its connection
 	HasError() error
 	// Close the IPC server
 	Close()
+	// WrapConnections of the clients before they are served, e.g. to record them. it has to
+	// be called before StartListening
+	WrapConnections(wrap func(conn net.Conn) net.Conn)
 }
 
 type ipcServer struct {
-	port          int
-	clients       map[string]*ClientCommand
-	requests      chan *clientRequest
-	serverClosing chan bool
-	err           error
-	listener      net.Listener
-	quit          chan bool
-	wg            sync.WaitGroup
+	port       int
+	readPolicy ReadPolicy
+	wrap       func(conn net.Conn) net.Conn
+	quit       chan bool
+	wg         sync.WaitGroup
+	// lock guards the fields below, the clients are served concurrently
+	lock     sync.Mutex
+	listener net.Listener
+	clients  map[string]*ClientCommand
+	err      error
 }
 
 func (is *ipcServer) setError(err error) {
 	logging.LogFmt(logging.LOG_ERROR, "[IPCSERVER] detect error: %v", err)
+	is.lock.Lock()
+	defer is.lock.Unlock()
 	is.err = err
 }
 
-// handleRequests is the central request handler for all clients
-func (is *ipcServer) handleRequests(cmdHdl func(cc *ClientCommand) (*ServerResponse, error)) {
-	is.wg.Add(1)
-	defer is.wg.Done()
-	for {
-		select {
-		case req := <-is.requests:
-			logging.LogFmt(logging.LOG_INFO, "[handler]: receive request [%s] on channel --> calling command handler", req.id)
-			sr, err := cmdHdl(req.cc)
-			if err != nil {
-				is.setError(err)
-				continue
-			}
-			is.clients[sr.ID] = req.cc
-			respData, err := sr.GetResponse2Send()
-			if err != nil {
-				is.setError(err)
-				continue
-			}
-			_, err = req.conn.Write(respData)
-			if err != nil {
-				is.setError(err)
-				continue
-			}
-			logging.LogFmt(logging.LOG_MAIN, "[handler]: request [%s] successfully reponded", req.id)
-		case <-is.serverClosing:
-			logging.Log(logging.LOG_INFO, "[handler]: receive termination signal")
-			return
-		default:
-			time.Sleep(50 * time.Millisecond)
-		}
+// handleRequest calls the command handler and responds to the client. an error of the handler
+// is sent to the client as error of the response. false is returned if the response cannot be
+// sent
+func (is *ipcServer) handleRequest(req *clientRequest, cmdHdl func(cc *ClientCommand) (*ServerResponse, error)) bool {
+	sr, err := cmdHdl(req.cc)
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[handler]: request [%s] failed: %v", req.id, err)
+		sr = NewServerResponse()
+		sr.Cmd = req.cc.Cmd
+		sr.ID = req.cc.ID
+		sr.Error = err.Error()
 	}
+	is.lock.Lock()
+	is.clients[sr.ID] = req.cc
+	is.lock.Unlock()
+	respData, err := sr.GetResponse2Send()
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[handler]: response of request [%s] failed: %v", req.id, err)
+		return false
+	}
+	_, err = req.conn.Write(respData)
+	if err != nil {
+		logging.LogFmt(logging.LOG_ERROR, "[handler]: respond to request [%s] failed: %v", req.id, err)
+		return false
+	}
+	logging.LogFmt(logging.LOG_MAIN, "[handler]: request [%s] successfully reponded", req.id)
+	return true
 }
 
-// serveClient is started for each client. incoming request were push to the request channel and
-// handled by handleRequests method
-func (is *ipcServer) serveClient(cr *clientRequest) {
+// serveClient is started for each client. it handles a request and responds to it before the
+// next request is read, so the responses of a client keep the order of its requests. an error
+// of the client closes its connection only, the other clients are served on
+func (is *ipcServer) serveClient(cr *clientRequest, cmdHdl func(cc *ClientCommand) (*ServerResponse, error)) {
 	defer func() {
 		logging.LogFmt(logging.LOG_INFO, "[IPCSERVER] stop serving [%s]", cr.id)
 		cr.conn.Close()
@@ -103,9 +107,9 @@ func (is *ipcServer) serveClient(cr *clientRequest) {
 		logging.Log(logging.LOG_INFO, "[IPCSERVER] serve client excaped")
 	}()
 	for {
-		buf, err := ReadUntilEOF(bufio.NewReader(cr.conn)) //.ReadBytes(0)
+		buf, err := ReadUntilEOF(bufio.NewReader(cr.conn), is.readPolicy) //.ReadBytes(0)
 		if (err != nil) || (len(buf) < 1) {
-			is.setError(err)
+			logging.LogFmt(logging.LOG_WARN, "[IPCSERVER] read from client [%s] failed: %v", cr.id, err)
 			return
 		}
 		if string(buf) == CLIENT_QUIT_COMMAND {
@@ -114,11 +118,13 @@ func (is *ipcServer) serveClient(cr *clientRequest) {
 		}
 		cc, err := ClientCommandFromRequest(buf)
 		if err != nil {
-			is.setError(err)
+			logging.LogFmt(logging.LOG_WARN, "[IPCSERVER] invalid request of client [%s]: %v", cr.id, err)
+			return
+		}
+		logging.LogFmt(logging.LOG_INFO, "[handler]: receive request [%s] --> calling command handler", cr.id)
+		if !is.handleRequest(&clientRequest{cc: cc, id: cr.id, conn: cr.conn}, cmdHdl) {
 			return
 		}
-		cr.cc = cc
-		is.requests <- cr
 	}
 }
 
@@ -127,17 +133,15 @@ func (is *ipcServer) StartListening(cmdHdl func(cc *ClientCommand) (*ServerRespo
 	// create tcp server
 	l, err := net.Listen("tcp", connStr)
 	if err != nil {
-		is.err = err
+		is.setError(err)
 		return
 	}
+	is.lock.Lock()
 	is.listener = l
+	is.lock.Unlock()
 	is.wg.Add(1)
-	// start request handler
-	go is.handleRequests(cmdHdl)
 	defer func() {
 		logging.Log(logging.LOG_MAIN, "closing IPC server")
-		// tell request handler to close
-		is.serverClosing <- true
 		is.wg.Done()
 	}()
 	logging.LogFmt(logging.LOG_MAIN, "start listening to: %s", connStr)
@@ -157,30 +161,47 @@ func (is *ipcServer) StartListening(cmdHdl func(cc *ClientCommand) (*ServerRespo
 			continue
 		}
 		logging.Log(logging.LOG_DEBUG, "[IPCSERVER]: new client register request")
+		if is.wrap != nil {
+			conn = is.wrap(conn)
+		}
 		cr := new(clientRequest)
 		cr.conn = conn
 		cr.id = uuid.NewString()
 		is.wg.Add(1)
 		// start to serve new client
-		go is.serveClient(cr)
+		go is.serveClient(cr, cmdHdl)
 	}
 }
 
-func (is *ipcServer) Requests() chan *clientRequest {
-	return is.requests
+func (is *ipcServer) WrapConnections(wrap func(conn net.Conn) net.Conn) {
+	is.wrap = wrap
+}
+
+func (is *ipcServer) Addr() string {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	if is.listener == nil {
+		return ""
+	}
+	return is.listener.Addr().String()
 }
 
 func (is *ipcServer) HasError() error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
 	return is.err
 }
 
 func (is *ipcServer) Close() {
 	logging.Log(logging.LOG_DEBUG, "[IPCSERVER] CLOSE: close ipc server")
-	if is.listener == nil {
+	is.lock.Lock()
+	listener := is.listener
+	is.lock.Unlock()
+	if listener == nil {
 		return
 	}
 	logging.Log(logging.LOG_DEBUG, "[IPCSERVER] CLOSE: close listener")
-	is.listener.Close()
+	listener.Close()
 	logging.Log(logging.LOG_DEBUG, "[IPCSERVER] CLOSE: quit 'is' channel")
 	is.quit <- true
 	// time.Sleep(100 * time.Millisecond)
@@ -191,12 +212,11 @@ func (is *ipcServer) Close() {
 	logging.Log(logging.LOG_DEBUG, "[IPCSERVER] CLOSE: DONE")
 }
 
-func NewIpcServer(port int) IpcServer {
+func NewIpcServer(port int, rp ReadPolicy) IpcServer {
 	ret := new(ipcServer)
 	ret.clients = make(map[string]*ClientCommand)
 	ret.port = port
-	ret.requests = make(chan *clientRequest, 256)
-	ret.serverClosing = make(chan bool)
+	ret.readPolicy = rp
 	ret.quit = make(chan bool)
 	return ret
 }